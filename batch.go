@@ -0,0 +1,91 @@
+package hasty
+
+import "time"
+
+// Batch collects writes which are committed to the database atomically:
+// readers observe either all of them or none, and so does the recovery from the WAL after a crash.
+// Note, batch is not concurrency safe.
+type Batch struct {
+	db   *DB
+	recs []*record
+	// err is the first error of Set or Delete which is returned by Commit.
+	err error
+}
+
+// KeyValue is a key-value pair written by SetMany.
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// SetMany puts the keys in the database atomically like a Batch does, e.g., for bulk ingest.
+// Unlike calling Set in a loop, the records are encoded into one buffer which is written to the WAL
+// with a single write and sync, and they're applied to the memtable under a single lock acquisition.
+// If any of the keys is empty, nothing is written and ErrEmptyKey is returned.
+// Note, operation is concurrency safe.
+func (db *DB) SetMany(kvs []KeyValue) error {
+	if len(kvs) == 0 {
+		return nil
+	}
+	// The records are allocated at once rather than one by one.
+	recs := make([]record, len(kvs))
+	ptrs := make([]*record, len(kvs))
+	for i, kv := range kvs {
+		if kv.Key == "" {
+			return ErrEmptyKey
+		}
+		recs[i] = record{
+			key:   kv.Key,
+			value: kv.Value,
+		}
+		ptrs[i] = &recs[i]
+	}
+	defer db.observeSet(time.Now())
+
+	return db.write(ptrs...)
+}
+
+// NewBatch creates an empty batch of writes.
+func (db *DB) NewBatch() *Batch {
+	return &Batch{db: db}
+}
+
+// Set puts a key in the batch.
+func (b *Batch) Set(key string, value []byte) {
+	if key == "" {
+		b.err = ErrEmptyKey
+		return
+	}
+	b.recs = append(b.recs, &record{
+		key:   key,
+		value: value,
+	})
+}
+
+// Delete removes a key in the batch.
+func (b *Batch) Delete(key string) {
+	if key == "" {
+		b.err = ErrEmptyKey
+		return
+	}
+	b.recs = append(b.recs, &record{
+		key:     key,
+		deleted: true,
+	})
+}
+
+// Commit applies the batch's writes to the database in the order they were added.
+// The records are written to the WAL with a single write and sync, and then applied to the memtable.
+// The batch is emptied afterwards, so it can be reused.
+// If any of the writes had an empty key, nothing is committed and ErrEmptyKey is returned.
+func (b *Batch) Commit() error {
+	recs, err := b.recs, b.err
+	b.recs, b.err = nil, nil
+	if err != nil {
+		return err
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	return b.db.write(recs...)
+}
@@ -0,0 +1,227 @@
+package hasty
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionCodec defines how blocks of segment files are compressed.
+// Every block records its codec in the block header, so a segment is read correctly
+// even if it was written with another codec than the one currently configured.
+type CompressionCodec byte
+
+const (
+	// CompressionNone writes segment records as is.
+	CompressionNone CompressionCodec = iota
+	// CompressionSnappy compresses segment records in blocks with Snappy.
+	CompressionSnappy
+	// CompressionZstd compresses segment records in blocks with Zstandard.
+	// It's slower than Snappy, but the segments are smaller, e.g., the cold segments of the deeper levels.
+	CompressionZstd
+)
+
+// CompressionType is the former name of CompressionCodec.
+//
+// Deprecated: use CompressionCodec.
+type CompressionType = CompressionCodec
+
+// The former names of the compression codecs.
+//
+// Deprecated: use CompressionNone, CompressionSnappy, and CompressionZstd.
+const (
+	NoCompression = CompressionNone
+	SnappyBlock   = CompressionSnappy
+	ZstdBlock     = CompressionZstd
+)
+
+const (
+	// blockSize is a size of uncompressed records after which a block is cut.
+	// A block is cut at record boundary, so records never span blocks.
+	blockSize = 4 * 1024
+	// blockHeaderSize is 1 byte compression flag and 4 bytes length of compressed payload.
+	blockHeaderSize = 5
+	// blockFooterSize is 4 bytes uncompressed size of the block used for validation.
+	blockFooterSize = 4
+)
+
+// zstdEncoder and zstdDecoder are shared by all segments, their EncodeAll and DecodeAll are concurrency safe.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// blockMagic starts segment files which consist of blocks. Its first 4 bytes are zero record length
+// which is invalid for segments with plain records, so the formats can't be confused.
+var blockMagic = []byte{0, 0, 0, 0, 'H', 'B', 'L', 'K'}
+
+// blockHandle describes where a block is located in a segment file.
+type blockHandle struct {
+	// offset is a position of the block header in the file.
+	offset int64
+	// start is a position of the block's first record in the uncompressed records stream.
+	// Records in block segments are indexed by these positions.
+	start int64
+	// rawLen is the uncompressed size of the block.
+	rawLen int64
+	// dataLen is the size of the block payload in the file.
+	dataLen int64
+	flag    CompressionCodec
+}
+
+// levelCompression returns how blocks of new segment files at the level are compressed:
+// the compression set for the level takes priority over the default compression def.
+func levelCompression(levels map[int]CompressionCodec, level int, def CompressionCodec) CompressionCodec {
+	if c, ok := levels[level]; ok {
+		return c
+	}
+	return def
+}
+
+// blockWriter groups records into blocks and compresses them.
+// Callers must call EndRecord after each record so a block is cut at record boundary,
+// and Flush at the end to write the last block.
+type blockWriter struct {
+	out         io.Writer
+	compression CompressionCodec
+	buf         bytes.Buffer
+	wroteMagic  bool
+}
+
+// newBlockWriter creates a blockWriter which writes blocks compressed with c into out.
+func newBlockWriter(out io.Writer, c CompressionCodec) *blockWriter {
+	return &blockWriter{
+		out:         out,
+		compression: c,
+	}
+}
+
+// Write buffers bytes of a record.
+func (w *blockWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+// EndRecord cuts a block if enough records were buffered.
+func (w *blockWriter) EndRecord() error {
+	if w.buf.Len() < blockSize {
+		return nil
+	}
+	return w.Flush()
+}
+
+// Flush writes buffered records as a block.
+func (w *blockWriter) Flush() error {
+	ew := &errWriter{Writer: w.out}
+	if !w.wroteMagic {
+		ew.Write(blockMagic)
+		w.wroteMagic = true
+	}
+	if w.buf.Len() == 0 {
+		return ew.err
+	}
+
+	raw := w.buf.Bytes()
+	payload := raw
+	switch w.compression {
+	case CompressionSnappy:
+		payload = snappy.Encode(nil, raw)
+	case CompressionZstd:
+		payload = zstdEncoder.EncodeAll(raw, nil)
+	}
+
+	header := make([]byte, blockHeaderSize)
+	header[0] = byte(w.compression)
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(payload)))
+	footer := make([]byte, blockFooterSize)
+	binary.LittleEndian.PutUint32(footer, uint32(len(raw)))
+
+	ew.Write(header)
+	ew.Write(payload)
+	ew.Write(footer)
+	w.buf.Reset()
+	return ew.err
+}
+
+// blockReader reads uncompressed records stream from blocks.
+type blockReader struct {
+	r     io.Reader
+	block []byte
+	// skip is a number of bytes of the uncompressed stream to drop before the first Read,
+	// so the reader can start in the middle of a block.
+	skip int64
+}
+
+// newBlockReader creates a blockReader which reads blocks from r positioned after the block magic.
+func newBlockReader(r io.Reader) *blockReader {
+	return &blockReader{r: r}
+}
+
+// Read reads uncompressed records.
+func (br *blockReader) Read(p []byte) (int, error) {
+	for len(br.block) == 0 {
+		if err := br.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, br.block)
+	br.block = br.block[n:]
+	return n, nil
+}
+
+// next reads and decompresses the next block.
+func (br *blockReader) next() error {
+	header := make([]byte, blockHeaderSize)
+	if _, err := io.ReadFull(br.r, header); err != nil {
+		return err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(header[1:])+blockFooterSize)
+	if _, err := io.ReadFull(br.r, data); err != nil {
+		return fmt.Errorf("failed to read block: %w", ErrCorruptRecord)
+	}
+
+	var err error
+	footer := data[len(data)-blockFooterSize:]
+	if br.block, err = decodeBlock(CompressionCodec(header[0]), data[:len(data)-blockFooterSize], binary.LittleEndian.Uint32(footer)); err != nil {
+		return err
+	}
+	if br.skip > 0 {
+		n := br.skip
+		if n > int64(len(br.block)) {
+			n = int64(len(br.block))
+		}
+		br.block = br.block[n:]
+		br.skip -= n
+	}
+	return nil
+}
+
+// decodeBlock decompresses block payload and verifies its uncompressed size.
+func decodeBlock(flag CompressionCodec, payload []byte, rawLen uint32) ([]byte, error) {
+	var (
+		raw []byte
+		err error
+	)
+	switch flag {
+	case CompressionNone:
+		raw = payload
+	case CompressionSnappy:
+		if raw, err = snappy.Decode(nil, payload); err != nil {
+			return nil, fmt.Errorf("failed to decompress block: %v: %w", err, ErrCorruptRecord)
+		}
+	case CompressionZstd:
+		if raw, err = zstdDecoder.DecodeAll(payload, nil); err != nil {
+			return nil, fmt.Errorf("failed to decompress block: %v: %w", err, ErrCorruptRecord)
+		}
+	default:
+		return nil, fmt.Errorf("unknown block compression %d: %w", flag, ErrCorruptRecord)
+	}
+
+	if uint32(len(raw)) != rawLen {
+		return nil, fmt.Errorf("block size %d, expected %d: %w", len(raw), rawLen, ErrCorruptRecord)
+	}
+	return raw, nil
+}
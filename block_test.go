@@ -0,0 +1,264 @@
+package hasty
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/marselester/hastydb/internal/index"
+)
+
+func TestBlockWriter(t *testing.T) {
+	mem := index.Memtable{}
+	for i := 0; i < 1000; i++ {
+		mem.Set(fmt.Sprintf("key%04d", i), bytes.Repeat([]byte("value"), 20))
+	}
+	sw := sstableWriter{
+		encode: encode,
+	}
+	dir := t.TempDir()
+
+	rawPath := filepath.Join(dir, "raw")
+	writeSegment(t, rawPath, func(seg *segment) error {
+		return sw.write(seg, &mem)
+	})
+	want := readSegmentBody(t, rawPath)
+
+	tests := map[string]CompressionCodec{
+		"snappy": CompressionSnappy,
+		"zstd":   CompressionZstd,
+	}
+	for name, c := range tests {
+		t.Run(name, func(t *testing.T) {
+			segPath := filepath.Join(dir, name)
+			writeSegment(t, segPath, func(seg *segment) error {
+				out := newSegmentWriter(seg, c)
+				if err := sw.write(out, &mem); err != nil {
+					return err
+				}
+				return out.Flush()
+			})
+
+			segInfo, err := os.Stat(segPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if segInfo.Size() > int64(len(want))/4 {
+				t.Errorf("expected compressed size %d to be at least 4 times smaller than %d", segInfo.Size(), len(want))
+			}
+
+			// Compression is detected when the segment is opened.
+			seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer seg.Close()
+			if seg.size != int64(len(want)) {
+				t.Errorf("expected records stream size %d, got: %d", len(want), seg.size)
+			}
+			if seg.blocks[0].flag != c {
+				t.Errorf("expected block compression %d, got: %d", c, seg.blocks[0].flag)
+			}
+
+			var i int
+			for offset := int64(0); offset < seg.size; i++ {
+				rec, err := seg.ReadRecord(offset)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := fmt.Sprintf("key%04d", i); rec.key != want {
+					t.Fatalf("expected: %q, got: %q", want, rec.key)
+				}
+				offset += int64(rec.size())
+			}
+			if i != 1000 {
+				t.Errorf("expected 1000 records, got: %d", i)
+			}
+
+			got, err := ioutil.ReadAll(seg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Error("expected decompressed stream to equal uncompressed segment")
+			}
+		})
+	}
+}
+
+func TestBlockWriter_noCompression(t *testing.T) {
+	segPath := filepath.Join(t.TempDir(), "seg")
+	writeSegment(t, segPath, func(seg *segment) error {
+		bw := newBlockWriter(seg, CompressionNone)
+		rec := record{key: "name", value: []byte("Bob")}
+		if err := encode(bw, &rec); err != nil {
+			return err
+		}
+		return bw.Flush()
+	})
+
+	seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+
+	rec, err := seg.ReadRecord(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.key != "name" || string(rec.value) != "Bob" {
+		t.Errorf("expected name=Bob, got: %s=%s", rec.key, rec.value)
+	}
+}
+
+// writeSegment creates a segment file at segPath and fills it with write func.
+func writeSegment(t testing.TB, segPath string, write func(seg *segment) error) {
+	t.Helper()
+
+	seg, err := openWriteonlySegment(segPath, DefaultFileMode, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = write(seg); err != nil {
+		t.Fatal(err)
+	}
+	if err = seg.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readSegmentBody returns the contents of the segment file after the version header.
+func readSegmentBody(t testing.TB, segPath string) []byte {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(segPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, segmentMagic) {
+		t.Fatalf("expected version header in %s", segPath)
+	}
+	return b[segmentHeaderSize:]
+}
+
+func TestDBGet_mixedCompression(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithCompression(CompressionSnappy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// The compression setting changes between flushes, but both segments are readable,
+	// because the compression is detected from the segment files.
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+	db.sstWriter.compression = CompressionNone
+	if err = db.Set("planet", []byte("Earth")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+
+	for key, want := range map[string]string{"name": "Alice", "planet": "Earth"} {
+		got, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("expected %s=%s, got: %s", key, want, got)
+		}
+	}
+}
+
+func TestDB_levelCompression(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithCompactionTrigger(2), WithCompression(CompressionSnappy), WithLevelCompression(1, CompressionZstd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// The compactor is blocked, so it doesn't merge the segments concurrently with the test.
+	if err = db.compactor.sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = db.Set(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		flushDB(t, db)
+	}
+	ss := db.segments.Load().([]*segment)
+	if len(ss) != 2 || ss[0].blocks[0].flag != CompressionSnappy {
+		t.Fatalf("expected snappy segments at level 0, got: %d segments", len(ss))
+	}
+
+	err = db.compactor.compactLevels()
+	db.compactor.sem.Release(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss = db.segments.Load().([]*segment)
+	if len(ss) != 1 || ss[0].level != 1 {
+		t.Fatalf("expected 1 segment at level 1, got: %d segments", len(ss))
+	}
+	if ss[0].blocks[0].flag != CompressionZstd {
+		t.Errorf("expected zstd segment at level 1, got: %d", ss[0].blocks[0].flag)
+	}
+	if got, err := db.Get("key1"); string(got) != "value" || err != nil {
+		t.Errorf("expected value, got: %q %v", got, err)
+	}
+}
+
+// BenchmarkSegmentCompression reports the size of a segment file compressed by every compression type
+// and the latency of reading random records from it.
+func BenchmarkSegmentCompression(b *testing.B) {
+	mem := index.Memtable{}
+	for i := 0; i < 10000; i++ {
+		value := fmt.Sprintf(`{"id":%d,"name":"user%d","email":"user%d@example.com","active":%t}`, i, i, i, i%3 == 0)
+		mem.Set(fmt.Sprintf("user:%06d", i), []byte(value))
+	}
+	sw := sstableWriter{
+		encode: encode,
+	}
+	tests := map[string]CompressionCodec{
+		"none":   CompressionNone,
+		"snappy": CompressionSnappy,
+		"zstd":   CompressionZstd,
+	}
+	for name, c := range tests {
+		b.Run(name, func(b *testing.B) {
+			segPath := filepath.Join(b.TempDir(), "seg")
+			writeSegment(b, segPath, func(seg *segment) error {
+				out := newSegmentWriter(seg, c)
+				if err := sw.write(out, &mem); err != nil {
+					return err
+				}
+				return out.Flush()
+			})
+			seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer seg.Close()
+			offsets := make([]int64, 0, len(seg.index))
+			for _, offset := range seg.index {
+				offsets = append(offsets, offset)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err = seg.ReadRecord(offsets[i%len(offsets)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(seg.fileSize), "segment-bytes")
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package hasty
+
+import "math"
+
+// bloomFilter is a probabilistic data structure which tells whether a key is definitely not in a set
+// or it may be in the set. It is used to skip disk reads for keys which don't exist.
+// Note, filter is not concurrency safe, it must not be modified once it's shared.
+type bloomFilter struct {
+	// bits is a bitset of m bits.
+	bits []uint64
+	m    uint64
+	// k is a number of hash functions.
+	k uint64
+}
+
+// newBloomFilter creates a Bloom filter sized for n keys with desired false positive rate,
+// e.g., 0.01 means 1% of lookups of missing keys will report that they may be in the set.
+func newBloomFilter(n int, fpRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	// Optimal number of bits m = -n*ln(p) / ln(2)^2.
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	return newBloomFilterBits(n, m)
+}
+
+// newBloomFilterBitsPerKey creates a Bloom filter sized for n keys using bitsPerKey bits for each of them,
+// e.g., 10 bits per key give about 1% false positive rate.
+func newBloomFilterBitsPerKey(n, bitsPerKey int) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	return newBloomFilterBits(n, uint64(n)*uint64(bitsPerKey))
+}
+
+// newBloomFilterBits creates a Bloom filter of m bits for n keys.
+func newBloomFilterBits(n int, m uint64) *bloomFilter {
+	if m < 64 {
+		m = 64
+	}
+	// Optimal number of hash functions k = m/n * ln(2).
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// Add adds the key to the set.
+func (f *bloomFilter) Add(key string) {
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// MayContain returns false if the key is definitely not in the set.
+// True means the key may be in the set. A nil filter may contain any key.
+func (f *bloomFilter) MayContain(key string) bool {
+	if f == nil {
+		return true
+	}
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHash returns two hashes of the key which are used to simulate k hash functions
+// as h1 + i*h2, see "Less Hashing, Same Performance: Building a Better Bloom Filter" by Kirsch and Mitzenmacher.
+// The key is hashed with 64-bit FNV-1a, then the hash is spread with MurmurHash3 finalizer.
+func bloomHash(key string) (h1, h2 uint64) {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= prime64
+	}
+	h1 = fmix64(h)
+	h2 = fmix64(h1) | 1
+	return h1, h2
+}
+
+// fmix64 is MurmurHash3 finalizer which forces all bits of a hash to avalanche.
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
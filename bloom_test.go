@@ -0,0 +1,116 @@
+package hasty
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/marselester/hastydb/internal/index"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const (
+		n      = 10000
+		fpRate = 0.01
+	)
+	f := newBloomFilter(n, fpRate)
+	for i := 0; i < n; i++ {
+		f.Add(fmt.Sprintf("key%d", i))
+	}
+
+	for i := 0; i < n; i++ {
+		if key := fmt.Sprintf("key%d", i); !f.MayContain(key) {
+			t.Fatalf("false negative %q", key)
+		}
+	}
+
+	var fp int
+	for i := 0; i < n; i++ {
+		if f.MayContain(fmt.Sprintf("missing%d", i)) {
+			fp++
+		}
+	}
+	// Sampling error of 10k lookups is about 0.1% for 1% rate.
+	if got := float64(fp) / n; got > fpRate+0.002 {
+		t.Errorf("expected false positive rate <= %.3f, got: %.3f", fpRate, got)
+	}
+}
+
+func TestDBGlobalBloom(t *testing.T) {
+	db := DB{
+		cfg: Config{
+			globalBloomRate: DefaultGlobalBloomFalsePositiveRate,
+		},
+		memtable: &index.Memtable{},
+	}
+	db.prom = newPrometheusCollector(&db)
+	// Segment files are not opened, so a lookup would panic if a segment was read.
+	db.setSegments([]*segment{
+		{index: map[string]int64{"name": 0}},
+		{index: map[string]int64{"planet": 0}},
+	})
+
+	bf := db.globalBloom.Load().(*bloomFilter)
+	if !bf.MayContain("name") || !bf.MayContain("planet") {
+		t.Error("expected filter to contain segment keys")
+	}
+	if _, err := db.Get("surname"); err != ErrKeyNotFound {
+		t.Errorf("expected: %v, got: %v", ErrKeyNotFound, err)
+	}
+}
+
+func TestSegmentBloom(t *testing.T) {
+	mem := index.Memtable{}
+	for i := 0; i < 1000; i++ {
+		mem.Set(fmt.Sprintf("key%d", i), []byte("value"))
+	}
+	sw := sstableWriter{
+		bloomBitsPerKey: DefaultBloomFilterBitsPerKey,
+		encode:          encode,
+	}
+	var out *segmentWriter
+	segPath := filepath.Join(t.TempDir(), "seg")
+	writeSegment(t, segPath, func(seg *segment) error {
+		out = newSegmentWriter(seg, CompressionNone)
+		if err := sw.write(out, &mem); err != nil {
+			return err
+		}
+		return out.Flush()
+	})
+
+	for i := 0; i < 1000; i++ {
+		if key := fmt.Sprintf("key%d", i); !out.bloom.MayContain(key) {
+			t.Fatalf("false negative %q", key)
+		}
+	}
+	var fp int
+	for i := 0; i < 1000; i++ {
+		if out.bloom.MayContain(fmt.Sprintf("missing%d", i)) {
+			fp++
+		}
+	}
+	if fp > 30 {
+		t.Errorf("expected about 1%% false positives, got: %d out of 1000", fp)
+	}
+}
+
+func TestDBGet_segmentBloom(t *testing.T) {
+	db := DB{
+		cfg: Config{
+			globalBloomRate: DefaultGlobalBloomFalsePositiveRate,
+		},
+		memtable: &index.Memtable{},
+	}
+	db.prom = newPrometheusCollector(&db)
+	bf := newBloomFilterBitsPerKey(100, DefaultBloomFilterBitsPerKey)
+	bf.Add("name")
+	// The segment file is not opened, so a lookup would panic if the segment was read.
+	// The filter is consulted before the index, so the segment is skipped.
+	db.setSegments([]*segment{
+		{index: map[string]int64{"planet": 0}, bloom: bf},
+	})
+
+	if _, err := db.Get("planet"); err != ErrKeyNotFound {
+		t.Errorf("expected: %v, got: %v", ErrKeyNotFound, err)
+	}
+}
@@ -0,0 +1,89 @@
+package hasty
+
+import (
+	"container/list"
+	"sync"
+)
+
+// blockCache is an LRU cache of records recently read from segment files.
+// Records are keyed by their segment path and offset which never change, because segments are immutable.
+// The cache is bounded by the total size of the cached records,
+// the least recently used records are evicted when a new record doesn't fit.
+// Note, cache is concurrency safe.
+type blockCache struct {
+	mu sync.Mutex
+	// capacity is the maximum total size of the cached records in bytes.
+	capacity int
+	// size is the total size of the cached records in bytes.
+	size int
+	// lru is a list of cached entries where the front is the most recently used one.
+	lru   *list.List
+	items map[cacheKey]*list.Element
+}
+
+// cacheKey identifies a record in a segment file.
+type cacheKey struct {
+	path   string
+	offset int64
+}
+
+// cacheEntry is an element of the LRU list.
+type cacheEntry struct {
+	key cacheKey
+	rec *record
+}
+
+// newBlockCache creates a blockCache which holds at most capacity bytes of records.
+func newBlockCache(capacity int) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		items:    make(map[cacheKey]*list.Element),
+	}
+}
+
+// Get returns the record found by the segment path and the offset, or nil if it's not cached.
+// Note, the record must not be modified.
+func (c *blockCache) Get(path string, offset int64) *record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[cacheKey{path: path, offset: offset}]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).rec
+}
+
+// Add caches the record read from the segment path by the offset.
+// The least recently used records are evicted until the record fits,
+// and a record larger than the whole cache isn't cached at all.
+func (c *blockCache) Add(path string, offset int64, rec *record) {
+	n := int(rec.size())
+	if n > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey{path: path, offset: offset}
+	if e, ok := c.items[key]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	for c.size+n > c.capacity {
+		c.evict()
+	}
+	c.items[key] = c.lru.PushFront(&cacheEntry{key: key, rec: rec})
+	c.size += n
+}
+
+// evict removes the least recently used record.
+func (c *blockCache) evict() {
+	e := c.lru.Back()
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.items, entry.key)
+	c.size -= int(entry.rec.size())
+}
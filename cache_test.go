@@ -0,0 +1,102 @@
+package hasty
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	// Every record is 4+4+1+5+4 = 18 bytes long, so the cache fits only two of them.
+	c := newBlockCache(40)
+	c.Add("seg", 0, &record{key: "key0", value: []byte("value")})
+	c.Add("seg", 18, &record{key: "key1", value: []byte("value")})
+	// The first record becomes the most recently used, so the second one is evicted.
+	if rec := c.Get("seg", 0); rec == nil || rec.key != "key0" {
+		t.Fatalf("expected key0, got: %v", rec)
+	}
+	c.Add("seg", 36, &record{key: "key2", value: []byte("value")})
+
+	if rec := c.Get("seg", 18); rec != nil {
+		t.Errorf("expected key1 to be evicted, got: %v", rec)
+	}
+	if rec := c.Get("seg", 36); rec == nil || rec.key != "key2" {
+		t.Errorf("expected key2, got: %v", rec)
+	}
+	if rec := c.Get("other", 0); rec != nil {
+		t.Errorf("expected a miss for another segment, got: %v", rec)
+	}
+	if c.size != 36 {
+		t.Errorf("expected cache size 36, got: %d", c.size)
+	}
+
+	// The record larger than the cache is not cached.
+	c.Add("seg", 54, &record{key: "key3", value: make([]byte, 30)})
+	if rec := c.Get("seg", 54); rec != nil {
+		t.Errorf("expected key3 not to be cached, got: %v", rec)
+	}
+	if c.lru.Len() != 2 {
+		t.Errorf("expected 2 cached records, got: %d", c.lru.Len())
+	}
+}
+
+func TestDBGet_blockCache(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+	if _, err = db.Get("name"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached record is returned even though the segment file can't be read anymore.
+	seg := db.segments.Load().([]*segment)[0]
+	if err = os.Truncate(seg.path, 0); err != nil {
+		t.Fatal(err)
+	}
+	value, err := db.Get("name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "Alice" {
+		t.Errorf("expected Alice, got: %s", value)
+	}
+
+	// The caller can't change the cached value.
+	value[0] = 'a'
+	if value, _ = db.Get("name"); string(value) != "Alice" {
+		t.Errorf("expected Alice, got: %s", value)
+	}
+}
+
+func BenchmarkDBGet_blockCache(b *testing.B) {
+	for name, cacheSize := range map[string]int{"cold": 0, "hit": DefaultBlockCacheSize} {
+		b.Run(name, func(b *testing.B) {
+			db, close, err := Open(b.TempDir(), WithBlockCacheSize(cacheSize))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer close()
+
+			for i := 0; i < 100; i++ {
+				if err = db.Set(fmt.Sprintf("key%d", i), make([]byte, 100)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			flushDB(b, db)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err = db.Get(fmt.Sprintf("key%d", i%100)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package hasty
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Codec encodes the keys and values of the segment records, so they can be stored in a custom format,
+// e.g., for compatibility with another database.
+// The database frames every encoded record with its length and checksum,
+// and it keeps the record metadata (the expiry time, the prefix compression of keys) in the frame.
+// A nil value stands for a deleted key (tombstone), and Decode must return a nil value for it.
+// Decode gets exactly the bytes written by Encode.
+// Note, the WAL and the value log files are always written in the binary format.
+type Codec interface {
+	Encode(w io.Writer, key string, value []byte) error
+	Decode(b []byte) (key string, value []byte, err error)
+}
+
+// BinaryCodec is the default Codec: the key is followed by zero byte delimeter and the value.
+// A tombstone is encoded as a key without a delimeter, therefore the keys must not contain zero bytes.
+type BinaryCodec struct{}
+
+// Encode writes the key and the value separated by zero byte.
+func (BinaryCodec) Encode(w io.Writer, key string, value []byte) error {
+	ew := &errWriter{Writer: w}
+	io.WriteString(ew, key)
+	if value != nil {
+		ew.Write([]byte{recordKeyValueDelimeter})
+		ew.Write(value)
+	}
+	return ew.err
+}
+
+// Decode returns the key and the value from b, the value is nil if there is no delimeter.
+func (BinaryCodec) Decode(b []byte) (key string, value []byte, err error) {
+	i := bytes.IndexByte(b, recordKeyValueDelimeter)
+	if i == -1 {
+		return string(b), nil, nil
+	}
+	return string(b[:i]), b[i+1:], nil
+}
+
+// isBinaryCodec returns true if c is the binary codec, nil means the default codec.
+func isBinaryCodec(c Codec) bool {
+	_, ok := c.(BinaryCodec)
+	return ok || c == nil
+}
+
+// codecFuncs returns the functions which encode and decode the records with the codec.
+// The binary codec is built into the record format, so the records are encoded as usual,
+// whereas the other codecs are framed as follows: 4 bytes of the length with the record flags,
+// the shared length byte if the key is prefix-compressed, 8 bytes of expiresAt if the key expires,
+// the key-value bytes encoded by the codec, and 4 bytes CRC-32C checksum of the bytes after the length.
+func codecFuncs(c Codec) (enc func(out io.Writer, rec *record) error, dec func(b []byte) (*record, error)) {
+	if isBinaryCodec(c) {
+		return encode, decode
+	}
+
+	enc = func(out io.Writer, rec *record) error {
+		var buf bytes.Buffer
+		// The space for the length is reserved to calculate the checksum of the rest of the bytes.
+		buf.Write(make([]byte, recordLengthSize))
+		if rec.shared != 0 {
+			buf.WriteByte(byte(rec.shared))
+		}
+		if rec.hasExpiry() {
+			buf.Write(rec.expiresHeader())
+		}
+		value := rec.value
+		switch {
+		case rec.deleted:
+			value = nil
+		case value == nil:
+			value = []byte{}
+		}
+		if err := c.Encode(&buf, rec.key, value); err != nil {
+			return err
+		}
+
+		if buf.Len()+recordChecksumSize > maxRecordLen {
+			return fmt.Errorf("record exceeds %d bytes: %w", maxRecordLen, ErrValueTooLarge)
+		}
+		n := uint32(buf.Len() + recordChecksumSize)
+		if rec.hasExpiry() {
+			n |= recordExpiresFlag
+		}
+		if rec.shared != 0 {
+			n |= recordSharedFlag
+		}
+		if rec.pointer && !rec.deleted {
+			n |= recordPointerFlag
+		}
+		b := buf.Bytes()
+		binary.LittleEndian.PutUint32(b, n)
+		crc := crc32.Checksum(b[recordLengthSize:], crcTable)
+		binary.Write(&buf, binary.LittleEndian, crc)
+		_, err := out.Write(buf.Bytes())
+		return err
+	}
+
+	dec = func(b []byte) (*record, error) {
+		if len(b) < recordLengthSize+recordChecksumSize {
+			return nil, ErrCorruptRecord
+		}
+		n := len(b) - recordChecksumSize
+		if crc32.Checksum(b[recordLengthSize:n], crcTable) != binary.LittleEndian.Uint32(b[n:]) {
+			return nil, ErrChecksum
+		}
+		flags := binary.LittleEndian.Uint32(b) & recordFlags
+		b = b[recordLengthSize:n]
+
+		var rec record
+		if flags&recordSharedFlag != 0 {
+			if len(b) == 0 || b[0] == 0 {
+				return nil, ErrCorruptRecord
+			}
+			rec.shared = int(b[0])
+			b = b[1:]
+		}
+		if flags&recordExpiresFlag != 0 {
+			if len(b) < recordExpiresSize {
+				return nil, ErrCorruptRecord
+			}
+			rec.expiresAt = int64(binary.LittleEndian.Uint64(b))
+			b = b[recordExpiresSize:]
+		}
+
+		var err error
+		if rec.key, rec.value, err = c.Decode(b); err != nil {
+			return nil, err
+		}
+		if rec.value == nil {
+			rec.deleted = true
+			rec.expiresAt = 0
+		}
+		rec.pointer = !rec.deleted && flags&recordPointerFlag != 0
+		return &rec, nil
+	}
+	return enc, dec
+}
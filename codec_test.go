@@ -0,0 +1,224 @@
+package hasty
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// lengthCodec stores the key and the value lengths as 2 bytes each followed by the key and the value.
+// The value length 0xffff stands for a tombstone.
+type lengthCodec struct{}
+
+func (lengthCodec) Encode(w io.Writer, key string, value []byte) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, uint16(len(key)))
+	if value == nil {
+		binary.BigEndian.PutUint16(b[2:], 0xffff)
+	} else {
+		binary.BigEndian.PutUint16(b[2:], uint16(len(value)))
+	}
+	ew := &errWriter{Writer: w}
+	ew.Write(b)
+	io.WriteString(ew, key)
+	ew.Write(value)
+	return ew.err
+}
+
+func (lengthCodec) Decode(b []byte) (key string, value []byte, err error) {
+	if len(b) < 4 {
+		return "", nil, ErrCorruptRecord
+	}
+	klen, vlen := int(binary.BigEndian.Uint16(b)), int(binary.BigEndian.Uint16(b[2:]))
+	b = b[4:]
+	switch {
+	case vlen == 0xffff && len(b) == klen:
+		return string(b), nil, nil
+	case len(b) != klen+vlen:
+		return "", nil, ErrCorruptRecord
+	}
+	return string(b[:klen]), b[klen:], nil
+}
+
+func TestBinaryCodec(t *testing.T) {
+	tests := map[string]*record{
+		"value":     {key: "name", value: []byte("Alice")},
+		"empty":     {key: "name", value: []byte{}},
+		"tombstone": {key: "name", deleted: true},
+	}
+	for name, rec := range tests {
+		t.Run(name, func(t *testing.T) {
+			value := rec.value
+			if rec.deleted {
+				value = nil
+			}
+			var got, want bytes.Buffer
+			if err := (BinaryCodec{}).Encode(&got, rec.key, value); err != nil {
+				t.Fatal(err)
+			}
+			// The codec writes the record bytes between the length and the checksum.
+			if err := encode(&want, rec); err != nil {
+				t.Fatal(err)
+			}
+			body := want.Bytes()[recordLengthSize : want.Len()-recordChecksumSize]
+			if diff := cmp.Diff(body, got.Bytes()); diff != "" {
+				t.Error(diff)
+			}
+
+			key, value, err := (BinaryCodec{}).Decode(got.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != rec.key || (value == nil) != rec.deleted || !bytes.Equal(value, rec.value) {
+				t.Errorf("expected %+v, got: %q %q", rec, key, value)
+			}
+		})
+	}
+}
+
+func TestCodecFuncs(t *testing.T) {
+	enc, dec := codecFuncs(lengthCodec{})
+	tests := map[string]*record{
+		"value":     {key: "name", value: []byte("Alice")},
+		"empty":     {key: "name", value: []byte{}},
+		"tombstone": {key: "name", deleted: true},
+		"expiry":    {key: "name", value: []byte("Alice"), expiresAt: 123},
+		"shared":    {key: "me", value: []byte("Alice"), shared: 2},
+		"pointer":   {key: "name", value: []byte("ptr"), pointer: true},
+	}
+	for name, want := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := enc(&buf, want); err != nil {
+				t.Fatal(err)
+			}
+			if n := int(recordLength(buf.Bytes())); n != buf.Len() {
+				t.Errorf("expected record length %d, got: %d", buf.Len(), n)
+			}
+			got, err := dec(buf.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want.value == nil {
+				want.value = []byte{}
+			}
+			if want.deleted {
+				want.value = nil
+			}
+			if diff := cmp.Diff(want, got, cmp.AllowUnexported(record{})); diff != "" {
+				t.Error(diff)
+			}
+
+			b := buf.Bytes()
+			b[len(b)-recordChecksumSize-1] ^= 0xff
+			if _, err = dec(b); !errors.Is(err, ErrChecksum) {
+				t.Errorf("expected: %v, got: %v", ErrChecksum, err)
+			}
+		})
+	}
+}
+
+func TestDB_codec(t *testing.T) {
+	tests := map[string][]ConfigOption{
+		"plain":  {WithRestartInterval(4)},
+		"blocks": {WithCompression(CompressionSnappy)},
+		"sparse": {WithSparseIndexInterval(64)},
+	}
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts = append(opts, WithCodec(lengthCodec{}))
+			db, close, err := Open(dir, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := make(map[string]string)
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("key%03d", i)
+				want[key] = fmt.Sprintf("value%d", i)
+				if err = db.Set(key, []byte(want[key])); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = db.SetWithTTL("expired", []byte("v"), time.Nanosecond); err != nil {
+				t.Fatal(err)
+			}
+			flushDB(t, db)
+			for i := 0; i < 50; i += 5 {
+				key := fmt.Sprintf("key%03d", i)
+				delete(want, key)
+				if err = db.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			flushDB(t, db)
+			if err = db.Compact(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			// The records are stored in the format of the codec.
+			seg := db.segments.Load().([]*segment)[0]
+			b, err := readRecord(seg.newStreamReader(), seg.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec, err := decode(b); err == nil && rec.key == "key001" {
+				t.Errorf("expected record encoded by codec, got: %+v", rec)
+			}
+
+			check := func(db *DB) {
+				for key, value := range want {
+					if got, err := db.Get(key); string(got) != value || err != nil {
+						t.Fatalf("expected %s, got: %q %v", value, got, err)
+					}
+				}
+				for _, key := range []string{"key000", "expired"} {
+					if _, err := db.Get(key); !errors.Is(err, ErrKeyNotFound) {
+						t.Errorf("expected %s: %v, got: %v", key, ErrKeyNotFound, err)
+					}
+				}
+				r, err := db.GetReader("key001")
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := ioutil.ReadAll(r)
+				r.Close()
+				if string(got) != "value1" || err != nil {
+					t.Errorf("GetReader expected value1, got: %q %v", got, err)
+				}
+
+				values := make(map[string]string)
+				err = db.ForEach(func(key string, value []byte) error {
+					values[key] = string(value)
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(want, values); diff != "" {
+					t.Error(diff)
+				}
+			}
+			check(db)
+
+			if err = close(); err != nil {
+				t.Fatal(err)
+			}
+			db, close, err = OpenReadOnly(dir, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer close()
+			check(db)
+		})
+	}
+}
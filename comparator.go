@@ -0,0 +1,39 @@
+package hasty
+
+import "strings"
+
+// defaultComparatorName identifies the lexicographic order of the keys in the segment metadata.
+const defaultComparatorName = "bytewise"
+
+// keyComparator orders the keys of the database, see WithKeyComparator.
+// The zero value orders the keys lexicographically.
+type keyComparator struct {
+	// name identifies the order in the index sidecar files, empty name means defaultComparatorName.
+	name string
+	cmp  func(a, b string) int
+}
+
+// Name returns the name of the key order.
+func (c keyComparator) Name() string {
+	if c.name == "" {
+		return defaultComparatorName
+	}
+	return c.name
+}
+
+// Compare returns a negative number when a < b, zero when a == b, and a positive number when a > b.
+func (c keyComparator) Compare(a, b string) int {
+	if c.cmp == nil {
+		return strings.Compare(a, b)
+	}
+	return c.cmp(a, b)
+}
+
+// recordLess orders the records by key for the k-way merge.
+// Equal keys are ordered by the streams they came from, so the newest version comes first.
+func (c keyComparator) recordLess(a, b *record) bool {
+	if n := c.Compare(a.key, b.key); n != 0 {
+		return n < 0
+	}
+	return a.order < b.order
+}
@@ -0,0 +1,86 @@
+package hasty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// numericCompare orders non-negative integers written in decimal without leading zeros.
+func numericCompare(a, b string) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+func TestDB_keyComparator(t *testing.T) {
+	tests := map[string][]ConfigOption{
+		"plain":  {WithKeyComparator("numeric", numericCompare)},
+		"sparse": {WithKeyComparator("numeric", numericCompare), WithSparseIndexInterval(64)},
+	}
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := t.TempDir()
+			db, close, err := Open(path, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The keys are split between two segments and the memtable.
+			for i := 0; i < 120; i++ {
+				if err = db.Set(fmt.Sprint(i), []byte("v")); err != nil {
+					t.Fatal(err)
+				}
+				if i == 40 || i == 80 {
+					flushDB(t, db)
+				}
+			}
+			if err = db.Delete("100"); err != nil {
+				t.Fatal(err)
+			}
+			if err = db.Compact(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := db.Get("99"); string(got) != "v" || err != nil {
+				t.Errorf("expected value, got: %q %v", got, err)
+			}
+
+			var got []string
+			it := db.Scan("98", "102")
+			for ; it.Valid(); it.Next() {
+				got = append(got, it.Key())
+			}
+			if err = it.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff([]string{"98", "99", "101"}, got); diff != "" {
+				t.Error(diff)
+			}
+			if err = close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The segments can't be read in the lexicographic order.
+			if _, _, err = OpenReadOnly(path); !errors.Is(err, ErrComparatorMismatch) {
+				t.Fatalf("expected comparator mismatch, got: %v", err)
+			}
+			db, close, err = OpenReadOnly(path, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer close()
+			keys, err := db.Keys()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 119 || keys[9] != "9" || keys[10] != "10" || keys[118] != "119" {
+				t.Errorf("expected numeric order, got: %v", keys)
+			}
+		})
+	}
+}
@@ -1,14 +1,140 @@
 package hasty
 
+import (
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+)
+
 const (
 	// DefaultMaxMemtableSize is a maximum memtable size in bytes when it is written on disk.
 	// Default value is 4 megabytes.
 	DefaultMaxMemtableSize = 4 * 1024 * 1024
+	// DefaultWALPreallocSize is a size of disk space chunks in bytes reserved for the WAL file.
+	// Default value is 64 megabytes.
+	DefaultWALPreallocSize = 64 * 1024 * 1024
+	// DefaultGlobalBloomFalsePositiveRate is a false positive rate of the Bloom filter built over all segments.
+	// Default value is 1%.
+	DefaultGlobalBloomFalsePositiveRate = 0.01
+	// DefaultBloomFilterBitsPerKey is a number of bits per key in Bloom filters of segments.
+	// Default value gives about 1% false positive rate.
+	DefaultBloomFilterBitsPerKey = 10
+	// DefaultBlockCacheSize is a size of the cache of recently read segment records in bytes.
+	// Default value is 8 megabytes.
+	DefaultBlockCacheSize = 8 * 1024 * 1024
+	// DefaultMaxImmutableMemtables is a number of memtables which can wait to be written on disk
+	// before writes are blocked.
+	DefaultMaxImmutableMemtables = 2
+	// DefaultRateLimitBackpressureThreshold is a number of immutable memtables waiting to be written on disk
+	// when the write rate limit is applied.
+	DefaultRateLimitBackpressureThreshold = 1
+	// DefaultLevelCount is a number of compaction levels including level 0.
+	DefaultLevelCount = 7
+	// DefaultLevelSizeMultiplier is how many times every compaction level is larger than the previous one.
+	DefaultLevelSizeMultiplier = 10
+	// DefaultCompactionTrigger is a number of level 0 segments when they are merged into level 1.
+	// Default value is 4 like in LevelDB.
+	DefaultCompactionTrigger = 4
+	// DefaultRestartInterval is a number of records in segment files after which a key is stored uncompressed.
+	// Default value is 16 like in LevelDB.
+	DefaultRestartInterval = 16
+	// DefaultWALBufferSize is a size of the in-memory buffer of the WAL records in bytes.
+	// Default value is 64 kilobytes.
+	DefaultWALBufferSize = 64 * 1024
+	// DefaultWALSyncInterval is how often the WAL is synced to disk in SyncPeriodic mode.
+	// Default value is 100 milliseconds.
+	DefaultWALSyncInterval = 100 * time.Millisecond
+	// DefaultExpiryInterval is how often the expired keys are looked up in the memtable.
+	// Default value is 1 minute.
+	DefaultExpiryInterval = time.Minute
+	// DefaultValueLogGCInterval is how often the space of the overwritten values is reclaimed in the value log.
+	// Default value is 10 minutes.
+	DefaultValueLogGCInterval = 10 * time.Minute
+	// DefaultWatchBufferSize is a number of events buffered by every channel of Watch.
+	DefaultWatchBufferSize = 16
+	// DefaultFileMode is the permission bits of the database files.
+	DefaultFileMode os.FileMode = 0600
+	// DefaultDirMode is the permission bits of the database dir when it's created.
+	DefaultDirMode os.FileMode = 0700
 )
 
 // Config contains database settings which are updated with ConfigOption functions.
 type Config struct {
 	maxMemtableSize int
+	// maxImmutableMemtables is a number of full memtables which can wait to be written on disk.
+	maxImmutableMemtables int
+	walPreallocSize       int64
+	// maxWALSize is a size of the WAL file in bytes which makes the writes wait for the memtables flush,
+	// zero means no limit.
+	maxWALSize      int64
+	globalBloomRate float64
+	// bloomBitsPerKey is a number of bits per key in the Bloom filter of every new segment, zero disables the filters.
+	bloomBitsPerKey int
+	// sparseIndexInterval is a number of bytes of segment records per indexed key, zero indexes every key.
+	sparseIndexInterval int64
+	// restartInterval is a number of segment records per uncompressed key, one or less disables prefix compression.
+	restartInterval int
+	// blockCacheSize is a size of the cache of recently read segment records in bytes, zero disables the cache.
+	blockCacheSize int
+	// writeRateLimit is a number of bytes per second written when the flushes fall behind, zero disables it.
+	writeRateLimit int64
+	// rateLimitThreshold is a number of immutable memtables when the write rate limit is applied.
+	rateLimitThreshold int
+	// levelCount is a number of compaction levels including level 0.
+	levelCount int
+	// levelSizeMultiplier is how many times every compaction level is larger than the previous one.
+	levelSizeMultiplier int
+	// compactionTrigger is a number of level 0 segments when they are merged into level 1.
+	compactionTrigger int
+	// maxSegmentSize is a size of a segment file in bytes above which the segment is compacted
+	// into the next level before its level fills up, zero disables it.
+	maxSegmentSize int64
+	// expiryInterval is how often the expired keys are replaced with tombstones in the memtable, zero disables it.
+	expiryInterval time.Duration
+	compression    CompressionCodec
+	// levelCompression overrides the compression of the segments at the given compaction levels.
+	levelCompression map[int]CompressionCodec
+	// valueLogThreshold is a size of a value in bytes above which it's stored in the value log, zero disables it.
+	valueLogThreshold int
+	// valueLogGCInterval is how often the value log is garbage collected, zero disables it.
+	valueLogGCInterval time.Duration
+	// walRecoveryMode defines how invalid records are handled during WAL replay.
+	walRecoveryMode WALRecoveryMode
+	// walSyncMode defines when the WAL records are synced to disk.
+	walSyncMode WALSyncMode
+	// walSyncInterval is how often the WAL is synced in SyncPeriodic mode.
+	walSyncInterval time.Duration
+	// walBufferSize is a size of the in-memory buffer of the WAL records, zero disables buffering.
+	walBufferSize int
+	// onCompactionProgress is called while segments are read during compaction, nil disables it.
+	onCompactionProgress func(read, total int64)
+	// signals are OS signals which close the database, nil disables signal handling.
+	signals []os.Signal
+	// fileMode is the permission bits of the segment, sidecar, WAL, value log, and lock files.
+	fileMode os.FileMode
+	// dirMode is the permission bits of the database dir.
+	dirMode os.FileMode
+	// codec encodes the keys and values of the segment records.
+	codec Codec
+	// comparator orders the keys in the memtables and segments.
+	comparator keyComparator
+	// maxKeySize is a size of a key in bytes above which the writes are rejected, zero disables the limit.
+	maxKeySize int
+	// maxValueSize is a size of a value in bytes above which the writes are rejected, zero disables the limit.
+	maxValueSize int
+	// watchBufferSize is a number of events buffered by every channel of Watch.
+	watchBufferSize int
+	// dataScanInterval is how often the segments are scanned for corrupted records, zero disables it.
+	dataScanInterval time.Duration
+	// onCorruption is called for every problem found by the segment scan, nil means the problems are logged.
+	onCorruption func(segPath string, offset int64, err error)
+	// mergeStrategy defines which version of a key is kept when compaction merges segments.
+	mergeStrategy MergeStrategy
+	// directIO tells whether the segment files are read and written bypassing the page cache.
+	directIO bool
+	// logger reports the flushes, compactions, WAL truncations, slow syncs, and I/O errors.
+	logger *slog.Logger
 }
 
 // ConfigOption helps to change default database settings.
@@ -20,3 +146,357 @@ func WithMaxMemtableSize(threshold int) ConfigOption {
 		c.maxMemtableSize = threshold
 	}
 }
+
+// WithMaxImmutableMemtables sets how many full memtables can wait to be written on disk.
+// They keep serving reads, but when the limit is reached, writes block until a memtable is saved,
+// so the memory doesn't grow without bound when the disk is slow. There is at least one.
+func WithMaxImmutableMemtables(n int) ConfigOption {
+	return func(c *Config) {
+		c.maxImmutableMemtables = n
+	}
+}
+
+// WithWriteRateLimit sets how many bytes of records per second can be written
+// once the memtable flushes fall behind, see WithRateLimitBackpressureThreshold.
+// Unlike WithMaxImmutableMemtables which blocks writes, the limit slows them down,
+// so the flushes can catch up without stalling the writers. Up to one second worth of bytes can be written at once.
+// Zero disables the limit.
+func WithWriteRateLimit(bytesPerSecond int64) ConfigOption {
+	return func(c *Config) {
+		c.writeRateLimit = bytesPerSecond
+	}
+}
+
+// WithRateLimitBackpressureThreshold sets a number of immutable memtables waiting to be written on disk
+// when the write rate limit is applied. Zero applies the limit to all the writes.
+func WithRateLimitBackpressureThreshold(n int) ConfigOption {
+	return func(c *Config) {
+		c.rateLimitThreshold = n
+	}
+}
+
+// WithWALPreallocSize sets a size of disk space chunks in bytes which are reserved for the WAL file
+// to reduce its fragmentation. Zero size disables pre-allocation.
+// Note, pre-allocation is supported only on Linux.
+func WithWALPreallocSize(size int64) ConfigOption {
+	return func(c *Config) {
+		c.walPreallocSize = size
+	}
+}
+
+// WithMaxWALSize sets a size of the WAL files in bytes after which the write that exceeded it
+// saves the memtables on disk and waits until their WAL files are removed, see WithMaxMemtableSize.
+// It bounds the WAL, so the recovery doesn't take long, e.g., when the memtable size threshold is large,
+// or the values are stored in the value log and the memtable grows slowly. Zero means no limit.
+func WithMaxWALSize(bytes int64) ConfigOption {
+	return func(c *Config) {
+		c.maxWALSize = bytes
+	}
+}
+
+// WithGlobalBloomFalsePositiveRate sets a false positive rate of the Bloom filter built over all segments,
+// e.g., 0.01 means 1% of lookups of missing keys have to check the segments.
+func WithGlobalBloomFalsePositiveRate(rate float64) ConfigOption {
+	return func(c *Config) {
+		c.globalBloomRate = rate
+	}
+}
+
+// WithBloomFilterBitsPerKey sets a number of bits per key in the Bloom filters built for new segments,
+// so Get skips the segments which can't contain a key. More bits mean fewer false positives at the cost of memory,
+// e.g., 10 bits give about 1% false positive rate. Zero disables the filters.
+func WithBloomFilterBitsPerKey(n int) ConfigOption {
+	return func(c *Config) {
+		c.bloomBitsPerKey = n
+	}
+}
+
+// WithSparseIndexInterval makes new segments index one key per the given number of bytes of their records
+// instead of every key. A key is then found by reading the records after the nearest indexed key,
+// so memory is saved at the cost of extra reads. Zero (default) indexes every key.
+// Note, the global Bloom filter can't be built without all the keys, so it's disabled.
+func WithSparseIndexInterval(bytes int) ConfigOption {
+	return func(c *Config) {
+		c.sparseIndexInterval = int64(bytes)
+	}
+}
+
+// WithRestartInterval sets how often a key is stored uncompressed in new segment files (restart point).
+// The keys in between store only the bytes which differ from the previous key, e.g., "user:0002" after "user:0001"
+// is stored as "2" and the length of the shared prefix. The first key of every block is a restart point as well.
+// Longer interval saves more disk space, but reads of a sparse index have to start from a restart point,
+// see WithSparseIndexInterval. One or less disables prefix compression.
+func WithRestartInterval(n int) ConfigOption {
+	return func(c *Config) {
+		c.restartInterval = n
+	}
+}
+
+// WithBlockCacheSize sets a size in bytes of the LRU cache of records recently read from segment files,
+// so Get of hot keys doesn't read the disk. The records are evicted once their total size exceeds the limit.
+// Zero disables the cache.
+func WithBlockCacheSize(bytes int) ConfigOption {
+	return func(c *Config) {
+		c.blockCacheSize = bytes
+	}
+}
+
+// WithLevelCount sets a number of compaction levels including level 0 where the memtable is flushed.
+// Level 1 is allowed to grow to the size of two memtables, and every next level is larger by the level size multiplier.
+// The last level grows without limit. There are at least 2 levels.
+func WithLevelCount(n int) ConfigOption {
+	return func(c *Config) {
+		c.levelCount = n
+	}
+}
+
+// WithLevelSizeMultiplier sets how many times every compaction level is larger than the previous one.
+// A larger multiplier means fewer levels to check on reads at the cost of more data rewritten by compaction.
+func WithLevelSizeMultiplier(m int) ConfigOption {
+	return func(c *Config) {
+		c.levelSizeMultiplier = m
+	}
+}
+
+// WithCompactionTrigger sets a number of level 0 segments when they are merged into level 1.
+// Every level 0 segment is checked by the reads of the keys it might contain, so fewer segments
+// mean faster reads at the cost of more frequent compactions. The trigger is at least 1.
+func WithCompactionTrigger(n int) ConfigOption {
+	return func(c *Config) {
+		c.compactionTrigger = n
+	}
+}
+
+// WithMaxSegmentSize sets a size of a segment file in bytes above which the segment is compacted
+// into the next level right away instead of waiting for its level to reach the target size,
+// e.g., a large batch flushed from the memtable doesn't slow down reads of level 0.
+// A merged segment which is still too large is compacted further until it reaches the last level.
+// Zero disables the limit.
+func WithMaxSegmentSize(bytes int64) ConfigOption {
+	return func(c *Config) {
+		c.maxSegmentSize = bytes
+	}
+}
+
+// WithMaxKeySize sets a size of a key in bytes above which the writes are rejected with ErrKeyTooLarge.
+// Zero disables the limit.
+func WithMaxKeySize(bytes int) ConfigOption {
+	return func(c *Config) {
+		c.maxKeySize = bytes
+	}
+}
+
+// WithMaxValueSize sets a size of a value in bytes above which the writes are rejected with ErrValueTooLarge.
+// Regardless of the limit, a record can't exceed 536 MB, see recordLengthSize. Zero disables the limit.
+func WithMaxValueSize(bytes int) ConfigOption {
+	return func(c *Config) {
+		c.maxValueSize = bytes
+	}
+}
+
+// WithWatchBufferSize sets a number of events buffered by every channel returned by Watch.
+// The events which don't fit in the buffer are dropped, so the writers aren't blocked by slow watchers.
+func WithWatchBufferSize(n int) ConfigOption {
+	return func(c *Config) {
+		c.watchBufferSize = n
+	}
+}
+
+// WithDataScanning enables the background scan of the segment files which reads every segment file
+// every interval and verifies its records like Verify does, so silently corrupted records are found early.
+// The reads are throttled to avoid impacting the foreground reads. Zero disables the scan which is the default.
+func WithDataScanning(interval time.Duration) ConfigOption {
+	return func(c *Config) {
+		c.dataScanInterval = interval
+	}
+}
+
+// WithCorruptionHandler sets a function which is called for every problem found by the background scan
+// of the segment files, see WithDataScanning. The offset is the offset of the record in the records stream,
+// or -1 if the problem isn't related to a particular record. By default the problems are logged.
+func WithCorruptionHandler(fn func(segPath string, offset int64, err error)) ConfigOption {
+	return func(c *Config) {
+		c.onCorruption = fn
+	}
+}
+
+// WithMergeStrategy sets which version of a key is kept when compaction merges segments, see MergeStrategy.
+// MergeStrategyLastWriteWins is used by default.
+func WithMergeStrategy(strategy MergeStrategy) ConfigOption {
+	return func(c *Config) {
+		c.mergeStrategy = strategy
+	}
+}
+
+// WithExpiryInterval sets how often the keys written with SetWithTTL are checked in the memtable,
+// so the expired ones are replaced with tombstones to free memory.
+// The expired keys are not returned regardless of this setting. Zero disables the checks.
+func WithExpiryInterval(d time.Duration) ConfigOption {
+	return func(c *Config) {
+		c.expiryInterval = d
+	}
+}
+
+// WithCompression sets the codec which compresses blocks of new segment files, e.g., CompressionSnappy.
+// Segments are read regardless of this setting, because the codec is recorded in the header of every block.
+func WithCompression(codec CompressionCodec) ConfigOption {
+	return func(c *Config) {
+		c.compression = codec
+	}
+}
+
+// WithLevelCompression sets how blocks of new segment files at the compaction level are compressed
+// instead of the compression set by WithCompression, see WithLevelCount.
+// For example, the hot segments of level 0 could use CompressionSnappy to be written and read faster,
+// while the cold segments of the deeper levels use CompressionZstd to take less disk space.
+func WithLevelCompression(level int, codec CompressionCodec) ConfigOption {
+	return func(c *Config) {
+		if c.levelCompression == nil {
+			c.levelCompression = make(map[int]CompressionCodec)
+		}
+		c.levelCompression[level] = codec
+	}
+}
+
+// WithValueLogThreshold enables key-value separation: values larger than the threshold in bytes
+// are stored in the value log when the memtable is written on disk, and segments keep only the pointers to them.
+// It reduces write amplification for large values, because compaction merges the pointers instead of the values.
+// The space of the overwritten values is reclaimed periodically, see WithValueLogGCInterval.
+// Zero disables the value log which is the default.
+func WithValueLogThreshold(bytes int) ConfigOption {
+	return func(c *Config) {
+		c.valueLogThreshold = bytes
+	}
+}
+
+// WithValueLogGCInterval sets how often the space of the overwritten values is reclaimed in the value log:
+// the live values of the oldest value log file are rewritten and the file is removed. Zero disables it.
+func WithValueLogGCInterval(d time.Duration) ConfigOption {
+	return func(c *Config) {
+		c.valueLogGCInterval = d
+	}
+}
+
+// WithWALRecoveryMode sets how invalid records are handled during WAL replay, see WALRecoveryMode.
+// AbortOnCorrupt is used by default.
+func WithWALRecoveryMode(m WALRecoveryMode) ConfigOption {
+	return func(c *Config) {
+		c.walRecoveryMode = m
+	}
+}
+
+// WithWALSyncMode sets when the WAL records are synced to disk, see WALSyncMode for durability trade-offs.
+// SyncAlways is used by default.
+func WithWALSyncMode(m WALSyncMode) ConfigOption {
+	return func(c *Config) {
+		c.walSyncMode = m
+	}
+}
+
+// WithWALSyncInterval sets how often the WAL is synced to disk in SyncPeriodic mode.
+// Longer interval makes writes faster, but more of them could be lost on a machine crash.
+func WithWALSyncInterval(d time.Duration) ConfigOption {
+	return func(c *Config) {
+		c.walSyncInterval = d
+	}
+}
+
+// WithWALBufferSize sets a size in bytes of the in-memory buffer where the WAL records are collected
+// before they're written to the file, so high write rates don't result in many small write syscalls.
+// The buffer is written when it's full and before the WAL is synced, i.e., on every write in SyncAlways mode.
+// Note, in the other modes the buffered records are lost if the process crashes, see WALSyncMode.
+// The buffer is DefaultWALBufferSize by default, zero disables buffering.
+func WithWALBufferSize(bytes int) ConfigOption {
+	return func(c *Config) {
+		c.walBufferSize = bytes
+	}
+}
+
+// WithCompactionProgress sets fn to report compaction progress:
+// how many bytes of the merged segments were read out of their total size.
+// Note, fn is called often, so it should be fast.
+func WithCompactionProgress(fn func(read, total int64)) ConfigOption {
+	return func(c *Config) {
+		c.onCompactionProgress = fn
+	}
+}
+
+// WithSignalHandling closes the database when the process receives one of the signals,
+// so recent changes are saved on disk even if the application doesn't call close.
+// By default SIGTERM and SIGINT are handled.
+// Once the database is closed, the signal is sent again to the process with the handler removed,
+// so it terminates the process as usual unless the application handles the signal itself.
+func WithSignalHandling(signals ...os.Signal) ConfigOption {
+	return func(c *Config) {
+		if len(signals) == 0 {
+			signals = []os.Signal{syscall.SIGTERM, os.Interrupt}
+		}
+		c.signals = signals
+	}
+}
+
+// WithFileMode sets the permission bits of the database files: segments, their sidecar files, WAL, value log, and LOCK.
+// By default the files are accessible only by the owner (0600).
+// For example, 0640 lets a group of processes share read access to the segment files.
+// Note, the permissions are subject to the process umask.
+func WithFileMode(mode os.FileMode) ConfigOption {
+	return func(c *Config) {
+		c.fileMode = mode
+	}
+}
+
+// WithDirMode sets the permission bits of the database dir when it's created.
+// By default the dir is accessible only by the owner (0700).
+// Note, the permissions are subject to the process umask.
+func WithDirMode(mode os.FileMode) ConfigOption {
+	return func(c *Config) {
+		c.dirMode = mode
+	}
+}
+
+// WithCodec sets the codec which encodes the keys and values of the segment records, see Codec.
+// By default BinaryCodec is used. Note, the segments written with one codec can't be read with another.
+func WithCodec(codec Codec) ConfigOption {
+	return func(c *Config) {
+		c.codec = codec
+	}
+}
+
+// WithKeyComparator sets the order of the keys, e.g., to iterate numeric keys in numeric order.
+// The cmp function returns a negative number when a < b, zero when a == b, and a positive number when a > b.
+// By default the keys are ordered lexicographically by strings.Compare under the name "bytewise".
+// The name is saved along with the segments, so opening the database with a comparator of another name
+// fails with ErrComparatorMismatch instead of reading the segments in a wrong order.
+// Note, PrefixScan assumes the lexicographic order of the keys.
+func WithKeyComparator(name string, cmp func(a, b string) int) ConfigOption {
+	return func(c *Config) {
+		c.comparator = keyComparator{
+			name: name,
+			cmp:  cmp,
+		}
+	}
+}
+
+// WithDirectIO enables the direct I/O of the segment files on Linux: they're opened with O_DIRECT,
+// so their reads and writes bypass the OS page cache, e.g., to avoid memory pressure and latency spikes
+// caused by the page cache in a write-intensive workload. The reads and writes are aligned to 4096 bytes.
+// The segments are read from disk every time, so consider WithBlockCacheSize to cache the hot records.
+// It does nothing on other platforms and on file systems which don't support the direct I/O, e.g., tmpfs.
+// The WAL, value log, and sidecar files are accessed as usual.
+func WithDirectIO(enabled bool) ConfigOption {
+	return func(c *Config) {
+		c.directIO = enabled
+	}
+}
+
+// WithLogger sets the logger of the database events: the memtable flushes and compactions are logged at Info level,
+// the WAL truncations and removals, and compaction triggers at Debug, the WAL syncs slower than 100ms at Warn,
+// and the I/O errors at Error level. The logger is slog.Default() by default or if l is nil.
+func WithLogger(l *slog.Logger) ConfigOption {
+	return func(c *Config) {
+		if l == nil {
+			l = slog.Default()
+		}
+		c.logger = l
+	}
+}
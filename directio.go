@@ -0,0 +1,120 @@
+package hasty
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+const (
+	// directIOAlignment is the alignment of the buffers, offsets, and lengths of the direct I/O
+	// which is the block size of most file systems.
+	directIOAlignment = 4096
+	// directIOBufferSize is a size of the buffer where directIOWriter accumulates the writes.
+	directIOBufferSize = 64 * directIOAlignment
+)
+
+// alignedBuffer returns a zeroed buffer of size bytes whose address is aligned for the direct I/O.
+func alignedBuffer(size int) []byte {
+	b := make([]byte, size+directIOAlignment)
+	offset := int(uintptr(unsafe.Pointer(&b[0])) & (directIOAlignment - 1))
+	if offset != 0 {
+		offset = directIOAlignment - offset
+	}
+	return b[offset : offset+size]
+}
+
+// alignDown rounds n down to a multiple of directIOAlignment.
+func alignDown(n int64) int64 {
+	return n &^ (directIOAlignment - 1)
+}
+
+// alignUp rounds n up to a multiple of directIOAlignment.
+func alignUp(n int64) int64 {
+	return alignDown(n + directIOAlignment - 1)
+}
+
+// directIOWriter writes a file opened with O_DIRECT sequentially from the beginning.
+// The writes are accumulated in an aligned buffer which is written to the file once it's full.
+// Flush writes the rest of the buffer padded to the alignment and truncates the file to the written size,
+// so the file can be appended after Flush: the last partial block is rewritten then.
+type directIOWriter struct {
+	f *os.File
+	// buf is the aligned buffer whose first n bytes are written to the file at the offset.
+	buf    []byte
+	n      int
+	offset int64
+}
+
+func newDirectIOWriter(f *os.File) *directIOWriter {
+	return &directIOWriter{
+		f:   f,
+		buf: alignedBuffer(directIOBufferSize),
+	}
+}
+
+func (w *directIOWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		written += n
+		p = p[n:]
+		if w.n < len(w.buf) {
+			break
+		}
+		if _, err := w.f.WriteAt(w.buf, w.offset); err != nil {
+			return written, err
+		}
+		w.offset += int64(len(w.buf))
+		w.n = 0
+	}
+	return written, nil
+}
+
+// Flush writes the buffered bytes to the file.
+func (w *directIOWriter) Flush() error {
+	if w.n == 0 {
+		return nil
+	}
+	// The padding after the buffered bytes is zeroed, because the buffer is reused.
+	size := int(alignUp(int64(w.n)))
+	for i := w.n; i < size; i++ {
+		w.buf[i] = 0
+	}
+	if _, err := w.f.WriteAt(w.buf[:size], w.offset); err != nil {
+		return err
+	}
+	return w.f.Truncate(w.offset + int64(w.n))
+}
+
+// directIOReader reads a file opened with O_DIRECT at arbitrary offsets:
+// the aligned range of the file which covers the requested bytes is read into an aligned buffer.
+type directIOReader struct {
+	f *os.File
+}
+
+func (r directIOReader) ReadAt(p []byte, offset int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	start := alignDown(offset)
+	buf := alignedBuffer(int(alignUp(offset+int64(len(p))) - start))
+	n, err := r.f.ReadAt(buf, start)
+	skip := int(offset - start)
+	if n <= skip {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+
+	n = copy(p, buf[skip:n])
+	if n == len(p) {
+		return n, nil
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
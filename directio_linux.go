@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package hasty
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openDirectFile opens the file with O_DIRECT, so its reads and writes bypass the page cache.
+// The file is opened as usual if the file system doesn't support the direct I/O, e.g., tmpfs,
+// then direct is false.
+func openDirectFile(path string, flag int, mode os.FileMode) (f *os.File, direct bool, err error) {
+	f, err = os.OpenFile(path, flag|unix.O_DIRECT, mode)
+	if errors.Is(err, unix.EINVAL) {
+		// The file might have been created before O_DIRECT was rejected.
+		f, err = os.OpenFile(path, flag&^os.O_EXCL, mode)
+		return f, false, err
+	}
+	return f, err == nil, err
+}
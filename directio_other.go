@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package hasty
+
+import "os"
+
+// openDirectFile opens the file as usual on platforms that don't support O_DIRECT, so direct is always false.
+func openDirectFile(path string, flag int, mode os.FileMode) (f *os.File, direct bool, err error) {
+	f, err = os.OpenFile(path, flag, mode)
+	return f, false, err
+}
@@ -0,0 +1,125 @@
+package hasty
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirectIO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seg")
+	f, direct, err := openDirectFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !direct {
+		t.Skip("direct I/O is not supported")
+	}
+
+	// The writes of arbitrary sizes cross the buffer boundaries, and the file is appended after Flush.
+	want := make([]byte, directIOBufferSize*2+100)
+	rand.New(rand.NewSource(1)).Read(want)
+	w := newDirectIOWriter(f)
+	for _, chunk := range [][]byte{want[:10], want[10 : directIOBufferSize+5], want[directIOBufferSize+5 : directIOBufferSize+50]} {
+		if _, err = w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(want[directIOBufferSize+50:]); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatalf("expected %d written bytes, got: %d", len(want), len(got))
+	}
+
+	rf, _, err := openDirectFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	r := directIOReader{f: rf}
+	tests := []struct {
+		offset int64
+		size   int
+	}{
+		{0, 10},
+		{directIOAlignment - 1, 2},
+		{12345, directIOAlignment * 3},
+		{int64(len(want)) - 7, 7},
+	}
+	for _, tc := range tests {
+		b := make([]byte, tc.size)
+		if n, err := r.ReadAt(b, tc.offset); n != tc.size || err != nil {
+			t.Fatalf("offset %d: expected %d bytes, got: %d %v", tc.offset, tc.size, n, err)
+		}
+		if !bytes.Equal(want[tc.offset:tc.offset+int64(tc.size)], b) {
+			t.Errorf("offset %d: unexpected bytes", tc.offset)
+		}
+	}
+	// The read past the end of the file is short.
+	b := make([]byte, 10)
+	if n, err := r.ReadAt(b, int64(len(want))-3); n != 3 || err != io.EOF {
+		t.Errorf("expected 3 bytes and EOF, got: %d %v", n, err)
+	}
+	if n, err := r.ReadAt(b, int64(len(want))+directIOAlignment); n != 0 || err != io.EOF {
+		t.Errorf("expected EOF, got: %d %v", n, err)
+	}
+}
+
+func TestDB_directIO(t *testing.T) {
+	for _, c := range []CompressionCodec{CompressionNone, CompressionSnappy} {
+		dir := t.TempDir()
+		db, close, err := Open(dir, WithDirectIO(true), WithCompression(c), WithBlockCacheSize(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err = db.Set(fmt.Sprintf("key%04d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+				t.Fatal(err)
+			}
+			if i%300 == 0 {
+				flushDB(t, db)
+			}
+		}
+		flushDB(t, db)
+		if err = db.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err = close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The segments written with the direct I/O are read with it after reopening.
+		if db, close, err = Open(dir, WithDirectIO(true), WithCompression(c), WithBlockCacheSize(0)); err != nil {
+			t.Fatal(err)
+		}
+		defer close()
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			if got, err := db.Get(key); string(got) != fmt.Sprintf("value%d", i) || err != nil {
+				t.Fatalf("compression %d: %s: unexpected value: %q %v", c, key, got, err)
+			}
+		}
+		keys, err := db.Keys()
+		if err != nil || len(keys) != 1000 {
+			t.Errorf("compression %d: expected 1000 keys, got: %d %v", c, len(keys), err)
+		}
+	}
+}
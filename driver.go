@@ -0,0 +1,278 @@
+package hasty
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DriverName is a name of HastyDB driver registered in database/sql package.
+const DriverName = "hastydb"
+
+func init() {
+	sql.Register(DriverName, &Driver{})
+}
+
+// Driver implements database/sql/driver.Driver interface, so the database can be opened with
+// sql.Open("hastydb", "/path/to/db"). The same database is shared by all connections with the same name.
+//
+// HastyDB is a key-value storage, so it supports only the following statements
+// where operands are either ? placeholders or literals:
+//
+//	GET key          returns a single row with "value" column or no rows if the key is not found
+//	SET key value    puts a key in the database
+//	DELETE key       removes a key from the database
+type Driver struct {
+	mu  sync.Mutex
+	dbs map[string]*sharedDB
+}
+
+// sharedDB is a database shared by connections and closed when the last connection is closed.
+type sharedDB struct {
+	db    *DB
+	close func() error
+	refs  int
+}
+
+// Open returns a new connection to the database located at name path.
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.dbs == nil {
+		d.dbs = make(map[string]*sharedDB)
+	}
+	sdb, ok := d.dbs[name]
+	if !ok {
+		db, close, err := Open(name)
+		if err != nil {
+			return nil, err
+		}
+		sdb = &sharedDB{
+			db:    db,
+			close: close,
+		}
+		d.dbs[name] = sdb
+	}
+	sdb.refs++
+
+	c := Conn{
+		driver: d,
+		name:   name,
+		db:     sdb.db,
+	}
+	return &c, nil
+}
+
+// release closes the named database when it's no longer used by connections.
+func (d *Driver) release(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sdb, ok := d.dbs[name]
+	if !ok {
+		return nil
+	}
+	if sdb.refs--; sdb.refs > 0 {
+		return nil
+	}
+	delete(d.dbs, name)
+	return sdb.close()
+}
+
+// Conn implements database/sql/driver.Conn interface.
+// Note, connection is not concurrency safe, database/sql package takes care of that.
+type Conn struct {
+	driver *Driver
+	name   string
+	db     *DB
+	// tx is the current transaction where statements are executed.
+	tx *Tx
+}
+
+// Prepare parses a statement, see Driver for supported statements.
+func (c *Conn) Prepare(query string) (driver.Stmt, error) {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty statement")
+	}
+
+	s := stmt{
+		conn:     c,
+		cmd:      strings.ToUpper(fields[0]),
+		operands: fields[1:],
+	}
+	var want int
+	switch s.cmd {
+	case "GET", "DELETE":
+		want = 1
+	case "SET":
+		want = 2
+	default:
+		return nil, fmt.Errorf("unsupported statement %q", query)
+	}
+	if len(s.operands) != want {
+		return nil, fmt.Errorf("%s statement expects %d operands, got %d", s.cmd, want, len(s.operands))
+	}
+	for _, op := range s.operands {
+		if op == "?" {
+			s.numInput++
+		}
+	}
+	return &s, nil
+}
+
+// Close releases the connection.
+func (c *Conn) Close() error {
+	return c.driver.release(c.name)
+}
+
+// Begin starts a transaction, see Tx.
+func (c *Conn) Begin() (driver.Tx, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	c.tx = tx
+	return &connTx{conn: c, tx: tx}, nil
+}
+
+// store returns the current transaction if there is one, otherwise the database.
+func (c *Conn) store() interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	Delete(key string) error
+} {
+	if c.tx != nil {
+		return c.tx
+	}
+	return c.db
+}
+
+// connTx detaches the transaction from the connection once it's finished.
+type connTx struct {
+	conn *Conn
+	tx   *Tx
+}
+
+func (t *connTx) Commit() error {
+	t.conn.tx = nil
+	return t.tx.Commit()
+}
+
+func (t *connTx) Rollback() error {
+	t.conn.tx = nil
+	return t.tx.Rollback()
+}
+
+// stmt is a prepared statement.
+type stmt struct {
+	conn *Conn
+	// cmd is a statement command, e.g., GET.
+	cmd string
+	// operands are either ? placeholders or literals.
+	operands []string
+	// numInput is a number of placeholders.
+	numInput int
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return s.numInput
+}
+
+// Exec executes SET and DELETE statements.
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	ops, err := s.bind(args)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s.cmd {
+	case "SET":
+		err = s.conn.store().Set(string(ops[0]), ops[1])
+	case "DELETE":
+		err = s.conn.store().Delete(string(ops[0]))
+	default:
+		return nil, fmt.Errorf("%s statement must be queried", s.cmd)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+// Query executes GET statement.
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.cmd != "GET" {
+		return nil, fmt.Errorf("%s statement must be executed", s.cmd)
+	}
+	ops, err := s.bind(args)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := s.conn.store().Get(string(ops[0]))
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		return &rows{}, nil
+	case err != nil:
+		return nil, err
+	}
+	return &rows{value: value, found: true}, nil
+}
+
+// bind substitutes placeholders with arguments.
+func (s *stmt) bind(args []driver.Value) ([][]byte, error) {
+	ops := make([][]byte, len(s.operands))
+	for i, op := range s.operands {
+		if op != "?" {
+			ops[i] = []byte(op)
+			continue
+		}
+
+		if len(args) == 0 {
+			return nil, fmt.Errorf("missing argument for %d operand", i)
+		}
+		switch v := args[0].(type) {
+		case string:
+			ops[i] = []byte(v)
+		case []byte:
+			ops[i] = v
+		default:
+			return nil, fmt.Errorf("unsupported argument type %T", v)
+		}
+		args = args[1:]
+	}
+	return ops, nil
+}
+
+// rows is a result of GET statement which has at most one row.
+type rows struct {
+	value []byte
+	found bool
+}
+
+func (r *rows) Columns() []string {
+	return []string{"value"}
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if !r.found {
+		return io.EOF
+	}
+	dest[0] = r.value
+	r.found = false
+	return nil
+}
@@ -0,0 +1,96 @@
+package hasty_test
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	hasty "github.com/marselester/hastydb"
+)
+
+func ExampleDriver() {
+	dir, err := ioutil.TempDir("", "hastydb")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open(hasty.DriverName, dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err = db.Exec("SET ? ?", "name", "Alice"); err != nil {
+		log.Fatal(err)
+	}
+
+	var name string
+	if err = db.QueryRow("GET ?", "name").Scan(&name); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(name)
+	// Output:
+	// Alice
+}
+
+func TestDriver_tx(t *testing.T) {
+	db, err := sql.Open(hasty.DriverName, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.Exec("SET name ?", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.QueryRow("GET name").Scan(new(string)); err != sql.ErrNoRows {
+		t.Errorf("expected: %v, got: %v", sql.ErrNoRows, err)
+	}
+
+	var name string
+	if err = tx.QueryRow("GET name").Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "Alice" {
+		t.Errorf("expected: Alice, got: %q", name)
+	}
+
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.QueryRow("GET name").Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "Alice" {
+		t.Errorf("expected: Alice, got: %q", name)
+	}
+}
+
+func TestDriver_badStatement(t *testing.T) {
+	db, err := sql.Open(hasty.DriverName, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := map[string]string{
+		"unknown command": "SELECT * FROM users",
+		"no operands":     "GET",
+		"extra operands":  "DELETE name surname",
+	}
+	for name, query := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := db.Exec(query); err == nil {
+				t.Errorf("expected error for %q", query)
+			}
+		})
+	}
+}
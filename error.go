@@ -1,10 +1,62 @@
 package hasty
 
-import "io"
+import (
+	"fmt"
+	"io"
+)
 
 // ErrKeyNotFound is returned when a requested key is not found in database.
 const ErrKeyNotFound = Error("key not found")
 
+// ErrEmptyKey is returned when a key is an empty string.
+// Empty keys are ambiguous in range scans, so they are not allowed.
+const ErrEmptyKey = Error("empty key")
+
+// ErrClosed is returned when the database is closed or being closed.
+const ErrClosed = Error("database is closed")
+
+// ErrReadOnly is returned when the database doesn't accept writes, e.g., during defragmentation.
+const ErrReadOnly = Error("database is read-only")
+
+// ErrLocked is returned when the database dir is already opened by another process for writes,
+// or it's opened for reads when a process wants to write it.
+const ErrLocked = Error("database is locked")
+
+// ErrCorruptRecord is returned when a record in a segment file can't be read because it's damaged.
+const ErrCorruptRecord = Error("corrupt record")
+
+// ErrUnsupportedVersion is returned when a segment file was written in a newer incompatible format.
+const ErrUnsupportedVersion = Error("unsupported segment format version")
+
+// ErrChecksum is returned when a record doesn't match its checksum, i.e., the data was silently corrupted on disk.
+const ErrChecksum = Error("record checksum mismatch")
+
+// ErrValueTooLarge is returned when a value exceeds the size limit set by the caller or WithMaxValueSize,
+// or when a record is too large to be encoded.
+const ErrValueTooLarge = Error("value too large")
+
+// ErrKeyTooLarge is returned when a key exceeds the size limit set by WithMaxKeySize.
+const ErrKeyTooLarge = Error("key too large")
+
+// ErrInvalidKey is returned when a key contains a zero byte which delimits the keys from the values in the records.
+const ErrInvalidKey = Error("invalid key")
+
+// ErrTxDone is returned when a transaction was already committed or rolled back.
+const ErrTxDone = Error("transaction has already been committed or rolled back")
+
+// ErrSnapshotClosed is returned when a snapshot is read after it was closed.
+const ErrSnapshotClosed = Error("snapshot is closed")
+
+// ErrIndexNotFound is returned when a secondary index wasn't created.
+const ErrIndexNotFound = Error("index not found")
+
+// ErrIndexExists is returned when a secondary index with the same name was already created.
+const ErrIndexExists = Error("index already exists")
+
+// ErrComparatorMismatch is returned when the database segments were ordered by another key comparator,
+// see WithKeyComparator.
+const ErrComparatorMismatch = Error("key comparator mismatch")
+
 // Error defines HastyDB errors.
 type Error string
 
@@ -12,6 +64,45 @@ func (e Error) Error() string {
 	return string(e)
 }
 
+// KeyError describes a failure to read or write the key,
+// so the key can be extracted with errors.As, e.g., for logging.
+type KeyError struct {
+	Key string
+	// Err is the cause, e.g., SegmentError.
+	Err error
+}
+
+func (e KeyError) Error() string {
+	return fmt.Sprintf("key %q: %v", e.Key, e.Err)
+}
+
+func (e KeyError) Unwrap() error {
+	return e.Err
+}
+
+// SegmentError describes an I/O failure in the segment file,
+// so the path of the file can be extracted with errors.As to find a damaged file.
+type SegmentError struct {
+	// Path is the path of the segment file.
+	Path string
+	// Offset is the offset of the record in the records stream,
+	// -1 means the failure is not related to a particular record.
+	Offset int64
+	// Err is the cause, e.g., ErrCorruptRecord or io.EOF.
+	Err error
+}
+
+func (e SegmentError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("segment %s: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("segment %s at offset %d: %v", e.Path, e.Offset, e.Err)
+}
+
+func (e SegmentError) Unwrap() error {
+	return e.Err
+}
+
 // errWriter fulfils the io.Writer contract so it can be used to wrap an existing io.Writer.
 // errWriter passes writes through to its underlying writer until an error is detected.
 // From that point on, it discards any writes and returns the previous error.
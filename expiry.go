@@ -0,0 +1,58 @@
+package hasty
+
+import (
+	"context"
+	"time"
+)
+
+// newExpiryWorker creates an expiryWorker that looks for expired keys every interval.
+func newExpiryWorker(db *DB, interval time.Duration) *expiryWorker {
+	return &expiryWorker{
+		db:       db,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// expiryWorker is an actor that is responsible for replacing expired keys in the memtable with tombstones,
+// so their values don't occupy memory and aren't written on disk.
+// The tombstones are not written to the WAL: an expired key is recovered from the WAL as expired anyway.
+// The immutable memtables are left as they are, because they're being saved on disk,
+// and the expired keys in segments are discarded by compaction.
+type expiryWorker struct {
+	db       *DB
+	interval time.Duration
+	now      func() time.Time
+}
+
+// Run starts the actor which is stopped by cancelling context.
+func (e *expiryWorker) Run(ctx context.Context) error {
+	t := time.NewTicker(e.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			e.expire()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// expire replaces the expired keys of the memtable with tombstones and returns their number.
+// The tombstones shadow the older versions of the keys stored elsewhere.
+func (e *expiryWorker) expire() int {
+	now := e.now().UnixNano()
+
+	e.db.memMu.Lock()
+	defer e.db.memMu.Unlock()
+	keys := e.db.memtable.Expired(now)
+	for _, key := range keys {
+		e.db.memtable.Delete(key)
+	}
+	if len(keys) != 0 {
+		e.db.memChanged()
+	}
+	return len(keys)
+}
@@ -0,0 +1,169 @@
+package hasty
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiryWorker_expire(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithExpiryInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.SetWithTTL("name", []byte("Alice"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.SetWithTTL("session", []byte("123"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("city", []byte("Paris")); err != nil {
+		t.Fatal(err)
+	}
+
+	e := newExpiryWorker(db, time.Minute)
+	if n := e.expire(); n != 0 {
+		t.Errorf("expected no expired keys, got: %d", n)
+	}
+
+	e.now = func() time.Time {
+		return time.Now().Add(2 * time.Minute)
+	}
+	if n := e.expire(); n != 1 {
+		t.Errorf("expected 1 expired key, got: %d", n)
+	}
+	if value, deleted, _ := db.memtable.Lookup("session"); !deleted || value != nil {
+		t.Errorf("expected session tombstone, got: %q", value)
+	}
+	for _, key := range []string{"name", "city"} {
+		if _, deleted, ok := db.memtable.Lookup(key); deleted || !ok {
+			t.Errorf("expected %s to stay", key)
+		}
+	}
+}
+
+func TestDB_expiryWorker(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithExpiryInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.SetWithTTL("session", []byte("123"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.memMu.RLock()
+		_, deleted, _ := db.memtable.Lookup("session")
+		db.memMu.RUnlock()
+		if deleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the expired key to be replaced with a tombstone")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDBSetWithTTL_segment(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithExpiryInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.SetWithTTL("name", []byte("Alice"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.SetWithTTL("session", []byte("123"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+	time.Sleep(5 * time.Millisecond)
+
+	if got, err := db.Get("name"); string(got) != "Alice" || err != nil {
+		t.Errorf("expected Alice, got: %q %v", got, err)
+	}
+	// The expired key is cached on the first Get, so the second one reads it from the cache.
+	for i := 0; i < 2; i++ {
+		if _, err = db.Get("session"); err != ErrKeyNotFound {
+			t.Errorf("expected: %v, got: %v", ErrKeyNotFound, err)
+		}
+	}
+	if _, err = db.GetReader("session"); err != ErrKeyNotFound {
+		t.Errorf("expected: %v, got: %v", ErrKeyNotFound, err)
+	}
+	if keys, err := db.Keys(); len(keys) != 1 || keys[0] != "name" || err != nil {
+		t.Errorf("expected [name], got: %q %v", keys, err)
+	}
+}
+
+func TestDBSetExpiry(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithExpiryInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.SetWithTTL("session", []byte("123"), 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("city", []byte("Paris")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete("city"); err != nil {
+		t.Fatal(err)
+	}
+	// The name is looked up in the segment, the others are in the memtable.
+	flushDB(t, db)
+	if err = db.SetWithTTL("session", []byte("123"), 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := time.Now().Add(time.Hour)
+	for _, key := range []string{"session", "name"} {
+		if err = db.SetExpiry(key, expiry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"city", "planet"} {
+		if err = db.SetExpiry(key, expiry); err != ErrKeyNotFound {
+			t.Errorf("%s: expected: %v, got: %v", key, ErrKeyNotFound, err)
+		}
+		if _, err = db.GetExpiry(key); err != ErrKeyNotFound {
+			t.Errorf("%s: expected: %v, got: %v", key, ErrKeyNotFound, err)
+		}
+	}
+
+	// The session outlives its original TTL.
+	time.Sleep(150 * time.Millisecond)
+	for key, want := range map[string]string{"session": "123", "name": "Alice"} {
+		if got, err := db.Get(key); string(got) != want || err != nil {
+			t.Errorf("expected %s, got: %q %v", want, got, err)
+		}
+		if got, err := db.GetExpiry(key); !got.Equal(time.Unix(0, expiry.UnixNano())) || err != nil {
+			t.Errorf("%s: expected expiry %v, got: %v %v", key, expiry, got, err)
+		}
+	}
+
+	// The zero expiry makes the key persistent.
+	if err = db.SetExpiry("session", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.GetExpiry("session"); !got.IsZero() || err != nil {
+		t.Errorf("expected no expiry, got: %v %v", got, err)
+	}
+	if err = db.SetExpiry("name", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Get("name"); err != ErrKeyNotFound {
+		t.Errorf("expected expired name, got: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package hasty
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ExportFormat defines how the key-value pairs are encoded by Export and decoded by Import.
+type ExportFormat int
+
+const (
+	// ExportFormatCSV encodes every key-value pair as a CSV line with the key and the base64 encoded value.
+	// The keys are quoted according to RFC 4180 if needed, e.g., when they contain commas.
+	ExportFormatCSV ExportFormat = iota
+	// ExportFormatJSONL encodes every key-value pair as a JSON object on its own line,
+	// e.g., {"key":"name","value":"QWxpY2U="} where the value is base64 encoded.
+	ExportFormatJSONL
+	// ExportFormatWithTombstones is like ExportFormatJSONL, but it also includes the deleted and expired keys
+	// as tombstones without a value, e.g., {"key":"name","deleted":true}.
+	// Importing such an export deletes the keys, so it can replicate the deletions to another database.
+	ExportFormatWithTombstones
+)
+
+// exportEntry is a key-value pair as it's encoded in ExportFormatJSONL and ExportFormatWithTombstones.
+type exportEntry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+	// Deleted indicates a tombstone, see ExportFormatWithTombstones.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// exportTombstone is a deleted key as it's encoded in ExportFormatWithTombstones.
+type exportTombstone struct {
+	Key     string `json:"key"`
+	Deleted bool   `json:"deleted"`
+}
+
+// Export writes all the key-value pairs to w in ascending key order without the deleted or expired keys
+// unless the format is ExportFormatWithTombstones. The tombstones are kept only until compaction drops them,
+// so the export has the keys deleted since the last compaction of their segments.
+// The pairs are read from a snapshot, so the writes made during the export don't affect the output.
+// Note, operation is concurrency safe.
+func (db *DB) Export(w io.Writer, format ExportFormat) error {
+	bw := bufio.NewWriter(w)
+	var (
+		write func(key string, value []byte, deleted bool) error
+		// flush writes the buffered pairs of the encoder to bw.
+		flush = func() error { return nil }
+	)
+	switch format {
+	case ExportFormatCSV:
+		cw := csv.NewWriter(bw)
+		write = func(key string, value []byte, _ bool) error {
+			return cw.Write([]string{key, base64.StdEncoding.EncodeToString(value)})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case ExportFormatJSONL, ExportFormatWithTombstones:
+		enc := json.NewEncoder(bw)
+		write = func(key string, value []byte, deleted bool) error {
+			if deleted {
+				return enc.Encode(exportTombstone{Key: key, Deleted: true})
+			}
+			return enc.Encode(exportEntry{Key: key, Value: value})
+		}
+	default:
+		return fmt.Errorf("unsupported export format %d", format)
+	}
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	if err = snap.forEach(format == ExportFormatWithTombstones, write); err != nil {
+		return fmt.Errorf("failed to export: %w", err)
+	}
+
+	if err = flush(); err != nil {
+		return fmt.Errorf("failed to export: %w", err)
+	}
+	return bw.Flush()
+}
+
+// Import reads the key-value pairs encoded by Export from r and writes them to the database.
+// The tombstones of ExportFormatWithTombstones delete their keys.
+// The pairs are written in batches like with Batch, so the memtable is saved on disk as it grows.
+// The pairs read before a malformed line are kept in the database, ErrEmptyKey is returned if a key is empty.
+func (db *DB) Import(r io.Reader, format ExportFormat) error {
+	var read func() (*record, error)
+	switch format {
+	case ExportFormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = 2
+		cr.ReuseRecord = true
+		read = func() (*record, error) {
+			fields, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				line, _ := cr.FieldPos(1)
+				return nil, fmt.Errorf("bad value at line %d: %w", line, err)
+			}
+			return &record{key: fields[0], value: value}, nil
+		}
+	case ExportFormatJSONL, ExportFormatWithTombstones:
+		dec := json.NewDecoder(r)
+		read = func() (*record, error) {
+			var e exportEntry
+			if err := dec.Decode(&e); err != nil {
+				return nil, err
+			}
+			if e.Deleted {
+				return &record{key: e.Key, deleted: true}, nil
+			}
+			return &record{key: e.Key, value: e.Value}, nil
+		}
+	default:
+		return fmt.Errorf("unsupported export format %d", format)
+	}
+
+	batch := make([]*record, 0, walReplayBatchSize)
+	for {
+		rec, err := read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to import: %w", err)
+		}
+		if rec.key == "" {
+			return ErrEmptyKey
+		}
+
+		if batch = append(batch, rec); len(batch) < walReplayBatchSize {
+			continue
+		}
+		if err = db.write(batch...); err != nil {
+			return err
+		}
+		batch = make([]*record, 0, walReplayBatchSize)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return db.write(batch...)
+}
@@ -0,0 +1,156 @@
+package hasty
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDBExport(t *testing.T) {
+	tt := map[string]struct {
+		format ExportFormat
+		want   string
+	}{
+		"csv": {
+			format: ExportFormatCSV,
+			want:   "age,MzA=\n\"name,full\",QWxpY2UgU21pdGg=\n",
+		},
+		"jsonl": {
+			format: ExportFormatJSONL,
+			want:   "{\"key\":\"age\",\"value\":\"MzA=\"}\n{\"key\":\"name,full\",\"value\":\"QWxpY2UgU21pdGg=\"}\n",
+		},
+		"jsonl with tombstones": {
+			format: ExportFormatWithTombstones,
+			want:   "{\"key\":\"age\",\"value\":\"MzA=\"}\n{\"key\":\"city\",\"deleted\":true}\n{\"key\":\"name,full\",\"value\":\"QWxpY2UgU21pdGg=\"}\n",
+		},
+	}
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			db, close, err := Open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer close()
+
+			if err = db.Set("age", []byte("30")); err != nil {
+				t.Fatal(err)
+			}
+			if err = db.Set("city", []byte("Paris")); err != nil {
+				t.Fatal(err)
+			}
+			flushDB(t, db)
+			if err = db.Set("name,full", []byte("Alice Smith")); err != nil {
+				t.Fatal(err)
+			}
+			if err = db.Delete("city"); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			if err = db.Export(&buf, tc.format); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tc.want {
+				t.Fatalf("expected %q, got: %q", tc.want, got)
+			}
+
+			imported, closeImported, err := Open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeImported()
+			if err = imported.Import(&buf, tc.format); err != nil {
+				t.Fatal(err)
+			}
+			if got := imported.MustGet("name,full"); string(got) != "Alice Smith" {
+				t.Errorf("expected Alice Smith, got: %q", got)
+			}
+			keys, err := imported.Keys()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(keys, " "); got != "age name,full" {
+				t.Errorf("expected age and name,full keys, got: %q", got)
+			}
+		})
+	}
+}
+
+func TestDBImport_tombstones(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("age", []byte("30")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("city", []byte("Paris")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+
+	// The replica deletes the key, and the deletion is replicated further.
+	input := "{\"key\":\"city\",\"deleted\":true}\n{\"key\":\"name\",\"value\":\"QWxpY2U=\"}\n"
+	if err = db.Import(strings.NewReader(input), ExportFormatWithTombstones); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Get("city"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", ErrKeyNotFound, err)
+	}
+	var buf bytes.Buffer
+	if err = db.Export(&buf, ExportFormatWithTombstones); err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"key\":\"age\",\"value\":\"MzA=\"}\n" + input
+	if got := buf.String(); got != want {
+		t.Errorf("expected %q, got: %q", want, got)
+	}
+}
+
+func TestDBImport_malformed(t *testing.T) {
+	tt := map[string]struct {
+		format ExportFormat
+		input  string
+		want   error
+	}{
+		"csv bad value": {
+			format: ExportFormatCSV,
+			input:  "age,MzA=\nname,Alice\n",
+		},
+		"csv empty key": {
+			format: ExportFormatCSV,
+			input:  ",MzA=\n",
+			want:   ErrEmptyKey,
+		},
+		"jsonl bad object": {
+			format: ExportFormatJSONL,
+			input:  "{\"key\":\"age\",\"value\":\"MzA=\"}\n{\"key\":",
+		},
+	}
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			db, close, err := Open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer close()
+
+			err = db.Import(strings.NewReader(tc.input), tc.format)
+			if err == nil || (tc.want != nil && !errors.Is(err, tc.want)) {
+				t.Errorf("expected %v, got: %v", tc.want, err)
+			}
+		})
+	}
+
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	if err = db.Export(&bytes.Buffer{}, ExportFormat(5)); err == nil {
+		t.Error("expected unsupported export format")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package hasty
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fallocate reserves size bytes of disk space for the file starting from the offset.
+// The file size is not changed (FALLOC_FL_KEEP_SIZE) and no zeros are written,
+// so the pre-allocation is cheap. File systems that don't support fallocate are silently skipped.
+func fallocate(f *os.File, offset, size int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, offset, size)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package hasty
+
+import "os"
+
+// fallocate is a no-op on platforms that don't support fallocate.
+func fallocate(f *os.File, offset, size int64) error {
+	return nil
+}
@@ -1,8 +1,25 @@
 module github.com/marselester/hastydb
 
-go 1.14
+go 1.21
 
 require (
-	github.com/google/go-cmp v0.4.0
-	golang.org/x/sync v0.0.0-20200317015054-43a5402ce75a
+	github.com/golang/snappy v0.0.1
+	github.com/google/go-cmp v0.5.5
+	github.com/klauspost/compress v1.15.15
+	github.com/prometheus/client_golang v1.11.0
+	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
+	golang.org/x/sys v0.0.0-20210603081109-ebe580a85c40
+	golang.org/x/time v0.3.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.26.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
+	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
+	google.golang.org/protobuf v1.26.0-rc.1 // indirect
 )
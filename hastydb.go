@@ -3,152 +3,1904 @@
 package hasty
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 
 	"github.com/marselester/hastydb/internal/index"
 )
 
 // DB represents HastyDB database on disk.
 type DB struct {
+	// segSeq is a sequence number of the next segment file.
+	// It goes first in the struct to be 64-bit aligned for atomic operations.
+	segSeq uint64
+	// memGen is a generation of the memtables which is incremented under memMu whenever they change,
+	// it's 64-bit aligned because it follows segSeq.
+	memGen uint64
+	// metrics are counters of Stats, they're 64-bit aligned because they follow memGen.
+	metrics dbMetrics
+
 	// path is a dir where segment files are stored.
 	path string
 	cfg  Config
 
-	memMu            sync.RWMutex
-	memtable         *index.Memtable
-	flushingMemtable *index.Memtable
+	memMu    sync.RWMutex
+	memtable *index.Memtable
+	// memMisses are the keys recently looked up in the segments, so their reads skip memMu, see memGen.
+	memMisses memMissCache
+	// sketch estimates the number of distinct keys set since the database was opened.
+	sketch *hyperLogLog
+	// immutables are the memtables waiting to be written on disk, the newest first.
+	// They keep serving reads until they're saved in segments.
+	immutables []*index.Memtable
+	// immutableSem limits the number of immutable memtables,
+	// so writes wait for the flushes once it's exhausted (back-pressure).
+	immutableSem *semaphore.Weighted
+	// limiter slows down the writes while the immutable memtables wait to be flushed, nil if it's disabled.
+	limiter *rate.Limiter
 
-	// wal is a write-ahead log file where records are appended to recover from a database crash.
+	// walMu guards wal: the writes hold the read lock while they append records to the WAL and apply them
+	// to the memtable, so the WAL is replaced along with the memtable under the write lock.
+	walMu sync.RWMutex
+	// wal is a write-ahead log file where records of the memtable are appended to recover from a database crash.
 	wal *wal
+	// walSeq is a sequence number of the next WAL file, it's guarded by walMu.
+	walSeq uint64
+	// immutableWALs are the WAL files of the immutable memtables, e.g., immutableWALs[0] has the records
+	// of immutables[0]. A file is removed once its memtable is saved on disk. They're guarded by memMu.
+	immutableWALs []*wal
 
 	segMu sync.Mutex
 	// segments is a slice of segment files where records are stored.
 	// Newest segments are in the beginning of the slice.
 	segments atomic.Value
+	// manifest lists the segments, it's saved whenever the segments change under segMu.
+	manifest *manifest
+	// cache keeps recently read segment records, nil if it's disabled.
+	cache *blockCache
+	// globalBloom is a Bloom filter over all the keys stored in segments (*bloomFilter).
+	// It is replaced whenever segments change and never persisted.
+	globalBloom atomic.Value
+	// vlog is the value log where large values are stored apart from the segments.
+	vlog *valueLog
+
+	indexMu sync.RWMutex
+	// indexes are the extractors of the secondary indexes by their names.
+	indexes map[string]IndexExtractor
+
+	// snapshots is a number of open snapshots, the value log files are kept while there are any.
+	snapshots int32
+
+	// watchMu serializes the changes of watchers.
+	watchMu sync.Mutex
+	// watchers are the channels of Watch by their keys ([]chan WatchEvent).
+	watchers sync.Map
+
+	// prom exposes the metrics to Prometheus.
+	prom *PrometheusCollector
 
 	sstWriter *sstableWriter
-	segMerger *segmentMerger
+	compactor *LeveledCompactor
+	expirer   *expiryWorker
+	walSyncer *walSyncer
+	vlogGC    *valueLogGC
+	scanner   *dataScanner
+	// workers runs the actors which are started lazily:
+	// sstableWriter, walSyncer (SyncPeriodic mode), and valueLogGC (when the value log is enabled) on the first write,
+	// LeveledCompactor after the first flush,
+	// and expiryWorker on the first write of a key with TTL.
+	// The dataScanner is started when the database is opened if the scan is enabled.
+	workers     *errgroup.Group
+	workersCtx  context.Context
+	sstOnce     sync.Once
+	compactOnce sync.Once
+	expiryOnce  sync.Once
+	// sstStarted is set to 1 when sstableWriter is started.
+	sstStarted int32
+
+	// readOnly is set when the database is opened with OpenReadOnly, so writes are rejected.
+	readOnly bool
+	// lock prevents other processes from writing the database dir while it's open.
+	lock *lockFile
+
+	// defragMu serializes Defragment calls.
+	defragMu sync.Mutex
+	// defragmenting is set to 1 while the segments are defragmented, so writes are rejected.
+	defragmenting int32
+
+	// closing is set to 1 at the very start of closing the database, so new operations are rejected.
+	closing int32
+	// inFlight tracks operations in progress: each of them holds a read lock,
+	// so closing the database waits for them by acquiring the write lock.
+	inFlight sync.RWMutex
 }
 
 // Open opens a database directory named path where it expects to find segment files.
+// The segments are loaded at the compaction levels encoded in their file names.
 // If a database doesn't exist, it will be created.
 // Make sure to close database to save recent changes on disk.
 func Open(path string, options ...ConfigOption) (db *DB, close func() error, err error) {
-	db = &DB{
+	db = newDB(path, options...)
+
+	if err = os.MkdirAll(db.path, db.cfg.dirMode); err != nil {
+		return nil, nil, fmt.Errorf("failed to create database dir: %w", err)
+	}
+	// Another process writing the same dir would corrupt the database.
+	if db.lock, err = openLockFile(db.path, true, db.cfg.fileMode); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			db.lock.Close()
+		}
+	}()
+	if err = db.loadSegmentSeq(); err != nil {
+		return nil, nil, err
+	}
+	if err = db.loadSegments(); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			closeSegments(db.segments.Load().([]*segment))
+		}
+	}()
+	if db.vlog, err = openValueLog(db.path, db.cfg.fileMode); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			db.vlog.Close()
+		}
+	}()
+
+	// If there are WAL files, then their memtables probably were not saved last time,
+	// because the WAL file of a memtable is removed once the memtable is successfully written on disk.
+	if err = db.recover(); err != nil {
+		return nil, nil, err
+	}
+	if db.wal, err = db.openWAL(); err != nil {
+		return nil, nil, fmt.Errorf("failed to open new WAL file: %w", err)
+	}
+
+	// System workers that write memtable on disk and merge old segments are launched when they're needed,
+	// so a database opened only for reads doesn't run them.
+	ctx, quit := context.WithCancel(context.Background())
+	db.workers, db.workersCtx = errgroup.WithContext(ctx)
+	db.sstWriter = newSSTableWriter(db)
+	db.compactor = newLeveledCompactor(db)
+	db.expirer = newExpiryWorker(db, db.cfg.expiryInterval)
+	db.walSyncer = newWALSyncer(db, db.cfg.walSyncInterval)
+	db.vlogGC = &valueLogGC{db: db, interval: db.cfg.valueLogGCInterval}
+	db.scanner = newDataScanner(db, db.cfg.dataScanInterval)
+	if db.cfg.dataScanInterval > 0 {
+		db.workers.Go(func() error {
+			return db.scanner.Run(db.workersCtx)
+		})
+	}
+
+	// Close database and releases associated resources.
+	// New operations are rejected with ErrClosed, but those in progress are finished first.
+	closeDB := func() error {
+		if !atomic.CompareAndSwapInt32(&db.closing, 0, 1) {
+			return nil
+		}
+		db.inFlight.Lock()
+		db.inFlight.Unlock()
+
+		// Flush memtable on disk before exiting unless nothing was written.
+		// The sstableWriter saves the immutable memtables when it's stopped.
+		// Rotation fails only if the sstableWriter has already stopped with an error which is returned by Wait.
+		if atomic.LoadInt32(&db.sstStarted) == 1 {
+			db.rotateMemtable(0)
+		}
+		quit()
+		// The workers stopped by quit return context.Canceled which isn't a failure.
+		err := db.workers.Wait()
+		if err == context.Canceled {
+			err = nil
+		}
+		if walErr := db.wal.Close(); err == nil {
+			err = walErr
+		}
+		// The immutable memtables are left only if a flush failed, their WAL files are recovered next time.
+		for _, w := range db.immutableWALs {
+			w.Close()
+		}
+		// The segments are closed after the workers, so a flush or compaction doesn't read a closed file.
+		closeSegments(db.segments.Load().([]*segment))
+		if vlogErr := db.vlog.Close(); err == nil {
+			err = vlogErr
+		}
+		if lockErr := db.lock.Close(); err == nil {
+			err = lockErr
+		}
+		return err
+	}
+	if db.cfg.signals == nil {
+		return db, closeDB, nil
+	}
+
+	// The signal handler is stopped when the database is closed explicitly.
+	stopSignals := handleSignals(db.cfg.signals, closeDB, db.cfg.logger)
+	close = func() error {
+		stopSignals()
+		return closeDB()
+	}
+	return db, close, nil
+}
+
+// newDB creates a database with default settings changed by the options.
+func newDB(path string, options ...ConfigOption) *DB {
+	db := DB{
 		path: path,
 		cfg: Config{
-			maxMemtableSize: DefaultMaxMemtableSize,
+			maxMemtableSize:       DefaultMaxMemtableSize,
+			maxImmutableMemtables: DefaultMaxImmutableMemtables,
+			rateLimitThreshold:    DefaultRateLimitBackpressureThreshold,
+			walPreallocSize:       DefaultWALPreallocSize,
+			globalBloomRate:       DefaultGlobalBloomFalsePositiveRate,
+			bloomBitsPerKey:       DefaultBloomFilterBitsPerKey,
+			blockCacheSize:        DefaultBlockCacheSize,
+			levelCount:            DefaultLevelCount,
+			levelSizeMultiplier:   DefaultLevelSizeMultiplier,
+			compactionTrigger:     DefaultCompactionTrigger,
+			restartInterval:       DefaultRestartInterval,
+			walSyncInterval:       DefaultWALSyncInterval,
+			walBufferSize:         DefaultWALBufferSize,
+			expiryInterval:        DefaultExpiryInterval,
+			valueLogGCInterval:    DefaultValueLogGCInterval,
+			watchBufferSize:       DefaultWatchBufferSize,
+			fileMode:              DefaultFileMode,
+			dirMode:               DefaultDirMode,
+			codec:                 BinaryCodec{},
+			logger:                slog.Default(),
 		},
-		memtable: &index.Memtable{},
+		sketch: newHyperLogLog(hllPrecision),
 	}
 	for _, opt := range options {
 		opt(&db.cfg)
 	}
+	db.memtable = db.newMemtable()
+	db.manifest = &manifest{
+		path: filepath.Join(path, manifestFileName),
+		mode: db.cfg.fileMode,
+	}
+	db.setSegments([]*segment{})
+	db.prom = newPrometheusCollector(&db)
+	if db.cfg.maxImmutableMemtables < 1 {
+		db.cfg.maxImmutableMemtables = 1
+	}
+	if db.cfg.walSyncInterval <= 0 {
+		db.cfg.walSyncInterval = DefaultWALSyncInterval
+	}
+	if db.cfg.watchBufferSize < 0 {
+		db.cfg.watchBufferSize = 0
+	}
+	db.immutableSem = semaphore.NewWeighted(int64(db.cfg.maxImmutableMemtables))
+	if db.cfg.writeRateLimit > 0 {
+		db.limiter = rate.NewLimiter(rate.Limit(db.cfg.writeRateLimit), int(db.cfg.writeRateLimit))
+	}
+	if db.cfg.blockCacheSize > 0 {
+		db.cache = newBlockCache(db.cfg.blockCacheSize)
+	}
+	return &db
+}
 
-	if err = os.MkdirAll(db.path, 0700); err != nil {
-		return nil, nil, fmt.Errorf("failed to create database dir: %w", err)
+// newMemtable creates an empty memtable whose keys are ordered by the key comparator.
+func (db *DB) newMemtable() *index.Memtable {
+	return index.NewMemtable(db.cfg.comparator.cmp)
+}
+
+// OpenReadOnly opens an existing database directory named path only for reads, e.g., for analytics or backups.
+// The segment files found in the directory are loaded, but the WAL is not replayed,
+// so the changes which weren't saved in segments are not visible.
+// Set and Delete return ErrReadOnly, and no background workers are started.
+// The database dir is locked in shared mode, so it can be opened read-only by multiple processes,
+// but ErrLocked is returned if it's opened for writes and vice versa.
+// A segment file without the index sidecar file which can't be read
+// is considered partially written before a crash and it's skipped.
+// Make sure to close database to release the segment files and the lock.
+func OpenReadOnly(path string, options ...ConfigOption) (db *DB, close func() error, err error) {
+	db = newDB(path, options...)
+	db.readOnly = true
+
+	if _, err = os.Stat(db.path); err != nil {
+		return nil, nil, fmt.Errorf("failed to open database dir: %w", err)
+	}
+	if db.lock, err = openLockFile(db.path, false, db.cfg.fileMode); err != nil {
+		return nil, nil, err
+	}
+	if db.vlog, err = openValueLog(db.path, db.cfg.fileMode); err != nil {
+		db.lock.Close()
+		return nil, nil, err
+	}
+	if err = db.loadSegments(); err != nil {
+		db.vlog.Close()
+		db.lock.Close()
+		return nil, nil, err
+	}
+
+	close = func() error {
+		if !atomic.CompareAndSwapInt32(&db.closing, 0, 1) {
+			return nil
+		}
+		db.inFlight.Lock()
+		db.inFlight.Unlock()
+
+		var err error
+		for _, seg := range db.segments.Load().([]*segment) {
+			if closeErr := seg.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+		if vlogErr := db.vlog.Close(); err == nil {
+			err = vlogErr
+		}
+		if lockErr := db.lock.Close(); err == nil {
+			err = lockErr
+		}
+		return err
 	}
+	return db, close, nil
+}
 
-	// If WAL is not empty, then the memtable probably was not saved last time,
-	// because the WAL file is truncated every time memtable is successfully written on disk.
-	walPath := filepath.Join(db.path, "wal")
-	if db.wal, err = openReadonlyWAL(walPath); err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return nil, nil, fmt.Errorf("failed to open WAL file to recover database: %w", err)
+// loadSegments opens the live segment files listed in the manifest and builds their indices,
+// the segment files which aren't listed are ignored.
+// If there is no manifest, e.g., the database was written by an older version,
+// the segments are found in the database dir, and the manifest is created unless the database is read-only.
+func (db *DB) loadSegments() error {
+	files, err := db.manifest.Load()
+	var ss []*segment
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if ss, err = db.scanSegments(); err != nil {
+			return err
+		}
+		if !db.readOnly {
+			if err = db.manifest.Save(ss); err != nil {
+				closeSegments(ss)
+				return fmt.Errorf("failed to save manifest: %w", err)
+			}
 		}
-	} else {
-		// Recover from WAL file and then truncate it...
-		if err = db.wal.Close(); err != nil {
-			return nil, nil, fmt.Errorf("failed to close WAL file after database recovery: %w", err)
+	case err != nil:
+		return fmt.Errorf("failed to load manifest: %w", err)
+	default:
+		if ss, err = db.openManifestSegments(files); err != nil {
+			return err
 		}
 	}
-	if db.wal, err = openAppendonlyWAL(walPath); err != nil {
-		return nil, nil, fmt.Errorf("failed to open new WAL file: %w", err)
+
+	db.segMu.Lock()
+	db.setSegments(ss)
+	db.segMu.Unlock()
+	return nil
+}
+
+// openManifestSegments opens the segment files listed in the manifest keeping their order and levels.
+// The orphaned segment files found in the database dir are logged.
+func (db *DB) openManifestSegments(files []segmentFile) ([]*segment, error) {
+	live := make(map[string]bool, len(files))
+	ss := make([]*segment, 0, len(files))
+	for _, f := range files {
+		seg, err := db.loadSegment(f.path)
+		if err != nil {
+			closeSegments(ss)
+			return nil, fmt.Errorf("failed to load %q segment: %w", f.path, err)
+		}
+		seg.level = f.level
+		ss = append(ss, seg)
+		live[filepath.Base(f.path)] = true
 	}
 
-	// Launch system workers that write memtable on disk, merge old segments.
-	ctx, quit := context.WithCancel(context.Background())
-	g, ctx := errgroup.WithContext(ctx)
-	db.sstWriter = newSSTableWriter(db)
-	db.segMerger = newSegmentMerger(db)
-	g.Go(func() error {
-		return db.sstWriter.Run(ctx)
-	})
-	g.Go(func() error {
-		return db.segMerger.Run(ctx)
-	})
+	all, err := db.listSegmentFiles()
+	if err != nil {
+		closeSegments(ss)
+		return nil, err
+	}
+	for _, f := range all {
+		if !live[filepath.Base(f.path)] {
+			db.cfg.logger.Warn("hasty: ignored segment which is not in the manifest", "path", f.path)
+		}
+	}
+	return ss, nil
+}
 
-	// Close database and releases associated resources.
-	close = func() error {
-		// Flush memtable on disk before exiting.
-		db.sstWriter.Notify()
-		quit()
-		if err := g.Wait(); err != context.Canceled {
-			return err
+// closeSegments closes the segment files, e.g., when the database failed to open.
+func closeSegments(ss []*segment) {
+	for _, s := range ss {
+		s.Close()
+	}
+}
+
+// scanSegments opens the segment files found in the database dir and builds their indices.
+// The segments are put at the levels encoded in their file names.
+// A segment which overlaps a newer segment of the same level (except level 0) was merged into it
+// by a compaction interrupted before the merged segments were removed, so it's skipped,
+// and its files are removed unless the database is read-only.
+func (db *DB) scanSegments() ([]*segment, error) {
+	files, err := db.listSegmentFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	// Newest segments are loaded first, so they go first within level 0.
+	ss := make([]*segment, 0, len(files))
+	for i := len(files) - 1; i >= 0; i-- {
+		segPath := files[i].path
+		seg, err := db.loadSegment(segPath)
+		if err != nil {
+			// The sidecar file is written after the segment file, so a segment without it might be still being written.
+			if _, statErr := os.Stat(segPath + indexFileSuffix); errors.Is(statErr, os.ErrNotExist) {
+				db.cfg.logger.Warn("hasty: skipped segment without sidecar file", "path", segPath, "error", err)
+				continue
+			}
+			closeSegments(ss)
+			return nil, fmt.Errorf("failed to load %q segment: %w", segPath, err)
+		}
+		seg.level = files[i].level
+		if supersededSegment(ss, seg) {
+			db.cfg.logger.Info("hasty: skipped segment replaced by compaction", "path", segPath)
+			seg.Close()
+			if !db.readOnly {
+				os.Remove(segPath)
+				os.Remove(segPath + indexFileSuffix)
+			}
+			continue
+		}
+		ss = insertSegment(ss, seg)
+	}
+	return ss, nil
+}
+
+// supersededSegment reports whether the segment of level 1 or deeper overlaps a segment of the same level in ss.
+// Since ss contains the newer segments, the segment must have been merged into the overlapping one.
+// The segments with unknown key ranges are kept.
+func supersededSegment(ss []*segment, seg *segment) bool {
+	if seg.level == 0 || seg.maxKey == "" {
+		return false
+	}
+	for _, s := range ss {
+		if s.level == seg.level && s.maxKey != "" && s.Overlaps(seg.minKey, seg.maxKey) {
+			return true
 		}
-		return nil
 	}
+	return false
+}
 
-	return db, close, nil
+// loadSegment opens the segment file to serve reads.
+// The index is loaded from the sidecar file or built by scanning the segment file.
+func (db *DB) loadSegment(segPath string) (*segment, error) {
+	seg, err := openReadonlySegment(segPath, db.cfg.codec, db.cfg.comparator)
+	if err != nil {
+		return nil, err
+	}
+	if db.cfg.directIO {
+		if err = seg.useDirectIO(); err != nil {
+			seg.Close()
+			return nil, err
+		}
+	}
+	if len(seg.index) == 0 {
+		if err = seg.LoadIndex(); err != nil {
+			seg.Close()
+			return nil, err
+		}
+	}
+	if db.cfg.bloomBitsPerKey > 0 {
+		seg.bloom = newBloomFilterBitsPerKey(len(seg.index), db.cfg.bloomBitsPerKey)
+		for key := range seg.index {
+			seg.bloom.Add(key)
+		}
+	}
+	seg.buildSketch()
+	if db.cfg.sparseIndexInterval > 0 {
+		if err = seg.LoadSparseIndex(db.cfg.sparseIndexInterval); err != nil {
+			seg.Close()
+			return nil, err
+		}
+	}
+	return seg, nil
+}
+
+// walReplayBatchSize is a number of WAL records applied to the memtable at once during recovery.
+const walReplayBatchSize = 1024
+
+// recover rebuilds the memtable from the WAL files unless there are none.
+// The records are replayed in batches, and once the memtable grows larger than its maximum size,
+// it's saved in a segment, so the recovery uses about as much memory as a memtable regardless of the WAL size.
+// The rest of the recovered records is saved in a segment as well, and then the WAL files are removed,
+// so another crash doesn't replay the same records into duplicate segments.
+func (db *DB) recover() error {
+	paths, err := db.listWALFiles()
+	if err != nil {
+		return err
+	}
+
+	sw := newSSTableWriter(db)
+	for _, p := range paths {
+		if err = db.replayWAL(sw, p); err != nil {
+			return fmt.Errorf("failed to recover database from WAL file: %w", err)
+		}
+	}
+	if db.memtable.Len() != 0 {
+		if err = sw.saveMemtable(db.memtable); err != nil {
+			return fmt.Errorf("failed to recover database from WAL file: %w", err)
+		}
+		db.memtable = db.newMemtable()
+	}
+
+	// The recovered records are in the segments listed in the manifest, so the WAL files aren't needed anymore.
+	for _, p := range paths {
+		if err = os.Remove(p); err != nil {
+			return fmt.Errorf("failed to remove WAL file after database recovery: %w", err)
+		}
+	}
+	return nil
+}
+
+// replayWAL applies the records of the WAL file found at path to the memtable.
+// The memtable is saved in a segment by sw whenever it grows larger than its maximum size.
+func (db *DB) replayWAL(sw *sstableWriter, path string) error {
+	w, err := openReadonlyWAL(path)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	w.logger = db.cfg.logger
+
+	return w.ReplayInBatches(db.cfg.walRecoveryMode, walReplayBatchSize, func(batch []*record) error {
+		for _, rec := range batch {
+			// Records with empty keys could be written by older versions.
+			switch {
+			case rec.key == "":
+				db.cfg.logger.Warn("hasty: skipped WAL record with empty key", "path", path)
+			case rec.deleted:
+				db.memtable.Delete(rec.key)
+			default:
+				db.memtable.SetWithExpiry(rec.key, rec.value, rec.expiresAt)
+				db.sketch.Add(rec.key)
+			}
+		}
+		if db.memtable.Size() <= db.cfg.maxMemtableSize {
+			return nil
+		}
+		if err := sw.saveMemtable(db.memtable); err != nil {
+			return err
+		}
+		db.memtable = db.newMemtable()
+		return nil
+	})
 }
 
 // Set puts a key in database. Note, operation is concurrency safe.
 func (db *DB) Set(key string, value []byte) error {
-	db.memMu.Lock()
-	db.memtable.Set(key, value)
-	db.memMu.Unlock()
+	if key == "" {
+		return ErrEmptyKey
+	}
+	defer db.observeSet(time.Now())
 
-	err := db.wal.WriteRecord(&record{
+	return db.write(&record{
 		key:   key,
 		value: value,
 	})
-	if err != nil {
-		return fmt.Errorf("failed to write record to WAL file: %w", err)
-	}
+}
 
-	// Trigger memtable rotation (save the current one on disk, create new memtable).
-	if db.memtable.Size() > db.cfg.maxMemtableSize {
-		db.sstWriter.Notify()
+// SetWithTTL puts a key in database which expires after ttl, so Get reports ErrKeyNotFound afterwards.
+// The expired key is replaced with a tombstone in the memtable by the expiry worker,
+// and segments compaction discards it. Non-positive ttl means the key never expires like with Set.
+// Note, operation is concurrency safe.
+func (db *DB) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	if key == "" {
+		return ErrEmptyKey
 	}
+	defer db.observeSet(time.Now())
 
+	rec := record{
+		key:   key,
+		value: value,
+	}
+	if ttl > 0 {
+		rec.expiresAt = time.Now().Add(ttl).UnixNano()
+	}
+	if err := db.write(&rec); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		db.startExpiryWorker()
+	}
 	return nil
 }
 
-// Get retrieves a key from database. Note, operation is concurrency safe.
-func (db *DB) Get(key string) (value []byte, err error) {
-	db.memMu.RLock()
-	value = db.memtable.Get(key)
-	if value == nil && db.flushingMemtable != nil {
-		value = db.flushingMemtable.Get(key)
+// SetExpiry changes when the key expires without the caller rewriting its value, e.g., to extend the TTL
+// of a large cached value. The key gets an expiry even if it was set without TTL,
+// and the zero expiry makes the key persistent like with Set.
+// ErrKeyNotFound is returned if the key doesn't exist (it's absent, deleted, or expired).
+// Note, operation is concurrency safe and atomic with respect to other writes.
+func (db *DB) SetExpiry(key string, expiry time.Time) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+	if err := db.enter(); err != nil {
+		return err
+	}
+	defer db.leave()
+	if db.readOnly || atomic.LoadInt32(&db.defragmenting) == 1 {
+		return ErrReadOnly
+	}
+	defer db.observeSet(time.Now())
+
+	db.startSSTableWriter()
+
+	for {
+		// The current record is fetched from segments before the lock is acquired,
+		// so the memtable writers aren't blocked by disk reads.
+		ss := db.acquireSegments()
+		current, err := db.findValueRecord(ss, key)
+		releaseSegments(ss)
+		// The value log file might have been removed by the garbage collector after the live values were rewritten.
+		if errors.Is(err, errValueLogMissing) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		rec := record{key: key}
+		if current != nil {
+			rec.value = current.value
+		}
+		if err = db.throttle([]*record{&rec}); err != nil {
+			return err
+		}
+
+		// The record is re-read under the lock, so the value written meanwhile isn't overwritten.
+		// The memtables hold the latest version if there is one, otherwise the prefetched record is still current
+		// unless the segments were replaced.
+		db.walMu.RLock()
+		db.memMu.Lock()
+		if mem := db.searchMemtableRecord(key); mem != nil {
+			current = mem
+		} else if !sameSegments(ss, db.segments.Load().([]*segment)) {
+			db.memMu.Unlock()
+			db.walMu.RUnlock()
+			continue
+		}
+		if current == nil || current.deleted || current.expired(time.Now().UnixNano()) {
+			db.memMu.Unlock()
+			db.walMu.RUnlock()
+			return ErrKeyNotFound
+		}
+
+		rec.value = current.value
+		if !expiry.IsZero() {
+			rec.expiresAt = expiry.UnixNano()
+		}
+		if err = db.wal.WriteRecords(&rec); err != nil {
+			db.memMu.Unlock()
+			db.walMu.RUnlock()
+			return fmt.Errorf("failed to write records to WAL file: %w", err)
+		}
+		db.applyRecords([]*record{&rec})
+		db.notify([]*record{&rec})
+		size := db.memtable.Size()
+		db.memMu.Unlock()
+		db.walMu.RUnlock()
+
+		if rec.expiresAt != 0 {
+			db.startExpiryWorker()
+		}
+		if size > db.cfg.maxMemtableSize {
+			if err = db.rotateMemtable(db.cfg.maxMemtableSize); err != nil {
+				return err
+			}
+		}
+		return db.limitWAL()
+	}
+}
+
+// GetExpiry returns when the key expires without reading its value, the zero time means the key never expires.
+// ErrKeyNotFound is returned if the key doesn't exist (it's absent, deleted, or expired).
+// Note, operation is concurrency safe.
+func (db *DB) GetExpiry(key string) (time.Time, error) {
+	if key == "" {
+		return time.Time{}, ErrEmptyKey
 	}
+	if err := db.enter(); err != nil {
+		return time.Time{}, err
+	}
+	defer db.leave()
+
+	db.memMu.RLock()
+	rec := db.searchMemtableRecord(key)
 	db.memMu.RUnlock()
+	if rec == nil {
+		ss := db.acquireSegments()
+		var err error
+		rec, err = db.findRecord(context.Background(), ss, key)
+		releaseSegments(ss)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
 
-	if value != nil {
-		return value, nil
+	switch {
+	case rec == nil || rec.deleted || rec.expired(time.Now().UnixNano()):
+		return time.Time{}, ErrKeyNotFound
+	case rec.expiresAt == 0:
+		return time.Time{}, nil
 	}
+	return time.Unix(0, rec.expiresAt), nil
+}
 
-	ss := db.segments.Load().([]*segment)
-	var (
-		found  bool
-		offset int64
-		rec    *record
-	)
-	for i := range ss {
-		if offset, found = ss[i].index[key]; found {
-			if rec, err = ss[i].ReadRecord(offset); err != nil {
-				return nil, fmt.Errorf("failed to read record: %w", err)
+// CompareAndSet replaces the value of the key with newValue only if its current value equals expected,
+// and reports whether the value was replaced. The nil expected means the key must not exist
+// (it's absent, deleted, or expired), whereas an empty non-nil expected matches an empty value.
+// Note, operation is concurrency safe and atomic with respect to other writes.
+func (db *DB) CompareAndSet(key string, expected, newValue []byte) (bool, error) {
+	if key == "" {
+		return false, ErrEmptyKey
+	}
+	if err := db.enter(); err != nil {
+		return false, err
+	}
+	defer db.leave()
+	if db.readOnly || atomic.LoadInt32(&db.defragmenting) == 1 {
+		return false, ErrReadOnly
+	}
+	defer db.observeSet(time.Now())
+
+	db.startSSTableWriter()
+
+	for {
+		// The current value is fetched from segments before the lock is acquired,
+		// so the memtable writers aren't blocked by disk reads.
+		ss := db.segments.Load().([]*segment)
+		current, err := db.get(context.Background(), key)
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return false, err
+		}
+		exists := err == nil
+		if !matchValue(current, exists, expected) {
+			return false, nil
+		}
+		// The index entries are derived from the prefetched value which is verified below.
+		recs := []*record{{key: key, value: newValue}}
+		if err = db.checkRecord(recs[0]); err != nil {
+			return false, err
+		}
+		idx, err := db.indexRecords(recs)
+		if err != nil {
+			return false, err
+		}
+		recs = append(recs, idx...)
+		if err = db.throttle(recs); err != nil {
+			return false, err
+		}
+
+		db.walMu.RLock()
+		db.memMu.Lock()
+		// The key is re-verified under the lock. The memtables hold the latest version if there is one,
+		// otherwise the prefetched value is still current unless the segments were replaced,
+		// e.g., a newer version of the key was flushed from the memtable meanwhile.
+		value, deleted, ok := db.searchMemtables(key)
+		switch {
+		case ok:
+			current, exists = value, !deleted
+		case !sameSegments(ss, db.segments.Load().([]*segment)):
+			db.memMu.Unlock()
+			db.walMu.RUnlock()
+			continue
+		}
+		if !matchValue(current, exists, expected) {
+			db.memMu.Unlock()
+			db.walMu.RUnlock()
+			return false, nil
+		}
+
+		if err = db.wal.WriteRecords(recs...); err != nil {
+			db.memMu.Unlock()
+			db.walMu.RUnlock()
+			return false, fmt.Errorf("failed to write records to WAL file: %w", err)
+		}
+		db.applyRecords(recs)
+		db.notify(recs[:1])
+		size := db.memtable.Size()
+		db.memMu.Unlock()
+		db.walMu.RUnlock()
+
+		if size > db.cfg.maxMemtableSize {
+			if err = db.rotateMemtable(db.cfg.maxMemtableSize); err != nil {
+				return true, err
 			}
-			return rec.value, nil
+		}
+		return true, db.limitWAL()
+	}
+}
+
+// matchValue reports whether the current value of the key matches the expected one,
+// where nil expected matches only a nonexistent key.
+func matchValue(current []byte, exists bool, expected []byte) bool {
+	if expected == nil {
+		return !exists
+	}
+	return exists && bytes.Equal(current, expected)
+}
+
+// sameSegments reports whether both lists consist of the same segments.
+func sameSegments(a, b []*segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Delete removes a key from database. Note, operation is concurrency safe.
+// The key is marked as deleted (tombstone) and its older versions are removed during segments compaction.
+func (db *DB) Delete(key string) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	return db.write(&record{
+		key:     key,
+		deleted: true,
+	})
+}
+
+// write puts records in the WAL and the memtable at once, so neither readers nor the recovery
+// observe only some of them.
+func (db *DB) write(recs ...*record) error {
+	if err := db.enter(); err != nil {
+		return err
+	}
+	defer db.leave()
+	if db.readOnly || atomic.LoadInt32(&db.defragmenting) == 1 {
+		return ErrReadOnly
+	}
+	for _, rec := range recs {
+		if err := db.checkRecord(rec); err != nil {
+			return err
+		}
+	}
+
+	// The secondary index entries are written along with the records.
+	idx, err := db.indexRecords(recs)
+	if err != nil {
+		return err
+	}
+	// The watchers are notified only about the keys written by the caller.
+	written := recs
+	recs = append(recs[:len(recs):len(recs)], idx...)
+
+	db.startSSTableWriter()
+
+	if err := db.throttle(recs); err != nil {
+		return err
+	}
+
+	// The records are written to the WAL as a single unit before they're applied to the memtable,
+	// so after a crash either all of them are recovered or none.
+	// The WAL isn't rotated until they're applied, so the records end up in the WAL file of their memtable.
+	db.walMu.RLock()
+	if err := db.wal.WriteRecords(recs...); err != nil {
+		db.walMu.RUnlock()
+		return fmt.Errorf("failed to write records to WAL file: %w", err)
+	}
+
+	db.memMu.Lock()
+	db.applyRecords(recs)
+	// The watchers are notified under the lock, so they observe the writes of a key in order.
+	db.notify(written)
+	// The size is captured under the lock, because concurrent writes change the memtable.
+	size := db.memtable.Size()
+	db.memMu.Unlock()
+	db.walMu.RUnlock()
+
+	// Trigger memtable rotation (save the current one on disk, create new memtable).
+	if size > db.cfg.maxMemtableSize {
+		if err := db.rotateMemtable(db.cfg.maxMemtableSize); err != nil {
+			return err
 		}
 	}
 
-	return nil, ErrKeyNotFound
+	return db.limitWAL()
+}
+
+// checkRecord rejects the record which can't be written: its key contains a zero byte,
+// the key or value exceed the configured limits, or the record is too large to be encoded.
+func (db *DB) checkRecord(rec *record) error {
+	switch {
+	case strings.IndexByte(rec.key, recordKeyValueDelimeter) != -1:
+		return fmt.Errorf("key contains zero byte: %w", ErrInvalidKey)
+	case db.cfg.maxKeySize > 0 && len(rec.key) > db.cfg.maxKeySize:
+		return fmt.Errorf("key of %d bytes exceeds %d bytes limit: %w", len(rec.key), db.cfg.maxKeySize, ErrKeyTooLarge)
+	case db.cfg.maxValueSize > 0 && len(rec.value) > db.cfg.maxValueSize:
+		return fmt.Errorf("value of %d bytes exceeds %d bytes limit: %w", len(rec.value), db.cfg.maxValueSize, ErrValueTooLarge)
+	case !rec.fits():
+		return fmt.Errorf("record exceeds %d bytes: %w", maxRecordLen, ErrValueTooLarge)
+	}
+	return nil
+}
+
+// throttle waits until the records can be written without exceeding the write rate limit.
+// The limit is applied only when the flushes fall behind, i.e., enough immutable memtables wait to be saved.
+func (db *DB) throttle(recs []*record) error {
+	if db.limiter == nil {
+		return nil
+	}
+	db.memMu.RLock()
+	n := len(db.immutables)
+	db.memMu.RUnlock()
+	if n < db.cfg.rateLimitThreshold {
+		return nil
+	}
+
+	var size int
+	for _, rec := range recs {
+		size += int(rec.size())
+	}
+	// The records larger than the burst take all the tokens, otherwise they could never be written.
+	if b := db.limiter.Burst(); size > b {
+		size = b
+	}
+	if err := db.limiter.WaitN(db.workersCtx, size); err != nil {
+		return fmt.Errorf("failed to wait for write rate limit: %w", err)
+	}
+	return nil
+}
+
+// applyRecords applies the records to the memtable.
+// Note, the caller must hold memMu lock.
+func (db *DB) applyRecords(recs []*record) {
+	db.memChanged()
+	for _, rec := range recs {
+		if rec.deleted {
+			db.memtable.Delete(rec.key)
+		} else {
+			db.memtable.SetWithExpiry(rec.key, rec.value, rec.expiresAt)
+			db.sketch.Add(rec.key)
+			atomic.AddUint64(&db.metrics.sets, 1)
+		}
+	}
+}
+
+// rotateMemtable makes the memtable immutable once it's larger than size bytes and
+// asks sstableWriter to save it on disk, new writes go into a new memtable.
+// It blocks while the maximum number of immutable memtables wait to be saved on disk.
+// The new memtable gets a new WAL file, so the WAL file of the immutable memtable can be removed
+// once it's saved on disk without losing the newer writes.
+func (db *DB) rotateMemtable(size int) error {
+	if err := db.immutableSem.Acquire(db.workersCtx, 1); err != nil {
+		return fmt.Errorf("failed to wait for memtable flush: %w", err)
+	}
+	// The writes are blocked by walMu, so the memtable doesn't change until it's rotated along with its WAL.
+	db.walMu.Lock()
+	db.memMu.RLock()
+	small := db.memtable.Size() <= size
+	db.memMu.RUnlock()
+	// The memtable might have been rotated by a concurrent write.
+	if small {
+		db.walMu.Unlock()
+		db.immutableSem.Release(1)
+		return nil
+	}
+	w, err := db.openWAL()
+	if err != nil {
+		db.walMu.Unlock()
+		db.immutableSem.Release(1)
+		return fmt.Errorf("failed to open new WAL file: %w", err)
+	}
+	prev := db.wal
+	db.wal = w
+	db.memMu.Lock()
+	db.immutables = append([]*index.Memtable{db.memtable}, db.immutables...)
+	db.immutableWALs = append([]*wal{prev}, db.immutableWALs...)
+	db.memtable = db.newMemtable()
+	db.memChanged()
+	db.memMu.Unlock()
+	db.walMu.Unlock()
+
+	// The walSyncer syncs only the current WAL, so the last records of the previous one are synced here.
+	if prev.syncMode != SyncNever {
+		if err = prev.Sync(); err != nil {
+			return fmt.Errorf("failed to sync WAL: %w", err)
+		}
+	}
+	db.sstWriter.Notify()
+	return nil
+}
+
+// openWAL creates the next WAL file where the records of a new memtable are appended.
+// Note, the caller must hold walMu lock unless the database is being opened.
+func (db *DB) openWAL() (*wal, error) {
+	path := filepath.Join(db.path, fmt.Sprintf(walNameFormat, db.walSeq))
+	w, err := openAppendonlyWAL(path, db.cfg.walPreallocSize, db.cfg.fileMode)
+	if err != nil {
+		return nil, err
+	}
+	w.syncMode = db.cfg.walSyncMode
+	w.logger = db.cfg.logger
+	if err = w.SetBufferSize(db.cfg.walBufferSize); err != nil {
+		w.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to set WAL buffer: %w", err)
+	}
+	// The synced records would be lost after a crash if the new file weren't found in the dir.
+	if err = syncDir(db.path); err != nil {
+		w.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to sync database dir: %w", err)
+	}
+	db.walSeq++
+	return w, nil
+}
+
+// syncWAL commits the records of the current WAL file to disk.
+func (db *DB) syncWAL() error {
+	db.walMu.RLock()
+	defer db.walMu.RUnlock()
+	return db.wal.Sync()
+}
+
+// walSize returns the size of the WAL files of the memtable and the immutable memtables in bytes.
+func (db *DB) walSize() int64 {
+	db.walMu.RLock()
+	size := db.wal.Size()
+	db.walMu.RUnlock()
+
+	db.memMu.RLock()
+	for _, w := range db.immutableWALs {
+		size += w.Size()
+	}
+	db.memMu.RUnlock()
+	return size
+}
+
+// limitWAL saves the memtables on disk once the WAL files are larger than the limit set by WithMaxWALSize,
+// so the WAL files are removed even if the memtable rarely reaches its size threshold.
+// It waits until the memtables are saved, so the writes slow down instead of growing the WAL.
+func (db *DB) limitWAL() error {
+	if db.cfg.maxWALSize <= 0 || db.walSize() <= db.cfg.maxWALSize {
+		return nil
+	}
+	if err := db.rotateMemtable(0); err != nil {
+		return err
+	}
+	if err := db.sstWriter.flush(); err != nil {
+		return fmt.Errorf("failed to flush memtables: %w", err)
+	}
+	return nil
+}
+
+// Get retrieves a key from database. Note, operation is concurrency safe.
+func (db *DB) Get(key string) (value []byte, err error) {
+	return db.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but the search stops once ctx is done, e.g., to put a timeout on slow disk reads.
+// The context is checked before every segment is read, so ctx.Err() is returned as soon as the current read finishes.
+// Note, operation is concurrency safe.
+func (db *DB) GetContext(ctx context.Context, key string) (value []byte, err error) {
+	if key == "" {
+		return nil, ErrEmptyKey
+	}
+	if err = db.enter(); err != nil {
+		return nil, err
+	}
+	defer db.leave()
+	defer db.observeGet(time.Now())
+
+	return db.get(ctx, key)
+}
+
+// get finds the latest version of the key in the memtables and segments.
+// Note, the caller must be registered with enter.
+func (db *DB) get(ctx context.Context, key string) (value []byte, err error) {
+	value, err = db.getOnce(ctx, key)
+	// The value log file might have been removed by the garbage collector after the live values were rewritten,
+	// so the key is looked up again to find the rewritten value.
+	if errors.Is(err, errValueLogMissing) {
+		value, err = db.getOnce(ctx, key)
+	}
+	return value, err
+}
+
+// getOnce is get without retries.
+// The memtables are skipped without locking memMu if the key wasn't found there last time
+// and they haven't changed since then.
+func (db *DB) getOnce(ctx context.Context, key string) (value []byte, err error) {
+	if !db.memMisses.Has(key, atomic.LoadUint64(&db.memGen)) {
+		db.memMu.RLock()
+		gen := atomic.LoadUint64(&db.memGen)
+		value, deleted, ok := db.searchMemtables(key)
+		db.memMu.RUnlock()
+
+		switch {
+		case deleted:
+			return nil, ErrKeyNotFound
+		case ok:
+			return value, nil
+		}
+		db.memMisses.Add(key, gen)
+	}
+
+	// Skip the segments if none of them contains the key.
+	if !db.globalBloom.Load().(*bloomFilter).MayContain(key) {
+		return nil, ErrKeyNotFound
+	}
+
+	ss := db.acquireSegments()
+	defer releaseSegments(ss)
+	return db.searchSegments(ctx, ss, key)
+}
+
+// searchSegments looks up the value of the key in the segments from the newest to the oldest.
+// The value stored in the value log is read by its pointer.
+func (db *DB) searchSegments(ctx context.Context, ss []*segment, key string) (value []byte, err error) {
+	rec, err := db.findRecord(ctx, ss, key)
+	switch {
+	case err != nil:
+		return nil, err
+	case rec == nil || rec.deleted || rec.expired(time.Now().UnixNano()):
+		return nil, ErrKeyNotFound
+	case rec.pointer:
+		if value, err = db.vlog.Value(key, rec.value); err != nil {
+			return nil, KeyError{Key: key, Err: fmt.Errorf("failed to read value log: %w", err)}
+		}
+		return value, nil
+	}
+	return rec.value, nil
+}
+
+// findRecord returns the newest record of the key in the segments, nil is returned if the key is not found.
+// The search stops with ctx.Err() once ctx is done.
+// The reads of the segment files are accumulated in the database metrics.
+func (db *DB) findRecord(ctx context.Context, ss []*segment, key string) (rec *record, err error) {
+	var (
+		found  bool
+		offset int64
+		st     ReadStats
+		readSt ReadStats
+	)
+	defer func() { db.metrics.observeSegmentReads(st) }()
+
+	for i := range ss {
+		// The segment's Bloom filter is cheaper to check than its index.
+		if !ss[i].MayContain(key) {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		offset, found, readSt, err = ss[i].LookupWithStats(key)
+		st.add(readSt)
+		if err != nil {
+			return nil, KeyError{Key: key, Err: fmt.Errorf("failed to look up key: %w", err)}
+		}
+		if !found && ss[i].bloom != nil {
+			atomic.AddUint64(&db.metrics.bloomFalsePositives, 1)
+		}
+		if found {
+			rec, readSt, err = db.readRecord(ss[i], offset)
+			st.add(readSt)
+			if err != nil {
+				return nil, KeyError{Key: key, Err: fmt.Errorf("failed to read record: %w", err)}
+			}
+			return rec, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// findValueRecord is like findRecord, but the value stored in the value log is read by its pointer.
+func (db *DB) findValueRecord(ss []*segment, key string) (*record, error) {
+	rec, err := db.findRecord(context.Background(), ss, key)
+	if err != nil || rec == nil || !rec.pointer || rec.deleted {
+		return rec, err
+	}
+	if rec.value, err = db.vlog.Value(key, rec.value); err != nil {
+		return nil, KeyError{Key: key, Err: fmt.Errorf("failed to read value log: %w", err)}
+	}
+	rec.pointer = false
+	return rec, nil
+}
+
+// readRecord reads the record by the offset from the segment unless it's found in the block cache.
+// The value of the returned record is a copy of the cached one, so it can be modified by the caller.
+// The reads of the segment file are reported as well, there are none when the record is cached.
+func (db *DB) readRecord(seg *segment, offset int64) (*record, ReadStats, error) {
+	if db.cache == nil {
+		return seg.ReadRecordWithStats(offset)
+	}
+
+	cached := db.cache.Get(seg.path, offset)
+	if cached == nil {
+		rec, st, err := seg.ReadRecordWithStats(offset)
+		if err != nil {
+			return nil, st, err
+		}
+		cached = &record{
+			key:       rec.key,
+			value:     append([]byte(nil), rec.value...),
+			deleted:   rec.deleted,
+			expiresAt: rec.expiresAt,
+			pointer:   rec.pointer,
+		}
+		db.cache.Add(seg.path, offset, cached)
+		return rec, st, nil
+	}
+
+	rec := *cached
+	rec.value = append([]byte(nil), cached.value...)
+	return &rec, ReadStats{}, nil
+}
+
+// LimitedGet retrieves a key from database unless its value is larger than maxBytes,
+// in that case ErrValueTooLarge is returned. The value is not loaded in memory when it's too large.
+// Note, operation is concurrency safe.
+func (db *DB) LimitedGet(key string, maxBytes int) ([]byte, error) {
+	if key == "" {
+		return nil, ErrEmptyKey
+	}
+	if err := db.enter(); err != nil {
+		return nil, err
+	}
+	defer db.leave()
+	defer db.observeGet(time.Now())
+
+	ss := db.acquireSegments()
+	defer releaseSegments(ss)
+	r, n, err := db.lookupValue(ss, key)
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(maxBytes) {
+		return nil, fmt.Errorf("value of %d bytes exceeds %d bytes limit: %w", n, maxBytes, ErrValueTooLarge)
+	}
+
+	value := make([]byte, n)
+	if _, err = io.ReadFull(r, value); err != nil {
+		return nil, fmt.Errorf("failed to read value: %w", err)
+	}
+	return value, nil
+}
+
+// GetReader returns a reader of the key's value, so a large value can be streamed without loading it in memory.
+// The reader must be closed, because the database waits for open readers when it's being closed.
+// Note, operation is concurrency safe.
+func (db *DB) GetReader(key string) (io.ReadCloser, error) {
+	if key == "" {
+		return nil, ErrEmptyKey
+	}
+	if err := db.enter(); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	// The segments are released once the reader is closed, because the value might be streamed from one of them.
+	ss := db.acquireSegments()
+	r, _, err := db.lookupValue(ss, key)
+	db.observeGet(start)
+	if err != nil {
+		releaseSegments(ss)
+		db.leave()
+		return nil, err
+	}
+	return &valueReader{
+		Reader: r,
+		leave: func() {
+			releaseSegments(ss)
+			db.leave()
+		},
+	}, nil
+}
+
+// memChanged starts a new generation of the memtables, so the keys remembered in memMisses are looked up again.
+// Note, the caller must hold memMu write lock.
+func (db *DB) memChanged() {
+	atomic.AddUint64(&db.memGen, 1)
+}
+
+// lookupMemtables looks up the key in the memtable and then in the immutable memtables from the newest to the oldest.
+func (db *DB) lookupMemtables(key string) (value []byte, deleted, ok bool) {
+	db.memMu.RLock()
+	defer db.memMu.RUnlock()
+
+	return db.searchMemtables(key)
+}
+
+// searchMemtables is like lookupMemtables, but the caller must hold memMu lock.
+func (db *DB) searchMemtables(key string) (value []byte, deleted, ok bool) {
+	value, deleted, ok = lookupMemtable(db.memtable, key)
+	for i := 0; !ok && i < len(db.immutables); i++ {
+		value, deleted, ok = lookupMemtable(db.immutables[i], key)
+	}
+	return value, deleted, ok
+}
+
+// searchMemtableRecord returns the latest version of the key in the memtables including its expiry,
+// nil is returned if the key isn't there. Note, the caller must hold memMu lock.
+func (db *DB) searchMemtableRecord(key string) *record {
+	if rec := memtableRecord(db.memtable, key); rec != nil {
+		return rec
+	}
+	for _, mem := range db.immutables {
+		if rec := memtableRecord(mem, key); rec != nil {
+			return rec
+		}
+	}
+	return nil
+}
+
+// memtableRecord returns the record of the key in the memtable, nil is returned if the key isn't there.
+func memtableRecord(mem *index.Memtable, key string) *record {
+	value, deleted, ok := mem.Lookup(key)
+	if !ok {
+		return nil
+	}
+	return &record{key: key, value: value, deleted: deleted, expiresAt: mem.ExpiresAt(key)}
+}
+
+// lookupMemtable looks up the key in the memtable.
+// The expired key is reported as deleted even if the expiry worker hasn't replaced it with a tombstone yet.
+func lookupMemtable(mem *index.Memtable, key string) (value []byte, deleted, ok bool) {
+	value, deleted, ok = mem.Lookup(key)
+	if ok && !deleted {
+		rec := record{expiresAt: mem.ExpiresAt(key)}
+		if rec.expired(time.Now().UnixNano()) {
+			return nil, true, true
+		}
+	}
+	return value, deleted, ok
+}
+
+// lookupValue finds the latest version of the key and returns a reader of its value along with the value length.
+// The segments ss must stay pinned while the reader is used, see acquireSegments.
+// Note, the caller must be registered with enter.
+func (db *DB) lookupValue(ss []*segment, key string) (io.Reader, int64, error) {
+	value, deleted, ok := db.lookupMemtables(key)
+
+	switch {
+	case deleted:
+		return nil, 0, ErrKeyNotFound
+	case ok:
+		return bytes.NewReader(value), int64(len(value)), nil
+	}
+
+	if !db.globalBloom.Load().(*bloomFilter).MayContain(key) {
+		return nil, 0, ErrKeyNotFound
+	}
+
+	for i := range ss {
+		if !ss[i].MayContain(key) {
+			continue
+		}
+		offset, found, err := ss[i].Lookup(key)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to look up key: %w", err)
+		}
+		if !found {
+			if ss[i].bloom != nil {
+				atomic.AddUint64(&db.metrics.bloomFalsePositives, 1)
+			}
+			continue
+		}
+		r, n, pointer, err := ss[i].valueReader(offset, key, time.Now().UnixNano())
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read record: %w", err)
+		}
+		if n < 0 {
+			return nil, 0, ErrKeyNotFound
+		}
+		if !pointer {
+			return r, n, nil
+		}
+		// The value stored in the value log is read entirely, because its pointer has to be decoded first.
+		ptr, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read record: %w", err)
+		}
+		value, err := db.vlog.Value(key, ptr)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read value log: %w", err)
+		}
+		return bytes.NewReader(value), int64(len(value)), nil
+	}
+
+	return nil, 0, ErrKeyNotFound
+}
+
+// valueReader reads a value returned by GetReader.
+// Closing the reader lets the database know the read is finished.
+type valueReader struct {
+	io.Reader
+	once  sync.Once
+	leave func()
+}
+
+// Close releases the reader. It's safe to call Close multiple times.
+func (r *valueReader) Close() error {
+	r.once.Do(r.leave)
+	return nil
+}
+
+// Defragment rewrites all the segments into a single segment keeping only the latest versions of the keys,
+// deleted keys are dropped. Unlike regular compaction it reclaims the most disk space at the cost of high I/O.
+// Defragment blocks until the segments are rewritten, meanwhile the database is read-only:
+// writes return ErrReadOnly. The memtable is not flushed, so it's not defragmented.
+func (db *DB) Defragment() error {
+	if err := db.enter(); err != nil {
+		return err
+	}
+	defer db.leave()
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.defragMu.Lock()
+	defer db.defragMu.Unlock()
+	atomic.StoreInt32(&db.defragmenting, 1)
+	defer atomic.StoreInt32(&db.defragmenting, 0)
+
+	// Flushes and compactions in progress are finished first, and new ones wait for defragmentation.
+	ctx := context.Background()
+	if err := db.sstWriter.sem.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer db.sstWriter.sem.Release(1)
+	if err := db.compactor.sem.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer db.compactor.sem.Release(1)
+
+	ss := db.segments.Load().([]*segment)
+	if len(ss) == 0 {
+		return nil
+	}
+	// All the keys end up in one segment, so it belongs to the last level.
+	level := db.compactor.levels - 1
+	segPath := db.nextSegmentPath(level)
+	if err := db.compactor.compact(ctx, ss, level, segPath); err != nil {
+		return fmt.Errorf("failed to defragment segments: %w", err)
+	}
+	return nil
+}
+
+// Compact merges all the segments into one segment, e.g., before taking a backup.
+// Unlike Defragment it doesn't block writes: the memtables flushed in the meantime
+// are saved into new segments which aren't compacted.
+// It blocks until the compaction is done or ctx is cancelled, in that case the segments stay as they are.
+// The background compaction is paused meanwhile.
+func (db *DB) Compact(ctx context.Context) error {
+	if err := db.enter(); err != nil {
+		return err
+	}
+	defer db.leave()
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := db.compactor.sem.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer db.compactor.sem.Release(1)
+
+	ss := db.segments.Load().([]*segment)
+	if len(ss) == 0 {
+		return nil
+	}
+	// All the keys end up in one segment, so it belongs to the last level.
+	level := db.compactor.levels - 1
+	segPath := db.nextSegmentPath(level)
+	if err := db.compactor.compact(ctx, ss, level, segPath); err != nil {
+		os.Remove(segPath)
+		os.Remove(segPath + indexFileSuffix)
+		return fmt.Errorf("failed to compact segments: %w", err)
+	}
+	return nil
+}
+
+// Truncate deletes all the data of the database: the memtables are discarded along with their WAL files,
+// and the segment and value log files are removed, so the database is empty but it stays open and ready for writes,
+// e.g., to reset a cache or a test fixture.
+// The segments read by snapshots and iterators are removed once they're done,
+// but the value log files are removed right away, so they fail to read the large values.
+// Flushes and compactions in progress are finished first, and a write concurrent with Truncate
+// might be kept or discarded.
+func (db *DB) Truncate() error {
+	if err := db.enter(); err != nil {
+		return err
+	}
+	defer db.leave()
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	// Defragmentation would bring back the removed segments.
+	db.defragMu.Lock()
+	defer db.defragMu.Unlock()
+	ctx := context.Background()
+	if err := db.sstWriter.sem.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer db.sstWriter.sem.Release(1)
+	if err := db.compactor.sem.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer db.compactor.sem.Release(1)
+
+	// The WAL is truncated under the lock, so the records applied to the discarded memtables aren't replayed.
+	db.walMu.Lock()
+	db.memMu.Lock()
+	db.memtable = db.newMemtable()
+	// The discarded immutable memtables won't be flushed, so the writes waiting for them can proceed.
+	if n := len(db.immutables); n > 0 {
+		db.immutableSem.Release(int64(n))
+	}
+	db.immutables = nil
+	wals := db.immutableWALs
+	db.immutableWALs = nil
+	db.sketch = newHyperLogLog(hllPrecision)
+	db.memChanged()
+	db.memMu.Unlock()
+	err := db.wal.Truncate()
+	for _, w := range wals {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		if rmErr := os.Remove(w.path); err == nil {
+			err = rmErr
+		}
+	}
+	db.walMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to truncate WAL: %w", err)
+	}
+	// The memtables which could point to the values are discarded, and the flushes are paused,
+	// so the values aren't appended meanwhile.
+	if err = db.vlog.truncate(); err != nil {
+		return fmt.Errorf("failed to truncate value log: %w", err)
+	}
+
+	db.segMu.Lock()
+	defer db.segMu.Unlock()
+	ss := db.segments.Load().([]*segment)
+	// The segments become orphans once the manifest doesn't list them, so they're ignored if removing them fails.
+	if err = db.manifest.Save(nil); err != nil {
+		return fmt.Errorf("failed to save manifest: %w", err)
+	}
+	db.setSegments([]*segment{})
+	for _, s := range ss {
+		s.retire()
+	}
+	return nil
+}
+
+// ListSegmentPaths returns paths to the segment files which currently serve reads, from the newest to the oldest.
+func (db *DB) ListSegmentPaths() ([]string, error) {
+	if err := db.enter(); err != nil {
+		return nil, err
+	}
+	defer db.leave()
+
+	ss := db.segments.Load().([]*segment)
+	paths := make([]string, len(ss))
+	for i := range ss {
+		paths[i] = ss[i].path
+	}
+	return paths, nil
+}
+
+// OpenSegment opens a segment file for external readers, e.g., analytics tools that parse SSTables.
+// The reader returns the records stream: compressed blocks are decompressed.
+// A record starts with 4 bytes of its length (little endian), followed by the key,
+// zero byte delimeter, and the value. A deleted key has no delimeter and value.
+func (db *DB) OpenSegment(path string) (io.ReadSeekCloser, error) {
+	seg, err := openReadonlySegment(path, db.cfg.codec, db.cfg.comparator)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q segment: %w", path, err)
+	}
+	return seg, nil
+}
+
+// WALAge returns how long ago the WAL file of the memtable was started, i.e., since the memtable was last rotated.
+// An old WAL indicates that the memtable hasn't been flushed recently.
+// Zero is returned if the WAL was written by an older version without the creation time,
+// or the database is read-only.
+func (db *DB) WALAge() time.Duration {
+	if db.readOnly {
+		return 0
+	}
+	db.walMu.RLock()
+	createdAt := db.wal.CreatedAt()
+	db.walMu.RUnlock()
+	if createdAt.IsZero() {
+		return 0
+	}
+	return time.Since(createdAt)
+}
+
+// NewWALBackupReader returns a reader which streams the WAL from the beginning without blocking writes,
+// e.g., to back up the writes which aren't in the segments yet along with the segment files.
+// The WAL files of the immutable memtables and the memtable are streamed as a single file
+// which can be converted into a database with ReplayWAL.
+// The reader returns io.EOF once it catches up with the writes, and the next Read continues with the records
+// appended since then until the memtable is rotated, i.e., its records are going to be flushed into a segment.
+// The database can't be closed until the reader is closed.
+// ErrReadOnly is returned if the database is read-only, because it has no WAL.
+func (db *DB) NewWALBackupReader() (io.ReadCloser, error) {
+	if err := db.enter(); err != nil {
+		return nil, err
+	}
+	if db.readOnly {
+		db.leave()
+		return nil, ErrReadOnly
+	}
+	db.walMu.RLock()
+	db.memMu.RLock()
+	ww := make([]*wal, 0, len(db.immutableWALs)+1)
+	for i := len(db.immutableWALs) - 1; i >= 0; i-- {
+		ww = append(ww, db.immutableWALs[i])
+	}
+	ww = append(ww, db.wal)
+	db.memMu.RUnlock()
+	db.walMu.RUnlock()
+	br := newChainedBackupReader(ww)
+	r := valueReader{
+		Reader: br,
+		leave: func() {
+			br.Close()
+			db.leave()
+		},
+	}
+	return &r, nil
+}
+
+// startSSTableWriter launches sstableWriter actor unless it's already running.
+// The walSyncer actor is launched along with it in SyncPeriodic mode.
+func (db *DB) startSSTableWriter() {
+	db.sstOnce.Do(func() {
+		db.workers.Go(func() error {
+			return db.sstWriter.Run(db.workersCtx)
+		})
+		if db.cfg.walSyncMode == SyncPeriodic {
+			db.workers.Go(func() error {
+				return db.walSyncer.Run(db.workersCtx)
+			})
+		}
+		if db.cfg.valueLogThreshold > 0 && db.cfg.valueLogGCInterval > 0 {
+			db.workers.Go(func() error {
+				return db.vlogGC.Run(db.workersCtx)
+			})
+		}
+		atomic.StoreInt32(&db.sstStarted, 1)
+	})
+}
+
+// startCompactor launches LeveledCompactor actor unless it's already running.
+func (db *DB) startCompactor() {
+	db.compactOnce.Do(func() {
+		db.workers.Go(func() error {
+			return db.compactor.Run(db.workersCtx)
+		})
+	})
+}
+
+// startExpiryWorker launches expiryWorker actor unless it's already running or it's disabled.
+func (db *DB) startExpiryWorker() {
+	if db.cfg.expiryInterval <= 0 {
+		return
+	}
+	db.expiryOnce.Do(func() {
+		db.workers.Go(func() error {
+			return db.expirer.Run(db.workersCtx)
+		})
+	})
+}
+
+// enter registers an operation in progress unless the database is being closed.
+// Every successful enter must be followed by leave.
+func (db *DB) enter() error {
+	if atomic.LoadInt32(&db.closing) == 1 {
+		return ErrClosed
+	}
+	db.inFlight.RLock()
+	if atomic.LoadInt32(&db.closing) == 1 {
+		db.inFlight.RUnlock()
+		return ErrClosed
+	}
+	return nil
+}
+
+// leave marks the operation as finished.
+func (db *DB) leave() {
+	db.inFlight.RUnlock()
+}
+
+// setSegments replaces the database segments and rebuilds the global Bloom filter.
+// The filter is built only when all the keys are known, i.e., none of the segments has a sparse index,
+// otherwise the global filter is nil which may contain any key.
+// Note, the caller must hold segMu lock.
+func (db *DB) setSegments(ss []*segment) {
+	var n int
+	for i := range ss {
+		if ss[i].sparse != nil {
+			db.globalBloom.Store((*bloomFilter)(nil))
+			db.segments.Store(ss)
+			return
+		}
+		n += len(ss[i].index)
+	}
+	bf := newBloomFilter(n, db.cfg.globalBloomRate)
+	for i := range ss {
+		for key := range ss[i].index {
+			bf.Add(key)
+		}
+	}
+
+	db.globalBloom.Store(bf)
+	db.segments.Store(ss)
+}
+
+// acquireSegments returns the database segments pinned with ref, so they aren't removed while being read
+// even if compaction replaces them meanwhile. The segments must be released with releaseSegments.
+func (db *DB) acquireSegments() []*segment {
+	for {
+		// The segments retired in the meantime aren't pinned, so the replaced list is loaded again.
+		ss := db.segments.Load().([]*segment)
+		if pinSegments(ss) {
+			return ss
+		}
+	}
+}
+
+// pinSegments pins all the segments with ref.
+// False is returned if one of them was retired, then none of the segments stays pinned.
+func pinSegments(ss []*segment) bool {
+	for i := range ss {
+		if !ss[i].ref() {
+			releaseSegments(ss[:i])
+			return false
+		}
+	}
+	return true
+}
+
+// releaseSegments unpins the segments acquired with acquireSegments.
+func releaseSegments(ss []*segment) {
+	for _, s := range ss {
+		s.unref()
+	}
+}
+
+// segmentNameFormat is a name of a segment file which encodes its compaction level and sequence number,
+// so the levels are restored from the file names, and the segments with greater numbers are newer.
+const segmentNameFormat = "seg-L%d-%06d"
+
+// legacySegmentNameFormat is a name of a segment file written before the levels were encoded in the names.
+// Such segments are loaded at level 0 where the key ranges of segments may overlap.
+const legacySegmentNameFormat = "seg-%06d"
+
+// segmentFile is a segment file found in the database dir.
+type segmentFile struct {
+	path  string
+	level int
+	seq   uint64
+}
+
+// nextSegmentPath allocates a sequence number for a new segment file at the level and returns its path.
+// Note, operation is concurrency safe.
+func (db *DB) nextSegmentPath(level int) string {
+	seq := atomic.AddUint64(&db.segSeq, 1) - 1
+	return filepath.Join(db.path, fmt.Sprintf(segmentNameFormat, level, seq))
+}
+
+// loadSegmentSeq continues the segment sequence after the segment files found in the database dir,
+// so new segments never overwrite the existing ones.
+func (db *DB) loadSegmentSeq() error {
+	files, err := db.listSegmentFiles()
+	if err != nil {
+		return err
+	}
+	if len(files) != 0 {
+		db.segSeq = files[len(files)-1].seq + 1
+	}
+	return nil
+}
+
+// listSegmentFiles returns the segment files found in the database dir in ascending order of their sequence numbers.
+func (db *DB) listSegmentFiles() ([]segmentFile, error) {
+	paths, err := filepath.Glob(filepath.Join(db.path, "seg-*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list segment files: %w", err)
+	}
+
+	var files []segmentFile
+	for _, p := range paths {
+		if level, seq, ok := parseSegmentName(filepath.Base(p)); ok {
+			files = append(files, segmentFile{path: p, level: level, seq: seq})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].seq < files[j].seq
+	})
+	return files, nil
+}
+
+// parseSegmentName returns the level and the sequence number of the segment file name.
+// False is returned if the name doesn't belong to a segment.
+func parseSegmentName(name string) (level int, seq uint64, ok bool) {
+	// Sidecar files such as seg-L0-000001.idx have the segment's number, but they are not segments.
+	if _, err := fmt.Sscanf(name, "seg-L%d-%d", &level, &seq); err == nil {
+		return level, seq, level >= 0 && name == fmt.Sprintf(segmentNameFormat, level, seq)
+	}
+	if _, err := fmt.Sscanf(name, "seg-%d", &seq); err == nil {
+		return 0, seq, name == fmt.Sprintf(legacySegmentNameFormat, seq)
+	}
+	return 0, 0, false
+}
+
+// walNameFormat is a name of a WAL file which encodes its sequence number, so the files with greater numbers are newer.
+// Each memtable has its own WAL file which is removed once the memtable is saved on disk.
+const walNameFormat = "wal-%06d"
+
+// legacyWALName is a name of the only WAL file written before the memtables had their own WAL files.
+const legacyWALName = "wal"
+
+// listWALFiles returns paths to the WAL files found in the database dir from the oldest to the newest,
+// and continues the WAL sequence after them, so new WAL files never overwrite the existing ones.
+func (db *DB) listWALFiles() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(db.path, "wal-*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL files: %w", err)
+	}
+
+	seqs := make(map[string]uint64, len(paths))
+	var files []string
+	for _, p := range paths {
+		var seq uint64
+		name := filepath.Base(p)
+		if _, err = fmt.Sscanf(name, "wal-%d", &seq); err != nil || name != fmt.Sprintf(walNameFormat, seq) {
+			continue
+		}
+		seqs[p] = seq
+		files = append(files, p)
+		if seq >= db.walSeq {
+			db.walSeq = seq + 1
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return seqs[files[i]] < seqs[files[j]]
+	})
+
+	// The legacy WAL file is older than the numbered ones, because they're written only by newer versions.
+	legacy := filepath.Join(db.path, legacyWALName)
+	if _, err = os.Stat(legacy); err == nil {
+		files = append([]string{legacy}, files...)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to stat WAL file: %w", err)
+	}
+	return files, nil
 }
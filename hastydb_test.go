@@ -1,14 +1,34 @@
 package hasty_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
 
 	hasty "github.com/marselester/hastydb"
 )
 
 func Example() {
-	db, close, err := hasty.Open("testdata/mydb")
+	dir, err := os.MkdirTemp("", "mydb")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, close, err := hasty.Open(dir)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -29,3 +49,817 @@ func Example() {
 		log.Fatal(err)
 	}
 }
+
+func TestDBSet_emptyKey(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("", []byte("Alice")); !errors.Is(err, hasty.ErrEmptyKey) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrEmptyKey, err)
+	}
+}
+
+func TestDBSet_limits(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir(), hasty.WithMaxKeySize(4), hasty.WithMaxValueSize(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	tt := map[string]struct {
+		key   string
+		value []byte
+		want  error
+	}{
+		"max key and value": {key: "name", value: []byte("Alice")},
+		"key over limit":    {key: "names", value: []byte("Alice"), want: hasty.ErrKeyTooLarge},
+		"value over limit":  {key: "name", value: []byte("Alice!"), want: hasty.ErrValueTooLarge},
+		"zero byte in key":  {key: "na\x00me", value: []byte("Bob"), want: hasty.ErrInvalidKey},
+	}
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			if err = db.Set(tc.key, tc.value); !errors.Is(err, tc.want) {
+				t.Errorf("expected: %v, got: %v", tc.want, err)
+			}
+		})
+	}
+	if err = db.Delete("names"); !errors.Is(err, hasty.ErrKeyTooLarge) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrKeyTooLarge, err)
+	}
+}
+
+func TestDBSet_recordTooLarge(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// The value doesn't fit in 29 bits of the record length, it's rejected before it's read.
+	value := make([]byte, 1<<29)
+	if err = db.Set("name", value); !errors.Is(err, hasty.ErrValueTooLarge) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrValueTooLarge, err)
+	}
+}
+
+func TestDBGet_newDatabase(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// There are no segments yet, so the lookup must not fail on them.
+	if _, err = db.Get("name"); !errors.Is(err, hasty.ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrKeyNotFound, err)
+	}
+}
+
+func TestDBGet_emptyKey(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if _, err = db.Get(""); !errors.Is(err, hasty.ErrEmptyKey) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrEmptyKey, err)
+	}
+}
+
+func TestOpen_emptyKeyInWAL(t *testing.T) {
+	dir := t.TempDir()
+	// The WAL contains a record with an empty key and a value "x" which was written by an older version.
+	walRecord := []byte{6, 0, 0, 0, 0, 'x'}
+	if err := ioutil.WriteFile(filepath.Join(dir, "wal"), walRecord, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, nil))
+	_, close, err := hasty.Open(dir, hasty.WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `level=WARN msg="hasty: skipped WAL record with empty key"`
+	if got := out.String(); !strings.Contains(got, want) {
+		t.Errorf("expected %q in the log, got: %s", want, got)
+	}
+}
+
+func TestDBDelete(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete("name"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Get("name"); !errors.Is(err, hasty.ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrKeyNotFound, err)
+	}
+	if err = db.Delete(""); !errors.Is(err, hasty.ErrEmptyKey) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrEmptyKey, err)
+	}
+}
+
+func TestDBSetWithTTL(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.SetWithTTL("name", []byte("Alice"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.SetWithTTL("session", []byte("123"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.SetWithTTL("", nil, time.Hour); !errors.Is(err, hasty.ErrEmptyKey) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrEmptyKey, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if got, err := db.Get("name"); string(got) != "Alice" || err != nil {
+		t.Errorf("expected Alice, got: %q %v", got, err)
+	}
+	if _, err = db.Get("session"); !errors.Is(err, hasty.ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrKeyNotFound, err)
+	}
+	if keys, err := db.Keys(); len(keys) != 1 || keys[0] != "name" || err != nil {
+		t.Errorf("expected [name], got: %q %v", keys, err)
+	}
+}
+
+func TestDBCompareAndSet(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	tests := map[string]struct {
+		expected []byte
+		newValue []byte
+		want     bool
+		wantGet  string
+	}{
+		"missing key":     {expected: []byte("Alice"), newValue: []byte("Bob"), want: false},
+		"create":          {expected: nil, newValue: []byte("Alice"), want: true, wantGet: "Alice"},
+		"create existing": {expected: nil, newValue: []byte("Bob"), want: false, wantGet: "Alice"},
+		"mismatch":        {expected: []byte("Bob"), newValue: []byte("Carol"), want: false, wantGet: "Alice"},
+		"replace":         {expected: []byte("Alice"), newValue: []byte("Bob"), want: true, wantGet: "Bob"},
+	}
+	for _, name := range []string{"missing key", "create", "create existing", "mismatch", "replace"} {
+		tc := tests[name]
+		ok, err := db.CompareAndSet("name", tc.expected, tc.newValue)
+		if ok != tc.want || err != nil {
+			t.Errorf("%s: expected %t, got: %t %v", name, tc.want, ok, err)
+		}
+		if got, _ := db.Get("name"); string(got) != tc.wantGet {
+			t.Errorf("%s: expected %q, got: %q", name, tc.wantGet, got)
+		}
+	}
+
+	if err = db.Delete("name"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.CompareAndSet("name", nil, []byte("Dave")); !ok || err != nil {
+		t.Errorf("expected deleted key to be replaced, got: %t %v", ok, err)
+	}
+	if _, err = db.CompareAndSet("", nil, nil); !errors.Is(err, hasty.ErrEmptyKey) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrEmptyKey, err)
+	}
+}
+
+func TestDBCompareAndSet_concurrent(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir(), hasty.WithMaxMemtableSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("counter", []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every goroutine increments the counter, so no increment is lost
+	// even though the memtables are being flushed into segments meanwhile.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; {
+				current, err := db.Get("counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, _ := strconv.Atoi(string(current))
+				ok, err := db.CompareAndSet("counter", current, []byte(strconv.Itoa(n+1)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, err := db.Get("counter"); string(got) != "200" || err != nil {
+		t.Errorf("expected 200, got: %q %v", got, err)
+	}
+}
+
+func TestDB_concurrentClose(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errc := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", i)
+			for {
+				if err := db.Set(key, []byte("value")); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		if err = <-errc; !errors.Is(err, hasty.ErrClosed) {
+			t.Errorf("expected: %v, got: %v", hasty.ErrClosed, err)
+		}
+	}
+	if _, err = db.Get("key0"); !errors.Is(err, hasty.ErrClosed) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrClosed, err)
+	}
+	if err = close(); err != nil {
+		t.Errorf("expected idempotent close, got: %v", err)
+	}
+}
+
+func TestDB_closed(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]func() error{
+		"Set":        func() error { return db.Set("name", []byte("Bob")) },
+		"SetWithTTL": func() error { return db.SetWithTTL("name", []byte("Bob"), time.Hour) },
+		"SetMany":    func() error { return db.SetMany([]hasty.KeyValue{{Key: "name", Value: []byte("Bob")}}) },
+		"Delete":     func() error { return db.Delete("name") },
+		"CompareAndSet": func() error {
+			_, err := db.CompareAndSet("name", []byte("Alice"), []byte("Bob"))
+			return err
+		},
+		"Batch": func() error {
+			b := db.NewBatch()
+			b.Set("name", []byte("Bob"))
+			return b.Commit()
+		},
+		"Begin": func() error {
+			_, err := db.Begin()
+			return err
+		},
+		"Get": func() error {
+			_, err := db.Get("name")
+			return err
+		},
+		"GetReader": func() error {
+			_, err := db.GetReader("name")
+			return err
+		},
+		"MultiGet": func() error {
+			_, err := db.MultiGet([]string{"name"})
+			return err
+		},
+		"Keys": func() error {
+			_, err := db.Keys()
+			return err
+		},
+		"NewIterator": func() error { return db.NewIterator().Err() },
+		"ForEach": func() error {
+			return db.ForEach(func(key string, value []byte) error { return nil })
+		},
+		"Snapshot": func() error {
+			_, err := db.Snapshot()
+			return err
+		},
+		"Compact":    func() error { return db.Compact(context.Background()) },
+		"Defragment": func() error { return db.Defragment() },
+		"Truncate":   func() error { return db.Truncate() },
+	}
+	for name, fn := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := fn(); !errors.Is(err, hasty.ErrClosed) {
+				t.Errorf("expected: %v, got: %v", hasty.ErrClosed, err)
+			}
+		})
+	}
+}
+
+func TestOpen_lazyWorkers(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Get("name"); !errors.Is(err, hasty.ErrKeyNotFound) {
+		t.Fatalf("expected: %v, got: %v", hasty.ErrKeyNotFound, err)
+	}
+	if got := runtime.NumGoroutine(); got != before {
+		t.Errorf("expected %d goroutines after Get, got: %d", before, got)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := runtime.NumGoroutine(); got != before {
+		t.Errorf("expected %d goroutines after close, got: %d", before, got)
+	}
+}
+
+func TestOpen_lazyWorkersStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	if got := runtime.NumGoroutine(); got <= before {
+		t.Errorf("expected workers to start after Set, got %d goroutines", got)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Goroutines might need a moment to exit after they returned.
+	for i := 0; i < 100 && runtime.NumGoroutine() != before; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got != before {
+		t.Errorf("expected %d goroutines after close, got: %d", before, got)
+	}
+}
+
+func TestDBSet_writeRateLimit(t *testing.T) {
+	tests := map[string]struct {
+		threshold int
+		limited   bool
+		// cas writes the keys with CompareAndSet instead of Set.
+		cas bool
+	}{
+		"applied":                     {threshold: 0, limited: true},
+		"applied to CompareAndSet":    {threshold: 0, limited: true, cas: true},
+		"no immutable memtables wait": {threshold: 1, limited: false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, close, err := hasty.Open(
+				t.TempDir(),
+				hasty.WithWriteRateLimit(10000),
+				hasty.WithRateLimitBackpressureThreshold(tc.threshold),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer close()
+
+			// The burst of 10000 bytes is written at once, the rest takes about half a second.
+			value := bytes.Repeat([]byte("v"), 2500)
+			start := time.Now()
+			for i := 0; i < 6; i++ {
+				key := fmt.Sprintf("key%d", i)
+				if tc.cas {
+					_, err = db.CompareAndSet(key, nil, value)
+				} else {
+					err = db.Set(key, value)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if limited := time.Since(start) > 300*time.Millisecond; limited != tc.limited {
+				t.Errorf("expected writes limited %t, took: %s", tc.limited, time.Since(start))
+			}
+		})
+	}
+}
+
+func TestOpen_fileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits aren't supported")
+	}
+
+	dir := filepath.Join(t.TempDir(), "db")
+	db, close, err := hasty.Open(dir, hasty.WithFileMode(0640), hasty.WithDirMode(0750))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0750 {
+		t.Errorf("expected dir mode 0750, got: %#o", got)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 3 {
+		t.Fatalf("expected lock, WAL, and segment files, got: %d files", len(files))
+	}
+	for _, fi := range files {
+		if got := fi.Mode().Perm(); got != 0640 {
+			t.Errorf("expected %s mode 0640, got: %#o", fi.Name(), got)
+		}
+	}
+}
+
+func TestDBLimitedGet(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.LimitedGet("name", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "Alice" {
+		t.Errorf("expected: Alice, got: %s", got)
+	}
+	if _, err = db.LimitedGet("name", 4); !errors.Is(err, hasty.ErrValueTooLarge) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrValueTooLarge, err)
+	}
+	if _, err = db.LimitedGet("city", 4); !errors.Is(err, hasty.ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrKeyNotFound, err)
+	}
+}
+
+func TestDBGetReader(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir(), hasty.WithMaxMemtableSize(64<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	want := bytes.Repeat([]byte("0123456789"), 1<<20)
+	if err = db.Set("huge", want); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := db.GetReader("huge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var got []byte
+	chunk := make([]byte, 4096)
+	for {
+		n, err := r.Read(chunk)
+		got = append(got, chunk[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("expected %d bytes value, got %d bytes", len(want), len(got))
+	}
+}
+
+func TestDBWALAge(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	time.Sleep(100 * time.Millisecond)
+	if age := db.WALAge(); age < 100*time.Millisecond {
+		t.Errorf("expected WAL age at least 100ms, got: %v", age)
+	}
+}
+
+// TestDBSet_concurrent is meant to be run with -race flag to detect data races on the memtable size.
+func TestDBSet_concurrent(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := db.Set(fmt.Sprintf("key%d-%d", i, j), []byte("value")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if _, err = db.Get("key9-99"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpen_recoverWAL(t *testing.T) {
+	dir := t.TempDir()
+	db, _, err := hasty.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err = db.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The database wasn't closed as if the process crashed.
+	// The OS would release the lock of the crashed process, here the lock file is replaced instead.
+	if err = os.Remove(filepath.Join(dir, "LOCK")); err != nil {
+		t.Fatal(err)
+	}
+	db, close, err := hasty.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for i := 1; i < 1000; i++ {
+		value, err := db.Get(fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("value%d", i); string(value) != want {
+			t.Errorf("expected: %s, got: %s", want, value)
+		}
+	}
+	if _, err = db.Get("key0"); !errors.Is(err, hasty.ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrKeyNotFound, err)
+	}
+}
+
+func TestOpen_recoverLargeWAL(t *testing.T) {
+	dir := t.TempDir()
+	db, _, err := hasty.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := db.NewBatch()
+	for i := 0; i < 1000; i++ {
+		b.Set(fmt.Sprintf("key%03d", i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	b.Delete("key000")
+	if err = b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("key001", []byte("latest")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The database crashed, and the WAL doesn't fit into the memtable when it's opened again.
+	if err = os.Remove(filepath.Join(dir, "LOCK")); err != nil {
+		t.Fatal(err)
+	}
+	db, close, err := hasty.Open(dir, hasty.WithMaxMemtableSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	paths, err := db.ListSegmentPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Error("expected recovered records to be saved in segments")
+	}
+	for i := 2; i < 1000; i++ {
+		value, err := db.Get(fmt.Sprintf("key%03d", i))
+		if want := fmt.Sprintf("value%d", i); string(value) != want || err != nil {
+			t.Fatalf("expected: %s, got: %q %v", want, value, err)
+		}
+	}
+	if value, err := db.Get("key001"); string(value) != "latest" || err != nil {
+		t.Errorf("expected latest, got: %q %v", value, err)
+	}
+	if _, err = db.Get("key000"); !errors.Is(err, hasty.ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrKeyNotFound, err)
+	}
+}
+
+func TestOpen_recoverTornWAL(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal")
+	// The second record was partially written.
+	wal := []byte{9, 0, 0, 0, 'a', 'g', 'e', 0, '5', 12, 0, 0, 0, 'n', 'a'}
+	if err := ioutil.WriteFile(walPath, wal, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, close, err := hasty.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	if got := db.MustGet("age"); string(got) != "5" {
+		t.Errorf("expected age 5, got: %s", got)
+	}
+
+	// The recovered record was saved in a segment, so the WAL was started anew with only its 16 bytes header.
+	if _, err = os.Stat(walPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected removed WAL, got: %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "wal-000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 16 {
+		t.Errorf("expected WAL size 16, got: %d", fi.Size())
+	}
+}
+
+func TestOpen_segmentSequence(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"seg-L1-000003", "seg-L2-000007", "seg-L1-000009.idx", "seg-x"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, close, err := hasty.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	// The memtable is flushed into the segment which follows the existing ones.
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "seg-L0-000008")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	db, close, err := hasty.Open(dir, hasty.WithMaxMemtableSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"Alice", "Bob"} {
+		if err = db.Set("name", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Set("age", []byte("5")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Set("planet", []byte("Earth")); err != nil {
+		t.Fatal(err)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+	// A segment which is still being written has a partial record and no index sidecar file.
+	if err = ioutil.WriteFile(filepath.Join(dir, "seg-999999"), []byte{20, 0, 0, 0, 'n'}, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, close, err = hasty.OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for key, want := range map[string]string{"name": "Bob", "age": "5", "planet": "Earth"} {
+		got, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("expected %s=%s, got: %s", key, want, got)
+		}
+	}
+	if err = db.Set("name", []byte("Alice")); !errors.Is(err, hasty.ErrReadOnly) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrReadOnly, err)
+	}
+	if err = db.Delete("name"); !errors.Is(err, hasty.ErrReadOnly) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrReadOnly, err)
+	}
+}
+
+func TestOpen_locked(t *testing.T) {
+	dir := t.TempDir()
+	_, close, err := hasty.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = hasty.Open(dir); !errors.Is(err, hasty.ErrLocked) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrLocked, err)
+	}
+	if _, _, err = hasty.OpenReadOnly(dir); !errors.Is(err, hasty.ErrLocked) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrLocked, err)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only databases share the lock, but the writer has to wait for them.
+	_, closeReader1, err := hasty.OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, closeReader2, err := hasty.OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = hasty.Open(dir); !errors.Is(err, hasty.ErrLocked) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrLocked, err)
+	}
+	closeReader1()
+	closeReader2()
+
+	_, close, err = hasty.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close()
+}
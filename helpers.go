@@ -0,0 +1,37 @@
+package hasty
+
+import (
+	"errors"
+	"fmt"
+)
+
+// GetDefault retrieves a key from database or returns defaultValue if the key is not found.
+func (db *DB) GetDefault(key string, defaultValue []byte) ([]byte, error) {
+	return db.GetDefaultFunc(key, func() []byte {
+		return defaultValue
+	})
+}
+
+// GetDefaultFunc retrieves a key from database.
+// If the key is not found, fn is called to get the default value.
+// It is useful when the default value is expensive to compute.
+func (db *DB) GetDefaultFunc(key string, fn func() []byte) ([]byte, error) {
+	value, err := db.Get(key)
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		return fn(), nil
+	case err != nil:
+		return nil, err
+	}
+	return value, nil
+}
+
+// MustGet retrieves a key from database and panics if it fails, e.g., the key is not found.
+// It is meant to be used in tests.
+func (db *DB) MustGet(key string) []byte {
+	value, err := db.Get(key)
+	if err != nil {
+		panic(fmt.Sprintf("hasty: failed to get %q key: %v", key, err))
+	}
+	return value
+}
@@ -0,0 +1,97 @@
+package hasty_test
+
+import (
+	"bytes"
+	"testing"
+
+	hasty "github.com/marselester/hastydb"
+)
+
+func TestDBGetDefault(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		key  string
+		want []byte
+	}{
+		"key exists":    {"name", []byte("Alice")},
+		"key not found": {"surname", []byte("Bob")},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := db.GetDefault(tc.key, []byte("Bob"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("expected: %q, got: %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDBGetDefaultFunc(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	fn := func() []byte {
+		calls++
+		return []byte("Bob")
+	}
+	if _, err = db.GetDefaultFunc("name", fn); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 {
+		t.Errorf("expected no default func calls, got: %d", calls)
+	}
+
+	got, err := db.GetDefaultFunc("surname", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("Bob"); !bytes.Equal(got, want) {
+		t.Errorf("expected: %q, got: %q", want, got)
+	}
+	if calls != 1 {
+		t.Errorf("expected one default func call, got: %d", calls)
+	}
+}
+
+func TestDBMustGet(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := db.MustGet("name"), []byte("Alice"); !bytes.Equal(got, want) {
+		t.Errorf("expected: %q, got: %q", want, got)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic on missing key")
+		}
+	}()
+	db.MustGet("surname")
+}
@@ -0,0 +1,91 @@
+package hasty
+
+import (
+	"math"
+	"math/bits"
+)
+
+// hllPrecision is a number of bits of a key hash which select a register of HyperLogLog sketch.
+// It gives 2^14 registers (16 KB) and about 0.8% standard error of the estimate.
+const hllPrecision = 14
+
+// hyperLogLog is a probabilistic data structure which estimates a number of distinct keys in a set
+// using a fixed amount of memory. Sketches of different sets can be merged to estimate their union.
+// Note, sketch is not concurrency safe, it must not be modified once it's shared.
+type hyperLogLog struct {
+	// p is the precision: the first p bits of a hash select one of 2^p registers.
+	p uint8
+	// registers keep the maximum position of the leftmost 1-bit seen in the rest of the hash bits.
+	registers []uint8
+}
+
+// newHyperLogLog creates a HyperLogLog sketch with the precision p from 4 to 18.
+// Greater precision gives more accurate estimates: the standard error is 1.04/sqrt(2^p).
+func newHyperLogLog(p uint8) *hyperLogLog {
+	switch {
+	case p < 4:
+		p = 4
+	case p > 18:
+		p = 18
+	}
+	return &hyperLogLog{
+		p:         p,
+		registers: make([]uint8, 1<<p),
+	}
+}
+
+// Add adds the key to the set.
+func (h *hyperLogLog) Add(key string) {
+	x, _ := bloomHash(key)
+	i := x >> (64 - h.p)
+	// The guard bit limits the position when the rest of the hash bits are zeros.
+	w := x<<h.p | 1<<(h.p-1)
+	if rho := uint8(bits.LeadingZeros64(w) + 1); rho > h.registers[i] {
+		h.registers[i] = rho
+	}
+}
+
+// Merge adds the keys of the other sketch of the same precision to the set.
+func (h *hyperLogLog) Merge(other *hyperLogLog) {
+	if other == nil || other.p != h.p {
+		return
+	}
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// Clone returns a copy of the sketch.
+func (h *hyperLogLog) Clone() *hyperLogLog {
+	c := hyperLogLog{
+		p:         h.p,
+		registers: make([]uint8, len(h.registers)),
+	}
+	copy(c.registers, h.registers)
+	return &c
+}
+
+// Count returns the estimated number of distinct keys in the set.
+// Small sets are estimated with linear counting of the empty registers which is more accurate for them.
+func (h *hyperLogLog) Count() uint64 {
+	m := float64(len(h.registers))
+	var (
+		sum   float64
+		zeros int
+	)
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	e := alpha * m * m / sum
+	if e <= 2.5*m && zeros != 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
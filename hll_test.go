@@ -0,0 +1,51 @@
+package hasty
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	tests := []int{0, 10, 1000, 100000, 1000000}
+	for _, n := range tests {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			h := newHyperLogLog(hllPrecision)
+			for i := 0; i < n; i++ {
+				h.Add(fmt.Sprintf("key%d", i))
+				// Repeated keys don't change the estimate.
+				h.Add(fmt.Sprintf("key%d", i))
+			}
+			got := float64(h.Count())
+			if math.Abs(got-float64(n)) > float64(n)*0.02 {
+				t.Errorf("expected about %d keys, got: %.0f", n, got)
+			}
+		})
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a := newHyperLogLog(hllPrecision)
+	b := newHyperLogLog(hllPrecision)
+	// The sets have 50k keys in common.
+	for i := 0; i < 100000; i++ {
+		a.Add(fmt.Sprintf("key%d", i))
+		b.Add(fmt.Sprintf("key%d", i+50000))
+	}
+
+	c := a.Clone()
+	c.Merge(b)
+	if got := float64(c.Count()); math.Abs(got-150000) > 150000*0.02 {
+		t.Errorf("expected about 150000 keys, got: %.0f", got)
+	}
+	if got := float64(a.Count()); math.Abs(got-100000) > 100000*0.02 {
+		t.Errorf("expected the clone to be merged, got: %.0f", got)
+	}
+
+	// Sketches of different precision can't be merged.
+	d := newHyperLogLog(10)
+	d.Merge(a)
+	if d.Count() != 0 {
+		t.Errorf("expected empty sketch, got: %d", d.Count())
+	}
+}
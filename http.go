@@ -0,0 +1,117 @@
+package hasty
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// HTTPHandler returns an HTTP gateway to the database with the following endpoints:
+//
+//	GET /keys/{key}        returns the value (200) or 404 if the key is not found
+//	PUT /keys/{key}        puts the request body as a value of the key (204)
+//	DELETE /keys/{key}     removes the key (204) or 404 if the key is not found
+//	GET /keys?prefix=X     returns a JSON array of {"key": "...", "value_b64": "..."} objects
+//	GET /metrics           returns the database metrics in Prometheus text format, see PrometheusCollector
+//
+// Values are sent as application/octet-stream. Note, authentication is not provided.
+func (db *DB) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys", db.handleKeys)
+	mux.HandleFunc("/keys/", db.handleKey)
+	// The registry has only the database metrics, so the handlers of different databases don't conflict.
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(db.prom)
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// handleKey gets, puts, or deletes a single key.
+func (db *DB) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/keys/")
+
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		var value []byte
+		if value, err = db.Get(key); err == nil {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(value)
+			return
+		}
+	case http.MethodPut:
+		var value []byte
+		if value, err = ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = db.Set(key, value); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case http.MethodDelete:
+		if _, err = db.Get(key); err == nil {
+			err = db.Delete(key)
+		}
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	httpError(w, err)
+}
+
+// keyValue is a key-value pair returned by GET /keys endpoint.
+// The value is base64 encoded by encoding/json.
+type keyValue struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value_b64"`
+}
+
+// handleKeys lists the keys with the given prefix along with their values.
+func (db *DB) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The values are read along with the keys, so the deleted keys are skipped by the iterator.
+	it := db.PrefixScan(r.URL.Query().Get("prefix"))
+	defer it.Close()
+	kv := []keyValue{}
+	for ; it.Valid(); it.Next() {
+		kv = append(kv, keyValue{Key: it.Key(), Value: it.Value()})
+	}
+	if err := it.Err(); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(kv)
+}
+
+// httpError responds with HTTP status code corresponding to the database error.
+func httpError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, ErrEmptyKey):
+		code = http.StatusBadRequest
+	case errors.Is(err, ErrClosed), errors.Is(err, ErrReadOnly):
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), code)
+}
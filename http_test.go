@@ -0,0 +1,64 @@
+package hasty_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	hastytesting "github.com/marselester/hastydb/testing"
+)
+
+func TestDBHTTPHandler(t *testing.T) {
+	db := hastytesting.NewTestDB(t)
+	h := db.HTTPHandler()
+
+	tests := []struct {
+		method   string
+		target   string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{http.MethodPut, "/keys/user:1", "Alice", http.StatusNoContent, ""},
+		{http.MethodPut, "/keys/user:2", "Bob", http.StatusNoContent, ""},
+		{http.MethodPut, "/keys/city", "Oslo", http.StatusNoContent, ""},
+		{http.MethodGet, "/keys/user:1", "", http.StatusOK, "Alice"},
+		{http.MethodGet, "/keys/user:3", "", http.StatusNotFound, "key not found\n"},
+		{http.MethodGet, "/keys/", "", http.StatusBadRequest, "empty key\n"},
+		{http.MethodDelete, "/keys/user:2", "", http.StatusNoContent, ""},
+		{http.MethodDelete, "/keys/user:2", "", http.StatusNotFound, "key not found\n"},
+		{http.MethodGet, "/keys?prefix=user:", "", http.StatusOK, `[{"key":"user:1","value_b64":"QWxpY2U="}]` + "\n"},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+
+		if w.Code != tc.wantCode {
+			t.Errorf("%s %s: expected status %d, got: %d", tc.method, tc.target, tc.wantCode, w.Code)
+		}
+		if diff := cmp.Diff(tc.wantBody, w.Body.String()); diff != "" {
+			t.Errorf("%s %s: %s", tc.method, tc.target, diff)
+		}
+	}
+}
+
+func TestDBHTTPHandler_metrics(t *testing.T) {
+	db := hastytesting.NewTestDB(t)
+	if err := db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	db.HTTPHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got: %d", http.StatusOK, w.Code)
+	}
+	for _, metric := range []string{"hastydb_set_duration_seconds_count 1", "hastydb_segment_count"} {
+		if !strings.Contains(w.Body.String(), metric) {
+			t.Errorf("expected %s metric, got: %s", metric, w.Body)
+		}
+	}
+}
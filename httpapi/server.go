@@ -0,0 +1,34 @@
+// Package httpapi serves HastyDB over HTTP, so the database can be used as a key-value microservice.
+package httpapi
+
+import (
+	"net/http"
+	"time"
+
+	hasty "github.com/marselester/hastydb"
+)
+
+// readHeaderTimeout is how long the server waits for request headers, so idle clients don't hold connections.
+const readHeaderTimeout = 10 * time.Second
+
+// NewHTTPServer returns a server listening on addr which exposes the database with the following endpoints:
+//
+//	GET /v1/keys/{key}      returns the value (200) or 404 if the key is not found
+//	PUT /v1/keys/{key}      puts the request body as a value of the key (204)
+//	DELETE /v1/keys/{key}   removes the key (204) or 404 if the key is not found
+//	GET /v1/keys?prefix=X   returns a JSON array of {"key": "...", "value_b64": "..."} objects
+//
+// Values are binary, so they're sent and received as application/octet-stream,
+// and they're base64 encoded in the JSON array. Note, authentication is not provided.
+// The caller starts the server with ListenAndServe, and it should Shutdown the server before closing the database.
+func NewHTTPServer(db *hasty.DB, addr string) *http.Server {
+	h := http.StripPrefix("/v1", db.HTTPHandler())
+	mux := http.NewServeMux()
+	mux.Handle("/v1/keys", h)
+	mux.Handle("/v1/keys/", h)
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+}
@@ -0,0 +1,67 @@
+package httpapi_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/marselester/hastydb/httpapi"
+	hastytesting "github.com/marselester/hastydb/testing"
+)
+
+func TestNewHTTPServer(t *testing.T) {
+	db := hastytesting.NewTestDB(t)
+	srv := httptest.NewServer(httpapi.NewHTTPServer(db, "").Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		method      string
+		target      string
+		body        string
+		wantCode    int
+		wantBody    string
+		contentType string
+	}{
+		{http.MethodPut, "/v1/keys/user:1", "Alice", http.StatusNoContent, "", ""},
+		{http.MethodPut, "/v1/keys/user:2", "\x00Bob", http.StatusNoContent, "", ""},
+		{http.MethodPut, "/v1/keys/city", "Oslo", http.StatusNoContent, "", ""},
+		{http.MethodGet, "/v1/keys/user:2", "", http.StatusOK, "\x00Bob", "application/octet-stream"},
+		{http.MethodGet, "/v1/keys/user:3", "", http.StatusNotFound, "key not found\n", ""},
+		{http.MethodDelete, "/v1/keys/city", "", http.StatusNoContent, "", ""},
+		{http.MethodDelete, "/v1/keys/city", "", http.StatusNotFound, "key not found\n", ""},
+		{
+			http.MethodGet, "/v1/keys?prefix=user:", "", http.StatusOK,
+			`[{"key":"user:1","value_b64":"QWxpY2U="},{"key":"user:2","value_b64":"AEJvYg=="}]` + "\n",
+			"application/json",
+		},
+		{http.MethodGet, "/keys/user:1", "", http.StatusNotFound, "404 page not found\n", ""},
+		{http.MethodGet, "/v1/metrics", "", http.StatusNotFound, "404 page not found\n", ""},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest(tc.method, srv.URL+tc.target, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != tc.wantCode {
+			t.Errorf("%s %s expected code %d, got: %d", tc.method, tc.target, tc.wantCode, resp.StatusCode)
+		}
+		if string(body) != tc.wantBody {
+			t.Errorf("%s %s expected body %q, got: %q", tc.method, tc.target, tc.wantBody, body)
+		}
+		if got := resp.Header.Get("Content-Type"); tc.contentType != "" && got != tc.contentType {
+			t.Errorf("%s %s expected content type %q, got: %q", tc.method, tc.target, tc.contentType, got)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Package heap provides an indexed priority queue which is used to merge sorted streams.
+package heap
+
+// IndexMinHeap is a binary heap that allows clients to refer to items on priority queue.
+// The number of compares required is proportional to at most log n for "insert" and "remove the minimum" operations.
+type IndexMinHeap[T any] struct {
+	// n is number of elements on priority queue.
+	n int
+	// pq is a binary heap using 1-based indexing.
+	pq []int
+	// qp is inverse of pq: qp[pq[i]] = pq[qp[i]] = i.
+	qp []int
+	// items holds items with priorities: items[i] = priority of i.
+	items []T
+	// less reports whether item a has higher priority (is smaller) than item b.
+	less func(a, b T) bool
+}
+
+// NewIndexMinHeap creates a binary heap of size n to prioritize min items according to the less function.
+func NewIndexMinHeap[T any](n int, less func(a, b T) bool) *IndexMinHeap[T] {
+	h := IndexMinHeap[T]{
+		pq:    make([]int, n+1),
+		qp:    make([]int, n+1),
+		items: make([]T, n+1),
+		less:  less,
+	}
+	for i := 0; i <= n; i++ {
+		h.qp[i] = -1
+	}
+	return &h
+}
+
+// Insert adds the new item and associates it with index i.
+// Think of it as pq[i] = item.
+func (h *IndexMinHeap[T]) Insert(i int, item T) {
+	h.n++
+	h.qp[i] = h.n
+	h.pq[h.n] = i
+	h.items[i] = item
+	h.swim(h.n)
+}
+
+// Min takes the smallest item off the top.
+// Note, the first returned value is the index associated with the item.
+func (h *IndexMinHeap[T]) Min() (int, T) {
+	var zero T
+	if h.Size() == 0 {
+		return -1, zero
+	}
+
+	indexOfMin := h.pq[1]
+	min := h.items[indexOfMin]
+
+	h.exchange(1, h.n)
+	h.n--
+	h.sink(1)
+
+	h.items[indexOfMin] = zero // blank item
+	h.qp[indexOfMin] = -1
+	h.pq[h.n+1] = -1
+
+	return indexOfMin, min
+}
+
+// Size returns size of the heap.
+func (h *IndexMinHeap[T]) Size() int {
+	return h.n
+}
+
+func (h *IndexMinHeap[T]) greater(i, j int) bool {
+	return h.less(h.items[h.pq[j]], h.items[h.pq[i]])
+}
+
+func (h *IndexMinHeap[T]) exchange(i, j int) {
+	swap := h.pq[i]
+	h.pq[i] = h.pq[j]
+	h.pq[j] = swap
+	h.qp[h.pq[i]] = i
+	h.qp[h.pq[j]] = j
+}
+
+func (h *IndexMinHeap[T]) swim(k int) {
+	for k > 1 && h.greater(k/2, k) {
+		h.exchange(k, k/2)
+		k = k / 2
+	}
+}
+
+func (h *IndexMinHeap[T]) sink(k int) {
+	for 2*k <= h.n {
+		j := 2 * k
+		if j < h.n && h.greater(j, j+1) {
+			j++
+		}
+		if !h.greater(k, j) {
+			break
+		}
+		h.exchange(k, j)
+		k = j
+	}
+}
@@ -0,0 +1,64 @@
+package heap
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestIndexMinHeap_int(t *testing.T) {
+	h := NewIndexMinHeap(5, func(a, b int) bool { return a < b })
+	for i, item := range []int{50, 10, 40, 20, 30} {
+		h.Insert(i, item)
+	}
+	if h.Size() != 5 {
+		t.Fatalf("Size() got %d, want 5", h.Size())
+	}
+
+	var got []int
+	var indices []int
+	for h.Size() != 0 {
+		i, item := h.Min()
+		got = append(got, item)
+		indices = append(indices, i)
+	}
+	if diff := cmp.Diff([]int{10, 20, 30, 40, 50}, got); diff != "" {
+		t.Error(diff)
+	}
+	if diff := cmp.Diff([]int{1, 3, 4, 2, 0}, indices); diff != "" {
+		t.Error(diff)
+	}
+
+	if i, item := h.Min(); i != -1 || item != 0 {
+		t.Errorf("Min() got %d %d, want -1 0", i, item)
+	}
+}
+
+func TestIndexMinHeap_string(t *testing.T) {
+	// The items of the streams are merged: every time the min item is taken,
+	// the next item from the same stream is inserted with the same index.
+	streams := [][]string{
+		{"apple", "melon", "zucchini"},
+		{"banana", "cherry"},
+		{"kiwi"},
+	}
+	h := NewIndexMinHeap(len(streams), func(a, b string) bool { return a < b })
+	for i := range streams {
+		h.Insert(i, streams[i][0])
+		streams[i] = streams[i][1:]
+	}
+
+	var got []string
+	for h.Size() != 0 {
+		i, item := h.Min()
+		got = append(got, item)
+		if len(streams[i]) != 0 {
+			h.Insert(i, streams[i][0])
+			streams[i] = streams[i][1:]
+		}
+	}
+	want := []string{"apple", "banana", "cherry", "kiwi", "melon", "zucchini"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
@@ -1,6 +1,8 @@
 // Package index provides a memtable in the form of a red-black binary search tree.
 package index
 
+import "strings"
+
 const (
 	red   = true
 	black = false
@@ -35,12 +37,34 @@ After insertion perform balancing operations on the way up the tree:
 */
 type Memtable struct {
 	root *node
+	// cmp orders the keys, nil means the lexicographic order of strings.Compare.
+	cmp func(a, b string) int
+}
+
+// NewMemtable creates an empty memtable whose keys are ordered by the cmp function
+// which returns a negative number when a < b, zero when a == b, and a positive number when a > b.
+// The zero value of Memtable is also ready to use, it orders the keys lexicographically.
+func NewMemtable(cmp func(a, b string) int) *Memtable {
+	return &Memtable{cmp: cmp}
 }
+
+// compare returns the comparison function of the memtable.
+func (t *Memtable) compare() func(a, b string) int {
+	if t.cmp == nil {
+		return strings.Compare
+	}
+	return t.cmp
+}
+
 type node struct {
 	// key is a unique comparable key, e.g., name.
 	key string
 	// value is a value associated with the key, e.g., Bob.
 	value []byte
+	// deleted indicates that the key was deleted (tombstone).
+	deleted bool
+	// expiresAt is Unix time in nanoseconds when the key expires, zero means it never expires.
+	expiresAt int64
 	// color of the link from parent to this node (red or black).
 	color bool
 	// left is pointer to the left subtree where smaller keys are stored.
@@ -49,6 +73,8 @@ type node struct {
 	right *node
 	// size represents size in bytes of the subtree rooted at the node.
 	size int
+	// count is a number of nodes in the subtree rooted at the node.
+	count int
 }
 
 // isRed returns true if its link to parent is red.
@@ -59,21 +85,69 @@ func (n *node) isRed() bool {
 	return n.color == red
 }
 
-// Get retrieves a key from the tree.
+// Get retrieves a key from the tree. Deleted keys are reported as nil values.
 func (t *Memtable) Get(key string) []byte {
-	found := search(key, t.root)
-	if found == nil {
+	found := search(t.compare(), key, t.root)
+	if found == nil || found.deleted {
 		return nil
 	}
 	return found.value
 }
 
+// Lookup retrieves a key from the tree and tells whether it was found (ok) or deleted.
+// Unlike Get, it helps to distinguish a missing key from a deleted one (tombstone),
+// so that older versions of a deleted key stored elsewhere are not looked up.
+func (t *Memtable) Lookup(key string) (value []byte, deleted, ok bool) {
+	found := search(t.compare(), key, t.root)
+	if found == nil {
+		return nil, false, false
+	}
+	return found.value, found.deleted, true
+}
+
+// ExpiresAt returns Unix time in nanoseconds when the key expires.
+// Zero is returned if the key never expires or it is not found.
+func (t *Memtable) ExpiresAt(key string) int64 {
+	found := search(t.compare(), key, t.root)
+	if found == nil {
+		return 0
+	}
+	return found.expiresAt
+}
+
+// Expired returns keys sorted in ascending order that expired by the given Unix time in nanoseconds.
+// Deleted keys are not reported.
+func (t *Memtable) Expired(now int64) []string {
+	var kk []string
+	for _, n := range nodes(nil, t.root) {
+		if !n.deleted && n.expiresAt != 0 && n.expiresAt <= now {
+			kk = append(kk, n.key)
+		}
+	}
+	return kk
+}
+
 // Set stores the key in the tree. First it looks up the key and if found, updates the value.
 // If the key is new, it will be added to the tree.
 // The root is colored black after each insertion: a red root implies that the root is part of a 3-node,
 // but that's not the case.
 func (t *Memtable) Set(key string, value []byte) {
-	t.root = put(key, value, t.root)
+	t.root = put(t.compare(), key, value, false, 0, t.root)
+	t.root.color = black
+}
+
+// SetWithExpiry stores the key in the tree like Set does,
+// and the key expires at the given Unix time in nanoseconds.
+// Zero expiresAt means the key never expires.
+func (t *Memtable) SetWithExpiry(key string, value []byte, expiresAt int64) {
+	t.root = put(t.compare(), key, value, false, expiresAt, t.root)
+	t.root.color = black
+}
+
+// Delete marks the key as deleted by storing a tombstone in the tree.
+// The tombstone shadows older versions of the key until they are compacted.
+func (t *Memtable) Delete(key string) {
+	t.root = put(t.compare(), key, nil, true, 0, t.root)
 	t.root.color = black
 }
 
@@ -82,48 +156,95 @@ func (t *Memtable) Keys() []string {
 	return keys(nil, t.root)
 }
 
+// Merge returns a new memtable containing the keys of both memtables.
+// The other memtable is considered newer, so its keys (including tombstones) take priority over the receiver's.
+// Both trees are traversed in order and the merged keys are inserted in ascending order
+// which keeps the new tree balanced. Neither memtable is changed.
+func (t *Memtable) Merge(other *Memtable) *Memtable {
+	older := nodes(nil, t.root)
+	newer := nodes(nil, other.root)
+
+	cmp := t.compare()
+	merged := Memtable{cmp: t.cmp}
+	var n *node
+	for i, j := 0, 0; i < len(older) || j < len(newer); {
+		switch {
+		case j == len(newer):
+			n = older[i]
+			i++
+		case i == len(older):
+			n = newer[j]
+			j++
+		case cmp(older[i].key, newer[j].key) < 0:
+			n = older[i]
+			i++
+		case cmp(older[i].key, newer[j].key) > 0:
+			n = newer[j]
+			j++
+		default:
+			n = newer[j]
+			i++
+			j++
+		}
+		merged.root = put(cmp, n.key, n.value, n.deleted, n.expiresAt, merged.root)
+		merged.root.color = black
+	}
+	return &merged
+}
+
 // Size returns memtable size in bytes calculated as a sum of all its keys and values.
 func (t *Memtable) Size() int {
 	return subtreeSize(t.root)
 }
 
+// Len returns a number of keys in the memtable including the deleted ones.
+func (t *Memtable) Len() int {
+	return subtreeCount(t.root)
+}
+
 // search recursively looks up node by key starting from node n.
-func search(key string, n *node) *node {
-	switch {
-	// Search miss.
-	case n == nil:
+// The keys are ordered by the cmp function.
+func search(cmp func(a, b string) int, key string, n *node) *node {
+	if n == nil {
+		// Search miss.
 		return nil
-	// Search hit.
-	case key == n.key:
-		return n
+	}
+	switch c := cmp(key, n.key); {
 	// Check smaller keys on the left side.
-	case key < n.key:
-		return search(key, n.left)
+	case c < 0:
+		return search(cmp, key, n.left)
 	// Check larger keys on the right side.
-	case key > n.key:
-		return search(key, n.right)
+	case c > 0:
+		return search(cmp, key, n.right)
 	}
-	return nil
+	// Search hit.
+	return n
 }
 
 // put updates the value of found node which was looked up by key.
 // If key is not found, the new node with red link is added to the tree.
-func put(key string, value []byte, n *node) *node {
+// The keys are ordered by the cmp function.
+func put(cmp func(a, b string) int, key string, value []byte, deleted bool, expiresAt int64, n *node) *node {
 	if n == nil {
 		return &node{
-			key:   key,
-			value: value,
-			color: red,
-			size:  len(key) + len(value),
+			key:       key,
+			value:     value,
+			deleted:   deleted,
+			expiresAt: expiresAt,
+			color:     red,
+			size:      len(key) + len(value),
+			count:     1,
 		}
 	}
 
-	if key < n.key {
-		n.left = put(key, value, n.left)
-	} else if key > n.key {
-		n.right = put(key, value, n.right)
+	if c := cmp(key, n.key); c < 0 {
+		n.left = put(cmp, key, value, deleted, expiresAt, n.left)
+	} else if c > 0 {
+		n.right = put(cmp, key, value, deleted, expiresAt, n.right)
 	} else {
 		n.value = value
+		n.deleted = deleted
+		n.expiresAt = expiresAt
 	}
 
 	// Balance the tree on the way up the search path.
@@ -138,6 +259,7 @@ func put(key string, value []byte, n *node) *node {
 	}
 
 	n.size = subtreeSize(n.left) + subtreeSize(n.right) + len(n.key) + len(n.value)
+	n.count = subtreeCount(n.left) + subtreeCount(n.right) + 1
 	return n
 }
 
@@ -158,6 +280,8 @@ func rotateLeft(h *node) *node {
 	h.color = red
 	x.size = h.size
 	h.size = subtreeSize(h.left) + subtreeSize(h.right) + len(h.key) + len(h.value)
+	x.count = h.count
+	h.count = subtreeCount(h.left) + subtreeCount(h.right) + 1
 	return x
 }
 
@@ -172,6 +296,8 @@ func rotateRight(h *node) *node {
 	h.color = red
 	x.size = h.size
 	h.size = subtreeSize(h.left) + subtreeSize(h.right) + len(h.key) + len(h.value)
+	x.count = h.count
+	h.count = subtreeCount(h.left) + subtreeCount(h.right) + 1
 	return x
 }
 
@@ -195,6 +321,17 @@ func keys(kk []string, n *node) []string {
 	return kk
 }
 
+// nodes recursively traverses the tree and returns all nodes in order.
+func nodes(nn []*node, n *node) []*node {
+	if n == nil {
+		return nn
+	}
+	nn = nodes(nn, n.left)
+	nn = append(nn, n)
+	nn = nodes(nn, n.right)
+	return nn
+}
+
 // subtreeSize returns size in bytes of the subtree rooted at the node.
 func subtreeSize(n *node) int {
 	if n == nil {
@@ -202,3 +339,11 @@ func subtreeSize(n *node) int {
 	}
 	return n.size
 }
+
+// subtreeCount returns a number of nodes in the subtree rooted at the node.
+func subtreeCount(n *node) int {
+	if n == nil {
+		return 0
+	}
+	return n.count
+}
@@ -3,6 +3,8 @@ package index
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -85,7 +87,7 @@ func TestSearch(t *testing.T) {
 	}
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			got := search(tc.key, tc.n)
+			got := search(strings.Compare, tc.key, tc.n)
 			if got != tc.want {
 				t.Errorf("search(%q, %+v) got %+v, want %+v", tc.key, tc.n, got, tc.want)
 			}
@@ -352,6 +354,32 @@ func TestMemtableKeys(t *testing.T) {
 	}
 }
 
+func TestNewMemtable(t *testing.T) {
+	reverse := func(a, b string) int {
+		return strings.Compare(b, a)
+	}
+	tree := NewMemtable(reverse)
+	for _, key := range []string{"E", "A", "S", "Y", "Q"} {
+		tree.Set(key, []byte(key))
+	}
+	tree.Delete("Q")
+	if got := tree.Get("S"); string(got) != "S" {
+		t.Errorf("Get(S) got %q, want S", got)
+	}
+
+	want := []string{"Y", "S", "Q", "E", "A"}
+	if kk := tree.Keys(); !equal(kk, want) {
+		t.Errorf("Keys() got %v, want %v", kk, want)
+	}
+	// The merged memtable keeps the order of the receiver.
+	other := NewMemtable(reverse)
+	other.Set("C", nil)
+	want = []string{"Y", "S", "Q", "E", "C", "A"}
+	if kk := tree.Merge(other).Keys(); !equal(kk, want) {
+		t.Errorf("Merge() got %v, want %v", kk, want)
+	}
+}
+
 func TestMemtableSize(t *testing.T) {
 	tests := []struct {
 		key   string
@@ -490,3 +518,219 @@ func leftLeaning() *node {
 		},
 	}
 }
+
+func TestMemtableDelete(t *testing.T) {
+	tree := abcTree()
+	tree.Delete("S")
+	tree.Delete("unknown")
+
+	if got := tree.Get("S"); got != nil {
+		t.Errorf("Get(S) got %q, want nil", got)
+	}
+
+	want := []string{"A", "C", "E", "H", "M", "R", "S", "X", "unknown"}
+	if kk := tree.Keys(); !equal(kk, want) {
+		t.Errorf("Keys() got %v, want %v", kk, want)
+	}
+
+	tree.Set("S", []byte("sea"))
+	if got, want := tree.Get("S"), []byte("sea"); !bytes.Equal(got, want) {
+		t.Errorf("Get(S) got %q, want %q", got, want)
+	}
+}
+
+func TestMemtableLookup(t *testing.T) {
+	tree := abcTree()
+	tree.Delete("R")
+
+	tt := []struct {
+		key         string
+		wantValue   []byte
+		wantDeleted bool
+		wantOK      bool
+	}{
+		{"S", []byte("sea"), false, true},
+		{"R", nil, true, true},
+		{"unknown", nil, false, false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.key, func(t *testing.T) {
+			value, deleted, ok := tree.Lookup(tc.key)
+			if !bytes.Equal(value, tc.wantValue) || deleted != tc.wantDeleted || ok != tc.wantOK {
+				t.Errorf("Lookup(%q) got (%q, %t, %t), want (%q, %t, %t)",
+					tc.key, value, deleted, ok, tc.wantValue, tc.wantDeleted, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestMemtableMerge(t *testing.T) {
+	older, newer := Memtable{}, Memtable{}
+	for i := 0; i < 500; i++ {
+		older.Set(fmt.Sprintf("key%04d", i), []byte("old"))
+		newer.Set(fmt.Sprintf("key%04d", i+400), []byte("new"))
+	}
+	newer.Delete("key0450")
+
+	merged := older.Merge(&newer)
+	if kk := merged.Keys(); len(kk) != 900 {
+		t.Fatalf("Keys() got %d keys, want 900", len(kk))
+	}
+	tt := map[string]string{
+		"key0000": "old",
+		"key0399": "old",
+		"key0400": "new",
+		"key0499": "new",
+		"key0899": "new",
+	}
+	for key, want := range tt {
+		if got := merged.Get(key); string(got) != want {
+			t.Errorf("Get(%s) got %q, want %q", key, got, want)
+		}
+	}
+	if _, deleted, _ := merged.Lookup("key0450"); !deleted {
+		t.Error("Lookup(key0450) expected tombstone")
+	}
+	if got, want := merged.Size(), subtreeSize(older.root)+subtreeSize(newer.root)-100*(len("key0400")+len("old")); got != want {
+		t.Errorf("Size() got %d, want %d", got, want)
+	}
+	if got := older.Get("key0400"); string(got) != "old" {
+		t.Errorf("receiver was changed: Get(key0400) got %q", got)
+	}
+}
+
+func TestMemtableExpired(t *testing.T) {
+	tree := abcTree()
+	tree.SetWithExpiry("S", []byte("sea"), 100)
+	tree.SetWithExpiry("X", []byte("xray"), 200)
+	tree.SetWithExpiry("R", []byte("red"), 50)
+	tree.Delete("R")
+
+	if got := tree.ExpiresAt("S"); got != 100 {
+		t.Errorf("ExpiresAt(S) got %d, want 100", got)
+	}
+	if got := tree.ExpiresAt("R"); got != 0 {
+		t.Errorf("ExpiresAt(R) got %d, want 0", got)
+	}
+	if got := tree.Expired(100); !reflect.DeepEqual(got, []string{"S"}) {
+		t.Errorf("Expired(100) got %q, want [S]", got)
+	}
+	if got := tree.Expired(99); got != nil {
+		t.Errorf("Expired(99) got %q, want none", got)
+	}
+
+	// Set clears the expiry of the key.
+	tree.Set("S", []byte("sea"))
+	if got := tree.Expired(1000); !reflect.DeepEqual(got, []string{"X"}) {
+		t.Errorf("Expired(1000) got %q, want [X]", got)
+	}
+}
+
+func TestMemtableLen(t *testing.T) {
+	tree := Memtable{}
+	if got := tree.Len(); got != 0 {
+		t.Fatalf("expected: 0 got: %d", got)
+	}
+	for i := 0; i < 100; i++ {
+		tree.Set(fmt.Sprintf("key%02d", i), []byte("v"))
+	}
+	// Updates and tombstones don't add keys.
+	tree.Set("key00", []byte("updated"))
+	tree.Delete("key01")
+	if got := tree.Len(); got != 100 {
+		t.Errorf("expected: 100 got: %d", got)
+	}
+	if got := tree.Merge(&Memtable{}).Len(); got != 100 {
+		t.Errorf("Merge expected: 100 got: %d", got)
+	}
+}
+
+// memtable is implemented by Memtable and SkiplistMemtable to compare them in benchmarks.
+type memtable interface {
+	Set(key string, value []byte)
+	Get(key string) []byte
+	Keys() []string
+	Size() int
+}
+
+// benchMemtables lists the memtables to compare along with the key counts and the key orders of the benchmarks.
+// Sequential keys are inserted in ascending order, e.g., timestamps or counters, random keys are shuffled.
+var benchMemtables = []struct {
+	name string
+	new  func() memtable
+}{
+	{"bst", func() memtable { return &Memtable{} }},
+	{"skiplist", func() memtable { return NewSkiplistMemtable(1) }},
+}
+
+func benchKeys(n int, order string) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%08d", i)
+	}
+	if order == "random" {
+		rnd := rand.New(rand.NewSource(1))
+		rnd.Shuffle(n, func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	}
+	return keys
+}
+
+func benchmarkMemtables(b *testing.B, fn func(b *testing.B, newMem func() memtable, keys []string)) {
+	for _, m := range benchMemtables {
+		for _, n := range []int{1000, 100000} {
+			for _, order := range []string{"sequential", "random"} {
+				keys := benchKeys(n, order)
+				b.Run(fmt.Sprintf("%s/%d/%s", m.name, n, order), func(b *testing.B) {
+					fn(b, m.new, keys)
+				})
+			}
+		}
+	}
+}
+
+func BenchmarkMemtableSet(b *testing.B) {
+	value := []byte("value")
+	benchmarkMemtables(b, func(b *testing.B, newMem func() memtable, keys []string) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			mem := newMem()
+			for _, key := range keys {
+				mem.Set(key, value)
+			}
+		}
+	})
+}
+
+func BenchmarkMemtableGet(b *testing.B) {
+	value := []byte("value")
+	benchmarkMemtables(b, func(b *testing.B, newMem func() memtable, keys []string) {
+		mem := newMem()
+		for _, key := range keys {
+			mem.Set(key, value)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if mem.Get(keys[i%len(keys)]) == nil {
+				b.Fatal("key not found")
+			}
+		}
+	})
+}
+
+func BenchmarkMemtableKeys(b *testing.B) {
+	value := []byte("value")
+	benchmarkMemtables(b, func(b *testing.B, newMem func() memtable, keys []string) {
+		mem := newMem()
+		for _, key := range keys {
+			mem.Set(key, value)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if len(mem.Keys()) != len(keys) {
+				b.Fatal("keys are missing")
+			}
+		}
+	})
+}
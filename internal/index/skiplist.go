@@ -0,0 +1,130 @@
+package index
+
+import "math/rand"
+
+const (
+	// skiplistMaxLevel is a maximum number of levels of a skip list,
+	// it's enough for 4^16 keys with the promotion probability 1/4.
+	skiplistMaxLevel = 16
+	// skiplistP is a probability that a node is promoted to the next level.
+	skiplistP = 0.25
+)
+
+/*
+SkiplistMemtable is an alternative memtable implemented as a probabilistic skip list like in LevelDB.
+It exists to compare it against the red-black BST of Memtable, see the benchmarks of the package.
+
+A skip list is a sorted linked list with express lanes: every node is in level 0,
+and a node is promoted to every next level with probability p, so each level skips over about 1/p nodes
+of the level below. A search starts at the highest level and moves right while the next key is smaller,
+then it descends a level. Get and Set take O(lg n) expected time, and Keys walks level 0 in order.
+
+The benchmarks (BenchmarkMemtableSet, BenchmarkMemtableGet, BenchmarkMemtableKeys) show that:
+
+  - Set is faster with the skip list, because it never rebalances: about 2x for 100k sequential keys
+    and about 15% for 100k random keys, it takes less memory but makes two allocations per key.
+    With 1k keys both are about the same.
+  - Get is about the same with 1k keys, but the BST is about 2x faster with 100k random keys,
+    since a skip list search visits more nodes (about lg n / p) scattered in memory.
+  - Keys is about the same with 1k keys, but the BST is about 1.7x faster with 100k keys,
+    because the skip list nodes inserted in random order are far apart in memory.
+
+So the BST suits the read path of the database better, and the skip list would pay off
+for write-heavy workloads with mostly ascending keys, or if the memtable had to support
+concurrent readers without locks which is simpler with a skip list.
+
+Note, skip list is not concurrency safe.
+*/
+type SkiplistMemtable struct {
+	head  skipnode
+	level int
+	size  int
+	rnd   *rand.Rand
+}
+
+type skipnode struct {
+	key   string
+	value []byte
+	// next are the following nodes at every level of the node.
+	next []*skipnode
+}
+
+// NewSkiplistMemtable creates an empty skip list whose node levels are chosen with the seeded random generator,
+// so the structure of the list is reproducible.
+func NewSkiplistMemtable(seed int64) *SkiplistMemtable {
+	return &SkiplistMemtable{
+		head:  skipnode{next: make([]*skipnode, skiplistMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Get retrieves a key from the skip list. Nil is returned if the key is not found.
+func (l *SkiplistMemtable) Get(key string) []byte {
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+	}
+	if x = x.next[0]; x != nil && x.key == key {
+		return x.value
+	}
+	return nil
+}
+
+// Set stores the key in the skip list. If the key is found, its value is updated.
+func (l *SkiplistMemtable) Set(key string, value []byte) {
+	// update keeps the rightmost node visited at every level, the new node is linked after them.
+	var update [skiplistMaxLevel]*skipnode
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	if x = x.next[0]; x != nil && x.key == key {
+		l.size += len(value) - len(x.value)
+		x.value = value
+		return
+	}
+
+	level := l.randomLevel()
+	for ; l.level < level; l.level++ {
+		update[l.level] = &l.head
+	}
+	n := skipnode{
+		key:   key,
+		value: value,
+		next:  make([]*skipnode, level),
+	}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = &n
+	}
+	l.size += len(key) + len(value)
+}
+
+// Keys returns all keys sorted in ascending order.
+func (l *SkiplistMemtable) Keys() []string {
+	var keys []string
+	for x := l.head.next[0]; x != nil; x = x.next[0] {
+		keys = append(keys, x.key)
+	}
+	return keys
+}
+
+// Size returns the skip list size in bytes calculated as a sum of all its keys and values.
+func (l *SkiplistMemtable) Size() int {
+	return l.size
+}
+
+// randomLevel returns a level of a new node: every next level is chosen with probability skiplistP.
+func (l *SkiplistMemtable) randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && l.rnd.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
@@ -0,0 +1,43 @@
+package index
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSkiplistMemtable(t *testing.T) {
+	l := NewSkiplistMemtable(1)
+	want := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i*7919%1000)
+		want[key] = fmt.Sprintf("value%d", i)
+		l.Set(key, []byte(want[key]))
+	}
+	// Overwritten values change the size.
+	l.Set("key1", []byte("v"))
+	want["key1"] = "v"
+
+	var (
+		keys []string
+		size int
+	)
+	for key, value := range want {
+		keys = append(keys, key)
+		size += len(key) + len(value)
+		if got := l.Get(key); string(got) != value {
+			t.Errorf("expected %s=%s, got: %q", key, value, got)
+		}
+	}
+	sort.Strings(keys)
+	if got := l.Keys(); !reflect.DeepEqual(keys, got) {
+		t.Errorf("expected sorted keys, got: %v", got)
+	}
+	if got := l.Size(); got != size {
+		t.Errorf("expected size %d, got: %d", size, got)
+	}
+	if got := l.Get("missing"); got != nil {
+		t.Errorf("expected nil, got: %q", got)
+	}
+}
@@ -0,0 +1,413 @@
+package hasty
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/marselester/hastydb/internal/heap"
+	"github.com/marselester/hastydb/internal/index"
+)
+
+// IteratorOption helps to restrict the range of keys scanned by Iterator.
+type IteratorOption func(*iteratorConfig)
+
+// iteratorConfig contains iterator settings which are updated with IteratorOption functions.
+type iteratorConfig struct {
+	lower    string
+	upper    string
+	hasUpper bool
+	// tombstones tells the iterator to stop at the deleted or expired keys, see Deleted.
+	tombstones bool
+}
+
+// WithLowerBound sets the smallest key (inclusive) the iterator starts from.
+func WithLowerBound(key string) IteratorOption {
+	return func(c *iteratorConfig) {
+		c.lower = key
+	}
+}
+
+// WithUpperBound sets the key (exclusive) where the iterator stops.
+func WithUpperBound(key string) IteratorOption {
+	return func(c *iteratorConfig) {
+		c.upper = key
+		c.hasUpper = true
+	}
+}
+
+// PrefixScan returns an iterator over the keys which start with the prefix.
+// The range is bounded by the prefix itself and the prefix with its last byte incremented,
+// e.g., "user:" is scanned up to "user;", so the iterator stops right after the last matching key.
+// Trailing 0xff bytes can't be incremented, so they are dropped first, e.g., "a\xff" is scanned up to "b".
+// An empty prefix or the one consisting only of 0xff bytes has no upper bound,
+// so the empty prefix scans all the keys.
+func (db *DB) PrefixScan(prefix string) *Iterator {
+	opts := []IteratorOption{WithLowerBound(prefix)}
+	if upper, ok := prefixUpperBound(prefix); ok {
+		opts = append(opts, WithUpperBound(upper))
+	}
+	return db.NewIterator(opts...)
+}
+
+// Scan returns an iterator over the keys from start (inclusive) to end (exclusive).
+// An empty start scans from the first key, and an empty end scans up to the last key.
+// Segments are positioned near start with their in-memory indices, so the preceding records aren't read.
+func (db *DB) Scan(start, end string) *Iterator {
+	opts := []IteratorOption{WithLowerBound(start)}
+	if end != "" {
+		opts = append(opts, WithUpperBound(end))
+	}
+	return db.NewIterator(opts...)
+}
+
+// Keys returns all the keys in ascending order without the deleted ones.
+// The memtables and segments are merged with an iterator, so the keys are streamed rather than collected
+// from the indices, but the whole database is read, so it's meant for debugging and introspection.
+func (db *DB) Keys() ([]string, error) {
+	if err := db.enter(); err != nil {
+		return nil, err
+	}
+	defer db.leave()
+
+	keys := []string{}
+	it := db.NewIterator()
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan keys: %w", err)
+	}
+	return keys, nil
+}
+
+// KeysWithPrefix returns the keys which start with the prefix in ascending order without the deleted ones.
+// Unlike Keys, the whole database isn't read: every segment is positioned near the prefix with its in-memory index,
+// see PrefixScan, and the scan stops right after the last matching key.
+// Note, the values are read along with the keys, since they're stored in the same records.
+func (db *DB) KeysWithPrefix(prefix string) ([]string, error) {
+	if err := db.enter(); err != nil {
+		return nil, err
+	}
+	defer db.leave()
+
+	keys := []string{}
+	it := db.PrefixScan(prefix)
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan keys: %w", err)
+	}
+	return keys, nil
+}
+
+// ForEach calls fn with each key-value pair in ascending key order without the deleted or expired keys.
+// The iteration stops once fn returns an error which is returned by ForEach.
+// The memtables and segments are merged with an iterator the same way the compaction merges segments,
+// so the segments are streamed rather than loaded into memory.
+// The iterator is created at the moment of the call, so the writes made during the iteration aren't visible.
+func (db *DB) ForEach(fn func(key string, value []byte) error) error {
+	if err := db.enter(); err != nil {
+		return err
+	}
+	defer db.leave()
+
+	it := db.NewIterator()
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		if err := fn(it.Key(), it.Value()); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("failed to scan keys: %w", err)
+	}
+	return nil
+}
+
+// prefixUpperBound returns the smallest key which is greater than all the keys with the prefix.
+// False is returned if there is no such key.
+func prefixUpperBound(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] != 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// Iterator is a forward cursor over the keys in ascending order.
+// It merges the live memtable, the immutable memtables being flushed, and the segments,
+// so only the most recent version of each key is presented, and deleted or expired keys are skipped.
+//
+//	it := db.NewIterator(hasty.WithLowerBound("user:"), hasty.WithUpperBound("user;"))
+//	defer it.Close()
+//	for ; it.Valid(); it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// Note, the memtables are copied when the iterator is created,
+// so the iterator doesn't see the keys written after that.
+// The segments are pinned until the iteration is over, see Close.
+type Iterator struct {
+	cfg iteratorConfig
+	// sources are sorted streams of records, the newest source comes first.
+	sources []recordSource
+	pq      *heap.IndexMinHeap[*record]
+	// vlog is where the values of the records with pointers are read.
+	vlog *valueLog
+	// pinned are the segments acquired by NewIterator, they're released once the iteration is over.
+	pinned []*segment
+	// cmp orders the keys, see WithKeyComparator.
+	cmp keyComparator
+
+	key   string
+	value []byte
+	// deleted indicates that the key at the current position is a tombstone.
+	deleted bool
+	// seen indicates that the key field holds the last seen key which can be a tombstone.
+	seen  bool
+	valid bool
+	err   error
+}
+
+// recordSource is a stream of records sorted by key.
+type recordSource interface {
+	// next returns the next record or nil when the stream is exhausted.
+	next() (*record, error)
+}
+
+// NewIterator returns an iterator positioned at the first key in the range.
+// The iterator fails with ErrClosed if the database is closed.
+func (db *DB) NewIterator(opts ...IteratorOption) *Iterator {
+	it := Iterator{
+		vlog: db.vlog,
+		cmp:  db.cfg.comparator,
+	}
+	for _, opt := range opts {
+		opt(&it.cfg)
+	}
+	// The iterator isn't registered with enter, because Keys and ForEach create it while they're registered.
+	if atomic.LoadInt32(&db.closing) == 1 {
+		it.err = ErrClosed
+		return &it
+	}
+
+	db.memMu.RLock()
+	it.sources = append(it.sources, newMemtableSource(db.memtable, it.cfg.lower, it.cmp))
+	for _, mem := range db.immutables {
+		it.sources = append(it.sources, newMemtableSource(mem, it.cfg.lower, it.cmp))
+	}
+	db.memMu.RUnlock()
+
+	it.pinned = db.acquireSegments()
+	it.start(it.pinned)
+	if !it.valid {
+		it.Close()
+	}
+	return &it
+}
+
+// start adds the segments to the sources of the iterator and positions it at the first key in the range.
+func (it *Iterator) start(ss []*segment) {
+	for i := range ss {
+		// The records preceding the lower bound are skipped using the in-memory index.
+		offset, prev := ss[i].seek(it.cfg.lower)
+		it.sources = append(it.sources, &segmentSource{
+			r:      bufio.NewReader(ss[i].newStreamReaderAt(offset)),
+			decode: ss[i].decode,
+			n:      ss[i].size - offset,
+			lower:  it.cfg.lower,
+			cmp:    it.cmp,
+			prev:   prev,
+		})
+	}
+
+	// Fill the priority queue with the first records from each source.
+	it.pq = heap.NewIndexMinHeap(len(it.sources), it.cmp.recordLess)
+	for i := range it.sources {
+		if !it.refill(i) {
+			return
+		}
+	}
+	it.Next()
+}
+
+// Valid reports whether the iterator is positioned at a key.
+// It is false once the keys are exhausted or an error occurred, see Err.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key at the current position.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the value at the current position.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Deleted reports whether the key at the current position is deleted or expired.
+// It's always false unless the iterator presents the tombstones, e.g., in ExportFormatWithTombstones.
+func (it *Iterator) Deleted() bool {
+	return it.deleted
+}
+
+// Err returns the error which stopped the iteration, e.g., a damaged segment.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the segments read by the iterator, so compaction can remove them once they're replaced.
+// The iterator is closed automatically when it's exhausted or failed, so Close is needed only to stop early.
+// It's safe to call Close multiple times.
+func (it *Iterator) Close() error {
+	releaseSegments(it.pinned)
+	it.pinned = nil
+	it.valid = false
+	// The remaining records mustn't be read from the released segments.
+	it.pq = heap.NewIndexMinHeap(0, it.cmp.recordLess)
+	return nil
+}
+
+// Next moves the iterator to the next key.
+func (it *Iterator) Next() {
+	it.valid = false
+	defer func() {
+		if !it.valid && it.pinned != nil {
+			it.Close()
+		}
+	}()
+
+	for it.err == nil && it.pq.Size() != 0 {
+		// Equal keys are taken in the order of sources, so the newest version comes first.
+		i, rec := it.pq.Min()
+		if !it.refill(i) {
+			return
+		}
+		// Older versions of the last seen key are skipped.
+		if it.seen && rec.key == it.key {
+			continue
+		}
+		if it.cfg.hasUpper && it.cmp.Compare(rec.key, it.cfg.upper) >= 0 {
+			return
+		}
+
+		it.key = rec.key
+		it.seen = true
+		if it.deleted = rec.deleted || rec.expired(time.Now().UnixNano()); it.deleted {
+			if !it.cfg.tombstones {
+				continue
+			}
+			it.value = nil
+			it.valid = true
+			return
+		}
+		it.value = rec.value
+		if rec.pointer {
+			if it.value, it.err = it.vlog.Value(rec.key, rec.value); it.err != nil {
+				return
+			}
+		}
+		it.valid = true
+		return
+	}
+}
+
+// refill puts the next record from i-th source to the priority queue.
+// It returns false if the source failed.
+func (it *Iterator) refill(i int) bool {
+	rec, err := it.sources[i].next()
+	if err != nil {
+		it.err = err
+		it.valid = false
+		return false
+	}
+	if rec != nil {
+		rec.order = i
+		it.pq.Insert(i, rec)
+	}
+	return true
+}
+
+// memtableSource streams the records of a memtable copied at the moment of creation.
+type memtableSource struct {
+	recs []*record
+}
+
+// newMemtableSource copies the records of the memtable starting from the lower bound key,
+// empty lower key means no bound. The keys are compared with cmp.
+// Note, the caller must hold a memtable lock.
+func newMemtableSource(bst *index.Memtable, lower string, cmp keyComparator) *memtableSource {
+	var src memtableSource
+	for _, key := range bst.Keys() {
+		if lower != "" && cmp.Compare(key, lower) < 0 {
+			continue
+		}
+		rec := record{
+			key: key,
+		}
+		rec.value, rec.deleted, _ = bst.Lookup(key)
+		rec.expiresAt = bst.ExpiresAt(key)
+		src.recs = append(src.recs, &rec)
+	}
+	return &src
+}
+
+func (src *memtableSource) next() (*record, error) {
+	if len(src.recs) == 0 {
+		return nil, nil
+	}
+	rec := src.recs[0]
+	src.recs = src.recs[1:]
+	return rec, nil
+}
+
+// segmentSource streams the records of a segment file starting from the lower bound key.
+type segmentSource struct {
+	r      *bufio.Reader
+	decode func(b []byte) (*record, error)
+	// n is the number of bytes left in the records stream.
+	n     int64
+	lower string
+	cmp   keyComparator
+	// prev is the key of the last read record to restore prefix-compressed keys.
+	prev string
+}
+
+func (src *segmentSource) next() (*record, error) {
+	for {
+		b, err := readRecord(src.r, src.n)
+		switch {
+		case err == io.EOF:
+			return nil, nil
+		case err != nil:
+			return nil, fmt.Errorf("failed to iterate segment: %w", err)
+		}
+		src.n -= int64(len(b))
+
+		rec, err := src.decode(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate segment: %w", err)
+		}
+		if err = rec.restoreKey(src.prev); err != nil {
+			return nil, fmt.Errorf("failed to iterate segment: %w", err)
+		}
+		src.prev = rec.key
+		if src.lower == "" || src.cmp.Compare(rec.key, src.lower) >= 0 {
+			return rec, nil
+		}
+	}
+}
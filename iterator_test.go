@@ -0,0 +1,436 @@
+package hasty
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/marselester/hastydb/internal/index"
+)
+
+func TestIterator(t *testing.T) {
+	dir := t.TempDir()
+	db, close, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// The oldest versions of the keys are in the segments.
+	var segs []*segment
+	for i, recs := range [][]record{
+		{{key: "b", value: []byte("b2")}, {key: "e", deleted: true}},
+		{{key: "a", value: []byte("a1")}, {key: "b", value: []byte("b1")}, {key: "e", value: []byte("e1")}, {key: "f", value: []byte("f1")}},
+	} {
+		segPath := filepath.Join(dir, fmt.Sprintf("old%d", i))
+		writeSegment(t, segPath, func(seg *segment) error {
+			out := newSegmentWriter(seg, CompressionSnappy)
+			for _, rec := range recs {
+				if err := encode(out, beginRecord(out, &rec)); err != nil {
+					return err
+				}
+				if err := endRecord(out); err != nil {
+					return err
+				}
+			}
+			return out.Flush()
+		})
+		seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer seg.Close()
+		segs = append(segs, seg)
+	}
+	db.setSegments(segs)
+
+	immutable := &index.Memtable{}
+	immutable.Set("c", []byte("c3"))
+	immutable.Set("f", []byte("f3"))
+	// The immutable memtable takes its slot and gets a WAL file as if the memtable was rotated.
+	db.immutableSem.TryAcquire(1)
+	db.walMu.Lock()
+	w, err := db.openWAL()
+	db.walMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.immutables = []*index.Memtable{immutable}
+	db.immutableWALs = []*wal{w}
+	if err = db.Set("c", []byte("c4")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete("f"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("g", []byte("g4")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		opts []IteratorOption
+		want []string
+	}{
+		"all": {
+			want: []string{"a=a1", "b=b2", "c=c4", "g=g4"},
+		},
+		"lower bound": {
+			opts: []IteratorOption{WithLowerBound("b")},
+			want: []string{"b=b2", "c=c4", "g=g4"},
+		},
+		"upper bound": {
+			opts: []IteratorOption{WithUpperBound("c")},
+			want: []string{"a=a1", "b=b2"},
+		},
+		"both bounds": {
+			opts: []IteratorOption{WithLowerBound("bb"), WithUpperBound("f")},
+			want: []string{"c=c4"},
+		},
+		"empty range": {
+			opts: []IteratorOption{WithLowerBound("x")},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			it := db.NewIterator(tc.opts...)
+			for ; it.Valid(); it.Next() {
+				got = append(got, it.Key()+"="+string(it.Value()))
+			}
+			if err := it.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestDBPrefixScan(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for _, key := range []string{"user", "user:1", "user:2", "user;", "a\xff", "a\xff\xff", "b", "\xff\xff"} {
+		if err = db.Set(key, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string][]string{
+		"user:":    {"user:1", "user:2"},
+		"user":     {"user", "user:1", "user:2", "user;"},
+		"a\xff":    {"a\xff", "a\xff\xff"},
+		"\xff":     {"\xff\xff"},
+		"":         {"a\xff", "a\xff\xff", "b", "user", "user:1", "user:2", "user;", "\xff\xff"},
+		"missing:": nil,
+	}
+	for prefix, want := range tests {
+		t.Run(prefix, func(t *testing.T) {
+			var got []string
+			it := db.PrefixScan(prefix)
+			for ; it.Valid(); it.Next() {
+				got = append(got, it.Key())
+			}
+			if err := it.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestDBScan(t *testing.T) {
+	tests := map[string][]ConfigOption{
+		"plain":  {WithRestartInterval(4)},
+		"blocks": {WithCompression(CompressionSnappy), WithRestartInterval(4)},
+		"sparse": {WithSparseIndexInterval(64), WithRestartInterval(4)},
+	}
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, close, err := Open(t.TempDir(), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer close()
+
+			for i := 0; i < 100; i++ {
+				if err = db.Set(fmt.Sprintf("key%03d", i), []byte("v")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			flushDB(t, db)
+			if err = db.Delete("key051"); err != nil {
+				t.Fatal(err)
+			}
+
+			seg := db.segments.Load().([]*segment)[0]
+			if offset, _ := seg.seek("key050"); offset == 0 {
+				t.Error("expected seek past the beginning of segment")
+			}
+			if got, _ := seg.seek("zzz"); got != seg.Size() {
+				t.Errorf("expected seek to the end %d, got: %d", seg.Size(), got)
+			}
+
+			scans := map[[2]string][]string{
+				{"key050", "key054"}:  {"key050", "key052", "key053"},
+				{"key0505", "key053"}: {"key052"},
+				{"", "key002"}:        {"key000", "key001"},
+				{"key098", ""}:        {"key098", "key099"},
+				{"zzz", ""}:           nil,
+			}
+			for r, want := range scans {
+				var got []string
+				it := db.Scan(r[0], r[1])
+				for ; it.Valid(); it.Next() {
+					got = append(got, it.Key())
+				}
+				if err := it.Err(); err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Errorf("%q: %s", r, diff)
+				}
+			}
+		})
+	}
+}
+
+// countingReaderAt counts the bytes read from r.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func TestDBScan_seek(t *testing.T) {
+	// The restart interval doesn't divide the seek interval, so the scans start at prefix-compressed records.
+	tests := map[string][]ConfigOption{
+		"plain":  {WithRestartInterval(5)},
+		"blocks": {WithCompression(CompressionSnappy), WithRestartInterval(5)},
+		"sparse": {WithSparseIndexInterval(64), WithRestartInterval(5)},
+	}
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, close, err := Open(t.TempDir(), append(opts, WithBlockCacheSize(0))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer close()
+
+			for i := 0; i < 1000; i++ {
+				if err = db.Set(fmt.Sprintf("key%03d", i), []byte("v")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			flushDB(t, db)
+			seg := db.segments.Load().([]*segment)[0]
+			counter := countingReaderAt{r: seg.body}
+			seg.body = io.NewSectionReader(&counter, 0, seg.body.Size())
+
+			scans := map[string]struct {
+				scan func() ([]string, error)
+				want []string
+			}{
+				"range": {
+					scan: func() ([]string, error) {
+						var keys []string
+						it := db.Scan("key900", "key903")
+						defer it.Close()
+						for ; it.Valid(); it.Next() {
+							keys = append(keys, it.Key())
+						}
+						return keys, it.Err()
+					},
+					want: []string{"key900", "key901", "key902"},
+				},
+				"prefix": {
+					scan: func() ([]string, error) {
+						return db.KeysWithPrefix("key95")
+					},
+					want: []string{
+						"key950", "key951", "key952", "key953", "key954",
+						"key955", "key956", "key957", "key958", "key959",
+					},
+				},
+			}
+			for scan, tc := range scans {
+				atomic.StoreInt64(&counter.n, 0)
+				got, err := tc.scan()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(tc.want, got); diff != "" {
+					t.Errorf("%s: %s", scan, diff)
+				}
+				// The records preceding the start key aren't read.
+				if n := atomic.LoadInt64(&counter.n); n > seg.Size()/4 {
+					t.Errorf("%s: expected less than %d bytes read, got: %d", scan, seg.Size()/4, n)
+				}
+			}
+		})
+	}
+}
+
+func TestDBKeys(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for _, key := range []string{"planet", "name", "age"} {
+		if err = db.Set(key, []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushDB(t, db)
+	// The newer versions shadow the flushed ones.
+	if err = db.Set("name", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete("age"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("city", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"city", "name", "planet"}, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestDBKeysWithPrefix(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithSparseIndexInterval(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for i := 0; i < 100; i++ {
+		for _, ns := range []string{"order:", "user:"} {
+			if err = db.Set(fmt.Sprintf("%s%03d", ns, i), []byte("v1")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	flushDB(t, db)
+	// The memtable keys are merged with the segment ones.
+	if err = db.Set("user:100", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i < 100; i++ {
+		if err = db.Delete(fmt.Sprintf("user:%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := db.KeysWithPrefix("user:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"user:000", "user:001", "user:100"}, got); diff != "" {
+		t.Error(diff)
+	}
+	if got, err = db.KeysWithPrefix("missing:"); err != nil || len(got) != 0 {
+		t.Errorf("expected no keys, got: %q %v", got, err)
+	}
+}
+
+func BenchmarkDBKeysWithPrefix(b *testing.B) {
+	db, close, err := Open(b.TempDir(), WithSparseIndexInterval(4096))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer close()
+
+	for i := 0; i < 100000; i++ {
+		if err = db.Set(fmt.Sprintf("key%06d", i), []byte("value")); err != nil {
+			b.Fatal(err)
+		}
+	}
+	flushDB(b, db)
+
+	b.Run("prefix", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err = db.KeysWithPrefix("key0500"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("all", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err = db.Keys(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestDBForEach(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for _, key := range []string{"planet", "name", "age"} {
+		if err = db.Set(key, []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushDB(t, db)
+	if err = db.Set("name", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete("age"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The writes made by fn aren't visible during the iteration.
+	got := make(map[string]string)
+	err = db.ForEach(func(key string, value []byte) error {
+		got[key] = string(value)
+		return db.Set("zoo", []byte("v1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"name":   "v2",
+		"planet": "v1",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+
+	stop := errors.New("stop")
+	var n int
+	err = db.ForEach(func(key string, value []byte) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("expected ForEach to stop after the first key, got: %d %v", n, err)
+	}
+}
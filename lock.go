@@ -0,0 +1,42 @@
+package hasty
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is a name of the file in the database dir which is locked while the database is open.
+const lockFileName = "LOCK"
+
+// lockFile is a file lock which prevents two processes from writing the same database dir.
+// A database opened for writes holds an exclusive lock, read-only databases share the lock.
+// The lock is advisory and it's released by the OS when the process exits.
+type lockFile struct {
+	f *os.File
+}
+
+// openLockFile acquires a lock on the LOCK file in the database dir,
+// the file is created with the mode permission bits if needed.
+// ErrLocked is returned if the lock is held by another process (or the same process via another DB).
+func openLockFile(dir string, exclusive bool, mode os.FileMode) (*lockFile, error) {
+	path := filepath.Join(dir, lockFileName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, mode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err = lock(f, exclusive); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %q: %w", path, err)
+	}
+	return &lockFile{f: f}, nil
+}
+
+// Close releases the lock.
+func (l *lockFile) Close() error {
+	if err := unlock(l.f); err != nil {
+		l.f.Close()
+		return fmt.Errorf("failed to unlock %q: %w", l.f.Name(), err)
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package hasty
+
+import "os"
+
+// lock is a no-op on platforms that don't support file locking.
+func lock(f *os.File, exclusive bool) error {
+	return nil
+}
+
+// unlock is a no-op on platforms that don't support file locking.
+func unlock(f *os.File) error {
+	return nil
+}
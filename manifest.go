@@ -0,0 +1,92 @@
+package hasty
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// manifestFileName is a name of the file in the database dir which lists the live segments.
+const manifestFileName = "MANIFEST"
+
+// manifest is an authoritative list of the live segment files.
+// It's rewritten every time the database's segments list changes, so the segment files which aren't listed,
+// e.g., a merged segment whose compaction crashed before the manifest was updated,
+// or the merged segments which weren't removed after it, are ignored when the database is opened.
+//
+// The file consists of lines with a segment file name and its level separated by a space,
+// the segments are listed in the order of the database's segments list.
+// The file is written under a temporary name and then renamed, so it's either the old or the new version.
+type manifest struct {
+	// path is a path to the manifest file.
+	path string
+	// mode is the permission bits of the manifest file.
+	mode os.FileMode
+}
+
+// Save replaces the manifest with the list of the segments ss.
+func (m *manifest) Save(ss []*segment) error {
+	tmpPath := m.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, m.mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	for _, s := range ss {
+		fmt.Fprintf(bw, "%s %d\n", filepath.Base(s.path), s.level)
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, m.path); err != nil {
+		return err
+	}
+	// The rename must be durable before the segments which are no longer listed are removed.
+	return syncDir(filepath.Dir(m.path))
+}
+
+// Load returns the segment files listed in the manifest in the order of the database's segments list.
+// The paths are resolved relative to the manifest dir.
+// ErrCorruptRecord is returned if a line can't be parsed.
+func (m *manifest) Load() ([]segmentFile, error) {
+	f, err := os.Open(m.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var files []segmentFile
+	dir := filepath.Dir(m.path)
+	s := bufio.NewScanner(f)
+	for i := 1; s.Scan(); i++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad line %d in %s: %w", i, m.path, ErrCorruptRecord)
+		}
+		_, seq, ok := parseSegmentName(fields[0])
+		level, err := strconv.Atoi(fields[1])
+		if !ok || err != nil || level < 0 {
+			return nil, fmt.Errorf("bad segment at line %d in %s: %w", i, m.path, ErrCorruptRecord)
+		}
+		files = append(files, segmentFile{
+			path:  filepath.Join(dir, fields[0]),
+			level: level,
+			seq:   seq,
+		})
+	}
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", m.path, err)
+	}
+	return files, nil
+}
@@ -0,0 +1,87 @@
+package hasty
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	m := manifest{path: filepath.Join(dir, manifestFileName), mode: DefaultFileMode}
+	ss := []*segment{
+		{path: filepath.Join(dir, "seg-L0-000004")},
+		{path: filepath.Join(dir, "seg-L1-000003"), level: 1},
+		{path: filepath.Join(dir, "seg-000001"), level: 2},
+	}
+	if err := m.Save(ss); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := m.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []segmentFile{
+		{path: ss[0].path, level: 0, seq: 4},
+		{path: ss[1].path, level: 1, seq: 3},
+		{path: ss[2].path, level: 2, seq: 1},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("expected %d files, got: %+v", len(want), files)
+	}
+	for i := range want {
+		if files[i] != want[i] {
+			t.Errorf("expected %+v, got: %+v", want[i], files[i])
+		}
+	}
+	if _, err = os.Stat(m.path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("expected temporary file to be renamed: %v", err)
+	}
+
+	if err = ioutil.WriteFile(m.path, []byte("seg-L0-000004\n"), DefaultFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Load(); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("expected corrupt manifest, got: %v", err)
+	}
+}
+
+func TestOpen_manifest(t *testing.T) {
+	dir := t.TempDir()
+	// The segment was written before the database had a manifest.
+	writeSegment(t, filepath.Join(dir, "seg-000001"), func(seg *segment) error {
+		return encode(seg, &record{key: "name", value: []byte("Alice")})
+	})
+
+	db, close, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+	m := manifest{path: filepath.Join(dir, manifestFileName)}
+	files, err := m.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || filepath.Base(files[0].path) != "seg-000001" {
+		t.Fatalf("expected seg-000001 in manifest, got: %+v", files)
+	}
+
+	// The orphaned segment isn't in the manifest, e.g., a compaction crashed before the manifest was saved.
+	writeSegment(t, filepath.Join(dir, "seg-L1-000002"), func(seg *segment) error {
+		return encode(seg, &record{key: "name", value: []byte("Bob")})
+	})
+	db, close, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	if got, err := db.Get("name"); string(got) != "Alice" || err != nil {
+		t.Errorf("expected Alice, got: %q %v", got, err)
+	}
+}
@@ -0,0 +1,37 @@
+package hasty
+
+import "sync/atomic"
+
+// memMissSlots is a number of keys remembered by memMissCache.
+const memMissSlots = 1024
+
+// memMissCache remembers the keys which weren't found in the memtables along with the memtables generation,
+// so Get of such a key skips memMu until the memtables change, e.g., in a read-heavy workload
+// when all the writes were flushed into the segments.
+// It's a direct-mapped cache: a key replaces another key which maps to the same slot.
+// Note, the cache is concurrency safe.
+type memMissCache struct {
+	slots [memMissSlots]atomic.Value
+}
+
+// memMiss is a key which wasn't found in the memtables of the generation gen.
+type memMiss struct {
+	key string
+	gen uint64
+}
+
+// Add remembers that the key wasn't found in the memtables of the generation gen.
+func (c *memMissCache) Add(key string, gen uint64) {
+	c.slot(key).Store(&memMiss{key: key, gen: gen})
+}
+
+// Has reports whether the key is known to be absent from the memtables of the generation gen.
+func (c *memMissCache) Has(key string, gen uint64) bool {
+	m, _ := c.slot(key).Load().(*memMiss)
+	return m != nil && m.gen == gen && m.key == key
+}
+
+func (c *memMissCache) slot(key string) *atomic.Value {
+	h, _ := bloomHash(key)
+	return &c.slots[h%memMissSlots]
+}
@@ -0,0 +1,71 @@
+package hasty
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDBGet_memMisses(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+
+	// The key is read from the segment, so the next reads skip the memtables.
+	if got := db.MustGet("name"); string(got) != "Alice" {
+		t.Errorf("expected Alice, got: %q", got)
+	}
+	if !db.memMisses.Has("name", atomic.LoadUint64(&db.memGen)) {
+		t.Fatal("expected key to be remembered as absent from memtables")
+	}
+	if got := db.MustGet("name"); string(got) != "Alice" {
+		t.Errorf("expected Alice, got: %q", got)
+	}
+
+	// A write starts a new generation of the memtables, so the key is looked up there again.
+	if err = db.Set("name", []byte("Bob")); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.MustGet("name"); string(got) != "Bob" {
+		t.Errorf("expected Bob, got: %q", got)
+	}
+	if err = db.Delete("name"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Get("name"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", ErrKeyNotFound, err)
+	}
+}
+
+func BenchmarkDBGet_memMisses(b *testing.B) {
+	db, close, err := Open(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer close()
+
+	for i := 0; i < 100; i++ {
+		if err = db.Set(fmt.Sprintf("key%d", i), make([]byte, 100)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	flushDB(b, db)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, err := db.Get(fmt.Sprintf("key%d", i%100)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
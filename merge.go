@@ -5,42 +5,121 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/sync/semaphore"
+
+	"github.com/marselester/hastydb/internal/heap"
 )
 
-// newSegmentMerger creates a segmentMerger that merges segments once at a time.
-func newSegmentMerger(db *DB) *segmentMerger {
-	return &segmentMerger{
-		db:     db,
-		notif:  make(chan struct{}),
-		sem:    semaphore.NewWeighted(1),
-		encode: encode,
-		decode: decode,
+// minMergeSegments is a number of memtables which level 1 is allowed to grow to.
+const minMergeSegments = 2
+
+// newLeveledCompactor creates a LeveledCompactor that merges segments once at a time.
+// A notification received while the compactor is busy is kept, so the segments flushed meanwhile are merged next.
+func newLeveledCompactor(db *DB) *LeveledCompactor {
+	c := LeveledCompactor{
+		db:              db,
+		notif:           make(chan struct{}, 1),
+		sem:             semaphore.NewWeighted(1),
+		compression:     db.cfg.compression,
+		compressions:    db.cfg.levelCompression,
+		progress:        db.cfg.onCompactionProgress,
+		bloomBitsPerKey: db.cfg.bloomBitsPerKey,
+		indexInterval:   db.cfg.sparseIndexInterval,
+		restartInterval: db.cfg.restartInterval,
+		fileMode:        db.cfg.fileMode,
+		directIO:        db.cfg.directIO,
+		levels:          db.cfg.levelCount,
+		multiplier:      db.cfg.levelSizeMultiplier,
+		trigger:         db.cfg.compactionTrigger,
+		baseLevelSize:   int64(db.cfg.maxMemtableSize) * minMergeSegments,
+		maxSegmentSize:  db.cfg.maxSegmentSize,
+		codec:           db.cfg.codec,
+		cmp:             db.cfg.comparator,
+		strategy:        db.cfg.mergeStrategy,
+		split:           split,
+	}
+	c.encode, c.decode = codecFuncs(c.codec)
+	// Level 0 must have a level to be merged into.
+	if c.levels < 2 {
+		c.levels = 2
+	}
+	if c.multiplier < 1 {
+		c.multiplier = 1
 	}
+	if c.trigger < 1 {
+		c.trigger = 1
+	}
+	return &c
 }
 
-// segmentMerger is an actor that is responsible for merging segments in background.
-type segmentMerger struct {
+// LeveledCompactor is an actor that is responsible for merging segments in background using leveled compaction.
+// Level 0 consists of the segments flushed from the memtable, so their key ranges might overlap.
+// The deeper levels are sorted runs: key ranges of their segments don't overlap,
+// and every level is allowed to be multiplier times larger than the previous one.
+// A level that exceeds its target size is merged into the next level, the last level grows without limit.
+type LeveledCompactor struct {
 	db    *DB
 	notif chan struct{}
 	sem   *semaphore.Weighted
-
-	decode func(b []byte) *record
+	// compression defines how blocks of segment files are compressed.
+	compression CompressionCodec
+	// compressions override the compression at the given levels.
+	compressions map[int]CompressionCodec
+	// progress is called as segments are read during compaction, it can be nil.
+	progress func(read, total int64)
+	// bloomBitsPerKey is a number of bits per key in the Bloom filters of segments, zero disables them.
+	bloomBitsPerKey int
+	// indexInterval is a number of bytes of records per indexed key, zero indexes every key.
+	indexInterval int64
+	// restartInterval is a number of records per uncompressed key, see segmentWriter.
+	restartInterval int
+	// fileMode is the permission bits of the merged segment files.
+	fileMode os.FileMode
+	// directIO tells whether the merged segment files bypass the page cache.
+	directIO bool
+	// codec encodes the records of the merged segments, see encode and decode.
+	codec Codec
+	// cmp orders the keys of the merged segments.
+	cmp keyComparator
+	// levels is a number of levels including level 0.
+	levels int
+	// multiplier is how many times every level is larger than the previous one starting from level 1.
+	multiplier int
+	// trigger is a number of level 0 segments when they are merged into level 1.
+	trigger int
+	// baseLevelSize is the target size of level 1 in bytes.
+	baseLevelSize int64
+	// maxSegmentSize is a size of a segment file above which it's merged into the next level, zero disables it.
+	maxSegmentSize int64
+	// strategy defines which version of a key is kept when segments are merged.
+	strategy MergeStrategy
+
+	split  bufio.SplitFunc
+	decode func(b []byte) (*record, error)
 	encode func(out io.Writer, rec *record) error
 }
 
 // Run starts the actor which is stopped by cancelling context.
 // Note, actor will finish its job before exiting or else the database might have partially merged segments.
-func (m *segmentMerger) Run(ctx context.Context) error {
+func (c *LeveledCompactor) Run(ctx context.Context) error {
 	for {
 		select {
-		case <-m.notif:
-			if !m.sem.TryAcquire(1) {
+		case <-c.notif:
+			if !c.sem.TryAcquire(1) {
 				break
 			}
-
-			m.sem.Release(1)
+			// Merge failure doesn't lose data, because the segments stay as they are,
+			// and every merge reads them from the beginning with its own readers,
+			// so the merging is retried on the next notification.
+			if err := c.compactLevels(); err != nil {
+				c.db.cfg.logger.Error("hasty: failed to merge segments", "error", err)
+			}
+			c.sem.Release(1)
 		case <-ctx.Done():
 			return ctx.Err()
 		}
@@ -48,35 +127,373 @@ func (m *segmentMerger) Run(ctx context.Context) error {
 }
 
 // Notify informs the actor to merge segments.
-// Note, if the merger is already busy, it ignores new notifications.
-func (m *segmentMerger) Notify() {
-	m.notif <- struct{}{}
+// Note, if the compactor is already busy, it keeps only one notification.
+func (c *LeveledCompactor) Notify() {
+	select {
+	case c.notif <- struct{}{}:
+	default:
+	}
+}
+
+// compactLevels merges the levels into the next ones until every level fits its target size.
+func (c *LeveledCompactor) compactLevels() error {
+	for {
+		ss := c.db.segments.Load().([]*segment)
+		segs, level := c.pick(ss)
+		if segs == nil {
+			return nil
+		}
+		c.db.cfg.logger.Debug(
+			"hasty: compaction triggered",
+			"level", level, "score", c.score(ss, level), "target", c.targetSize(level), "segments", len(segs),
+		)
+
+		// The merged segment's sequence number is allocated before segments are flushed in the meantime,
+		// so it stays older than them.
+		segPath := c.db.nextSegmentPath(level + 1)
+		if err := c.compact(context.Background(), segs, level+1, segPath); err != nil {
+			os.Remove(segPath)
+			os.Remove(segPath + indexFileSuffix)
+			return err
+		}
+	}
+}
+
+// targetSize returns the size the level is allowed to grow to.
+// Level 0 is measured in segments, because reads check every one of them.
+// The other levels are measured in bytes.
+func (c *LeveledCompactor) targetSize(level int) int64 {
+	if level == 0 {
+		return int64(c.trigger)
+	}
+	size := c.baseLevelSize
+	for i := 1; i < level; i++ {
+		size *= int64(c.multiplier)
+	}
+	return size
+}
+
+// score returns the ratio of the actual level size to its target size.
+// The level needs to be compacted when its score is at least 1.
+func (c *LeveledCompactor) score(ss []*segment, level int) float64 {
+	var size int64
+	for _, s := range ss {
+		switch {
+		case s.level != level:
+		case level == 0:
+			size++
+		default:
+			size += s.Size()
+		}
+	}
+	return float64(size) / float64(c.targetSize(level))
+}
+
+// pick chooses the segments to be merged into the next level from the level with the highest score.
+// Level 0 segments are merged all at once because their key ranges overlap.
+// From the other levels the segment with the lowest score is chosen,
+// i.e., it overlaps the fewest bytes of the next level relative to its own size, so it's the cheapest to merge.
+// Otherwise a segment larger than the max segment size is chosen from the lowest level.
+// The chosen segments are returned along with the overlapping segments of the next level
+// ordered from the newest to the oldest. No segments are returned if no level needs compaction.
+func (c *LeveledCompactor) pick(ss []*segment) (segs []*segment, level int) {
+	// The last level can't be merged further.
+	var best float64
+	level = -1
+	for l := 0; l < c.levels-1; l++ {
+		if score := c.score(ss, l); score >= 1 && score > best {
+			best, level = score, l
+		}
+	}
+	if level == -1 {
+		return c.pickOversized(ss)
+	}
+
+	var lowest float64
+	for _, s := range ss {
+		switch {
+		case s.level != level:
+		case level == 0:
+			segs = append(segs, s)
+		default:
+			score := float64(overlapSize(ss, level+1, s.minKey, s.maxKey)) / float64(s.Size()+1)
+			if segs == nil || score < lowest {
+				segs, lowest = []*segment{s}, score
+			}
+		}
+	}
+	return appendOverlaps(segs, ss, level+1), level
+}
+
+// pickOversized chooses a segment larger than the max segment size from the lowest level except the last one,
+// so it's merged into the next level even though its level doesn't need compaction.
+// Like in pick, level 0 segments are merged all at once.
+// No segments are returned if there is no such segment.
+func (c *LeveledCompactor) pickOversized(ss []*segment) (segs []*segment, level int) {
+	if c.maxSegmentSize <= 0 {
+		return nil, -1
+	}
+	var oversized *segment
+	for _, s := range ss {
+		if s.level < c.levels-1 && s.fileSize > c.maxSegmentSize && (oversized == nil || s.level < oversized.level) {
+			oversized = s
+		}
+	}
+	if oversized == nil {
+		return nil, -1
+	}
+
+	level = oversized.level
+	if level != 0 {
+		return appendOverlaps([]*segment{oversized}, ss, level+1), level
+	}
+	for _, s := range ss {
+		if s.level == 0 {
+			segs = append(segs, s)
+		}
+	}
+	return appendOverlaps(segs, ss, 1), 0
 }
 
-// merge opens the oldest segments to merge and compact them.
-// The resulting segment is written on disk.
-func (m *segmentMerger) merge() (err error) {
-	s0, _ := openReadonlySegment("seg0")
-	defer s0.Close()
+// appendOverlaps appends the segments of the level from ss which overlap the key range of segs.
+func appendOverlaps(segs, ss []*segment, level int) []*segment {
+	min, max := keyRange(segs)
+	for _, s := range ss {
+		if s.level == level && s.Overlaps(min, max) {
+			segs = append(segs, s)
+		}
+	}
+	return segs
+}
+
+// overlapSize returns the total size of the level segments which overlap the key range [min, max].
+func overlapSize(ss []*segment, level int, min, max string) int64 {
+	var size int64
+	for _, s := range ss {
+		if s.level == level && s.Overlaps(min, max) {
+			size += s.Size()
+		}
+	}
+	return size
+}
+
+// keyRange returns the key range spanned by the segments.
+// Empty max key is returned if a key range of any segment is unknown.
+func keyRange(segs []*segment) (min, max string) {
+	for i, s := range segs {
+		if s.maxKey == "" {
+			return "", ""
+		}
+		if i == 0 || s.cmp.Compare(s.minKey, min) < 0 {
+			min = s.minKey
+		}
+		if i == 0 || s.cmp.Compare(s.maxKey, max) > 0 {
+			max = s.maxKey
+		}
+	}
+	return min, max
+}
 
-	s1, _ := openReadonlySegment("seg1")
-	defer s1.Close()
+// compact merges the given database segments into a new segment written at outputPath
+// and puts it at the given level in the database's segments list instead of them.
+// Segments must be ordered as in the list (from the newest to the oldest).
+// The merged segment goes after the segments of the lower levels including those flushed in the meantime,
+// and it's ordered by its smallest key among the segments of its level.
+// Tombstones are dropped unless the older segments overlap the merged keys,
+// because then there are no older versions of the keys left.
+// The merging stops early if ctx is cancelled, then the segments stay as they are.
+func (c *LeveledCompactor) compact(ctx context.Context, segs []*segment, level int, outputPath string) error {
+	if len(segs) == 0 {
+		return nil
+	}
+	start := time.Now()
 
-	combined, _ := openWriteonlySegment("seg2")
+	// Merging segments in a wrong order would resurrect old values.
+	ss := c.db.segments.Load().([]*segment)
+	pos, err := segmentsPosition(ss, segs)
+	if err != nil {
+		return err
+	}
+	min, max := keyRange(segs)
+	dropTombstones := true
+	for _, s := range ss[pos:] {
+		if !containsSegment(segs, s) && s.Overlaps(min, max) {
+			dropTombstones = false
+			break
+		}
+	}
+	// The number of keys of the segments is estimated, because their indices might be sparse.
+	var keys uint64
+	for _, s := range segs {
+		if s.sketch != nil {
+			keys += s.sketch.Count()
+		}
+	}
+	c.db.cfg.logger.Info(
+		"hasty: merging segments",
+		"level", level, "segments", len(segs), "estimated_keys", keys, "drop_tombstones", dropTombstones,
+	)
+	if err = c.merge(ctx, segs, level, outputPath, dropTombstones); err != nil {
+		return err
+	}
+	merged, err := openReadonlySegment(outputPath, c.codec, c.cmp)
+	if err != nil {
+		return fmt.Errorf("failed to open %q segment: %w", outputPath, err)
+	}
+	if c.directIO {
+		if err = merged.useDirectIO(); err != nil {
+			merged.Close()
+			return fmt.Errorf("failed to open %q segment: %w", outputPath, err)
+		}
+	}
+	merged.level = level
+	// The keys of the merged segment are known from its index.
+	if c.bloomBitsPerKey > 0 {
+		merged.bloom = newBloomFilterBitsPerKey(len(merged.index), c.bloomBitsPerKey)
+		for key := range merged.index {
+			merged.bloom.Add(key)
+		}
+	}
+	merged.buildSketch()
+	mergedKeys := len(merged.index)
+	if c.indexInterval > 0 {
+		if err = merged.LoadSparseIndex(c.indexInterval); err != nil {
+			merged.Close()
+			return fmt.Errorf("failed to index %q segment: %w", outputPath, err)
+		}
+	}
+
+	// The merged segment file is synced by merge, and its directory entry must be on disk as well
+	// before the merged segments are removed.
+	if err = syncDir(filepath.Dir(outputPath)); err != nil {
+		merged.Close()
+		return fmt.Errorf("failed to sync %q segment dir: %w", outputPath, err)
+	}
+
+	c.db.segMu.Lock()
+	defer c.db.segMu.Unlock()
+
+	// New segments might have been flushed in the meantime which shifts the merged segments.
+	current := c.db.segments.Load().([]*segment)
+	if _, err = segmentsPosition(current, segs); err != nil {
+		merged.Close()
+		return err
+	}
+	atomic.AddUint64(&c.db.metrics.compactions, 1)
+	c.db.prom.compactionDuration.Observe(time.Since(start).Seconds())
+
+	ss = make([]*segment, 0, len(current)-len(segs)+1)
+	for _, s := range current {
+		if !containsSegment(segs, s) {
+			ss = append(ss, s)
+		}
+	}
+	// All the records might have been tombstones which were dropped.
+	empty := merged.Size() == 0
+	if !empty {
+		ss = insertSegment(ss, merged)
+	}
+	// The merged segments become orphans once the manifest doesn't list them, so they can be removed.
+	if err = c.db.manifest.Save(ss); err != nil {
+		merged.Close()
+		return fmt.Errorf("failed to save manifest: %w", err)
+	}
+	if empty {
+		merged.Close()
+		os.Remove(outputPath)
+		os.Remove(outputPath + indexFileSuffix)
+	}
+	c.db.setSegments(ss)
+	// The merged segments are removed once the readers which loaded them earlier are done.
+	for _, s := range segs {
+		s.retire()
+	}
+	c.db.cfg.logger.Info(
+		"hasty: merged segments",
+		"level", level, "segment", outputPath, "keys", mergedKeys, "size", merged.fileSize, "duration", time.Since(start),
+	)
+	return nil
+}
+
+// segmentsPosition returns the position of the first of segs in the database's segments list ss.
+// An error is returned unless all segs are found there in the same order (newest first).
+func segmentsPosition(ss, segs []*segment) (int, error) {
+	pos := -1
+	i := 0
+	for j := range ss {
+		if i < len(segs) && ss[j] == segs[i] {
+			if i == 0 {
+				pos = j
+			}
+			i++
+		}
+	}
+	switch {
+	case pos == -1:
+		return -1, fmt.Errorf("segments are not found in the database")
+	case i != len(segs):
+		return -1, fmt.Errorf("segments must be ordered from the newest to the oldest")
+	}
+	return pos, nil
+}
+
+// containsSegment returns true if s is one of segs.
+func containsSegment(segs []*segment, s *segment) bool {
+	for i := range segs {
+		if segs[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+// insertSegment inserts seg into the segments list ss after the segments of the lower levels.
+// Within level 0 the segments are ordered from the newest to the oldest,
+// and within the other levels they are ordered by their keys.
+func insertSegment(ss []*segment, seg *segment) []*segment {
+	i := 0
+	for ; i < len(ss); i++ {
+		if ss[i].level > seg.level || ss[i].level == seg.level && seg.level > 0 && seg.cmp.Compare(ss[i].minKey, seg.minKey) > 0 {
+			break
+		}
+	}
+	ss = append(ss, nil)
+	copy(ss[i+1:], ss[i:])
+	ss[i] = seg
+	return ss
+}
+
+// merge merges and compacts the given segments into a new segment of the level written on disk at outputPath.
+// Segments must be ordered from the newest to the oldest as in the database's segments list,
+// because records from the former segments take precedence over the latter ones.
+// Tombstones are kept unless dropTombstones is set.
+// The compaction progress is reported by the number of bytes read from the segments.
+// The segments aren't read anymore once ctx is cancelled, and its error is returned.
+func (c *LeveledCompactor) merge(ctx context.Context, segs []*segment, level int, outputPath string, dropTombstones bool) (err error) {
+	combined, err := openWriteonlySegment(outputPath, c.fileMode, c.directIO)
+	if err != nil {
+		return fmt.Errorf("failed to open %q segment: %w", outputPath, err)
+	}
 	defer combined.Close()
+	combined.cmp = c.cmp
 
-	streams := []*bufio.Scanner{
-		bufio.NewScanner(s0),
-		bufio.NewScanner(s1),
+	progress := progressReporter{
+		report: c.progress,
+	}
+	for i := range segs {
+		progress.total += segs[i].Size()
 	}
-	for i := range streams {
-		streams[i].Split(split)
+	streams := make([]*bufio.Scanner, len(segs))
+	for i := range segs {
+		streams[i] = bufio.NewScanner(progress.reader(contextReader(ctx, segs[i].newStreamReader())))
+		streams[i].Split(c.split)
 	}
-	if err = m.mergeStreams(combined, streams...); err != nil {
+	sw := newSegmentWriter(combined, levelCompression(c.compressions, level, c.compression))
+	sw.restartInterval = c.restartInterval
+	if err = c.mergeStreams(sw, dropTombstones, streams...); err != nil {
 		return fmt.Errorf("failed to merge segment streams: %w", err)
 	}
-
-	if err = combined.Flush(); err != nil {
+	if err = sw.Flush(); err != nil {
 		return fmt.Errorf("failed to flush compacted segment: %w", err)
 	}
 
@@ -84,9 +501,16 @@ func (m *segmentMerger) merge() (err error) {
 }
 
 // merge merges and compacts multiple sorted streams into one sorted stream using min priority queue.
-func (m *segmentMerger) mergeStreams(out io.Writer, streams ...*bufio.Scanner) (err error) {
-	pq := newIndexMinHeap(len(streams))
-
+// Streams must be ordered from the newest to the oldest: streams[0] is the newest segment,
+// so its records take precedence over the records with the same keys from the other streams.
+// Tombstones are kept unless dropTombstones is set.
+func (c *LeveledCompactor) mergeStreams(out io.Writer, dropTombstones bool, streams ...*bufio.Scanner) (err error) {
+	pq := heap.NewIndexMinHeap(len(streams), c.cmp.recordLess)
+	// prevKeys are the last keys read from each stream to restore prefix-compressed keys.
+	prevKeys := make([]string, len(streams))
+
+	// The records are decoded from copies of the tokens, because a stream reuses its buffer on the next Scan
+	// while the record is still referenced by the priority queue or prev.
 	// Fill the priority queue with the first records from each stream.
 	var rec *record
 	var i int
@@ -95,7 +519,13 @@ func (m *segmentMerger) mergeStreams(out io.Writer, streams ...*bufio.Scanner) (
 			continue
 		}
 
-		rec = m.decode(streams[i].Bytes())
+		if rec, err = c.decode(append([]byte(nil), streams[i].Bytes()...)); err != nil {
+			return fmt.Errorf("failed to decode %d stream: %w", i, err)
+		}
+		if err = rec.restoreKey(prevKeys[i]); err != nil {
+			return fmt.Errorf("failed to decode %d stream: %w", i, err)
+		}
+		prevKeys[i] = rec.key
 		rec.order = i
 		pq.Insert(i, rec)
 	}
@@ -103,30 +533,45 @@ func (m *segmentMerger) mergeStreams(out io.Writer, streams ...*bufio.Scanner) (
 	var prev *record
 	for pq.Size() != 0 {
 		// Take the smallest record from the priority queue (the min of all streams).
+		// Equal keys are taken in the order of streams, so the newest version comes first.
 		i, rec = pq.Min()
 
-		// Keep only last version of a key (segment compaction).
-		if prev == nil {
+		// Keep only one version of a key (segment compaction), by default it's the newest one, see MergeStrategy.
+		// Tombstones are kept because older versions of the key might reside in other segments.
+		switch {
+		case prev == nil:
 			prev = rec
-		}
-		if prev.key != rec.key {
-			if err = m.encode(out, prev); err != nil {
-				return fmt.Errorf("failed to encode record: %w", err)
+		case prev.key != rec.key:
+			if err = c.write(out, prev, dropTombstones); err != nil {
+				return err
 			}
 			prev = rec
+		// A key repeated within the same stream was appended later, hence it's newer.
+		case prev.order == rec.order:
+			prev = c.strategy.resolve(prev, rec)
+		// Otherwise rec is an older version of the key from an older stream.
+		default:
+			prev = c.strategy.resolve(rec, prev)
 		}
-		prev.value = rec.value
 
 		// Refill the priority queue from the stream where min record was found, unless this stream is exhausted.
 		if !streams[i].Scan() {
 			continue
 		}
-		rec = m.decode(streams[i].Bytes())
+		if rec, err = c.decode(append([]byte(nil), streams[i].Bytes()...)); err != nil {
+			return fmt.Errorf("failed to decode %d stream: %w", i, err)
+		}
+		if err = rec.restoreKey(prevKeys[i]); err != nil {
+			return fmt.Errorf("failed to decode %d stream: %w", i, err)
+		}
+		prevKeys[i] = rec.key
 		rec.order = i
 		pq.Insert(i, rec)
 	}
-	if err = m.encode(out, prev); err != nil {
-		return fmt.Errorf("failed to encode record: %w", err)
+	if prev != nil {
+		if err = c.write(out, prev, dropTombstones); err != nil {
+			return err
+		}
 	}
 
 	for i = range streams {
@@ -137,103 +582,108 @@ func (m *segmentMerger) mergeStreams(out io.Writer, streams ...*bufio.Scanner) (
 	return nil
 }
 
-// indexMinHeap is a binary heap that allows clients to refer to items on priority queue.
-// The number of compares required is proportional to at most log n for "insert" and "remove the minimum" operations.
-type indexMinHeap struct {
-	// n is number of elements on priority queue.
-	n int
-	// pq is a binary heap using 1-based indexing.
-	pq []int
-	// qp is inverse of pq: qp[pq[i]] = pq[qp[i]] = i.
-	qp []int
-	// items holds items with priorities: items[i] = priority of i.
-	items []*record
+// MergeStrategy defines which version of a key is kept when compaction merges the segments
+// containing multiple versions of the key.
+// Note, the strategy is applied only by compaction: the reads return the newest version of a key
+// until its versions are merged, and a key written again before the memtable is flushed keeps the last write.
+type MergeStrategy struct {
+	firstWins bool
+	// merge combines the values of the older and the newer versions of the key, nil means no merging.
+	merge func(key string, older, newer []byte) []byte
 }
 
-// newIndexMinHeap creates a binary heap of size n to prioritize min items.
-func newIndexMinHeap(n int) *indexMinHeap {
-	h := indexMinHeap{
-		pq:    make([]int, n+1),
-		qp:    make([]int, n+1),
-		items: make([]*record, n+1),
-	}
-	for i := 0; i <= n; i++ {
-		h.qp[i] = -1
-	}
-	return &h
-}
+var (
+	// MergeStrategyLastWriteWins keeps the newest version of a key, it's the default.
+	MergeStrategyLastWriteWins = MergeStrategy{}
+	// MergeStrategyFirstWriteWins keeps the oldest version of a key including a tombstone.
+	MergeStrategyFirstWriteWins = MergeStrategy{firstWins: true}
+)
 
-// Insert adds the new item and associates it with index i.
-// Think of it as pq[i] = item.
-func (h *indexMinHeap) Insert(i int, item *record) {
-	h.n++
-	h.qp[i] = h.n
-	h.pq[h.n] = i
-	h.items[i] = item
-	h.swim(h.n)
+// MergeStrategyCustom combines the versions of a key with fn which gets the values of the older and the newer versions
+// and returns the value to keep, e.g., the numerically largest one for CRDT-like counters.
+// The versions are combined pairwise as the segments are merged level by level,
+// so fn must be associative, i.e., fn(fn(a, b), c) must be equal to fn(a, fn(b, c)).
+// The newest version is kept as is if it's a tombstone or either version expires
+// or is stored in the value log, see WithValueLogThreshold.
+func MergeStrategyCustom(fn func(key string, older, newer []byte) []byte) MergeStrategy {
+	return MergeStrategy{merge: fn}
 }
 
-// Min takes the smallest item off the top.
-// Note, the first returned value is the index associated with the item.
-func (h *indexMinHeap) Min() (int, *record) {
-	if h.Size() == 0 {
-		return -1, nil
+// resolve returns the version of the key to keep given its older and newer versions.
+func (s MergeStrategy) resolve(older, newer *record) *record {
+	switch {
+	case s.firstWins:
+		return older
+	case s.merge == nil:
+		return newer
+	case older.deleted || newer.deleted || older.pointer || newer.pointer || older.hasExpiry() || newer.hasExpiry():
+		return newer
+	}
+	return &record{
+		key:   newer.key,
+		value: s.merge(newer.key, older.value, newer.value),
+		order: newer.order,
 	}
-
-	indexOfMin := h.pq[1]
-	min := h.items[indexOfMin]
-
-	h.exchange(1, h.n)
-	h.n--
-	h.sink(1)
-
-	h.items[indexOfMin] = nil // blank item
-	h.qp[indexOfMin] = -1
-	h.pq[h.n+1] = -1
-
-	return indexOfMin, min
-}
-
-// Size returns size of the heap.
-func (h *indexMinHeap) Size() int {
-	return h.n
 }
 
-func (h *indexMinHeap) greater(i, j int) bool {
-	if h.items[h.pq[i]].key > h.items[h.pq[j]].key {
-		return true
+// write writes the record into the merged segment unless it's a tombstone which should be dropped.
+// An expired record is treated as a tombstone: its value is discarded,
+// but the key still shadows its older versions unless tombstones are dropped.
+func (c *LeveledCompactor) write(out io.Writer, rec *record, dropTombstones bool) error {
+	if rec.expired(time.Now().UnixNano()) {
+		rec = &record{key: rec.key, deleted: true}
 	}
-	if h.items[h.pq[i]].key == h.items[h.pq[j]].key {
-		return h.items[h.pq[i]].order > h.items[h.pq[j]].order
+	if rec.deleted && dropTombstones {
+		return nil
 	}
-	return false
+	rec = beginRecord(out, rec)
+	if err := c.encode(out, rec); err != nil {
+		return fmt.Errorf("failed to encode record: %w", err)
+	}
+	if err := endRecord(out); err != nil {
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+	return nil
 }
 
-func (h *indexMinHeap) exchange(i, j int) {
-	swap := h.pq[i]
-	h.pq[i] = h.pq[j]
-	h.pq[j] = swap
-	h.qp[h.pq[i]] = i
-	h.qp[h.pq[j]] = j
+// progressReporter reports how many bytes were read out of total from multiple readers.
+type progressReporter struct {
+	read   int64
+	total  int64
+	report func(read, total int64)
 }
 
-func (h *indexMinHeap) swim(k int) {
-	for k > 1 && h.greater(k/2, k) {
-		h.exchange(k, k/2)
-		k = k / 2
+// reader wraps r to report the progress of reading it.
+func (p *progressReporter) reader(r io.Reader) io.Reader {
+	if p.report == nil {
+		return r
 	}
+	return readerFunc(func(b []byte) (int, error) {
+		n, err := r.Read(b)
+		if n > 0 {
+			p.read += int64(n)
+			p.report(p.read, p.total)
+		}
+		return n, err
+	})
 }
 
-func (h *indexMinHeap) sink(k int) {
-	for 2*k <= h.n {
-		j := 2 * k
-		if j < h.n && h.greater(j, j+1) {
-			j++
-		}
-		if !h.greater(k, j) {
-			break
-		}
-		h.exchange(k, j)
-		k = j
+// contextReader wraps r to fail the reads with the ctx error once ctx is cancelled.
+func contextReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		return r
 	}
+	return readerFunc(func(b []byte) (int, error) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return r.Read(b)
+	})
+}
+
+// readerFunc is an adapter to allow the use of ordinary functions as io.Reader.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
 }
@@ -3,23 +3,29 @@ package hasty
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
-func TestSegmentMerger(t *testing.T) {
+func TestLeveledCompactor(t *testing.T) {
 	tests := map[string]struct {
 		segments []string
 		want     string
 	}{
 		"databass.dev": {
 			[]string{
-				"k2:v1 k4:v2",
 				"k1:v3 k2:v4 k3:v5",
+				"k2:v1 k4:v2",
 			},
 			`
 k1:v3
@@ -29,9 +35,9 @@ k4:v2`,
 		},
 		"algs4.cs.princeton.edu": {
 			[]string{
-				"A:1 B:1 C:1 F:1 G:1 I:1 I:2 Z:1",
-				"B:2 D:1 H:1 P:1 Q:1 Q:2",
 				"A:2 B:3 E:1 F:2 J:1 N:1",
+				"B:2 D:1 H:1 P:1 Q:1 Q:2",
+				"A:1 B:1 C:1 F:1 G:1 I:1 I:2 Z:1",
 			},
 			`
 A:2
@@ -51,9 +57,9 @@ Z:1`,
 		},
 		"dataintensive.net": {
 			[]string{
-				"handbag:8786 handful:40308 handicap:65995 handkerchief:16324 handlebars:3869 handprinted:11150",
-				"handcuffs:2729 handful:42307 handicap:67884 handiwork:16912 handkerchief:20952 handprinted:15725",
 				"handful:44662 handicap:70836 handiwork:45521 handlebars:3869 handoff:5741 handprinted:33632",
+				"handcuffs:2729 handful:42307 handicap:67884 handiwork:16912 handkerchief:20952 handprinted:15725",
+				"handbag:8786 handful:40308 handicap:65995 handkerchief:16324 handlebars:3869 handprinted:11150",
 			},
 			`
 handbag:8786
@@ -68,9 +74,10 @@ handprinted:33632`,
 		},
 	}
 
-	sm := segmentMerger{
-		decode: plainDecode,
-		encode: plainEncode,
+	sm := LeveledCompactor{
+		fileMode: DefaultFileMode,
+		decode:   plainDecode,
+		encode:   plainEncode,
 	}
 
 	for name, tc := range tests {
@@ -82,7 +89,7 @@ handprinted:33632`,
 			}
 
 			var out bytes.Buffer
-			err := sm.mergeStreams(&out, streams...)
+			err := sm.mergeStreams(&out, false, streams...)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -94,15 +101,38 @@ handprinted:33632`,
 	}
 }
 
-func TestSegmentMerger_mergeStreams(t *testing.T) {
+func TestLeveledCompactor_newestStreamWins(t *testing.T) {
+	sm := LeveledCompactor{
+		fileMode: DefaultFileMode,
+		decode:   plainDecode,
+		encode:   plainEncode,
+	}
+	streams := []*bufio.Scanner{
+		bufio.NewScanner(strings.NewReader("k:new")),
+		bufio.NewScanner(strings.NewReader("k:old")),
+	}
+	for i := range streams {
+		streams[i].Split(bufio.ScanWords)
+	}
+
+	var out bytes.Buffer
+	if err := sm.mergeStreams(&out, false, streams...); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("\nk:new", out.String()); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestLeveledCompactor_mergeStreams(t *testing.T) {
 	tests := map[string]struct {
 		segments []string
 		want     string
 	}{
 		"databass.dev": {
 			[]string{
-				"k2:v1 k4:v2",
 				"k1:v3 k2:v4 k3:v5",
+				"k2:v1 k4:v2",
 			},
 			`
 k1:v3
@@ -112,9 +142,9 @@ k4:v2`,
 		},
 		"algs4.cs.princeton.edu": {
 			[]string{
-				"A:1 B:1 C:1 F:1 G:1 I:1 I:2 Z:1",
-				"B:2 D:1 H:1 P:1 Q:1 Q:2",
 				"A:2 B:3 E:1 F:2 J:1 N:1",
+				"B:2 D:1 H:1 P:1 Q:1 Q:2",
+				"A:1 B:1 C:1 F:1 G:1 I:1 I:2 Z:1",
 			},
 			`
 A:2
@@ -134,9 +164,9 @@ Z:1`,
 		},
 		"dataintensive.net": {
 			[]string{
-				"handbag:8786 handful:40308 handicap:65995 handkerchief:16324 handlebars:3869 handprinted:11150",
-				"handcuffs:2729 handful:42307 handicap:67884 handiwork:16912 handkerchief:20952 handprinted:15725",
 				"handful:44662 handicap:70836 handiwork:45521 handlebars:3869 handoff:5741 handprinted:33632",
+				"handcuffs:2729 handful:42307 handicap:67884 handiwork:16912 handkerchief:20952 handprinted:15725",
+				"handbag:8786 handful:40308 handicap:65995 handkerchief:16324 handlebars:3869 handprinted:11150",
 			},
 			`
 handbag:8786
@@ -151,22 +181,23 @@ handprinted:33632`,
 		},
 	}
 
-	sm := segmentMerger{
-		decode: plainDecode,
-		encode: plainEncode,
+	sm := LeveledCompactor{
+		fileMode: DefaultFileMode,
+		decode:   plainDecode,
+		encode:   plainEncode,
 	}
 	segName := "testdata/mergedsegment"
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			seg, err := openWriteonlySegment(segName)
+			seg, err := openWriteonlySegment(segName, DefaultFileMode, false)
 			if err != nil {
 				t.Fatal(err)
 			}
 			seg.encode = plainEncode
 			t.Cleanup(func() {
 				if err := os.Remove(segName); err != nil {
-					t.Errorf("failed to remove %q segment: %w", segName, err)
+					t.Errorf("failed to remove %q segment: %v", segName, err)
 				}
 			})
 
@@ -176,7 +207,7 @@ handprinted:33632`,
 				streams[i].Split(bufio.ScanWords)
 			}
 
-			if err = sm.mergeStreams(seg, streams...); err != nil {
+			if err = sm.mergeStreams(seg, false, streams...); err != nil {
 				t.Fatal(err)
 			}
 			if err = seg.Flush(); err != nil {
@@ -186,13 +217,920 @@ handprinted:33632`,
 				t.Fatal(err)
 			}
 
-			got, err := ioutil.ReadFile(segName)
-			if err != nil {
+			got := readSegmentBody(t, segName)
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Fatalf(diff)
+			}
+		})
+	}
+}
+
+func TestLeveledCompactor_mergeStreams_expired(t *testing.T) {
+	past := time.Now().Add(-time.Minute).UnixNano()
+	future := time.Now().Add(time.Hour).UnixNano()
+	newer := []record{
+		{key: "a", value: []byte("1"), expiresAt: past},
+		{key: "b", value: []byte("2"), expiresAt: future},
+	}
+	older := []record{
+		{key: "a", value: []byte("0")},
+		{key: "c", value: []byte("3"), expiresAt: past},
+	}
+
+	tests := map[string]struct {
+		dropTombstones bool
+		want           []record
+	}{
+		"keep tombstones": {
+			false,
+			[]record{
+				{key: "a", deleted: true},
+				{key: "b", value: []byte("2"), expiresAt: future},
+				{key: "c", deleted: true},
+			},
+		},
+		"drop tombstones": {
+			true,
+			[]record{
+				{key: "b", value: []byte("2"), expiresAt: future},
+			},
+		},
+	}
+
+	sm := LeveledCompactor{
+		fileMode: DefaultFileMode,
+		decode:   decode,
+		encode:   encode,
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			streams := make([]*bufio.Scanner, 2)
+			for i, recs := range [][]record{newer, older} {
+				var b bytes.Buffer
+				for j := range recs {
+					if err := encode(&b, &recs[j]); err != nil {
+						t.Fatal(err)
+					}
+				}
+				streams[i] = bufio.NewScanner(&b)
+				streams[i].Split(split)
+			}
+
+			var out bytes.Buffer
+			if err := sm.mergeStreams(&out, tc.dropTombstones, streams...); err != nil {
 				t.Fatal(err)
 			}
+
+			var got []record
+			sc := bufio.NewScanner(&out)
+			sc.Split(split)
+			for sc.Scan() {
+				rec, err := decode(sc.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, *rec)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(record{}), cmpopts.EquateEmpty()); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestLeveledCompactor_merge(t *testing.T) {
+	tests := map[string]struct {
+		segments []string
+		want     string
+	}{
+		"one segment": {
+			[]string{
+				"k1:v1 k2:v2 k3:v3",
+			},
+			`
+k1:v1
+k2:v2
+k3:v3`,
+		},
+		"five segments": {
+			[]string{
+				"A:3 N:1 Z:2",
+				"C:2 F:2 J:1",
+				"A:2 B:3 E:1",
+				"B:2 D:1 H:1",
+				"A:1 C:1 F:1 Z:1",
+			},
+			`
+A:3
+B:3
+C:2
+D:1
+E:1
+F:2
+H:1
+J:1
+N:1
+Z:2`,
+		},
+	}
+
+	sm := LeveledCompactor{
+		fileMode: DefaultFileMode,
+		split:    bufio.ScanWords,
+		decode:   plainDecode,
+		encode:   plainEncode,
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			segs := make([]*segment, len(tc.segments))
+			for i, s := range tc.segments {
+				segPath := filepath.Join(dir, fmt.Sprintf("seg%d", i))
+				if err := ioutil.WriteFile(segPath, []byte(s), 0600); err != nil {
+					t.Fatal(err)
+				}
+
+				seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer seg.Close()
+				segs[i] = seg
+			}
+
+			segPath := filepath.Join(dir, "merged")
+			if err := sm.merge(context.Background(), segs, 1, segPath, false); err != nil {
+				t.Fatal(err)
+			}
+
+			got := readSegmentBody(t, segPath)
 			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
 				t.Fatalf(diff)
 			}
 		})
 	}
 }
+
+func TestLeveledCompactor_compact(t *testing.T) {
+	dir := t.TempDir()
+	db, close, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// Segment A was flushed first, then B overwrote the key, and C was flushed while A and B were compacted.
+	var segs []*segment
+	for _, s := range []string{"x:9", "k:2", "k:1"} {
+		segPath := filepath.Join(dir, fmt.Sprintf("seg%d", len(segs)))
+		if err = ioutil.WriteFile(segPath, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+		seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer seg.Close()
+		segs = append(segs, seg)
+	}
+	db.setSegments(segs)
+
+	sm := LeveledCompactor{
+		fileMode: DefaultFileMode,
+		db:       db,
+		split:    bufio.ScanWords,
+		decode:   plainDecode,
+		encode:   plainEncode,
+	}
+	mergedPath := filepath.Join(dir, "merged")
+	if err = sm.compact(context.Background(), segs[1:], 1, mergedPath); err != nil {
+		t.Fatal(err)
+	}
+
+	ss := db.segments.Load().([]*segment)
+	if len(ss) != 2 {
+		t.Fatalf("expected 2 segments, got: %d", len(ss))
+	}
+	if ss[0] != segs[0] {
+		t.Errorf("expected the newest segment %s to stay first, got: %s", segs[0].path, ss[0].path)
+	}
+	if ss[1].path != mergedPath {
+		t.Fatalf("expected the merged segment second, got: %s", ss[1].path)
+	}
+	defer ss[1].Close()
+	if _, ok := ss[1].index["k"]; !ok {
+		t.Error("expected merged segment to index k")
+	}
+
+	got, err := ioutil.ReadAll(ss[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("\nk:2", string(got)); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestLeveledCompactor_Run(t *testing.T) {
+	dir := t.TempDir()
+	db, close, err := Open(dir, WithCompactionTrigger(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	db.compactor.split = bufio.ScanWords
+	db.compactor.decode = plainDecode
+	db.compactor.encode = plainEncode
+
+	var segs []*segment
+	for i, s := range []string{"k:2 x", "k:1 x:9"} {
+		segPath := filepath.Join(dir, fmt.Sprintf("seg%d", i+1))
+		if err = ioutil.WriteFile(segPath, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+		seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer seg.Close()
+		segs = append(segs, seg)
+	}
+	db.setSegments(segs)
+
+	db.startCompactor()
+	db.compactor.Notify()
+
+	var ss []*segment
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if ss = db.segments.Load().([]*segment); len(ss) == 1 {
+			break
+		}
+	}
+	if len(ss) != 1 {
+		t.Fatalf("expected segments to be merged into 1, got: %d", len(ss))
+	}
+	defer ss[0].Close()
+
+	got, err := ioutil.ReadAll(ss[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("\nk:2", string(got)); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestDB_compactionTrigger(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for i := 0; i < DefaultCompactionTrigger; i++ {
+		if err = db.Set(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		flushDB(t, db)
+		if i == DefaultCompactionTrigger-1 {
+			break
+		}
+		// Level 0 is below the trigger, so there is nothing to merge yet.
+		if segs, _ := db.compactor.pick(db.segments.Load().([]*segment)); segs != nil {
+			t.Fatalf("expected no compaction with %d segments, got: %d segments picked", i+1, len(segs))
+		}
+	}
+
+	var ss []*segment
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if ss = db.segments.Load().([]*segment); len(ss) == 1 {
+			break
+		}
+	}
+	if len(ss) != 1 || ss[0].level != 1 {
+		t.Fatalf("expected level 0 segments to be merged into 1 segment of level 1, got: %d", len(ss))
+	}
+	for i := 0; i < DefaultCompactionTrigger; i++ {
+		if got, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || string(got) != "value" {
+			t.Errorf("key%d: expected value, got: %q %v", i, got, err)
+		}
+	}
+}
+
+func TestDBDefragment(t *testing.T) {
+	var (
+		setErr      error
+		read, total int64
+		progress    func(r, t int64)
+	)
+	dir := t.TempDir()
+	db, close, err := Open(dir, WithCompactionProgress(func(r, t int64) { progress(r, t) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	// Writes are attempted while the segments are being defragmented.
+	progress = func(r, t int64) {
+		read, total = r, t
+		if setErr == nil {
+			setErr = db.Set("name", []byte("Bob"))
+		}
+	}
+	db.compactor.split = bufio.ScanWords
+	db.compactor.decode = plainDecode
+	db.compactor.encode = plainEncode
+
+	// The older segment has 10k keys and the newer one deletes half of them.
+	var older, newer bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err = plainEncode(&older, &record{key: key, value: []byte("value")}); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			continue
+		}
+		if err = plainEncode(&newer, &record{key: key, deleted: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var segs []*segment
+	for i, b := range [][]byte{newer.Bytes(), older.Bytes()} {
+		segPath := filepath.Join(dir, fmt.Sprintf("seg%d", i))
+		if err = ioutil.WriteFile(segPath, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer seg.Close()
+		segs = append(segs, seg)
+	}
+	db.setSegments(segs)
+
+	if err = db.Defragment(); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(setErr, ErrReadOnly) {
+		t.Errorf("expected: %v, got: %v", ErrReadOnly, setErr)
+	}
+	if read != total || total != int64(older.Len()+newer.Len()) {
+		t.Errorf("expected progress %d/%d, got: %d/%d", older.Len()+newer.Len(), older.Len()+newer.Len(), read, total)
+	}
+
+	ss := db.segments.Load().([]*segment)
+	if len(ss) != 1 {
+		t.Fatalf("expected 1 segment, got: %d", len(ss))
+	}
+	defer ss[0].Close()
+	if len(ss[0].index) != 5000 {
+		t.Errorf("expected 5000 keys, got: %d", len(ss[0].index))
+	}
+	if _, ok := ss[0].index["key00001"]; ok {
+		t.Error("expected key00001 to be dropped")
+	}
+	if ss[0].Size() > int64(older.Len()/2) {
+		t.Errorf("expected segment size at most %d, got: %d", older.Len()/2, ss[0].Size())
+	}
+
+	if err = db.Set("name", []byte("Bob")); err != nil {
+		t.Errorf("expected writes after defragmentation, got: %v", err)
+	}
+}
+
+func TestDBCompact(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithMaxMemtableSize(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// Three segments: the keys are written, half of them deleted, and some overwritten.
+	for i := 0; i < 100; i++ {
+		if err = db.Set(fmt.Sprintf("key%03d", i), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushDB(t, db)
+	for i := 0; i < 100; i += 2 {
+		if err = db.Delete(fmt.Sprintf("key%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushDB(t, db)
+	if err = db.Set("key001", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+
+	// A cancelled compaction keeps the segments as they are.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = db.Compact(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected: %v, got: %v", context.Canceled, err)
+	}
+	if got, err := db.Get("key001"); string(got) != "v2" || err != nil {
+		t.Fatalf("expected v2, got: %q %v", got, err)
+	}
+
+	if err = db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ss := db.segments.Load().([]*segment)
+	if len(ss) != 1 {
+		t.Fatalf("expected 1 segment, got: %d", len(ss))
+	}
+	if len(ss[0].index) != 50 {
+		t.Errorf("expected 50 keys, got: %d", len(ss[0].index))
+	}
+	if got, err := db.Get("key001"); string(got) != "v2" || err != nil {
+		t.Errorf("expected v2, got: %q %v", got, err)
+	}
+	if _, err = db.Get("key000"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", ErrKeyNotFound, err)
+	}
+}
+
+func TestDBCompact_manyRecords(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithBlockCacheSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// The segments are larger than the buffer of a stream,
+	// so the records are merged while the stream reuses its buffer.
+	for i := 0; i < 1000; i++ {
+		if err = db.Set(fmt.Sprintf("key%04d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i%300 == 0 {
+			flushDB(t, db)
+		}
+	}
+	flushDB(t, db)
+	if err = db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		key, want := fmt.Sprintf("key%04d", i), fmt.Sprintf("value%d", i)
+		if got, err := db.Get(key); string(got) != want || err != nil {
+			t.Fatalf("%s: expected %s, got: %q %v", key, want, got, err)
+		}
+	}
+}
+
+func TestDBCompact_cancelled(t *testing.T) {
+	// The first compaction is cancelled once it has read some of the records.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db, close, err := Open(t.TempDir(), WithBlockCacheSize(0), WithCompactionProgress(func(read, total int64) {
+		if read > 0 {
+			cancel()
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// The segments are larger than the buffer of a stream, so the cancelled merge reads only some of them.
+	for i := 0; i < 3000; i++ {
+		if err = db.Set(fmt.Sprintf("key%04d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i%1000 == 999 {
+			flushDB(t, db)
+		}
+	}
+	if err = db.Compact(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected: %v, got: %v", context.Canceled, err)
+	}
+	// The retried compaction reads the segments from the beginning.
+	if err = db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3000; i++ {
+		key, want := fmt.Sprintf("key%04d", i), fmt.Sprintf("value%d", i)
+		if got, err := db.Get(key); string(got) != want || err != nil {
+			t.Fatalf("%s: expected %s, got: %q %v", key, want, got, err)
+		}
+	}
+}
+
+func TestDBTruncate(t *testing.T) {
+	dir := t.TempDir()
+	db, close, err := Open(dir, WithValueLogThreshold(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys are in a segment, an immutable memtable, and the memtable.
+	// The large value of the segment is stored in the value log.
+	if err = db.Set("large", bytes.Repeat([]byte("v"), 100)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = db.Set(fmt.Sprintf("key%d", i), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+		switch i {
+		case 0:
+			flushDB(t, db)
+		case 1:
+			if err = db.rotateMemtable(0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err = db.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = db.Get(fmt.Sprintf("key%d", i)); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("key%d: expected: %v, got: %v", i, ErrKeyNotFound, err)
+		}
+	}
+	if paths, err := filepath.Glob(filepath.Join(dir, "seg-*")); err != nil || len(paths) != 0 {
+		t.Errorf("expected segment files to be removed, got: %q %v", paths, err)
+	}
+	if paths, err := filepath.Glob(filepath.Join(dir, "vlog-*")); err != nil || len(paths) != 0 {
+		t.Errorf("expected value log files to be removed, got: %q %v", paths, err)
+	}
+	if got := db.EstimatedKeyCount(); got != 0 {
+		t.Errorf("expected no keys, got: %d", got)
+	}
+
+	// The database is usable right away, and the truncated keys don't come back after reopening.
+	if err = db.Set("key1", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("large", bytes.Repeat([]byte("w"), 100)); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+	if paths, err := filepath.Glob(filepath.Join(dir, "vlog-*")); err != nil || len(paths) != 1 {
+		t.Errorf("expected a new value log file, got: %q %v", paths, err)
+	}
+	if err = db.Set("key2", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, close, err = Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	for key, want := range map[string]string{"key0": "", "key1": "v2", "key2": "v2", "large": strings.Repeat("w", 100)} {
+		got, err := db.Get(key)
+		if want == "" && !errors.Is(err, ErrKeyNotFound) || want != "" && string(got) != want {
+			t.Errorf("%s: expected %q, got: %q %v", key, want, got, err)
+		}
+	}
+}
+
+func TestDBCompact_mergeStrategy(t *testing.T) {
+	max := func(key string, older, newer []byte) []byte {
+		if string(older) > string(newer) {
+			return older
+		}
+		return newer
+	}
+	tests := map[string]struct {
+		strategy MergeStrategy
+		want     string
+	}{
+		"last write wins":  {MergeStrategyLastWriteWins, "2"},
+		"first write wins": {MergeStrategyFirstWriteWins, "1"},
+		"custom":           {MergeStrategyCustom(max), "3"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, close, err := Open(t.TempDir(), WithMergeStrategy(tc.strategy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer close()
+
+			// Every version of the key is flushed into its own segment.
+			for _, v := range []string{"1", "3", "2"} {
+				if err = db.Set("counter", []byte(v)); err != nil {
+					t.Fatal(err)
+				}
+				flushDB(t, db)
+			}
+			if err = db.Compact(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := db.Get("counter"); string(got) != tc.want || err != nil {
+				t.Errorf("expected %s, got: %q %v", tc.want, got, err)
+			}
+		})
+	}
+}
+
+func TestDBCompact_removeReplacedSegments(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithMaxMemtableSize(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 10; j++ {
+			if err = db.Set(fmt.Sprintf("key%03d", j), []byte(fmt.Sprintf("v%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flushDB(t, db)
+	}
+	old := db.segments.Load().([]*segment)
+
+	// The iterator pins the replaced segments, so their files are kept until it's done.
+	it := db.NewIterator()
+	if err = db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for ; it.Valid(); it.Next() {
+		if string(it.Value()) != "v1" {
+			t.Errorf("expected v1, got: %s=%q", it.Key(), it.Value())
+		}
+		if n++; n == 5 {
+			for _, s := range old {
+				if _, err = os.Stat(s.path); err != nil {
+					t.Errorf("expected pinned segment file: %v", err)
+				}
+			}
+		}
+	}
+	if err = it.Err(); err != nil || n != 10 {
+		t.Fatalf("expected 10 keys, got: %d %v", n, err)
+	}
+
+	for _, s := range old {
+		for _, path := range []string{s.path, s.path + indexFileSuffix} {
+			if _, err = os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected %s removed, got: %v", path, err)
+			}
+		}
+		if s.ref() {
+			t.Error("expected retired segment not to be pinned")
+		}
+	}
+	if got, err := db.Get("key001"); string(got) != "v1" || err != nil {
+		t.Errorf("expected v1, got: %q %v", got, err)
+	}
+}
+
+func TestLeveledCompactor_removeSegmentFiles(t *testing.T) {
+	dir := t.TempDir()
+	db, close, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// The compactor is blocked, so it doesn't merge the segments concurrently with the test.
+	if err = db.compactor.sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < DefaultCompactionTrigger; i++ {
+		if err = db.Set(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		flushDB(t, db)
+	}
+	err = db.compactor.compactLevels()
+	db.compactor.sem.Release(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss := db.segments.Load().([]*segment)
+	if len(ss) != 1 {
+		t.Fatalf("expected 1 segment, got: %d", len(ss))
+	}
+	want := []string{ss[0].path, ss[0].path + indexFileSuffix}
+	got, err := filepath.Glob(filepath.Join(dir, "seg-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestLeveledCompactor_pick(t *testing.T) {
+	c := LeveledCompactor{
+		levels:         3,
+		trigger:        2,
+		multiplier:     10,
+		baseLevelSize:  100,
+		maxSegmentSize: 80,
+	}
+	seg := func(level int, min, max string, size int64) *segment {
+		return &segment{
+			path:     fmt.Sprintf("L%d:%s-%s", level, min, max),
+			level:    level,
+			minKey:   min,
+			maxKey:   max,
+			size:     size,
+			fileSize: size,
+		}
+	}
+	paths := func(segs []*segment) []string {
+		var pp []string
+		for _, s := range segs {
+			pp = append(pp, s.path)
+		}
+		return pp
+	}
+
+	tests := map[string]struct {
+		segments  []*segment
+		wantLevel int
+		want      []string
+	}{
+		"level 0 fits": {
+			segments: []*segment{
+				seg(0, "a", "z", 50),
+				seg(1, "a", "c", 50),
+			},
+			wantLevel: -1,
+		},
+		"level 0 is merged with overlapping level 1": {
+			segments: []*segment{
+				seg(0, "d", "f", 10),
+				seg(0, "b", "e", 10),
+				seg(1, "a", "c", 50),
+				seg(1, "g", "k", 40),
+			},
+			wantLevel: 0,
+			want:      []string{"L0:d-f", "L0:b-e", "L1:a-c"},
+		},
+		"level 1 segment with the fewest overlapping bytes": {
+			segments: []*segment{
+				seg(0, "a", "z", 10),
+				seg(1, "a", "c", 60),
+				seg(1, "d", "f", 60),
+				seg(2, "a", "b", 500),
+				seg(2, "e", "e", 10),
+			},
+			wantLevel: 1,
+			want:      []string{"L1:d-f", "L2:e-e"},
+		},
+		"the last level is never merged": {
+			segments: []*segment{
+				seg(2, "a", "z", 100000),
+			},
+			wantLevel: -1,
+		},
+		"oversized level 0 segment is merged with the rest of level 0": {
+			segments: []*segment{
+				seg(0, "a", "c", 90),
+				seg(0, "x", "z", 10),
+				seg(1, "b", "d", 10),
+			},
+			wantLevel: 0,
+			want:      []string{"L0:a-c", "L0:x-z", "L1:b-d"},
+		},
+		"oversized segment from the lowest level": {
+			segments: []*segment{
+				seg(1, "a", "c", 90),
+				seg(1, "d", "f", 5),
+				seg(2, "b", "b", 10),
+				seg(2, "x", "x", 10),
+			},
+			wantLevel: 1,
+			want:      []string{"L1:a-c", "L2:b-b"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			segs, level := c.pick(tc.segments)
+			if level != tc.wantLevel {
+				t.Errorf("expected level %d, got: %d", tc.wantLevel, level)
+			}
+			if diff := cmp.Diff(tc.want, paths(segs)); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestDB_maxSegmentSize(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithLevelCount(3), WithMaxSegmentSize(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for i := 0; i < 50; i++ {
+		if err = db.Set(fmt.Sprintf("key%03d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The compactor is blocked, so it doesn't merge the segments concurrently with the test.
+	if err = db.compactor.sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+	ss := db.segments.Load().([]*segment)
+	if len(ss) != 1 || ss[0].fileSize <= 256 {
+		t.Fatalf("expected a segment over 256 bytes, got: %d segments", len(ss))
+	}
+	err = db.compactor.compactLevels()
+	db.compactor.sem.Release(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The segment is still too large after it's merged into level 1, so it ends up in the last level.
+	ss = db.segments.Load().([]*segment)
+	if len(ss) != 1 {
+		t.Fatalf("expected 1 segment, got: %d", len(ss))
+	}
+	if ss[0].level != 2 {
+		t.Errorf("expected segment at level 2, got: %d", ss[0].level)
+	}
+	if got, err := db.Get("key042"); string(got) != "value" || err != nil {
+		t.Errorf("expected value, got: %q %v", got, err)
+	}
+}
+
+func TestDB_leveledCompaction(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithMaxMemtableSize(512), WithLevelCount(3), WithLevelSizeMultiplier(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 10; j++ {
+			key := fmt.Sprintf("key%03d", (i*37+j)%100)
+			if err = db.Set(key, []byte(fmt.Sprintf("value%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The compactor is blocked, so it doesn't merge the segments concurrently with the test.
+		if err = db.compactor.sem.Acquire(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+		flushDB(t, db)
+		err = db.compactor.compactLevels()
+		db.compactor.sem.Release(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ss := db.segments.Load().([]*segment)
+	var deeper bool
+	for i, s := range ss {
+		if i > 0 && s.level < ss[i-1].level {
+			t.Fatalf("expected segments ordered by levels, got level %d after %d", s.level, ss[i-1].level)
+		}
+		if s.level == 0 {
+			continue
+		}
+		deeper = true
+		if i > 0 && s.level == ss[i-1].level && s.Overlaps(ss[i-1].minKey, ss[i-1].maxKey) {
+			t.Errorf("expected level %d segments not to overlap: %s %s", s.level, ss[i-1].path, s.path)
+		}
+	}
+	if !deeper {
+		t.Fatal("expected segments to be merged into deeper levels")
+	}
+
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 10; j++ {
+			key := fmt.Sprintf("key%03d", (i*37+j)%100)
+			want := fmt.Sprintf("value%d", i)
+			// The key could be overwritten later.
+			for k := i + 1; k < 20; k++ {
+				for l := 0; l < 10; l++ {
+					if (k*37+l)%100 == (i*37+j)%100 {
+						want = fmt.Sprintf("value%d", k)
+					}
+				}
+			}
+			got, err := db.Get(key)
+			if err != nil {
+				t.Fatalf("%s: %v", key, err)
+			}
+			if string(got) != want {
+				t.Errorf("expected %s=%s, got: %s", key, want, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package hasty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// MultiGet retrieves many keys at once. Unlike calling Get for every key,
+// the keys are looked up in the memtables under one lock, and then the segments are read one by one
+// from the newest to the oldest: the keys expected in a segment according to its Bloom filter and index
+// are read in the order of their offsets, so the reads of the segment file are sequential.
+// The keys which aren't found are absent from the returned map.
+// An error aborts the lookup, then the values found so far are returned along with the error.
+// Note, operation is concurrency safe.
+func (db *DB) MultiGet(keys []string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if key == "" {
+			return values, ErrEmptyKey
+		}
+	}
+	if err := db.enter(); err != nil {
+		return values, err
+	}
+	defer db.leave()
+	defer db.observeGet(time.Now())
+
+	// The keys which aren't resolved by the memtables are looked up in the segments.
+	pending := make(map[string]bool, len(keys))
+	db.memMu.RLock()
+	for _, key := range keys {
+		value, deleted, ok := db.searchMemtables(key)
+		switch {
+		case deleted:
+		case ok:
+			values[key] = value
+		default:
+			pending[key] = true
+		}
+	}
+	db.memMu.RUnlock()
+
+	bf := db.globalBloom.Load().(*bloomFilter)
+	for key := range pending {
+		if !bf.MayContain(key) {
+			delete(pending, key)
+		}
+	}
+	if len(pending) == 0 {
+		return values, nil
+	}
+
+	ss := db.acquireSegments()
+	defer releaseSegments(ss)
+	for _, seg := range ss {
+		if len(pending) == 0 {
+			break
+		}
+		if err := db.multiGetSegment(seg, pending, values); err != nil {
+			return values, err
+		}
+	}
+	return values, nil
+}
+
+// multiGetSegment looks up the pending keys in the segment.
+// The found keys are removed from pending, and their values are added to values unless they're deleted or expired.
+func (db *DB) multiGetSegment(seg *segment, pending map[string]bool, values map[string][]byte) error {
+	var (
+		st    ReadStats
+		found []indexEntry
+	)
+	defer func() { db.metrics.observeSegmentReads(st) }()
+
+	for key := range pending {
+		// The segment's Bloom filter is cheaper to check than its index.
+		if !seg.MayContain(key) {
+			continue
+		}
+		offset, ok, readSt, err := seg.LookupWithStats(key)
+		st.add(readSt)
+		if err != nil {
+			return fmt.Errorf("failed to look up key: %w", err)
+		}
+		if !ok {
+			if seg.bloom != nil {
+				atomic.AddUint64(&db.metrics.bloomFalsePositives, 1)
+			}
+			continue
+		}
+		found = append(found, indexEntry{key: key, offset: offset})
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].offset < found[j].offset
+	})
+
+	for _, e := range found {
+		rec, readSt, err := db.readRecord(seg, e.offset)
+		st.add(readSt)
+		if err != nil {
+			return fmt.Errorf("failed to read record: %w", err)
+		}
+		delete(pending, e.key)
+		if rec.deleted || rec.expired(time.Now().UnixNano()) {
+			continue
+		}
+		if !rec.pointer {
+			values[e.key] = rec.value
+			continue
+		}
+
+		value, err := db.vlog.Value(e.key, rec.value)
+		// The value log file might have been removed by the garbage collector after the live values were rewritten,
+		// so the key is looked up again to find the rewritten value.
+		if errors.Is(err, errValueLogMissing) {
+			value, err = db.get(context.Background(), e.key)
+			if errors.Is(err, ErrKeyNotFound) {
+				continue
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read value log: %w", err)
+		}
+		values[e.key] = value
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package hasty
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDBMultiGet(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithValueLogThreshold(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	large := strings.Repeat("f", 100)
+	for _, step := range []struct {
+		set     map[string]string
+		deleted []string
+		flush   bool
+	}{
+		{set: map[string]string{"a": "a1", "b": "b1", "c": "c1", "d": "d1", "f": large}, flush: true},
+		{set: map[string]string{"b": "b2"}, deleted: []string{"c"}, flush: true},
+		{set: map[string]string{"d": "d3"}, deleted: []string{"a"}},
+	} {
+		for key, value := range step.set {
+			if err = db.Set(key, []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, key := range step.deleted {
+			if err = db.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if step.flush {
+			flushDB(t, db)
+		}
+	}
+
+	got, err := db.MultiGet([]string{"a", "b", "c", "d", "f", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{
+		"b": []byte("b2"),
+		"d": []byte("d3"),
+		"f": []byte(large),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+
+	if _, err = db.MultiGet([]string{"b", ""}); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("expected: %v, got: %v", ErrEmptyKey, err)
+	}
+}
@@ -0,0 +1,97 @@
+package hasty
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newPrometheusCollector creates a PrometheusCollector of the database metrics.
+func newPrometheusCollector(db *DB) *PrometheusCollector {
+	return &PrometheusCollector{
+		db: db,
+		getDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "hastydb_get_duration_seconds",
+			Help:    "Duration of DB.Get calls.",
+			Buckets: prometheus.ExponentialBuckets(0.000001, 4, 12),
+		}),
+		setDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "hastydb_set_duration_seconds",
+			Help:    "Duration of DB.Set calls including the WAL write.",
+			Buckets: prometheus.ExponentialBuckets(0.000001, 4, 12),
+		}),
+		compactionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "hastydb_compaction_duration_seconds",
+			Help:    "Duration of segments compactions.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		memtableSize: prometheus.NewDesc(
+			"hastydb_memtable_size_bytes",
+			"Size of the keys and values of the memtable.",
+			nil, nil,
+		),
+		segmentCount: prometheus.NewDesc(
+			"hastydb_segment_count",
+			"Number of segment files.",
+			nil, nil,
+		),
+		walBytes: prometheus.NewDesc(
+			"hastydb_wal_bytes",
+			"Size of the WAL file.",
+			nil, nil,
+		),
+	}
+}
+
+// PrometheusCollector exposes the database metrics to Prometheus, see DB.PrometheusCollector.
+// The latencies are observed as the operations happen, and the gauges are read from Stats on every scrape.
+type PrometheusCollector struct {
+	db                 *DB
+	getDuration        prometheus.Histogram
+	setDuration        prometheus.Histogram
+	compactionDuration prometheus.Histogram
+	memtableSize       *prometheus.Desc
+	segmentCount       *prometheus.Desc
+	walBytes           *prometheus.Desc
+}
+
+// Describe sends the descriptors of the metrics to the channel.
+func (c *PrometheusCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.getDuration.Describe(ch)
+	c.setDuration.Describe(ch)
+	c.compactionDuration.Describe(ch)
+	ch <- c.memtableSize
+	ch <- c.segmentCount
+	ch <- c.walBytes
+}
+
+// Collect sends the current values of the metrics to the channel.
+func (c *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	c.getDuration.Collect(ch)
+	c.setDuration.Collect(ch)
+	c.compactionDuration.Collect(ch)
+
+	st := c.db.Stats()
+	ch <- prometheus.MustNewConstMetric(c.memtableSize, prometheus.GaugeValue, float64(st.MemtableSize))
+	ch <- prometheus.MustNewConstMetric(c.segmentCount, prometheus.GaugeValue, float64(st.SegmentCount))
+	ch <- prometheus.MustNewConstMetric(c.walBytes, prometheus.GaugeValue, float64(st.WALBytes))
+}
+
+// PrometheusCollector returns a collector of the database metrics which can be registered with a Prometheus registry.
+//
+//	prometheus.MustRegister(db.PrometheusCollector())
+func (db *DB) PrometheusCollector() prometheus.Collector {
+	return db.prom
+}
+
+// observeSet records the latency of a write of the key which started at the given time.
+func (db *DB) observeSet(start time.Time) {
+	db.prom.setDuration.Observe(time.Since(start).Seconds())
+}
+
+// observeGet records the latency of a read of the key which started at the given time.
+func (db *DB) observeGet(start time.Time) {
+	d := time.Since(start)
+	db.metrics.observeGet(d)
+	db.prom.getDuration.Observe(d.Seconds())
+}
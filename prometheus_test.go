@@ -0,0 +1,67 @@
+package hasty
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPrometheusCollector(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithCompactionTrigger(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	reg := prometheus.NewPedanticRegistry()
+	if err = reg.Register(db.PrometheusCollector()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The compactor is blocked, so it doesn't merge the segments concurrently with the test.
+	if err = db.compactor.sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	defer db.compactor.sem.Release(1)
+	for _, key := range []string{"name", "city"} {
+		if err = db.Set(key, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		flushDB(t, db)
+	}
+	if err = db.compactor.compactLevels(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("age", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	db.Get("name")
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, mf := range mfs {
+		m := mf.GetMetric()[0]
+		if h := m.GetHistogram(); h != nil {
+			got[mf.GetName()] = float64(h.GetSampleCount())
+		} else {
+			got[mf.GetName()] = m.GetGauge().GetValue()
+		}
+	}
+	want := map[string]float64{
+		"hastydb_get_duration_seconds":        1,
+		"hastydb_set_duration_seconds":        3,
+		"hastydb_compaction_duration_seconds": 1,
+		"hastydb_memtable_size_bytes":         4,
+		"hastydb_segment_count":               1,
+		"hastydb_wal_bytes":                   float64(db.wal.Size()),
+	}
+	for name, v := range want {
+		if got[name] != v {
+			t.Errorf("%s: expected %v, got: %v", name, v, got[name])
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package hasty
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/marselester/hastydb/internal/index"
+)
+
+// ReplayWAL converts the WAL file found at walPath into a database at destDBPath.
+// It is meant for disaster recovery when segment files are lost, but the WAL survived.
+// Records with empty keys are skipped. Unlike a database, ReplayWAL defaults to TolerateCorrupt recovery mode,
+// so it recovers the records preceding an invalid record instead of failing, see WithWALRecoveryMode.
+// The summary of the recovery is logged.
+func ReplayWAL(walPath, destDBPath string, options ...ConfigOption) error {
+	cfg := Config{
+		walRecoveryMode: TolerateCorrupt,
+		fileMode:        DefaultFileMode,
+		dirMode:         DefaultDirMode,
+		codec:           BinaryCodec{},
+		logger:          slog.Default(),
+	}
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
+	w, err := openReadonlyWAL(walPath)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL file: %w", err)
+	}
+	defer w.Close()
+	w.logger = cfg.logger
+
+	mem := index.NewMemtable(cfg.comparator.cmp)
+	var replayed, skipped int
+	err = w.Replay(cfg.walRecoveryMode, func(rec *record) error {
+		if rec.key == "" {
+			cfg.logger.Warn("hasty: skipped WAL record with empty key", "path", walPath)
+			skipped++
+			return nil
+		}
+
+		if rec.deleted {
+			mem.Delete(rec.key)
+		} else {
+			mem.SetWithExpiry(rec.key, rec.value, rec.expiresAt)
+		}
+		replayed++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replay WAL file: %w", err)
+	}
+
+	if err = os.MkdirAll(destDBPath, cfg.dirMode); err != nil {
+		return fmt.Errorf("failed to create database dir: %w", err)
+	}
+	// The destination is a new database, so its first segment is numbered zero.
+	segPath := filepath.Join(destDBPath, fmt.Sprintf(segmentNameFormat, 0, 0))
+	seg, err := openWriteonlySegment(segPath, cfg.fileMode, cfg.directIO)
+	if err != nil {
+		return fmt.Errorf("failed to open %q segment: %w", segPath, err)
+	}
+	defer seg.Close()
+
+	sw := sstableWriter{}
+	sw.encode, _ = codecFuncs(cfg.codec)
+	if err = sw.write(seg, mem); err != nil {
+		return fmt.Errorf("failed to write %q segment: %w", segPath, err)
+	}
+	if err = seg.Flush(); err != nil {
+		return fmt.Errorf("failed to flush %q segment: %w", segPath, err)
+	}
+	fi, err := seg.f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %q segment: %w", segPath, err)
+	}
+
+	cfg.logger.Info(
+		"hasty: replayed WAL",
+		"path", walPath, "replayed", replayed, "skipped", skipped,
+		"keys", len(mem.Keys()), "segment", segPath, "size", fi.Size(),
+	)
+	return nil
+}
+
+// RestoreFromWAL replays the WAL file found at walPath into the database, e.g., to rebuild a database
+// whose dir was lost from the WAL which survived on a separate disk. It works on an empty database as well.
+// The records are written in batches like with Batch, so the memtable is saved on disk as it grows.
+// The invalid records are handled according to the WAL recovery mode of the database, see WithWALRecoveryMode.
+// The WAL file is closed and removed once all of its records are written.
+// Note, walPath must not be the WAL of the database itself.
+func (db *DB) RestoreFromWAL(walPath string) error {
+	w, err := openReadonlyWAL(walPath)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL file: %w", err)
+	}
+	defer w.Close()
+	w.logger = db.cfg.logger
+
+	err = w.ReplayInBatches(db.cfg.walRecoveryMode, walReplayBatchSize, func(batch []*record) error {
+		recs := make([]*record, 0, len(batch))
+		for _, rec := range batch {
+			// Records with empty keys could be written by older versions.
+			if rec.key != "" {
+				recs = append(recs, rec)
+			}
+		}
+		if len(recs) == 0 {
+			return nil
+		}
+		return db.write(recs...)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore database from WAL file: %w", err)
+	}
+
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("failed to close WAL file after database restore: %w", err)
+	}
+	return os.Remove(walPath)
+}
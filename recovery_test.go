@@ -0,0 +1,258 @@
+package hasty
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplayWAL(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal")
+	w, err := openAppendonlyWAL(walPath, 0, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		rec := record{
+			key:   fmt.Sprintf("key%d", i),
+			value: []byte(fmt.Sprintf("value%d", i)),
+		}
+		if err = w.WriteRecord(&rec); err != nil {
+			t.Fatal(err)
+		}
+		want[rec.key] = string(rec.value)
+	}
+	// Simulate a torn write at the end of the WAL.
+	if _, err = w.f.Write([]byte{100, 0, 0, 0, 'k'}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbPath := filepath.Join(dir, "recovered")
+	if err = ReplayWAL(walPath, dbPath); err != nil {
+		t.Fatal(err)
+	}
+
+	seg, err := openReadonlySegment(filepath.Join(dbPath, "seg-L0-000000"), BinaryCodec{}, keyComparator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+
+	got := make(map[string]string)
+	for offset := int64(0); offset < seg.size; {
+		rec, err := seg.ReadRecord(offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[rec.key] = string(rec.value)
+		offset += int64(rec.size())
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d keys, got: %d", len(want), len(got))
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: expected: %q, got: %q", k, v, got[k])
+		}
+	}
+}
+
+func TestDBNewWALBackupReader(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	db, close, err := Open(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	// The flush is held back, so the first half of the keys stays in the WAL file of the immutable memtable.
+	if err = db.sstWriter.sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err = db.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i == 49 {
+			if err = db.rotateMemtable(0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The streamed WAL files make a valid WAL file, so the database can be restored from it.
+	r, err := db.NewWALBackupReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	walPath := filepath.Join(dir, "wal.backup")
+	f, err := os.Create(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(f, r)
+	f.Close()
+	r.Close()
+	db.sstWriter.sem.Release(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbPath := filepath.Join(dir, "restored")
+	if err = ReplayWAL(walPath, dbPath); err != nil {
+		t.Fatal(err)
+	}
+	restored, closeRestored, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeRestored()
+	for i := 0; i < 100; i++ {
+		got, err := restored.Get(fmt.Sprintf("key%d", i))
+		if want := fmt.Sprintf("value%d", i); string(got) != want || err != nil {
+			t.Errorf("key%d: expected %s, got: %q %v", i, want, got, err)
+		}
+	}
+}
+
+func TestDBNewWALBackupReader_flushed(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	db, close, err := Open(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	if err = db.sstWriter.sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err = db.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i == 49 {
+			if err = db.rotateMemtable(0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	r, err := db.NewWALBackupReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// The WAL file of the immutable memtable is removed before the backup starts,
+	// so the stream begins with the records of the memtable's WAL.
+	db.sstWriter.sem.Release(1)
+	if err = db.sstWriter.flush(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, walMagic) {
+		t.Fatalf("expected WAL header, got: %q", b[:walHeaderSize])
+	}
+
+	walPath := filepath.Join(dir, "wal.backup")
+	if err = ioutil.WriteFile(walPath, b, DefaultFileMode); err != nil {
+		t.Fatal(err)
+	}
+	w, err := openReadonlyWAL(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var keys []string
+	err = w.Replay(AbortOnCorrupt, func(rec *record) error {
+		keys = append(keys, rec.key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 50 || keys[0] != "key50" || keys[49] != "key99" {
+		t.Errorf("expected key50..key99, got: %q", keys)
+	}
+}
+
+func TestDBRestoreFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db")
+	db, close, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err = db.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Delete("key42"); err != nil {
+		t.Fatal(err)
+	}
+	// The WAL survives on another disk while the database dir including its segments is lost.
+	walPath := filepath.Join(dir, "wal")
+	if err = db.wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(db.wal.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(walPath, b, DefaultFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.RemoveAll(dbPath); err != nil {
+		t.Fatal(err)
+	}
+
+	db, close, err = Open(dbPath, WithMaxMemtableSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	if err = db.RestoreFromWAL(walPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(walPath); !os.IsNotExist(err) {
+		t.Errorf("expected WAL file to be removed: %v", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		got, err := db.Get(key)
+		if i == 42 {
+			if err != ErrKeyNotFound {
+				t.Errorf("expected deleted %s, got: %q %v", key, got, err)
+			}
+			continue
+		}
+		if want := fmt.Sprintf("value%d", i); string(got) != want || err != nil {
+			t.Errorf("expected %s=%s, got: %q %v", key, want, got, err)
+		}
+	}
+}
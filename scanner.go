@@ -0,0 +1,104 @@
+package hasty
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// dataScanRate is a number of bytes per second read by dataScanner,
+// so the scan doesn't compete with the foreground reads for disk bandwidth.
+const dataScanRate = 8 * 1024 * 1024
+
+// newDataScanner creates a dataScanner that scans the segments every interval.
+func newDataScanner(db *DB, interval time.Duration) *dataScanner {
+	s := dataScanner{
+		db:       db,
+		interval: interval,
+		limiter:  rate.NewLimiter(dataScanRate, dataScanRate),
+		onCorrupt: func(segPath string, offset int64, err error) {
+			db.cfg.logger.Error("hasty: corrupt segment", "path", segPath, "offset", offset, "error", err)
+		},
+	}
+	if db.cfg.onCorruption != nil {
+		s.onCorrupt = db.cfg.onCorruption
+	}
+	return &s
+}
+
+// dataScanner is an actor that is responsible for scrubbing: it periodically reads every segment file
+// sequentially like Verify does, and it reports the problems it finds with the corruption handler,
+// see WithCorruptionHandler. The damage is found before the records are needed by the reads or compaction,
+// so the segments can be restored from a backup while the damage is contained.
+// The reads are throttled with the limiter, and the segments replaced by compaction in the meantime
+// are still scanned until the end of the pass, because they're pinned.
+type dataScanner struct {
+	db       *DB
+	interval time.Duration
+	limiter  *rate.Limiter
+	// onCorrupt is called for every problem found in the segments.
+	onCorrupt func(segPath string, offset int64, err error)
+}
+
+// Run starts the actor which is stopped by cancelling context.
+func (s *dataScanner) Run(ctx context.Context) error {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := s.scan(ctx); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// scan verifies all the segments one by one, it stops with ctx.Err() once ctx is done.
+func (s *dataScanner) scan(ctx context.Context) error {
+	ss := s.db.acquireSegments()
+	defer releaseSegments(ss)
+
+	for _, seg := range ss {
+		errs := seg.verifyStream(&throttledReader{
+			ctx:     ctx,
+			r:       seg.newStreamReader(),
+			limiter: s.limiter,
+		})
+		// The scan was interrupted, so its errors aren't caused by the damage.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, e := range errs {
+			s.onCorrupt(e.Path, e.Offset, e.Err)
+		}
+	}
+	return nil
+}
+
+// throttledReader limits the rate of reads from r, it fails with ctx.Err() once ctx is done.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// The limiter can't wait for more bytes than its burst.
+	if len(p) > t.limiter.Burst() {
+		p = p[:t.limiter.Burst()]
+	}
+	n, err := t.r.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	if waitErr := t.limiter.WaitN(t.ctx, n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
@@ -0,0 +1,96 @@
+package hasty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDataScanner(t *testing.T) {
+	type corruption struct {
+		path   string
+		offset int64
+		err    error
+	}
+	found := make(chan corruption, 10)
+	db, close, err := Open(
+		t.TempDir(),
+		WithDataScanning(10*time.Millisecond),
+		WithCorruptionHandler(func(segPath string, offset int64, err error) {
+			// The next scans find the same corruption, so they mustn't block closing of the database.
+			select {
+			case found <- corruption{segPath, offset, err}:
+			default:
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for i := 0; i < 50; i++ {
+		if err = db.Set(fmt.Sprintf("key%03d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushDB(t, db)
+	select {
+	case c := <-found:
+		t.Fatalf("expected intact segment, got: %+v", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The last byte of the value is flipped, so the record doesn't match its checksum.
+	seg := db.segments.Load().([]*segment)[0]
+	offset := seg.index["key025"]
+	blen, _, err := seg.readRecordLen(offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(seg.path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{'X'}, segmentHeaderSize+offset+int64(blen)-recordChecksumSize-1)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case c := <-found:
+		if c.path != seg.path || c.offset != offset || !errors.Is(c.err, ErrChecksum) {
+			t.Errorf("expected checksum mismatch at offset %d of %s, got: %+v", offset, seg.path, c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected corruption to be found")
+	}
+}
+
+func TestDataScanner_cancel(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+
+	// The interrupted scan doesn't report the failed reads as corruption.
+	s := newDataScanner(db, time.Hour)
+	s.onCorrupt = func(segPath string, offset int64, err error) {
+		t.Errorf("unexpected corruption at offset %d of %s: %v", offset, segPath, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = s.scan(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected: %v, got: %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,183 @@
+package hasty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// indexKeyPrefix starts the keys of secondary index entries, so they're kept in a separate key namespace.
+// The keys with this prefix are reserved and they aren't indexed.
+const indexKeyPrefix = "__idx:"
+
+// indexBackfillBatchSize is a number of index entries committed at once when an index is created.
+const indexBackfillBatchSize = 1000
+
+// IndexExtractor derives a secondary index key from a key-value pair, empty result means the pair isn't indexed.
+type IndexExtractor func(key string, value []byte) string
+
+// indexKey returns the key of the index entry which maps the derived key to a primary key.
+func indexKey(name, derived string) string {
+	return indexKeyPrefix + name + ":" + derived
+}
+
+// CreateIndex creates a secondary index, so a key can be looked up by the attribute derived from it
+// and its value by the extractor, see IndexLookup. Every derived key maps to one primary key,
+// the latest written one if the extractor returns the same derived key for several pairs.
+// The index entries are stored in the database under the "__idx:<name>:" prefix,
+// and they're written in the same batch with the primary key by Set, SetWithTTL, Delete,
+// and the commits of batches and transactions. The existing keys are indexed when the index is created.
+// Note, the extractor isn't persisted, so the index must be created every time the database is opened.
+func (db *DB) CreateIndex(name string, extractor func(key string, value []byte) string) error {
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("invalid index name %q", name)
+	}
+
+	db.indexMu.Lock()
+	if _, ok := db.indexes[name]; ok {
+		db.indexMu.Unlock()
+		return ErrIndexExists
+	}
+	if db.indexes == nil {
+		db.indexes = make(map[string]IndexExtractor)
+	}
+	db.indexes[name] = extractor
+	db.indexMu.Unlock()
+
+	// The existing keys are indexed unless they were indexed before the database was reopened.
+	// The entries are committed once the iteration is over, because it reads the memtable.
+	var batches []*Batch
+	err := db.ForEach(func(key string, value []byte) error {
+		if strings.HasPrefix(key, indexKeyPrefix) {
+			return nil
+		}
+		derived := extractor(key, value)
+		if derived == "" {
+			return nil
+		}
+		primary, err := db.Get(indexKey(name, derived))
+		if err == nil && string(primary) == key {
+			return nil
+		}
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+
+		if len(batches) == 0 || len(batches[len(batches)-1].recs) == indexBackfillBatchSize {
+			batches = append(batches, db.NewBatch())
+		}
+		batches[len(batches)-1].Set(indexKey(name, derived), []byte(key))
+		return nil
+	})
+	for i := 0; err == nil && i < len(batches); i++ {
+		err = batches[i].Commit()
+	}
+	if err != nil {
+		db.indexMu.Lock()
+		delete(db.indexes, name)
+		db.indexMu.Unlock()
+		return fmt.Errorf("failed to index existing keys: %w", err)
+	}
+	return nil
+}
+
+// IndexLookup returns the primary key which the derived key maps to in the index.
+// ErrKeyNotFound is returned if there is no such derived key,
+// or the primary key doesn't derive it anymore, e.g., the primary key expired.
+func (db *DB) IndexLookup(indexName, derivedKey string) (primaryKey string, err error) {
+	db.indexMu.RLock()
+	extractor, ok := db.indexes[indexName]
+	db.indexMu.RUnlock()
+	if !ok {
+		return "", ErrIndexNotFound
+	}
+
+	primary, err := db.Get(indexKey(indexName, derivedKey))
+	if err != nil {
+		return "", err
+	}
+	value, err := db.Get(string(primary))
+	if err != nil {
+		return "", err
+	}
+	if extractor(string(primary), value) != derivedKey {
+		return "", ErrKeyNotFound
+	}
+	return string(primary), nil
+}
+
+// indexRecords returns the index entries to be written along with the records:
+// the entries of the derived keys of the new values, and the tombstones of the entries
+// of the previous values which don't derive the same keys.
+// Note, the caller must be registered with enter.
+func (db *DB) indexRecords(recs []*record) ([]*record, error) {
+	db.indexMu.RLock()
+	defer db.indexMu.RUnlock()
+	if len(db.indexes) == 0 {
+		return nil, nil
+	}
+
+	var idx []*record
+	// latest are the records of the batch by their keys, they're newer than the database.
+	latest := make(map[string]*record)
+	// entries are the primary keys of the index entries written by the batch, empty if removed.
+	entries := make(map[string]string)
+	for _, rec := range recs {
+		if strings.HasPrefix(rec.key, indexKeyPrefix) {
+			continue
+		}
+
+		var (
+			prev   []byte
+			exists bool
+		)
+		if r, ok := latest[rec.key]; ok {
+			prev, exists = r.value, !r.deleted
+		} else {
+			value, err := db.get(context.Background(), rec.key)
+			if err != nil && !errors.Is(err, ErrKeyNotFound) {
+				return nil, fmt.Errorf("failed to get previous value: %w", err)
+			}
+			prev, exists = value, err == nil
+		}
+		latest[rec.key] = rec
+
+		for name, extractor := range db.indexes {
+			var prevDerived, derived string
+			if exists {
+				prevDerived = extractor(rec.key, prev)
+			}
+			if !rec.deleted {
+				derived = extractor(rec.key, rec.value)
+			}
+
+			// The entry of the previous value is removed unless it was taken over by another key.
+			if prevDerived != "" && prevDerived != derived {
+				k := indexKey(name, prevDerived)
+				primary, ok := entries[k]
+				if !ok {
+					value, err := db.get(context.Background(), k)
+					if err != nil && !errors.Is(err, ErrKeyNotFound) {
+						return nil, fmt.Errorf("failed to get index entry: %w", err)
+					}
+					primary = string(value)
+				}
+				if primary == rec.key {
+					idx = append(idx, &record{key: k, deleted: true})
+					entries[k] = ""
+				}
+			}
+			if derived != "" {
+				k := indexKey(name, derived)
+				idx = append(idx, &record{
+					key:       k,
+					value:     []byte(rec.key),
+					expiresAt: rec.expiresAt,
+				})
+				entries[k] = rec.key
+			}
+		}
+	}
+	return idx, nil
+}
@@ -0,0 +1,151 @@
+package hasty
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// emailExtractor indexes the users by their emails which are stored as values.
+func emailExtractor(key string, value []byte) string {
+	if !strings.HasPrefix(key, "user:") {
+		return ""
+	}
+	return string(value)
+}
+
+func TestDBIndexLookup(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if _, err = db.IndexLookup("email", "bob@example.com"); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected: %v, got: %v", ErrIndexNotFound, err)
+	}
+	if err = db.CreateIndex("email", emailExtractor); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.CreateIndex("email", emailExtractor); !errors.Is(err, ErrIndexExists) {
+		t.Errorf("expected: %v, got: %v", ErrIndexExists, err)
+	}
+	if err = db.CreateIndex("e:mail", emailExtractor); err == nil {
+		t.Error("expected invalid index name error")
+	}
+
+	if err = db.Set("user:1", []byte("bob@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("planet", []byte("earth")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.IndexLookup("email", "bob@example.com")
+	if err != nil || got != "user:1" {
+		t.Errorf("expected user:1, got: %q %v", got, err)
+	}
+	if got, err = db.IndexLookup("email", "earth"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %q %v", ErrKeyNotFound, got, err)
+	}
+
+	// The entry of the previous value is removed on update.
+	if err = db.Set("user:1", []byte("robert@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+	if _, err = db.Get(indexKey("email", "bob@example.com")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected removed index entry, got: %v", err)
+	}
+	if got, err = db.IndexLookup("email", "robert@example.com"); err != nil || got != "user:1" {
+		t.Errorf("expected user:1, got: %q %v", got, err)
+	}
+
+	// The entry is removed on delete.
+	if err = db.Delete("user:1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Get(indexKey("email", "robert@example.com")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected removed index entry, got: %v", err)
+	}
+	if _, err = db.IndexLookup("email", "robert@example.com"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", ErrKeyNotFound, err)
+	}
+}
+
+func TestDBIndexLookup_batch(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.CreateIndex("email", emailExtractor); err != nil {
+		t.Fatal(err)
+	}
+
+	// The later writes of the batch see the earlier ones.
+	b := db.NewBatch()
+	b.Set("user:1", []byte("bob@example.com"))
+	b.Set("user:1", []byte("robert@example.com"))
+	b.Set("user:2", []byte("alice@example.com"))
+	b.Delete("user:2")
+	if err = b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		want string
+		err  error
+	}{
+		"bob@example.com":    {err: ErrKeyNotFound},
+		"robert@example.com": {want: "user:1"},
+		"alice@example.com":  {err: ErrKeyNotFound},
+	}
+	for derived, tc := range tests {
+		got, err := db.IndexLookup("email", derived)
+		if got != tc.want || !errors.Is(err, tc.err) {
+			t.Errorf("%s expected: %q %v, got: %q %v", derived, tc.want, tc.err, got, err)
+		}
+		if _, err = db.Get(indexKey("email", derived)); tc.err != nil && !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("%s expected no index entry, got: %v", derived, err)
+		}
+	}
+
+	// Compare-and-set updates the index as well.
+	ok, err := db.CompareAndSet("user:1", []byte("robert@example.com"), []byte("bobby@example.com"))
+	if !ok || err != nil {
+		t.Fatalf("expected swap, got: %t %v", ok, err)
+	}
+	if got, err := db.IndexLookup("email", "bobby@example.com"); err != nil || got != "user:1" {
+		t.Errorf("expected user:1, got: %q %v", got, err)
+	}
+	if _, err = db.Get(indexKey("email", "robert@example.com")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected removed index entry, got: %v", err)
+	}
+}
+
+func TestDBCreateIndex_existingKeys(t *testing.T) {
+	dir := t.TempDir()
+	db, close, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("user:1", []byte("bob@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+	if err = db.Set("user:2", []byte("alice@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.CreateIndex("email", emailExtractor); err != nil {
+		t.Fatal(err)
+	}
+	for derived, want := range map[string]string{"bob@example.com": "user:1", "alice@example.com": "user:2"} {
+		if got, err := db.IndexLookup("email", derived); err != nil || got != want {
+			t.Errorf("expected %s, got: %q %v", want, got, err)
+		}
+	}
+}
@@ -4,156 +4,1423 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 // segment represents a log file which is stored in SSTable format.
+//
+// The file is read only with ReadAt which is pread(2) on Unix: it doesn't change the file offset,
+// so ReadRecord is safe to call from multiple goroutines.
+// Read keeps its own offset in the records stream, therefore a sequential reader can run concurrently
+// with ReadRecord calls, though Read itself must be called from one goroutine at a time.
+// Segment merging and iterators don't share that offset, they read with newStreamReader instead.
 type segment struct {
 	// path is a path to the segment file.
 	path string
 	f    *os.File
+	// r reads the segment file, it's either the file or directIOReader.
+	r io.ReaderAt
+	// w writes the segment file, it's either the file or directIOWriter.
+	w io.Writer
+	// body reads the segment file after the version header, so the offsets don't depend on the header.
+	// It's set only when the segment is opened for reading.
+	body *io.SectionReader
+	// mode is the permission bits of the segment file, the sidecar file is created with the same ones.
+	mode os.FileMode
+	// custom indicates that the records are encoded by a custom Codec,
+	// so their values can be found only by decoding the whole records.
+	custom bool
+	// size is the size in bytes of the records stream known when the file was opened for reading.
+	// It equals the file size without the version header unless the segment consists of blocks.
+	size int64
+	// fileSize is the size of the segment file known when it was opened for reading.
+	fileSize int64
+	// blocks are the blocks of the segment file if it was written with blockWriter, otherwise nil.
+	blocks []blockHandle
+	// stream reads the records stream sequentially (uncompressed if the segment consists of blocks).
+	stream io.Reader
+	// pos is a position in the records stream where the next Read starts.
+	pos int64
 	// index is a hash map which is used to index keys on disk.
 	// Every key is mapped to a byte offset in the segment file where value is stored.
 	index map[string]int64
+	// sparse is a sparse index which replaces index when it's set: only one key per interval of the records stream
+	// is indexed, so a key is looked up by scanning forward from the nearest sampled key.
+	// Entries are sorted by keys as the records are.
+	sparse []indexEntry
+	// seekPoints are the keys sampled from index in sorted order to position scans, see seek.
+	// They're built once on the first seek, because only the segments which are scanned need them.
+	seekPoints []seekPoint
+	seekOnce   sync.Once
+	// bloom is a Bloom filter over the keys of the segment, nil means the segment may contain any key.
+	bloom *bloomFilter
+	// sketch estimates the number of distinct keys of the segment including the deleted ones, see buildSketch.
+	sketch *hyperLogLog
+	// level is the compaction level of the segment, see LeveledCompactor.
+	level int
+	// refs is a number of readers which pinned the segment, see ref and unref.
+	refs int32
+	// retired is set once compaction replaced the segment, see retire.
+	// It becomes 2 when the segment file is removed.
+	retired int32
+	// minKey and maxKey are the smallest and the largest keys of the segment known from its index.
+	// Empty maxKey means the key range is unknown.
+	minKey string
+	maxKey string
+	// cmp orders the keys of the segment, its name is saved in the sidecar file.
+	cmp keyComparator
 
-	decode func(b []byte) *record
+	decode func(b []byte) (*record, error)
 	encode func(out io.Writer, rec *record) error
 }
 
-// openReadonlySegment opens a segment file for reading.
-func openReadonlySegment(path string) (*segment, error) {
+// openReadonlySegment opens a segment file for reading, its records are decoded with the codec c
+// and its keys are ordered by cmp.
+// ErrComparatorMismatch is returned if the sidecar file says the keys were ordered by another comparator.
+func openReadonlySegment(path string, c Codec, cmp keyComparator) (*segment, error) {
 	s := segment{
-		path:  path,
-		index: make(map[string]int64),
+		path:   path,
+		index:  make(map[string]int64),
+		custom: !isBinaryCodec(c),
+		cmp:    cmp,
 	}
+	s.encode, s.decode = codecFuncs(c)
 
 	var err error
 	if s.f, err = os.Open(path); err != nil {
 		return nil, err
 	}
+	s.r = s.f
+	fi, err := s.f.Stat()
+	if err != nil {
+		s.f.Close()
+		return nil, err
+	}
+	s.mode = fi.Mode().Perm()
+	s.fileSize = fi.Size()
+	if err = s.readHeader(); err != nil {
+		s.f.Close()
+		return nil, err
+	}
+	s.stream = io.NewSectionReader(s.body, 0, s.size)
+
+	// Records might be grouped into blocks which is detected by the magic at the beginning of the body.
+	magic := make([]byte, len(blockMagic))
+	if _, err = s.body.ReadAt(magic, 0); err == nil && bytes.Equal(magic, blockMagic) {
+		if err = s.loadBlocks(s.size); err != nil {
+			s.f.Close()
+			return nil, err
+		}
+	}
+
+	// The index is loaded only when there is a sidecar file,
+	// otherwise it's up to the caller to build it with LoadIndex.
+	if _, err = os.Stat(path + indexFileSuffix); err == nil {
+		if err = s.LoadIndex(); err != nil {
+			s.f.Close()
+			return nil, err
+		}
+	}
 	return &s, nil
 }
 
-// openWriteonlySegment opens a new segment file for writing.
-func openWriteonlySegment(path string) (*segment, error) {
+// readHeader checks the version header of the segment file and positions the body after it.
+// The files written before the header was introduced have no header, so they're read from the beginning.
+// An error is returned if the file starts with an unrecognized magic or its major version is unknown.
+func (s *segment) readHeader() error {
+	s.body = io.NewSectionReader(s.r, 0, math.MaxInt64)
+	s.size = s.fileSize
+
+	// The headerless files start with a record length which is never zero, or with blockMagic.
+	header := make([]byte, segmentHeaderSize)
+	n, _ := s.r.ReadAt(header, 0)
+	if n < recordLengthSize || recordLength(header) != 0 || bytes.HasPrefix(header[:n], blockMagic) {
+		return nil
+	}
+	if n < segmentHeaderSize || !bytes.Equal(header[:len(segmentMagic)], segmentMagic) {
+		return fmt.Errorf("unrecognized magic in %s: %w", s.path, ErrCorruptRecord)
+	}
+	if v := binary.LittleEndian.Uint16(header[len(segmentMagic):]); v>>8 != segmentVersion>>8 {
+		return fmt.Errorf("%s has format version %d.%d: %w", s.path, v>>8, v&0xff, ErrUnsupportedVersion)
+	}
+
+	s.body = io.NewSectionReader(s.r, segmentHeaderSize, math.MaxInt64-segmentHeaderSize)
+	s.size -= segmentHeaderSize
+	return nil
+}
+
+// useDirectIO reopens the segment file opened for reading with O_DIRECT, so the reads bypass the page cache.
+// The file stays as is if the direct I/O isn't supported, see openDirectFile.
+// It must be called right after the segment is opened.
+func (s *segment) useDirectIO() error {
+	f, direct, err := openDirectFile(s.path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	if !direct {
+		return f.Close()
+	}
+	s.f.Close()
+	s.f = f
+	s.r = directIOReader{f: f}
+	// The body is positioned anew, and the size of the records stream is kept, because it's larger in a block segment.
+	size := s.size
+	if err = s.readHeader(); err != nil {
+		return err
+	}
+	s.size = size
+	_, err = s.Seek(0, io.SeekStart)
+	return err
+}
+
+// loadBlocks reads the headers and footers of the blocks to locate records in the segment file,
+// bodySize is the size of the file without the version header.
+func (s *segment) loadBlocks(bodySize int64) error {
+	s.blocks = []blockHandle{}
+	s.size = 0
+
+	header := make([]byte, blockHeaderSize)
+	footer := make([]byte, blockFooterSize)
+	for offset := int64(len(blockMagic)); offset < bodySize; {
+		if _, err := s.body.ReadAt(header, offset); err != nil {
+			return fmt.Errorf("failed to read block header at offset %d in %s: %w", offset, s.path, err)
+		}
+		h := blockHandle{
+			offset:  offset,
+			start:   s.size,
+			dataLen: int64(binary.LittleEndian.Uint32(header[1:])),
+			flag:    CompressionCodec(header[0]),
+		}
+		if _, err := s.body.ReadAt(footer, offset+blockHeaderSize+h.dataLen); err != nil {
+			return fmt.Errorf("failed to read block footer at offset %d in %s: %w", offset, s.path, err)
+		}
+		h.rawLen = int64(binary.LittleEndian.Uint32(footer))
+
+		s.blocks = append(s.blocks, h)
+		s.size += h.rawLen
+		offset += blockHeaderSize + h.dataLen + blockFooterSize
+	}
+
+	start := int64(len(blockMagic))
+	s.stream = newBlockReader(io.NewSectionReader(s.body, start, bodySize-start))
+	return nil
+}
+
+// openWriteonlySegment opens a new segment file for writing, the file is created with the mode permission bits,
+// and it starts with the version header of the current format.
+// The writes bypass the page cache if directIO is set and the file system supports it, see openDirectFile.
+func openWriteonlySegment(path string, mode os.FileMode, directIO bool) (*segment, error) {
 	s := segment{
-		path: path,
+		path:   path,
+		mode:   mode,
+		decode: decode,
+		encode: encode,
 	}
 
 	var err error
-	if s.f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err != nil {
+	flag := os.O_CREATE | os.O_EXCL | os.O_WRONLY
+	direct := false
+	if directIO {
+		s.f, direct, err = openDirectFile(path, flag, mode)
+	} else {
+		s.f, err = os.OpenFile(path, flag, mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.w = s.f
+	if direct {
+		s.w = newDirectIOWriter(s.f)
+	}
+	header := make([]byte, segmentHeaderSize)
+	copy(header, segmentMagic)
+	binary.LittleEndian.PutUint16(header[len(segmentMagic):], segmentVersion)
+	if _, err = s.w.Write(header); err != nil {
+		s.f.Close()
 		return nil, err
 	}
 	return &s, nil
 }
 
+// LoadIndex loads the segment index from the sidecar file if there is one,
+// otherwise the index is built by scanning the segment file.
+// A damaged sidecar file is replaced with the index built by the scan.
+// ErrComparatorMismatch is returned if the keys were ordered by another comparator.
+func (s *segment) LoadIndex() error {
+	idxPath := s.path + indexFileSuffix
+	index, cmpName, err := readIndexFile(idxPath)
+	if err == nil {
+		if cmpName != s.cmp.Name() {
+			return fmt.Errorf("%s keys are ordered by %q, not %q: %w", s.path, cmpName, s.cmp.Name(), ErrComparatorMismatch)
+		}
+		s.index = index
+		s.loadKeyRange()
+		return nil
+	}
+
+	if s.index, err = s.scanIndex(); err != nil {
+		return err
+	}
+	s.loadKeyRange()
+	if _, err = os.Stat(idxPath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return writeIndexFile(idxPath, s.index, s.cmp.Name(), s.mode)
+}
+
+// ref pins the segment, so it's kept while a reader uses it even if compaction replaced the segment.
+// False is returned if the segment was already retired, then it must not be read.
+func (s *segment) ref() bool {
+	atomic.AddInt32(&s.refs, 1)
+	if atomic.LoadInt32(&s.retired) != 0 {
+		s.unref()
+		return false
+	}
+	return true
+}
+
+// unref releases the segment pinned with ref.
+// The last reader of a retired segment removes its files.
+func (s *segment) unref() {
+	if atomic.AddInt32(&s.refs, -1) == 0 && atomic.LoadInt32(&s.retired) == 1 {
+		s.remove()
+	}
+}
+
+// retire marks the segment as replaced by compaction.
+// Its files are removed right away unless readers pinned the segment, then the last of them removes the files.
+// Note, the segment must be already excluded from the database segments, so new readers can't find it.
+func (s *segment) retire() {
+	atomic.StoreInt32(&s.retired, 1)
+	if atomic.LoadInt32(&s.refs) == 0 {
+		s.remove()
+	}
+}
+
+// remove closes the retired segment and removes its file along with the sidecar file.
+// The files are removed only once even if the last reader and retire race.
+func (s *segment) remove() {
+	if !atomic.CompareAndSwapInt32(&s.retired, 1, 2) {
+		return
+	}
+	s.Close()
+	os.Remove(s.path)
+	os.Remove(s.path + indexFileSuffix)
+}
+
+// pinned reports whether the segment is pinned by a snapshot.
+func (s *segment) pinned() bool {
+	return atomic.LoadInt32(&s.refs) > 0
+}
+
+// BuildIndex builds the segment index by scanning the segment file from the beginning
+// and saves it into the sidecar file, e.g., for segments written before sidecar files were introduced.
+func (s *segment) BuildIndex() error {
+	index, err := s.scanIndex()
+	if err != nil {
+		return err
+	}
+	s.index = index
+	s.loadKeyRange()
+	return writeIndexFile(s.path+indexFileSuffix, s.index, s.cmp.Name(), s.mode)
+}
+
+// buildSketch builds the sketch of the keys from the index,
+// so it must be called before the sparse index replaces the index.
+func (s *segment) buildSketch() {
+	s.sketch = newHyperLogLog(hllPrecision)
+	for key := range s.index {
+		s.sketch.Add(key)
+	}
+}
+
+// loadKeyRange finds the smallest and the largest keys in the index.
+func (s *segment) loadKeyRange() {
+	s.minKey, s.maxKey = "", ""
+	for key := range s.index {
+		if s.maxKey == "" || s.cmp.Compare(key, s.minKey) < 0 {
+			s.minKey = key
+		}
+		if s.maxKey == "" || s.cmp.Compare(key, s.maxKey) > 0 {
+			s.maxKey = key
+		}
+	}
+}
+
+// Overlaps returns true if the segment might contain keys from the range [min, max].
+// A segment with unknown key range or an empty max key overlaps any range.
+func (s *segment) Overlaps(min, max string) bool {
+	if s.maxKey == "" || max == "" {
+		return true
+	}
+	return s.cmp.Compare(s.minKey, max) <= 0 && s.cmp.Compare(min, s.maxKey) <= 0
+}
+
+// MayContain returns false if the key is definitely not in the segment.
+func (s *segment) MayContain(key string) bool {
+	return s.bloom == nil || s.bloom.MayContain(key)
+}
+
+// newStreamReader returns a reader of the records stream from the beginning.
+// Unlike Read, the reader has its own position, so multiple readers can be used concurrently.
+func (s *segment) newStreamReader() io.Reader {
+	if s.blocks == nil {
+		return io.NewSectionReader(s.body, 0, s.size)
+	}
+	return newBlockReader(io.NewSectionReader(s.body, int64(len(blockMagic)), math.MaxInt64-int64(len(blockMagic))))
+}
+
+// newStreamReaderAt returns a reader of the records stream starting at the offset.
+// Only the block containing the offset is decompressed in a block segment, the preceding blocks are skipped.
+func (s *segment) newStreamReaderAt(offset int64) io.Reader {
+	if s.blocks == nil {
+		return io.NewSectionReader(s.body, offset, s.size-offset)
+	}
+	i := s.searchBlock(offset)
+	if i == len(s.blocks) {
+		return bytes.NewReader(nil)
+	}
+	h := s.blocks[i]
+	br := newBlockReader(io.NewSectionReader(s.body, h.offset, math.MaxInt64-h.offset))
+	br.skip = offset - h.start
+	return br
+}
+
+// seek returns the offset in the records stream where a scan of the keys greater than or equal to key
+// should start, and the key of the record preceding that offset to restore the prefix-compressed key.
+// With a sparse index it's the offset of the nearest sampled key which precedes the key,
+// so the scan doesn't depend on the records before it.
+// With the hash index it's the offset of the nearest seek point which precedes the key.
+func (s *segment) seek(key string) (offset int64, prev string) {
+	if key == "" {
+		return 0, ""
+	}
+	if s.maxKey != "" && s.cmp.Compare(key, s.maxKey) > 0 {
+		return s.size, ""
+	}
+	if s.sparse != nil {
+		i := sort.Search(len(s.sparse), func(i int) bool {
+			return s.cmp.Compare(s.sparse[i].key, key) > 0
+		})
+		if i == 0 {
+			return 0, ""
+		}
+		return s.sparse[i-1].offset, ""
+	}
+
+	s.seekOnce.Do(s.loadSeekPoints)
+	i := sort.Search(len(s.seekPoints), func(i int) bool {
+		return s.cmp.Compare(s.seekPoints[i].key, key) > 0
+	})
+	if i == 0 {
+		return 0, ""
+	}
+	p := s.seekPoints[i-1]
+	return p.offset, p.prev
+}
+
+// seekInterval is a number of keys of the hash index per seek point.
+const seekInterval = 16
+
+// seekPoint is a key sampled from the hash index with the offset of its record.
+// The record's key might be prefix-compressed, so the key of the preceding record is kept to restore it.
+// The records of a segment are sorted and unique, so the preceding record has the preceding key of the index.
+type seekPoint struct {
+	key    string
+	offset int64
+	prev   string
+}
+
+// loadSeekPoints samples every seekInterval-th key of the hash index in sorted order.
+func (s *segment) loadSeekPoints() {
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.cmp.Compare(keys[i], keys[j]) < 0
+	})
+
+	points := make([]seekPoint, 0, len(keys)/seekInterval+1)
+	for i := 0; i < len(keys); i += seekInterval {
+		p := seekPoint{key: keys[i], offset: s.index[keys[i]]}
+		if i > 0 {
+			p.prev = keys[i-1]
+		}
+		points = append(points, p)
+	}
+	s.seekPoints = points
+}
+
+// scanIndex builds the index by reading the records stream from the beginning.
+// It doesn't affect Read.
+func (s *segment) scanIndex() (map[string]int64, error) {
+	index := make(map[string]int64)
+	err := s.scanRecords(func(key string, offset int64, _ bool) {
+		index[key] = offset
+	})
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// indexEntry is a key sampled into a sparse index and the offset of its record in the records stream.
+type indexEntry struct {
+	key    string
+	offset int64
+}
+
+// LoadSparseIndex replaces the index with a sparse index built by scanning the segment file:
+// one key is sampled per interval bytes of the records stream.
+// It trades memory for a bounded number of extra reads, see Lookup.
+func (s *segment) LoadSparseIndex(interval int64) error {
+	sparse := []indexEntry{}
+	next := int64(0)
+	var last string
+	err := s.scanRecords(func(key string, offset int64, restart bool) {
+		last = key
+		// Lookup reads the records starting from a sampled key, so its record must not depend on the previous ones.
+		if offset < next || !restart {
+			return
+		}
+		sparse = append(sparse, indexEntry{key: key, offset: offset})
+		next = offset + interval
+	})
+	if err != nil {
+		return err
+	}
+
+	s.sparse = sparse
+	s.index = nil
+	// Records are sorted, so the key range spans from the first to the last record.
+	s.minKey, s.maxKey = "", last
+	if len(sparse) != 0 {
+		s.minKey = sparse[0].key
+	}
+	return nil
+}
+
+// Lookup returns the offset of the record with the key in the records stream.
+// With a sparse index the records are read from the nearest sampled key which precedes the key
+// up to the next sampled key.
+func (s *segment) Lookup(key string) (offset int64, found bool, err error) {
+	offset, found, _, err = s.LookupWithStats(key)
+	return offset, found, err
+}
+
+// LookupWithStats is like Lookup, but it also reports the reads made to scan the segment file
+// when the segment has a sparse index.
+func (s *segment) LookupWithStats(key string) (offset int64, found bool, st ReadStats, err error) {
+	if s.sparse == nil {
+		offset, found = s.index[key]
+		return offset, found, st, nil
+	}
+
+	i := sort.Search(len(s.sparse), func(i int) bool {
+		return s.cmp.Compare(s.sparse[i].key, key) > 0
+	})
+	if i == 0 {
+		return 0, false, st, nil
+	}
+	end := s.size
+	if i < len(s.sparse) {
+		end = s.sparse[i].offset
+	}
+
+	var (
+		rec    *record
+		prev   string
+		n      uint32
+		readSt ReadStats
+	)
+	for offset = s.sparse[i-1].offset; offset < end; offset += int64(n) {
+		rec, n, readSt, err = s.readRecordAt(offset)
+		st.add(readSt)
+		if err != nil {
+			return 0, false, st, err
+		}
+		if err = rec.restoreKey(prev); err != nil {
+			return 0, false, st, SegmentError{Path: s.path, Offset: offset, Err: err}
+		}
+		prev = rec.key
+		switch {
+		case rec.key == key:
+			return offset, true, st, nil
+		case s.cmp.Compare(rec.key, key) > 0:
+			return 0, false, st, nil
+		}
+	}
+	return 0, false, st, nil
+}
+
+// scanRecords reads the records stream from the beginning and calls fn with every record's key and offset.
+// Restart tells whether the record's key is stored uncompressed, so the record can be read without the previous ones.
+// It doesn't affect Read.
+func (s *segment) scanRecords(fn func(key string, offset int64, restart bool)) error {
+	r := s.NewReader()
+	for r.Next() {
+		fn(r.Record().key, r.Offset(), r.Restart())
+	}
+	return r.Err()
+}
+
+// NewReader returns a reader which iterates over the records of the segment sequentially from the beginning
+// of the records stream, so the records are read without the index, e.g., to scan or verify the segment.
+// Like newStreamReader, it has its own position, so it doesn't affect Read.
+func (s *segment) NewReader() *segmentReader {
+	return &segmentReader{
+		seg: s,
+		r:   bufio.NewReader(s.newStreamReader()),
+	}
+}
+
+// segmentReader reads the records of a segment one by one, see NewReader.
+// It advances by the length of every record, and it restores the prefix-compressed keys from the previous ones.
+//
+//	r := seg.NewReader()
+//	for r.Next() {
+//		rec := r.Record()
+//	}
+//	if err := r.Err(); err != nil {
+//	}
+type segmentReader struct {
+	seg *segment
+	r   *bufio.Reader
+	// offset is the offset of the next record in the records stream.
+	offset int64
+	// rec is the current record and recOffset is its offset in the records stream.
+	rec       *record
+	recOffset int64
+	// restart tells whether the key of the current record is stored uncompressed.
+	restart bool
+	err     error
+}
+
+// Next reads the next record which is then available through Record.
+// It returns false when the end of the records stream is reached or an error occurred, see Err.
+func (r *segmentReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+
+	recordLen := make([]byte, recordLengthSize)
+	if _, err := io.ReadFull(r.r, recordLen); err == io.EOF {
+		return false
+	} else if err != nil {
+		r.err = fmt.Errorf("failed to read record at offset %d in %s: %v: %w", r.offset, r.seg.path, err, ErrCorruptRecord)
+		return false
+	}
+	blen := recordLength(recordLen)
+	if blen < recordLengthSize || int64(blen) > r.seg.size-r.offset {
+		r.err = fmt.Errorf("failed to read record at offset %d in %s: record length %d: %w", r.offset, r.seg.path, blen, ErrCorruptRecord)
+		return false
+	}
+
+	b := make([]byte, blen)
+	copy(b, recordLen)
+	if _, err := io.ReadFull(r.r, b[recordLengthSize:]); err != nil {
+		r.err = fmt.Errorf("failed to read record at offset %d in %s: %v: %w", r.offset, r.seg.path, err, ErrCorruptRecord)
+		return false
+	}
+	rec, err := r.seg.decode(b)
+	if err != nil {
+		r.err = fmt.Errorf("failed to decode record at offset %d in %s: %w", r.offset, r.seg.path, err)
+		return false
+	}
+	restart := rec.shared == 0
+	var prev string
+	if r.rec != nil {
+		prev = r.rec.key
+	}
+	if err = rec.restoreKey(prev); err != nil {
+		r.err = fmt.Errorf("failed to decode record at offset %d in %s: %w", r.offset, r.seg.path, err)
+		return false
+	}
+
+	r.rec, r.recOffset, r.restart = rec, r.offset, restart
+	r.offset += int64(blen)
+	return true
+}
+
+// Record returns the record read by the last Next call.
+func (r *segmentReader) Record() *record {
+	return r.rec
+}
+
+// Offset returns the offset of the current record in the records stream.
+func (r *segmentReader) Offset() int64 {
+	return r.recOffset
+}
+
+// Restart reports whether the key of the current record is stored uncompressed,
+// so the record can be read at its offset without the previous ones.
+func (r *segmentReader) Restart() bool {
+	return r.restart
+}
+
+// Err returns the first error that occurred while reading the records.
+func (r *segmentReader) Err() error {
+	return r.err
+}
+
 // Close closes a segment file which was opened either for reads or writes.
 func (s *segment) Close() error {
 	return s.f.Close()
 }
 
-// Read reads from underlying segment file without decoding bytes.
+// Read reads the records stream from underlying segment file without decoding bytes.
+// Blocks are decompressed, so the caller always reads the records stream.
+// The file offset is not changed, see ReadAt.
 func (s *segment) Read(p []byte) (n int, err error) {
-	return s.f.Read(p)
+	n, err = s.stream.Read(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+// Seek sets the position in the records stream for the next Read.
+// Blocks are skipped without decompression, only the block containing the position is decompressed.
+func (s *segment) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, fmt.Errorf("Seek in %s: invalid whence %d", s.path, whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Seek in %s: negative position %d", s.path, offset)
+	}
+
+	s.pos = offset
+	if s.blocks == nil {
+		s.stream = io.NewSectionReader(s.body, offset, s.size-offset)
+		return offset, nil
+	}
+
+	i := s.searchBlock(offset)
+	if i == len(s.blocks) {
+		s.stream = bytes.NewReader(nil)
+		return offset, nil
+	}
+	h := s.blocks[i]
+	s.stream = newBlockReader(io.NewSectionReader(s.body, h.offset, math.MaxInt64-h.offset))
+	if _, err := io.CopyN(ioutil.Discard, s.stream, offset-h.start); err != nil {
+		return 0, fmt.Errorf("Seek in %s: %w", s.path, err)
+	}
+	return offset, nil
+}
+
+// ReadAt reads len(p) bytes of the records stream starting at offset off.
+// Like Read, it doesn't change the file offset, and it doesn't affect Read either.
+func (s *segment) ReadAt(p []byte, off int64) (n int, err error) {
+	if s.blocks == nil {
+		return io.NewSectionReader(s.body, 0, s.size).ReadAt(p, off)
+	}
+
+	for n < len(p) {
+		i := s.searchBlock(off)
+		if off < 0 || i == len(s.blocks) {
+			return n, io.EOF
+		}
+		block, err := s.readBlock(i)
+		if err != nil {
+			return n, err
+		}
+		m := copy(p[n:], block[off-s.blocks[i].start:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// Size returns the size of the records stream in bytes.
+// It equals the file size unless the segment consists of blocks.
+func (s *segment) Size() int64 {
+	return s.size
 }
 
 // Write writes into underlying segment file.
 // Write can't encode bytes because it doesn't know its structure, so it's callers responsibility to
 // encode records and then calling Flush at the end to commit the changes on disk.
 func (s *segment) Write(p []byte) (n int, err error) {
-	return s.f.Write(p)
+	return s.w.Write(p)
 }
 
 // Flush commits the current contents of the segment to disk.
 func (s *segment) Flush() error {
+	if dw, ok := s.w.(*directIOWriter); ok {
+		if err := dw.Flush(); err != nil {
+			return err
+		}
+	}
 	return s.f.Sync()
 }
 
+// segmentWriter writes records into a segment file optionally grouping them into compressed blocks.
+// Records are indexed by their offsets in the records stream, and the index is saved into the sidecar file.
+// Callers must mark records with beginRecord and endRecord, and call Flush at the end.
+type segmentWriter struct {
+	seg *segment
+	// out is either the segment or the block writer.
+	out io.Writer
+	bw  *blockWriter
+	// offset is a position in the records stream where the next record starts.
+	offset int64
+	index  map[string]int64
+	// bloom collects the keys of the written records unless it's nil.
+	bloom *bloomFilter
+	// restartInterval is a number of records after which a key is stored uncompressed (restart point),
+	// the keys in between share their prefixes with the previous keys. One or less disables prefix compression.
+	restartInterval int
+	// prevKey is the key of the last written record.
+	prevKey string
+	// sinceRestart is a number of records written since the last restart point.
+	sinceRestart int
+}
+
+// newSegmentWriter creates a segmentWriter which compresses records with c.
+func newSegmentWriter(seg *segment, c CompressionCodec) *segmentWriter {
+	w := segmentWriter{
+		seg:   seg,
+		out:   seg,
+		index: make(map[string]int64),
+	}
+	if c != CompressionNone {
+		w.bw = newBlockWriter(seg, c)
+		w.out = w.bw
+	}
+	return &w
+}
+
+// Write writes bytes of a record.
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	n, err := w.out.Write(p)
+	w.offset += int64(n)
+	return n, err
+}
+
+// Flush writes the remaining records, commits the segment to disk, and saves the index sidecar file.
+func (w *segmentWriter) Flush() error {
+	if w.bw != nil {
+		if err := w.bw.Flush(); err != nil {
+			return fmt.Errorf("failed to write block: %w", err)
+		}
+	}
+	if err := w.seg.Flush(); err != nil {
+		return err
+	}
+	if err := writeIndexFile(w.seg.path+indexFileSuffix, w.index, w.seg.cmp.Name(), w.seg.mode); err != nil {
+		return fmt.Errorf("failed to write index file: %w", err)
+	}
+	return nil
+}
+
+// beginRecord tells segmentWriter that the record starts, so the record could be indexed.
+// It returns the record to encode whose key is prefix-compressed against the previous key
+// unless the record is a restart point or the compression is disabled.
+func beginRecord(out io.Writer, rec *record) *record {
+	w, ok := out.(*segmentWriter)
+	if !ok {
+		return rec
+	}
+	w.index[rec.key] = w.offset
+	if w.bloom != nil {
+		w.bloom.Add(rec.key)
+	}
+	if w.restartInterval <= 1 {
+		return rec
+	}
+
+	prev := w.prevKey
+	w.prevKey = rec.key
+	if w.sinceRestart == 0 {
+		w.sinceRestart = 1
+		return rec
+	}
+	if w.sinceRestart++; w.sinceRestart == w.restartInterval {
+		w.sinceRestart = 0
+	}
+	return rec.sharePrefix(prev)
+}
+
+// endRecord tells segmentWriter that a whole record was written, so it could cut a block.
+// The first record of a block is a restart point.
+func endRecord(out io.Writer) error {
+	w, ok := out.(*segmentWriter)
+	if !ok || w.bw == nil {
+		return nil
+	}
+	if err := w.bw.EndRecord(); err != nil {
+		return err
+	}
+	if w.bw.buf.Len() == 0 {
+		w.sinceRestart = 0
+	}
+	return nil
+}
+
 // ReadRecord reads a record (key-value pair) by the offset from the segment file.
+// The errors are SegmentError with the segment path and the offset to help finding a damaged file.
 func (s *segment) ReadRecord(offset int64) (*record, error) {
+	rec, _, err := s.ReadRecordWithStats(offset)
+	return rec, err
+}
+
+// ReadStats describes the reads of a segment file, so the read amplification can be measured,
+// e.g., how many bytes were read to find a key.
+type ReadStats struct {
+	// BytesRead is a number of bytes read from the segment file.
+	BytesRead int64
+	// SeeksPerformed is a number of reads at different offsets of the segment file.
+	SeeksPerformed int
+}
+
+// add accumulates the reads of other into st.
+func (st *ReadStats) add(other ReadStats) {
+	st.BytesRead += other.BytesRead
+	st.SeeksPerformed += other.SeeksPerformed
+}
+
+// ReadRecordWithStats is like ReadRecord, but it also reports the reads made to get the record.
+// The record length is read first and then the whole record, whereas the segment consisting of blocks
+// reads the entire block where the record is stored.
+func (s *segment) ReadRecordWithStats(offset int64) (*record, ReadStats, error) {
+	rec, _, st, err := s.readRecordAt(offset)
+	return rec, st, err
+}
+
+// readRecordAt is like ReadRecordWithStats, but it also returns the length of the encoded record,
+// so the next record can be read.
+func (s *segment) readRecordAt(offset int64) (*record, uint32, ReadStats, error) {
+	var st ReadStats
+	if s.blocks != nil {
+		if i := s.searchBlock(offset); offset >= 0 && i < len(s.blocks) {
+			st = ReadStats{BytesRead: s.blocks[i].dataLen, SeeksPerformed: 1}
+		}
+		rec, blen, err := s.readBlockRecord(offset)
+		return rec, blen, st, err
+	}
+
+	blen, _, err := s.readRecordLen(offset)
+	st = ReadStats{BytesRead: recordLengthSize, SeeksPerformed: 1}
+	if err != nil {
+		return nil, 0, st, err
+	}
+
+	b := make([]byte, blen)
+	st.add(ReadStats{BytesRead: int64(blen), SeeksPerformed: 1})
+	if _, err := s.body.ReadAt(b, offset); err != nil {
+		return nil, 0, st, SegmentError{Path: s.path, Offset: offset, Err: err}
+	}
+
+	rec, err := s.decode(b)
+	if err != nil {
+		return nil, 0, st, SegmentError{Path: s.path, Offset: offset, Err: err}
+	}
+	return rec, blen, st, nil
+}
+
+// readRecordLen reads only the length of a record stored by the offset in the segment file without blocks.
+// It also returns the record flags, e.g., whether the record value is prefixed with the expiry header.
+func (s *segment) readRecordLen(offset int64) (blen, flags uint32, err error) {
 	recordLen := make([]byte, recordLengthSize)
-	if _, err := s.f.ReadAt(recordLen, offset); err != nil {
-		return nil, err
+	if _, err = s.body.ReadAt(recordLen, offset); err != nil {
+		return 0, 0, SegmentError{Path: s.path, Offset: offset, Err: err}
+	}
+	blen = recordLength(recordLen)
+	if blen < recordLengthSize || int64(blen) > s.size-offset {
+		return 0, 0, SegmentError{Path: s.path, Offset: offset, Err: fmt.Errorf("record length %d: %w", blen, ErrCorruptRecord)}
+	}
+	return blen, binary.LittleEndian.Uint32(recordLen) & recordFlags, nil
+}
+
+// valueReader returns a reader of the value of the record with the key stored by the offset,
+// and the value length which is -1 for a tombstone or a record expired by now (Unix time in nanoseconds).
+// Only the record length and the expiry header are read from the file, unless the segment consists of blocks
+// which have to be decompressed. Pointer tells whether the value is a pointer to the value log.
+func (s *segment) valueReader(offset int64, key string, now int64) (r io.Reader, n int64, pointer bool, err error) {
+	if s.blocks != nil || s.custom {
+		rec, err := s.ReadRecord(offset)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if rec.deleted || rec.expired(now) {
+			return nil, -1, false, nil
+		}
+		return bytes.NewReader(rec.value), int64(len(rec.value)), rec.pointer, nil
+	}
+
+	blen, flags, err := s.readRecordLen(offset)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	// The prefix-compressed key is stored as the shared length byte and the rest of the key.
+	storedKey := []byte(key)
+	if flags&recordSharedFlag != 0 {
+		shared := make([]byte, 1)
+		if _, err = s.body.ReadAt(shared, offset+recordLengthSize); err != nil {
+			return nil, 0, false, SegmentError{Path: s.path, Offset: offset, Err: err}
+		}
+		if shared[0] == 0 || int(shared[0]) > len(key) {
+			return nil, 0, false, SegmentError{Path: s.path, Offset: offset, Err: ErrCorruptRecord}
+		}
+		storedKey = append(shared, key[shared[0]:]...)
+	}
+	// The record consists of the length, the key, the delimeter, the value, and the checksum.
+	// Tombstone has no delimeter, so its value length is -1.
+	start := offset + recordLengthSize + int64(len(storedKey)) + 1
+	n = int64(blen) - recordLengthSize - int64(len(storedKey)) - 1 - recordChecksumSize
+	if n < 0 {
+		return nil, -1, false, nil
+	}
+	crc := crc32.Update(crc32.Checksum(storedKey, crcTable), crcTable, []byte{recordKeyValueDelimeter})
+
+	// The value of a key with expiry is prefixed with the expiry header.
+	if flags&recordExpiresFlag != 0 {
+		if n < recordExpiresSize {
+			return nil, 0, false, SegmentError{Path: s.path, Offset: offset, Err: ErrCorruptRecord}
+		}
+		header := make([]byte, recordExpiresSize)
+		if _, err = s.body.ReadAt(header, start); err != nil {
+			return nil, 0, false, SegmentError{Path: s.path, Offset: offset, Err: err}
+		}
+		rec := record{expiresAt: int64(binary.LittleEndian.Uint64(header))}
+		if rec.expired(now) {
+			return nil, -1, false, nil
+		}
+		crc = crc32.Update(crc, crcTable, header)
+		start += recordExpiresSize
+		n -= recordExpiresSize
+	}
+
+	cr := checksumReader{
+		r:   io.NewSectionReader(s.body, start, n),
+		crc: crc,
+		sum: io.NewSectionReader(s.body, start+n, recordChecksumSize),
+	}
+	return &cr, n, flags&recordPointerFlag != 0, nil
+}
+
+// checksumReader reads a value of a record and verifies the record checksum once the value is read till the end.
+type checksumReader struct {
+	r io.Reader
+	// crc is the checksum of the record bytes read so far.
+	crc uint32
+	// sum reads the checksum stored in the record.
+	sum io.Reader
+	// err is the result of the checksum verification which is returned once the value is read.
+	err error
+}
+
+// Read reads the value. ErrChecksum is returned instead of io.EOF if the record doesn't match its checksum.
+func (c *checksumReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.r.Read(p)
+	c.crc = crc32.Update(c.crc, crcTable, p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+
+	b := make([]byte, recordChecksumSize)
+	switch _, err = io.ReadFull(c.sum, b); {
+	case err != nil:
+		c.err = fmt.Errorf("failed to read checksum: %v: %w", err, ErrCorruptRecord)
+	case c.crc != binary.LittleEndian.Uint32(b):
+		c.err = ErrChecksum
+	default:
+		c.err = io.EOF
+	}
+	return n, c.err
+}
+
+// readBlockRecord reads a record by the offset in the uncompressed records stream, and the record length.
+// The block containing the record is read and decompressed.
+func (s *segment) readBlockRecord(offset int64) (*record, uint32, error) {
+	i := s.searchBlock(offset)
+	if offset < 0 || i == len(s.blocks) {
+		return nil, 0, SegmentError{Path: s.path, Offset: offset, Err: io.EOF}
+	}
+	block, err := s.readBlock(i)
+	if err != nil {
+		return nil, 0, SegmentError{Path: s.path, Offset: offset, Err: err}
+	}
+
+	b := block[offset-s.blocks[i].start:]
+	if len(b) < recordLengthSize {
+		return nil, 0, SegmentError{Path: s.path, Offset: offset, Err: ErrCorruptRecord}
+	}
+	blen := recordLength(b)
+	if blen < recordLengthSize || int64(blen) > int64(len(b)) {
+		return nil, 0, SegmentError{Path: s.path, Offset: offset, Err: fmt.Errorf("record length %d: %w", blen, ErrCorruptRecord)}
+	}
+	rec, err := s.decode(b[:blen])
+	if err != nil {
+		return nil, 0, SegmentError{Path: s.path, Offset: offset, Err: err}
+	}
+	return rec, blen, nil
+}
+
+// readRecord reads the next encoded record from r which has n bytes left.
+// It returns io.EOF if there are no more records, and ErrCorruptRecord if the record is invalid.
+func readRecord(r io.Reader, n int64) ([]byte, error) {
+	recordLen := make([]byte, recordLengthSize)
+	if _, err := io.ReadFull(r, recordLen); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, ErrCorruptRecord
+	}
+	blen := recordLength(recordLen)
+	if blen < recordLengthSize || int64(blen) > n {
+		return nil, ErrCorruptRecord
 	}
-	blen := binary.LittleEndian.Uint32(recordLen)
 
 	b := make([]byte, blen)
-	if _, err := s.f.ReadAt(b, offset); err != nil {
-		return nil, err
+	copy(b, recordLen)
+	if _, err := io.ReadFull(r, b[recordLengthSize:]); err != nil {
+		return nil, ErrCorruptRecord
 	}
+	return b, nil
+}
+
+// searchBlock returns the index of the block which contains the offset in the records stream.
+// If the offset is beyond the stream, the number of blocks is returned.
+func (s *segment) searchBlock(offset int64) int {
+	return sort.Search(len(s.blocks), func(i int) bool {
+		return s.blocks[i].start+s.blocks[i].rawLen > offset
+	})
+}
 
-	return s.decode(b), nil
+// readBlock reads and decompresses i-th block.
+func (s *segment) readBlock(i int) ([]byte, error) {
+	h := s.blocks[i]
+	payload := make([]byte, h.dataLen)
+	if _, err := s.body.ReadAt(payload, h.offset+blockHeaderSize); err != nil {
+		return nil, err
+	}
+	return decodeBlock(h.flag, payload, uint32(h.rawLen))
 }
 
 const (
 	// recordLengthSize is a number of bytes needed to read a record from a file.
-	// 4 bytes are required for uint32 which gives max 4.295 GB record length.
+	// 4 bytes are required for uint32 where the three highest bits are reserved for recordExpiresFlag,
+	// recordSharedFlag, and recordPointerFlag which gives max 536 MB record length.
 	recordLengthSize        = 4
 	recordKeyValueDelimeter = byte('\x00')
+	// recordChecksumSize is a number of bytes of CRC-32C checksum at the end of a record.
+	recordChecksumSize = 4
+	// recordExpiresFlag is set in the record length when the value is prefixed with the expiry header.
+	recordExpiresFlag = 1 << 31
+	// recordExpiresSize is a number of bytes of the expiry header: Unix time in nanoseconds as int64.
+	recordExpiresSize = 8
+	// recordSharedFlag is set in the record length when the key is prefix-compressed:
+	// the length is followed by 1 byte which tells how many bytes the key shares with the previous key,
+	// and only the rest of the key is stored.
+	recordSharedFlag = 1 << 30
+	// recordPointerFlag is set in the record length when the value is a pointer to the value log
+	// where the actual value is stored, see valuePointer.
+	recordPointerFlag = 1 << 29
+	// recordFlags are the bits of the record length which are not a part of the length.
+	recordFlags = recordExpiresFlag | recordSharedFlag | recordPointerFlag
+	// maxSharedPrefix is the longest key prefix which can be shared with the previous key.
+	maxSharedPrefix = 255
+	// maxRecordLen is the longest record which fits in the record length without the flags.
+	maxRecordLen = recordPointerFlag - 1
+)
+
+/*
+The segment files start with the version header: 8 bytes of segmentMagic followed by
+2 bytes of the format version (little endian) where the high byte is the major version and the low byte is the minor one.
+The files written before the header was introduced have no header, they are read as the version 0.0.
+
+The minor version is bumped by compatible changes which don't change how the existing files are read,
+e.g., a new record flag or a new block compression type: the readers of the same major version
+keep reading the files which don't use them, and they report the records they can't decode as corrupt.
+The major version is bumped when the layout of the records or blocks changes, e.g., the width of the record length,
+so the readers reject the files of an unknown major version with ErrUnsupportedVersion,
+and the existing files require an explicit migration, e.g., rewriting them with a version which reads both formats.
+*/
+const (
+	// segmentHeaderSize is a number of bytes of the segment version header.
+	segmentHeaderSize = 10
+	// segmentVersion is the format version of the new segment files: major version 1, minor version 0.
+	segmentVersion uint16 = 0x0100
 )
 
+// segmentMagic starts the segment files with the version header.
+// Its first 4 bytes are zero record length like in blockMagic, so the headerless formats can't be confused with it.
+var segmentMagic = []byte{0, 0, 0, 0, 'H', 'S', 'E', 'G'}
+
+// crcTable is Castagnoli polynomial table used to checksum records.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // record represents a key-value pair in a segment file.
 type record struct {
 	// key represents priority to arrange records in priority queue during segment merging.
 	// When there are two records with the same key (equal priorities), then their order field is compared.
 	key   string
 	value []byte
-	// order is a segment number used during merging.
-	// It is used to return records in the order they were originally added.
+	// deleted indicates that the key was deleted (tombstone).
+	// Tombstone has no value and no key-value delimeter.
+	deleted bool
+	// order is a segment number used during merging, zero is the newest segment.
+	// Records with equal keys are returned from the newest segment to the oldest.
 	order int
+	// expiresAt is Unix time in nanoseconds when the key expires, zero means it never expires.
+	// Tombstone never expires.
+	expiresAt int64
+	// shared is a number of bytes the key shares with the key of the previous record in a segment.
+	// When it's not zero, the key holds only the rest of the bytes until it's restored with restoreKey.
+	shared int
+	// pointer indicates that the value is an encoded valuePointer to the value stored in the value log.
+	pointer bool
+}
+
+// restoreKey restores the prefix-compressed key of the record from the key of the previous record.
+// ErrCorruptRecord is returned if the previous key is too short.
+func (r *record) restoreKey(prev string) error {
+	if r.shared == 0 {
+		return nil
+	}
+	if r.shared > len(prev) {
+		return ErrCorruptRecord
+	}
+	r.key = prev[:r.shared] + r.key
+	r.shared = 0
+	return nil
+}
+
+// sharePrefix returns a copy of the record whose key is prefix-compressed against the previous key.
+// The record is returned as is if the keys have no common prefix.
+func (r *record) sharePrefix(prev string) *record {
+	n := 0
+	for n < len(prev) && n < len(r.key) && n < maxSharedPrefix && prev[n] == r.key[n] {
+		n++
+	}
+	if n == 0 {
+		return r
+	}
+	prefixed := *r
+	prefixed.key = r.key[n:]
+	prefixed.shared = n
+	return &prefixed
+}
+
+// expired returns true if the record expired by the given Unix time in nanoseconds.
+func (r *record) expired(now int64) bool {
+	return !r.deleted && r.expiresAt != 0 && r.expiresAt <= now
+}
+
+// hasExpiry returns true if the record is encoded with the expiry header.
+func (r *record) hasExpiry() bool {
+	return !r.deleted && r.expiresAt != 0
+}
+
+// size returns a number of bytes the record occupies when encoded.
+func (r *record) size() uint32 {
+	var n uint32
+	switch {
+	case r.deleted:
+		n = recordLengthSize + uint32(len(r.key)) + recordChecksumSize
+	case r.hasExpiry():
+		n = recordLen(r.key, r.value) + recordExpiresSize
+	default:
+		n = recordLen(r.key, r.value)
+	}
+	if r.shared != 0 {
+		n++
+	}
+	return n
+}
+
+// fits reports whether the record length fits in the record length bits, see maxRecordLen.
+// The length is calculated in int64, because size overflows uint32 on large values.
+func (r *record) fits() bool {
+	head := record{deleted: r.deleted, expiresAt: r.expiresAt, shared: r.shared}
+	n := int64(head.size()) + int64(len(r.key))
+	if !r.deleted {
+		n += int64(len(r.value))
+	}
+	return n <= maxRecordLen
+}
+
+// checksum returns CRC-32C of the key and value bytes of the record as they're encoded.
+func (r *record) checksum() uint32 {
+	var crc uint32
+	if r.shared != 0 {
+		crc = crc32.Checksum([]byte{byte(r.shared)}, crcTable)
+	}
+	crc = crc32.Update(crc, crcTable, []byte(r.key))
+	if r.deleted {
+		return crc
+	}
+	crc = crc32.Update(crc, crcTable, []byte{recordKeyValueDelimeter})
+	if r.hasExpiry() {
+		crc = crc32.Update(crc, crcTable, r.expiresHeader())
+	}
+	return crc32.Update(crc, crcTable, r.value)
+}
+
+// expiresHeader returns the encoded expiry header of the record.
+func (r *record) expiresHeader() []byte {
+	b := make([]byte, recordExpiresSize)
+	binary.LittleEndian.PutUint64(b, uint64(r.expiresAt))
+	return b
 }
 
 // encode prepares the key value pair to be stored in a file.
-// First 4 bytes store the length of a record. The rest of bytes are key-value (zero byte is used as a delimeter).
+// First 4 bytes store the length of a record. The rest of bytes are key-value (zero byte is used as a delimeter)
+// followed by 4 bytes CRC-32C checksum of the key-value bytes.
+// A tombstone is encoded as a key without a delimeter.
+// A key with expiry has recordExpiresFlag set in the length, and its value is prefixed with 8 bytes of expiresAt.
+// A prefix-compressed key has recordSharedFlag set in the length, and it's prefixed with the shared length byte.
+// A value stored in the value log has recordPointerFlag set in the length, and the value is the pointer to it.
 func encode(out io.Writer, rec *record) (err error) {
-	blen := recordLen(rec.key, rec.value)
-	if err = binary.Write(out, binary.LittleEndian, blen); err != nil {
+	if err = encodeRecord(out, rec, rec.size()); err != nil {
 		return err
 	}
+	return binary.Write(out, binary.LittleEndian, rec.checksum())
+}
+
+// decode returns key-value from encoded byte slice b.
+// ErrChecksum is returned if the key-value bytes don't match the checksum, i.e., the record is damaged.
+func decode(b []byte) (*record, error) {
+	if len(b) < recordLengthSize+recordChecksumSize {
+		return nil, ErrCorruptRecord
+	}
+	n := len(b) - recordChecksumSize
+	if crc32.Checksum(b[recordLengthSize:n], crcTable) != binary.LittleEndian.Uint32(b[n:]) {
+		return nil, ErrChecksum
+	}
+	return decodeUnchecked(b[:n])
+}
+
+// encodeUnchecked encodes the record without a checksum.
+// It is the format of the WAL files written by older versions.
+func encodeUnchecked(out io.Writer, rec *record) error {
+	return encodeRecord(out, rec, rec.size()-recordChecksumSize)
+}
 
+// encodeRecord writes the record length n followed by the key-value bytes.
+func encodeRecord(out io.Writer, rec *record, n uint32) error {
+	if !rec.fits() {
+		return fmt.Errorf("record exceeds %d bytes: %w", maxRecordLen, ErrValueTooLarge)
+	}
+	if rec.hasExpiry() {
+		n |= recordExpiresFlag
+	}
+	if rec.shared != 0 {
+		n |= recordSharedFlag
+	}
+	if rec.pointer && !rec.deleted {
+		n |= recordPointerFlag
+	}
 	ew := &errWriter{Writer: out}
+	binary.Write(ew, binary.LittleEndian, n)
+	if rec.shared != 0 {
+		ew.Write([]byte{byte(rec.shared)})
+	}
 	ew.Write([]byte(rec.key))
-	ew.Write([]byte{recordKeyValueDelimeter})
-	ew.Write(rec.value)
+	if !rec.deleted {
+		ew.Write([]byte{recordKeyValueDelimeter})
+		if rec.hasExpiry() {
+			ew.Write(rec.expiresHeader())
+		}
+		ew.Write(rec.value)
+	}
 	return ew.err
 }
 
-// decode returns key-value from encoded byte slice b.
-func decode(b []byte) *record {
+// decodeUnchecked returns key-value from encoded byte slice b which has no checksum.
+// A record without a key-value delimeter is a tombstone.
+// A prefix-compressed key is returned as is, see restoreKey.
+func decodeUnchecked(b []byte) (*record, error) {
+	if len(b) < recordLengthSize {
+		return nil, ErrCorruptRecord
+	}
+	flags := binary.LittleEndian.Uint32(b) & recordFlags
 	b = b[recordLengthSize:]
+	var shared int
+	if flags&recordSharedFlag != 0 {
+		if len(b) == 0 || b[0] == 0 {
+			return nil, ErrCorruptRecord
+		}
+		shared = int(b[0])
+		b = b[1:]
+	}
 	i := bytes.IndexByte(b, recordKeyValueDelimeter)
 	if i == -1 {
-		return nil
+		return &record{
+			key:     string(b),
+			deleted: true,
+			shared:  shared,
+		}, nil
 	}
 
 	rec := record{
 		key: string(b[0:i]),
 		// Skip delimeter and read till the end.
-		value: b[i+1:],
+		value:   b[i+1:],
+		shared:  shared,
+		pointer: flags&recordPointerFlag != 0,
 	}
-	return &rec
+	expires := flags&recordExpiresFlag != 0
+	if expires {
+		if len(rec.value) < recordExpiresSize {
+			return nil, ErrCorruptRecord
+		}
+		rec.expiresAt = int64(binary.LittleEndian.Uint64(rec.value))
+		rec.value = rec.value[recordExpiresSize:]
+	}
+	return &rec, nil
+}
+
+// recordLength returns the record length stored in the first 4 bytes of b without the flags.
+func recordLength(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b) &^ recordFlags
 }
 
 // recordLen is used to read next record in a segment file.
-// Max record len is 4,294,967,295 (4.295 GB).
+// Max record len is 536,870,911 (536 MB).
 // For example, start from 0 offset, read key-value pair, move to offset += recordLen(key, value).
 func recordLen(key string, value []byte) uint32 {
-	return recordLengthSize + uint32(len(key)) + 1 + uint32(len(value))
+	return recordLengthSize + uint32(len(key)) + 1 + uint32(len(value)) + recordChecksumSize
 }
 
 // split is a split function used to tokenize the input from segment file.
+// A token is a whole record including its length prefix which is the record boundary,
+// note the key-value delimeter can't be used for that since keys and values are binary.
+// The record length already counts the 4 bytes of the prefix, so it's the number of bytes to advance.
 func split(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	for i := 0; i < len(data); i++ {
-		if data[i] == recordKeyValueDelimeter {
-			return i + 1, data[:i], nil
+	if len(data) < recordLengthSize {
+		if atEOF && len(data) != 0 {
+			return 0, nil, ErrCorruptRecord
 		}
+		return 0, nil, nil
 	}
-	if !atEOF {
+
+	n := int(recordLength(data))
+	if n < recordLengthSize {
+		return 0, nil, ErrCorruptRecord
+	}
+	if len(data) < n {
+		if atEOF {
+			return 0, nil, ErrCorruptRecord
+		}
 		return 0, nil, nil
 	}
-	// There is one final token to be delivered, which may be the empty string.
-	// Returning bufio.ErrFinalToken here tells Scan there are no more tokens after this
-	// but does not trigger an error to be returned from Scan itself.
-	return 0, data, bufio.ErrFinalToken
+	return n, data[:n], nil
 }
@@ -1,14 +1,25 @@
 package hasty
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/marselester/hastydb/internal/index"
 )
 
 func TestOpenReadonlySegment_error(t *testing.T) {
@@ -22,7 +33,7 @@ func TestOpenReadonlySegment_error(t *testing.T) {
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			_, err := openReadonlySegment(tc.path)
+			_, err := openReadonlySegment(tc.path, BinaryCodec{}, keyComparator{})
 			if !errors.Is(err, tc.want) {
 				t.Errorf("expected: %v, got: %v", tc.want, err)
 			}
@@ -30,6 +41,53 @@ func TestOpenReadonlySegment_error(t *testing.T) {
 	}
 }
 
+func TestOpenReadonlySegment_version(t *testing.T) {
+	var rec bytes.Buffer
+	if err := encode(&rec, &record{key: "age", value: []byte("30")}); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		header []byte
+		want   error
+	}{
+		"current":       {header: []byte{0, 0, 0, 0, 'H', 'S', 'E', 'G', 0, 1}},
+		"newer minor":   {header: []byte{0, 0, 0, 0, 'H', 'S', 'E', 'G', 5, 1}},
+		"newer major":   {header: []byte{0, 0, 0, 0, 'H', 'S', 'E', 'G', 0, 2}, want: ErrUnsupportedVersion},
+		"unknown magic": {header: []byte{0, 0, 0, 0, 'H', 'X', 'X', 'X', 0, 1}, want: ErrCorruptRecord},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			segPath := filepath.Join(t.TempDir(), "seg")
+			if err := ioutil.WriteFile(segPath, append(tc.header, rec.Bytes()...), 0600); err != nil {
+				t.Fatal(err)
+			}
+			seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("expected: %v, got: %v", tc.want, err)
+			}
+			if err != nil {
+				return
+			}
+			defer seg.Close()
+
+			if seg.Size() != int64(rec.Len()) {
+				t.Errorf("expected records stream size %d, got: %d", rec.Len(), seg.Size())
+			}
+			if err = seg.LoadIndex(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := seg.ReadRecord(seg.index["age"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.key != "age" || string(got.value) != "30" {
+				t.Errorf("expected age 30, got: %+v", got)
+			}
+		})
+	}
+}
+
 func TestOpenWriteonlySegment_error(t *testing.T) {
 	tests := map[string]struct {
 		path string
@@ -45,7 +103,7 @@ func TestOpenWriteonlySegment_error(t *testing.T) {
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			_, err := openWriteonlySegment(tc.path)
+			_, err := openWriteonlySegment(tc.path, DefaultFileMode, false)
 			if !errors.Is(err, tc.want) {
 				t.Errorf("expected: %v, got: %v", tc.want, err)
 			}
@@ -64,8 +122,8 @@ func TestEncode(t *testing.T) {
 			key: "name",
 			// [66 111 98]
 			value: []byte("Bob"),
-			// record len (4 bytes) + key + delimeter (1 byte) + value
-			want: []byte{12, 0, 0, 0, 110, 97, 109, 101, 0, 66, 111, 98},
+			// record len (4 bytes) + key + delimeter (1 byte) + value + CRC-32C (4 bytes)
+			want: []byte{16, 0, 0, 0, 110, 97, 109, 101, 0, 66, 111, 98, 159, 209, 21, 104},
 		},
 	}
 
@@ -86,21 +144,65 @@ func TestEncode(t *testing.T) {
 	}
 }
 
+func TestRecordFits(t *testing.T) {
+	// The record length consists of 4 bytes of the length, the key, the delimeter, and 4 bytes of the checksum.
+	value := make([]byte, maxRecordLen-recordLen("name", nil))
+	rec := record{key: "name", value: value}
+	if !rec.fits() {
+		t.Errorf("expected %d bytes record to fit", rec.size())
+	}
+
+	rec.value = value[:len(value)-recordExpiresSize+1]
+	rec.expiresAt = 1
+	if rec.fits() {
+		t.Error("expected record with expiry header to be too large")
+	}
+	rec.deleted = true
+	if !rec.fits() {
+		t.Error("expected tombstone to fit")
+	}
+
+	// The value isn't written, because the record length overflows the length bits.
+	rec = record{key: "name", value: make([]byte, maxRecordLen)}
+	if err := encode(ioutil.Discard, &rec); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expected: %v, got: %v", ErrValueTooLarge, err)
+	}
+}
+
 func TestDecode(t *testing.T) {
 	tests := map[string]struct {
 		b         []byte
 		wantKey   string
 		wantValue []byte
+		wantErr   error
 	}{
 		"name=Bob": {
-			b:         []byte{12, 0, 0, 0, 110, 97, 109, 101, 0, 66, 111, 98},
+			b:         []byte{16, 0, 0, 0, 110, 97, 109, 101, 0, 66, 111, 98, 159, 209, 21, 104},
 			wantKey:   "name",
 			wantValue: []byte("Bob"),
 		},
+		"flipped byte": {
+			b:       []byte{16, 0, 0, 0, 110, 97, 109, 101, 0, 66, 111, 99, 159, 209, 21, 104},
+			wantErr: ErrChecksum,
+		},
+		"no checksum": {
+			b:       []byte{8, 0, 0, 0, 110, 97, 109, 101},
+			wantErr: ErrChecksum,
+		},
+		"too short": {
+			b:       []byte{7, 0, 0},
+			wantErr: ErrCorruptRecord,
+		},
 	}
 
-	for _, tc := range tests {
-		rec := decode(tc.b)
+	for name, tc := range tests {
+		rec, err := decode(tc.b)
+		if err != tc.wantErr {
+			t.Errorf("%s: expected: %v, got: %v", name, tc.wantErr, err)
+		}
+		if err != nil {
+			continue
+		}
 		if rec.key != tc.wantKey {
 			t.Errorf("expected key: %q got: %q", tc.wantKey, rec.key)
 		}
@@ -110,19 +212,820 @@ func TestDecode(t *testing.T) {
 	}
 }
 
-func plainDecode(b []byte) *record {
+// plainDecode decodes "key:value" record, a key without a value is a tombstone.
+func plainDecode(b []byte) (*record, error) {
 	kv := strings.Split(string(b), ":")
+	if len(kv) == 1 {
+		return &record{
+			key:     kv[0],
+			deleted: true,
+		}, nil
+	}
 	return &record{
 		key:   kv[0],
 		value: []byte(kv[1]),
-	}
+	}, nil
 }
 
 func plainEncode(out io.Writer, rec *record) (err error) {
 	ew := &errWriter{Writer: out}
 	ew.Write([]byte("\n"))
 	ew.Write([]byte(rec.key))
-	ew.Write([]byte(":"))
-	ew.Write([]byte(rec.value))
+	if !rec.deleted {
+		ew.Write([]byte(":"))
+		ew.Write([]byte(rec.value))
+	}
 	return ew.err
 }
+
+func TestEncodeDecode_tombstone(t *testing.T) {
+	rec := record{
+		key:     "name",
+		deleted: true,
+	}
+	var out bytes.Buffer
+	if err := encode(&out, &rec); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{12, 0, 0, 0, 110, 97, 109, 101, 231, 0, 18, 145}
+	if diff := cmp.Diff(want, out.Bytes()); diff != "" {
+		t.Fatalf(diff)
+	}
+
+	got, err := decode(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.key != rec.key || !got.deleted {
+		t.Errorf("expected tombstone %q, got: %+v", rec.key, got)
+	}
+}
+
+func FuzzEncodeDecode(f *testing.F) {
+	f.Add("name", []byte("Bob"))
+	f.Add("name", []byte{})
+	f.Add("user:1", []byte("\x00Alice\x00"))
+	f.Add("", []byte("empty key"))
+	f.Fuzz(func(t *testing.T, key string, value []byte) {
+		// The key-value delimeter can't be a part of a key.
+		if strings.IndexByte(key, recordKeyValueDelimeter) != -1 {
+			t.Skip()
+		}
+		var out bytes.Buffer
+		if err := encode(&out, &record{key: key, value: value}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := decode(out.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.key != key || got.deleted || !bytes.Equal(got.value, value) {
+			t.Errorf("expected %q=%q, got: %+v", key, value, got)
+		}
+	})
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte{16, 0, 0, 0, 110, 97, 109, 101, 0, 66, 111, 98, 159, 209, 21, 104})
+	f.Add([]byte{12, 0, 0, 0, 110, 97, 109, 101, 231, 0, 18, 145})
+	f.Add([]byte{8, 0, 0, 0, 110, 97, 109, 101})
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// Arbitrary bytes must be rejected with an error rather than a panic.
+		for _, dec := range []func([]byte) (*record, error){decode, decodeUnchecked} {
+			rec, err := dec(b)
+			if err == nil && rec == nil {
+				t.Errorf("expected record or error for %q", b)
+			}
+		}
+	})
+}
+
+func TestSegmentReadRecord(t *testing.T) {
+	seg, err := openReadonlySegment("testdata/readsegment", BinaryCodec{}, keyComparator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+
+	tests := map[string]struct {
+		offset int64
+		want   string
+	}{
+		"first record":  {0, "Bob"},
+		"second record": {16, "Jon"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec, err := seg.ReadRecord(tc.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rec.value) != tc.want {
+				t.Errorf("expected: %q, got: %q", tc.want, rec.value)
+			}
+		})
+	}
+}
+
+func TestSegmentReadRecordWithStats(t *testing.T) {
+	seg, err := openReadonlySegment("testdata/readsegment", BinaryCodec{}, keyComparator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+
+	// The record length is read first and then the whole 16 bytes record.
+	rec, st, err := seg.ReadRecordWithStats(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rec.value) != "Bob" {
+		t.Errorf("expected: Bob, got: %q", rec.value)
+	}
+	want := ReadStats{BytesRead: 20, SeeksPerformed: 2}
+	if st != want {
+		t.Errorf("expected: %+v, got: %+v", want, st)
+	}
+}
+
+func TestSegmentReadRecord_error(t *testing.T) {
+	seg, err := openReadonlySegment("testdata/readsegment", BinaryCodec{}, keyComparator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+
+	offset := seg.size + 1
+	_, err = seg.ReadRecord(offset)
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected: %v, got: %v", io.EOF, err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "testdata/readsegment") || !strings.Contains(msg, fmt.Sprint(offset)) {
+		t.Errorf("expected path and offset in error, got: %q", msg)
+	}
+	var segErr SegmentError
+	if !errors.As(err, &segErr) || segErr.Path != "testdata/readsegment" || segErr.Offset != offset {
+		t.Errorf("expected SegmentError at offset %d, got: %v", offset, err)
+	}
+}
+
+func TestSegmentReader(t *testing.T) {
+	mem := index.Memtable{}
+	mem.Set("alice", []byte("1"))
+	mem.Set("alien", []byte("2"))
+	mem.Delete("bob")
+	sw := sstableWriter{
+		encode:          encode,
+		restartInterval: 16,
+	}
+
+	for _, c := range []CompressionCodec{CompressionNone, CompressionSnappy} {
+		segPath := filepath.Join(t.TempDir(), "seg")
+		writeSegment(t, segPath, func(seg *segment) error {
+			out := newSegmentWriter(seg, c)
+			out.restartInterval = sw.restartInterval
+			if err := sw.write(out, &mem); err != nil {
+				return err
+			}
+			return out.Flush()
+		})
+		seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer seg.Close()
+
+		// The prefix-compressed key is restored, and the offsets match the index written along with the segment.
+		var got []string
+		r := seg.NewReader()
+		for r.Next() {
+			rec := r.Record()
+			if seg.index[rec.key] != r.Offset() {
+				t.Errorf("compression %d: expected %s at offset %d, got: %d", c, rec.key, seg.index[rec.key], r.Offset())
+			}
+			got = append(got, fmt.Sprintf("%s=%s deleted=%t restart=%t", rec.key, rec.value, rec.deleted, r.Restart()))
+		}
+		if err = r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{
+			"alice=1 deleted=false restart=true",
+			"alien=2 deleted=false restart=false",
+			"bob= deleted=true restart=true",
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("compression %d: %s", c, diff)
+		}
+		if r.Next() {
+			t.Errorf("compression %d: expected exhausted reader", c)
+		}
+	}
+}
+
+func TestSegmentReader_corrupt(t *testing.T) {
+	segPath := filepath.Join(t.TempDir(), "seg")
+	// The record length claims 100 bytes, but the file is shorter.
+	if err := ioutil.WriteFile(segPath, []byte{100, 0, 0, 0, 110, 0, 66}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+
+	r := seg.NewReader()
+	if r.Next() {
+		t.Fatalf("expected no records, got: %+v", r.Record())
+	}
+	if err = r.Err(); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("expected: %v, got: %v", ErrCorruptRecord, err)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	// The zero bytes in the values must not be taken for the record boundaries.
+	var in bytes.Buffer
+	recs := []*record{
+		{key: "age", value: []byte{0, 3, 0}},
+		{key: "name"},
+		{key: "zip", deleted: true},
+	}
+	for _, rec := range recs {
+		if err := encode(&in, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(in.Bytes()))
+	s.Split(split)
+	var got []*record
+	for s.Scan() {
+		rec, err := decode(s.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, rec)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(recs) {
+		t.Fatalf("expected %d records, got: %d", len(recs), len(got))
+	}
+	for i, rec := range recs {
+		if got[i].key != rec.key || !bytes.Equal(got[i].value, rec.value) || got[i].deleted != rec.deleted {
+			t.Errorf("expected %+v, got: %+v", rec, got[i])
+		}
+	}
+
+	// The last record is cut off.
+	s = bufio.NewScanner(bytes.NewReader(in.Bytes()[:in.Len()-1]))
+	s.Split(split)
+	for s.Scan() {
+	}
+	if err := s.Err(); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("expected: %v, got: %v", ErrCorruptRecord, err)
+	}
+}
+
+func TestSegmentReadRecord_corrupt(t *testing.T) {
+	segPath := filepath.Join(t.TempDir(), "seg")
+	// The record length claims 100 bytes, but the file is shorter.
+	if err := ioutil.WriteFile(segPath, []byte{100, 0, 0, 0, 110, 0, 66}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+
+	if _, err = seg.ReadRecord(0); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("expected: %v, got: %v", ErrCorruptRecord, err)
+	}
+}
+
+func TestSegment_concurrentReads(t *testing.T) {
+	segPath := filepath.Join(t.TempDir(), "seg")
+	var want bytes.Buffer
+	writeSegment(t, segPath, func(seg *segment) error {
+		out := newSegmentWriter(seg, CompressionNone)
+		for _, key := range []string{"age", "city", "name", "pet"} {
+			rec := record{key: key, value: []byte("value of " + key)}
+			beginRecord(out, &rec)
+			if err := encode(io.MultiWriter(out, &want), &rec); err != nil {
+				return err
+			}
+		}
+		return out.Flush()
+	})
+
+	seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+
+	// Records are looked up by offsets while the segment is read sequentially as during merging.
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			for key, offset := range seg.index {
+				rec, err := seg.ReadRecord(offset)
+				if err != nil {
+					errc <- err
+					return
+				}
+				if rec.key != key {
+					errc <- fmt.Errorf("expected %q, got: %q", key, rec.key)
+					return
+				}
+			}
+		}
+	}()
+
+	got, err := ioutil.ReadAll(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	select {
+	case err = <-errc:
+		t.Fatal(err)
+	default:
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("expected %q, got: %q", want.Bytes(), got)
+	}
+}
+
+func TestSegmentValueReader(t *testing.T) {
+	for _, c := range []CompressionCodec{CompressionNone, CompressionSnappy} {
+		segPath := filepath.Join(t.TempDir(), "seg")
+		writeSegment(t, segPath, func(seg *segment) error {
+			out := newSegmentWriter(seg, c)
+			for _, rec := range []record{
+				{key: "age", deleted: true},
+				{key: "city", value: []byte("Paris"), expiresAt: 100},
+				{key: "name", value: []byte("Bob")},
+				{key: "zip", value: []byte("7500"), expiresAt: 200},
+			} {
+				if err := encode(out, beginRecord(out, &rec)); err != nil {
+					return err
+				}
+			}
+			return out.Flush()
+		})
+
+		seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer seg.Close()
+
+		if _, n, _, err := seg.valueReader(seg.index["age"], "age", 150); err != nil || n != -1 {
+			t.Errorf("compression %d: expected tombstone, got: %d %v", c, n, err)
+		}
+		if _, n, _, err := seg.valueReader(seg.index["city"], "city", 150); err != nil || n != -1 {
+			t.Errorf("compression %d: expected expired key, got: %d %v", c, n, err)
+		}
+		tt := map[string]string{
+			"name": "Bob",
+			"zip":  "7500",
+		}
+		for key, want := range tt {
+			r, n, _, err := seg.valueReader(seg.index[key], key, 150)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(len(want)) {
+				t.Errorf("compression %d: expected %s value length %d, got: %d", c, key, len(want), n)
+			}
+			if got, err := ioutil.ReadAll(r); string(got) != want || err != nil {
+				t.Errorf("compression %d: expected %s, got: %s %v", c, want, got, err)
+			}
+		}
+	}
+}
+
+func TestRecordExpiry(t *testing.T) {
+	tt := []record{
+		{key: "name", value: []byte("Bob"), expiresAt: 1<<62 + 7},
+		{key: "name", value: []byte{}, expiresAt: 1},
+		{key: "name", value: []byte("Bob")},
+		// Tombstone is encoded without expiry.
+		{key: "name", deleted: true},
+	}
+	for _, rec := range tt {
+		var b bytes.Buffer
+		if err := encode(&b, &rec); err != nil {
+			t.Fatal(err)
+		}
+		if b.Len() != int(rec.size()) {
+			t.Errorf("%+v: expected encoded size %d, got: %d", rec, rec.size(), b.Len())
+		}
+		if got := recordLength(b.Bytes()); got != rec.size() {
+			t.Errorf("%+v: expected record length %d, got: %d", rec, rec.size(), got)
+		}
+
+		got, err := decode(b.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.key != rec.key || !bytes.Equal(got.value, rec.value) || got.deleted != rec.deleted || got.expiresAt != rec.expiresAt {
+			t.Errorf("expected %+v, got: %+v", rec, got)
+		}
+	}
+
+	rec := record{key: "name", value: []byte("Bob"), expiresAt: 100}
+	if rec.expired(99) || !rec.expired(100) {
+		t.Errorf("expected %+v to expire at 100", rec)
+	}
+	if rec = (record{key: "name", value: []byte("Bob")}); rec.expired(1 << 62) {
+		t.Errorf("expected %+v to never expire", rec)
+	}
+}
+
+func TestSegmentLookup_sparse(t *testing.T) {
+	mem := index.Memtable{}
+	for i := 0; i < 1000; i += 2 {
+		mem.Set(fmt.Sprintf("key%04d", i), []byte("value"))
+	}
+	sw := sstableWriter{
+		encode: encode,
+	}
+
+	for _, c := range []CompressionCodec{CompressionNone, CompressionSnappy} {
+		segPath := filepath.Join(t.TempDir(), "seg")
+		writeSegment(t, segPath, func(seg *segment) error {
+			out := newSegmentWriter(seg, c)
+			if err := sw.write(out, &mem); err != nil {
+				return err
+			}
+			return out.Flush()
+		})
+		seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer seg.Close()
+
+		want := seg.index
+		if err = seg.LoadSparseIndex(256); err != nil {
+			t.Fatal(err)
+		}
+		// Every record is 21 bytes long, so every 13th key is sampled.
+		if len(seg.sparse) != 39 || seg.index != nil {
+			t.Fatalf("expected 39 sampled keys instead of the index, got: %d", len(seg.sparse))
+		}
+
+		for i := -1; i <= 1000; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			offset, found, err := seg.Lookup(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantOffset, wantFound := want[key]
+			if found != wantFound || offset != wantOffset {
+				t.Fatalf("%s: expected offset %d found %t, got: %d %t", key, wantOffset, wantFound, offset, found)
+			}
+		}
+	}
+}
+
+func TestSegmentWriter_prefixCompression(t *testing.T) {
+	mem := index.Memtable{}
+	for i := 0; i < 1000; i += 2 {
+		mem.Set(fmt.Sprintf("key%04d", i), []byte("value"))
+	}
+	sw := sstableWriter{
+		encode:          encode,
+		restartInterval: 16,
+	}
+
+	for _, c := range []CompressionCodec{CompressionNone, CompressionSnappy} {
+		segPath := filepath.Join(t.TempDir(), "seg")
+		writeSegment(t, segPath, func(seg *segment) error {
+			out := newSegmentWriter(seg, c)
+			out.restartInterval = sw.restartInterval
+			if err := sw.write(out, &mem); err != nil {
+				return err
+			}
+			return out.Flush()
+		})
+		seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer seg.Close()
+
+		// Uncompressed records are 21 bytes long, a prefix-compressed one shares at least 5 bytes of the key with the previous one.
+		if seg.Size() >= 500*21 {
+			t.Errorf("compression %d: expected records stream shorter than %d bytes, got: %d", c, 500*21, seg.Size())
+		}
+		if rec, err := seg.ReadRecord(seg.index["key0002"]); err != nil || rec.shared != 6 || rec.key != "2" {
+			t.Errorf("compression %d: expected key0002 to share 6 bytes, got: %+v %v", c, rec, err)
+		}
+
+		// The keys restored by scanning the records must match the index written along with the segment.
+		scanned, err := seg.scanIndex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(seg.index, scanned); diff != "" {
+			t.Errorf("compression %d: %s", c, diff)
+		}
+		for key, offset := range seg.index {
+			r, n, _, err := seg.valueReader(offset, key, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := ioutil.ReadAll(r); string(got) != "value" || n != 5 || err != nil {
+				t.Fatalf("compression %d: expected %s value, got: %q %v", c, key, got, err)
+			}
+		}
+
+		// The sampled keys are restart points, so the keys after them can be restored.
+		want := seg.index
+		if err = seg.LoadSparseIndex(256); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range seg.sparse {
+			if rec, err := seg.ReadRecord(e.offset); err != nil || rec.shared != 0 {
+				t.Fatalf("compression %d: expected %s to be a restart point, got: %+v %v", c, e.key, rec, err)
+			}
+		}
+		for i := -1; i <= 1000; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			offset, found, err := seg.Lookup(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantOffset, wantFound := want[key]
+			if found != wantFound || offset != wantOffset {
+				t.Fatalf("compression %d: %s: expected offset %d found %t, got: %d %t", c, key, wantOffset, wantFound, offset, found)
+			}
+		}
+	}
+}
+
+func TestRecord_sharePrefix(t *testing.T) {
+	tt := []struct {
+		prev   string
+		rec    record
+		shared int
+	}{
+		{"", record{key: "user:0001", value: []byte("Bob")}, 0},
+		{"user:0001", record{key: "user:0002", value: []byte("Bob")}, 8},
+		{"user:0001", record{key: "user:1000", deleted: true}, 5},
+		{"user:0001", record{key: "user:0002", value: []byte("Bob"), expiresAt: 100}, 8},
+		{"admin", record{key: "user:0001", value: []byte("Bob")}, 0},
+		{strings.Repeat("a", 300), record{key: strings.Repeat("a", 301)}, maxSharedPrefix},
+	}
+	for _, tc := range tt {
+		prefixed := tc.rec.sharePrefix(tc.prev)
+		if prefixed.shared != tc.shared {
+			t.Errorf("%s: expected %d shared bytes, got: %d", tc.rec.key, tc.shared, prefixed.shared)
+		}
+
+		var b bytes.Buffer
+		if err := encode(&b, prefixed); err != nil {
+			t.Fatal(err)
+		}
+		if b.Len() != int(prefixed.size()) || recordLength(b.Bytes()) != prefixed.size() {
+			t.Errorf("%s: expected encoded size %d, got: %d", tc.rec.key, prefixed.size(), b.Len())
+		}
+		got, err := decode(b.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = got.restoreKey(tc.prev); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tc.rec, *got, cmp.AllowUnexported(record{}), cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%s: %s", tc.rec.key, diff)
+		}
+	}
+
+	rec := record{key: "2", shared: 5}
+	if err := rec.restoreKey("key"); err != ErrCorruptRecord {
+		t.Errorf("expected: %v, got: %v", ErrCorruptRecord, err)
+	}
+}
+
+func TestDBGet_sparseIndex(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithSparseIndexInterval(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for i := 0; i < 100; i++ {
+		if err = db.Set(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushDB(t, db)
+	if ss := db.segments.Load().([]*segment); len(ss) != 1 || ss[0].sparse == nil {
+		t.Fatal("expected a segment with a sparse index")
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, err = db.Get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = db.Get("missing"); err != ErrKeyNotFound {
+		t.Errorf("expected: %v, got: %v", ErrKeyNotFound, err)
+	}
+}
+
+func TestDBGetContext(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithSparseIndexInterval(64), WithBloomFilterBitsPerKey(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// The key is in the older segment, so the newer one is scanned first.
+	if err = db.Set("key005", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			continue
+		}
+		if err = db.Set(fmt.Sprintf("key%03d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushDB(t, db)
+
+	// The newer segment is slow to read.
+	seg := db.segments.Load().([]*segment)[0]
+	decode := seg.decode
+	seg.decode = func(b []byte) (*record, error) {
+		time.Sleep(5 * time.Millisecond)
+		return decode(b)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err = db.GetContext(ctx, "key005"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected: %v, got: %v", context.DeadlineExceeded, err)
+	}
+	if got, err := db.GetContext(context.Background(), "key005"); string(got) != "value" || err != nil {
+		t.Errorf("expected value, got: %q %v", got, err)
+	}
+}
+
+func TestDBOpenSegment(t *testing.T) {
+	type user struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+	want := map[string]user{
+		"user:1": {"Alice", 30},
+		"user:2": {"Bob", 25},
+		"user:3": {"Eve", 40},
+	}
+
+	for _, c := range []CompressionCodec{CompressionNone, CompressionSnappy} {
+		dir := t.TempDir()
+		db, close, err := Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer close()
+
+		segPath := filepath.Join(dir, "seg0")
+		writeSegment(t, segPath, func(seg *segment) error {
+			out := newSegmentWriter(seg, c)
+			for _, key := range []string{"user:1", "user:2", "user:3"} {
+				value, err := json.Marshal(want[key])
+				if err != nil {
+					return err
+				}
+				if err = encode(out, beginRecord(out, &record{key: key, value: value})); err != nil {
+					return err
+				}
+			}
+			return out.Flush()
+		})
+		seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer seg.Close()
+		db.setSegments([]*segment{seg})
+
+		paths, err := db.ListSegmentPaths()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]string{segPath}, paths); diff != "" {
+			t.Fatal(diff)
+		}
+
+		r, err := db.OpenSegment(paths[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		// An external reader parses the records on its own.
+		got := make(map[string]user)
+		recordLen := make([]byte, 4)
+		for {
+			if _, err = io.ReadFull(r, recordLen); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, binary.LittleEndian.Uint32(recordLen)-4)
+			if _, err = io.ReadFull(r, b); err != nil {
+				t.Fatal(err)
+			}
+			// The record ends with the checksum.
+			kv := bytes.SplitN(b[:len(b)-4], []byte{0}, 2)
+			var u user
+			if err = json.Unmarshal(kv[1], &u); err != nil {
+				t.Fatal(err)
+			}
+			got[string(kv[0])] = u
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("compression %d: %s", c, diff)
+		}
+
+		// The second record is read again after seeking to its offset, and with ReadAt.
+		offset := seg.index["user:2"]
+		if _, err = r.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(r, recordLen); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, binary.LittleEndian.Uint32(recordLen))
+		if _, err = seg.ReadAt(b, offset); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[:4], recordLen) {
+			t.Errorf("compression %d: expected record length %v, got: %v", c, recordLen, b[:4])
+		}
+		if rec, err := decode(b); err != nil || rec.key != "user:2" {
+			t.Errorf("compression %d: expected user:2, got: %s", c, rec.key)
+		}
+	}
+}
+
+func TestDBGet_checksum(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithBlockCacheSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+	// A byte of the value is flipped on disk.
+	seg := db.segments.Load().([]*segment)[0]
+	b, err := ioutil.ReadFile(seg.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[segmentHeaderSize+len("....name.")] ^= 1
+	if err = ioutil.WriteFile(seg.path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Get("name")
+	if !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected: %v, got: %v", ErrChecksum, err)
+	}
+	// The key and the damaged segment file are known from the error.
+	var keyErr KeyError
+	if !errors.As(err, &keyErr) || keyErr.Key != "name" {
+		t.Errorf("expected KeyError of name, got: %v", err)
+	}
+	var segErr SegmentError
+	if !errors.As(err, &segErr) || segErr.Path != seg.path || segErr.Offset != 0 {
+		t.Errorf("expected SegmentError at offset 0 of %s, got: %v", seg.path, err)
+	}
+
+	r, err := db.GetReader("name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err = ioutil.ReadAll(r); !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected: %v, got: %v", ErrChecksum, err)
+	}
+}
@@ -0,0 +1,124 @@
+package hasty
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// indexFileSuffix is appended to a segment path to name its index sidecar file.
+const indexFileSuffix = ".idx"
+
+// indexFileMagic starts every index sidecar file.
+var indexFileMagic = []byte("HIDX")
+
+// writeIndexFile saves the segment index into the sidecar file, so the segment doesn't have to be scanned
+// when it's opened. The file consists of 4 bytes magic, 4 bytes number of entries,
+// the entries sorted by key: 2 bytes key length, key, 8 bytes offset,
+// and the name of the comparator which ordered the segment keys: 2 bytes name length, name.
+// The file is written under a temporary name and then renamed, so it's either complete or absent.
+// Keys longer than 64 KB can't be saved, in that case the sidecar file is not written.
+// The file is created with the mode permission bits.
+func writeIndexFile(path string, index map[string]int64, cmpName string, mode os.FileMode) error {
+	keys := make([]string, 0, len(index))
+	for key := range index {
+		if len(key) > math.MaxUint16 {
+			return nil
+		}
+		keys = append(keys, key)
+	}
+	if len(cmpName) > math.MaxUint16 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	ew := &errWriter{Writer: bw}
+	b := make([]byte, 8)
+	ew.Write(indexFileMagic)
+	binary.LittleEndian.PutUint32(b, uint32(len(keys)))
+	ew.Write(b[:4])
+	for _, key := range keys {
+		binary.LittleEndian.PutUint16(b, uint16(len(key)))
+		ew.Write(b[:2])
+		ew.Write([]byte(key))
+		binary.LittleEndian.PutUint64(b, uint64(index[key]))
+		ew.Write(b)
+	}
+	binary.LittleEndian.PutUint16(b, uint16(len(cmpName)))
+	ew.Write(b[:2])
+	ew.Write([]byte(cmpName))
+	if ew.err != nil {
+		return ew.err
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// readIndexFile loads the segment index and the name of the comparator which ordered the keys from the sidecar file.
+// The files written before the comparator name was introduced are ordered by defaultComparatorName.
+// ErrCorruptRecord is returned if the file is damaged, e.g., truncated.
+func readIndexFile(path string) (index map[string]int64, cmpName string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	b := make([]byte, 8)
+	if _, err = io.ReadFull(r, b[:4]); err != nil || !bytes.Equal(b[:4], indexFileMagic) {
+		return nil, "", fmt.Errorf("bad magic in %s: %w", path, ErrCorruptRecord)
+	}
+	if _, err = io.ReadFull(r, b[:4]); err != nil {
+		return nil, "", fmt.Errorf("failed to read entries count in %s: %w", path, ErrCorruptRecord)
+	}
+	n := binary.LittleEndian.Uint32(b)
+
+	index = make(map[string]int64)
+	for i := uint32(0); i < n; i++ {
+		if _, err = io.ReadFull(r, b[:2]); err != nil {
+			return nil, "", fmt.Errorf("failed to read %d entry in %s: %w", i, path, ErrCorruptRecord)
+		}
+		key := make([]byte, binary.LittleEndian.Uint16(b))
+		if _, err = io.ReadFull(r, key); err != nil {
+			return nil, "", fmt.Errorf("failed to read %d entry in %s: %w", i, path, ErrCorruptRecord)
+		}
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, "", fmt.Errorf("failed to read %d entry in %s: %w", i, path, ErrCorruptRecord)
+		}
+		index[string(key)] = int64(binary.LittleEndian.Uint64(b))
+	}
+
+	switch _, err = io.ReadFull(r, b[:2]); {
+	case err == io.EOF:
+		return index, defaultComparatorName, nil
+	case err != nil:
+		return nil, "", fmt.Errorf("failed to read comparator name in %s: %w", path, ErrCorruptRecord)
+	}
+	name := make([]byte, binary.LittleEndian.Uint16(b))
+	if _, err = io.ReadFull(r, name); err != nil {
+		return nil, "", fmt.Errorf("failed to read comparator name in %s: %w", path, ErrCorruptRecord)
+	}
+	return index, string(name), nil
+}
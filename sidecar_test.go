@@ -0,0 +1,133 @@
+package hasty
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/marselester/hastydb/internal/index"
+)
+
+func TestIndexFile(t *testing.T) {
+	mem := index.Memtable{}
+	for i := 0; i < 100; i++ {
+		mem.Set(fmt.Sprintf("key%03d", i), []byte("value"))
+	}
+	mem.Delete("key042")
+	sw := sstableWriter{
+		encode: encode,
+	}
+	segPath := filepath.Join(t.TempDir(), "seg")
+	var want map[string]int64
+	writeSegment(t, segPath, func(seg *segment) error {
+		out := newSegmentWriter(seg, CompressionNone)
+		if err := sw.write(out, &mem); err != nil {
+			return err
+		}
+		want = out.index
+		return out.Flush()
+	})
+
+	if _, err := os.Stat(segPath + indexFileSuffix); err != nil {
+		t.Fatalf("expected index file: %v", err)
+	}
+	// The data file is emptied to make sure the index is loaded only from the sidecar file.
+	if err := os.Truncate(segPath, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+	if len(seg.index) != 100 {
+		t.Fatalf("expected 100 keys, got: %d", len(seg.index))
+	}
+	for key, offset := range want {
+		if seg.index[key] != offset {
+			t.Errorf("expected %s at offset %d, got: %d", key, offset, seg.index[key])
+		}
+	}
+}
+
+func TestIndexFile_corrupt(t *testing.T) {
+	tt := map[string][]byte{
+		"bad magic": []byte("HDX\x00\x01\x00\x00\x00"),
+		"truncated": []byte("HIDX\x02\x00\x00\x00\x04\x00name"),
+	}
+	for name, idx := range tt {
+		t.Run(name, func(t *testing.T) {
+			segPath := filepath.Join(t.TempDir(), "seg")
+			writeSegment(t, segPath, func(seg *segment) error {
+				if err := encode(seg, &record{key: "age", value: []byte("30")}); err != nil {
+					return err
+				}
+				return encode(seg, &record{key: "name", value: []byte("Bob")})
+			})
+			idxPath := segPath + indexFileSuffix
+			if err := os.WriteFile(idxPath, idx, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer seg.Close()
+			want := map[string]int64{"age": 0, "name": 14}
+			for key, offset := range want {
+				if got, ok := seg.index[key]; !ok || got != offset {
+					t.Errorf("expected %s at offset %d, got: %d", key, offset, got)
+				}
+			}
+
+			// The sidecar file is rewritten after the scan.
+			got, _, err := readIndexFile(idxPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 2 || got["name"] != 14 {
+				t.Errorf("expected rewritten index file, got: %v", got)
+			}
+		})
+	}
+}
+
+func TestSegmentBuildIndex(t *testing.T) {
+	segPath := filepath.Join(t.TempDir(), "seg")
+	writeSegment(t, segPath, func(seg *segment) error {
+		if err := encode(seg, &record{key: "age", value: []byte("30")}); err != nil {
+			return err
+		}
+		return encode(seg, &record{key: "name", value: []byte("Bob")})
+	})
+	idxPath := segPath + indexFileSuffix
+	if _, err := os.Stat(idxPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no index file: %v", err)
+	}
+
+	seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+	if len(seg.index) != 0 {
+		t.Fatalf("expected empty index, got: %v", seg.index)
+	}
+	if err = seg.BuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if seg.index["name"] != 14 {
+		t.Errorf("expected name at offset 14, got: %v", seg.index)
+	}
+
+	got, _, err := readIndexFile(idxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["age"] != 0 || got["name"] != 14 {
+		t.Errorf("expected index file, got: %v", got)
+	}
+}
@@ -0,0 +1,35 @@
+package hasty
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+)
+
+// handleSignals closes the database when one of the signals is received, and then re-sends the signal
+// to the process so it is handled as if the database wasn't listening.
+// The signals are registered before handleSignals returns, so none of them is missed.
+// The returned stop func stops handling the signals, e.g., when the database was closed explicitly.
+func handleSignals(signals []os.Signal, closeDB func() error, logger *slog.Logger) (stop func()) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, signals...)
+
+	ctx, stop := context.WithCancel(context.Background())
+	go func() {
+		defer signal.Stop(sigc)
+
+		select {
+		case sig := <-sigc:
+			if err := closeDB(); err != nil {
+				logger.Error("hasty: failed to close database on signal", "signal", sig, "error", err)
+			}
+			signal.Stop(sigc)
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				p.Signal(sig)
+			}
+		case <-ctx.Done():
+		}
+	}()
+	return stop
+}
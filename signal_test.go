@@ -0,0 +1,79 @@
+//go:build !windows
+// +build !windows
+
+package hasty
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWithSignalHandling(t *testing.T) {
+	// The child process writes keys and terminates itself without closing the database.
+	if dir := os.Getenv("HASTY_SIGNAL_TEST_DIR"); dir != "" {
+		db, _, err := Open(dir, WithSignalHandling())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err = db.Set(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Second)
+		t.Fatal("process wasn't terminated")
+	}
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWithSignalHandling$")
+	cmd.Env = append(os.Environ(), "HASTY_SIGNAL_TEST_DIR="+dir)
+	out, err := cmd.CombinedOutput()
+	if ee, ok := err.(*exec.ExitError); !ok || ee.Sys().(syscall.WaitStatus).Signal() != syscall.SIGTERM {
+		t.Fatalf("expected the process to be terminated by SIGTERM, got: %v\n%s", err, out)
+	}
+
+	// The memtable was saved on disk and its WAL file was removed.
+	seg, err := openReadonlySegment(filepath.Join(dir, "seg-L0-000000"), BinaryCodec{}, keyComparator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+	if len(seg.index) != 100 {
+		t.Errorf("expected 100 keys, got: %d", len(seg.index))
+	}
+	if _, err = os.Stat(filepath.Join(dir, "wal-000000")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected removed WAL, got: %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "wal-000001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != walHeaderSize {
+		t.Errorf("expected empty WAL, got %d bytes", fi.Size())
+	}
+}
+
+func TestWithSignalHandling_doubleClose(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithSignalHandling())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,154 @@
+package hasty
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/marselester/hastydb/internal/index"
+)
+
+// Snapshot is a point-in-time view of the database which isn't affected by later writes,
+// so multiple keys can be read consistently.
+// It keeps the immutable memtables and the segments pinned at the moment of creation,
+// therefore the snapshot should be closed once it's no longer needed to release them.
+// Note, snapshot is concurrency safe.
+type Snapshot struct {
+	db *DB
+
+	mu sync.RWMutex
+	// memtables are the immutable memtables ordered from the newest to the oldest.
+	// They're kept after they're flushed, because the segments they were saved in aren't pinned by the snapshot.
+	memtables []*index.Memtable
+	// segments are pinned with ref until the snapshot is closed.
+	segments []*segment
+	closed   bool
+}
+
+// Snapshot returns a point-in-time view of the database.
+// The memtable keeps changing, so unless it's empty, it's rotated to become immutable instead of being copied,
+// and then the snapshot shares the immutable memtables and segments with the database.
+// Note, the rotation starts a new WAL file and flushes the memtable into a segment however small it is,
+// so frequent snapshots of a database being written, e.g., by Begin or Export, produce small segments
+// of level 0 until compaction merges them. Snapshot also waits for a flush if the maximum number
+// of immutable memtables wait to be saved on disk.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	if err := db.enter(); err != nil {
+		return nil, err
+	}
+	defer db.leave()
+
+	// The writes made after the rotation go into the new memtable which the snapshot doesn't see.
+	// The memtable of the read-only database is always empty.
+	db.memMu.RLock()
+	empty := db.memtable.Len() == 0
+	db.memMu.RUnlock()
+	if !empty {
+		db.startSSTableWriter()
+		if err := db.rotateMemtable(0); err != nil {
+			return nil, err
+		}
+	}
+
+	snap := Snapshot{db: db}
+	db.memMu.RLock()
+	// The value log files aren't garbage collected while the snapshot might read them.
+	atomic.AddInt32(&db.snapshots, 1)
+	snap.memtables = append(snap.memtables, db.immutables...)
+	// The segments are loaded under the lock, so the immutable memtable being flushed is found
+	// either among the memtables or the segments.
+	snap.segments = db.acquireSegments()
+	db.memMu.RUnlock()
+
+	return &snap, nil
+}
+
+// Get retrieves a key from the snapshot.
+func (snap *Snapshot) Get(key string) ([]byte, error) {
+	if key == "" {
+		return nil, ErrEmptyKey
+	}
+	if err := snap.db.enter(); err != nil {
+		return nil, err
+	}
+	defer snap.db.leave()
+
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+	if snap.closed {
+		return nil, ErrSnapshotClosed
+	}
+
+	for _, mem := range snap.memtables {
+		value, deleted, ok := lookupMemtable(mem, key)
+		switch {
+		case deleted:
+			return nil, ErrKeyNotFound
+		case ok:
+			return value, nil
+		}
+	}
+	return snap.db.searchSegments(context.Background(), snap.segments, key)
+}
+
+// ForEach calls fn with each key-value pair of the snapshot in ascending key order
+// without the deleted or expired keys. The iteration stops once fn returns an error which is returned by ForEach.
+func (snap *Snapshot) ForEach(fn func(key string, value []byte) error) error {
+	return snap.forEach(false, func(key string, value []byte, _ bool) error {
+		return fn(key, value)
+	})
+}
+
+// forEach is like ForEach, but it also calls fn with the deleted or expired keys if tombstones is set.
+// The tombstones are kept in the segments until compaction drops them.
+func (snap *Snapshot) forEach(tombstones bool, fn func(key string, value []byte, deleted bool) error) error {
+	if err := snap.db.enter(); err != nil {
+		return err
+	}
+	defer snap.db.leave()
+
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+	if snap.closed {
+		return ErrSnapshotClosed
+	}
+
+	it := Iterator{
+		cfg:  iteratorConfig{tombstones: tombstones},
+		vlog: snap.db.vlog,
+		cmp:  snap.db.cfg.comparator,
+	}
+	for _, mem := range snap.memtables {
+		it.sources = append(it.sources, newMemtableSource(mem, "", it.cmp))
+	}
+	it.start(snap.segments)
+	for ; it.Valid(); it.Next() {
+		if err := fn(it.Key(), it.Value(), it.Deleted()); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("failed to scan keys: %w", err)
+	}
+	return nil
+}
+
+// Close releases the memtables and segments of the snapshot.
+// Closing the snapshot more than once has no effect.
+func (snap *Snapshot) Close() error {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	if snap.closed {
+		return nil
+	}
+
+	for _, s := range snap.segments {
+		s.unref()
+	}
+	atomic.AddInt32(&snap.db.snapshots, -1)
+	snap.memtables = nil
+	snap.segments = nil
+	snap.closed = true
+	return nil
+}
@@ -0,0 +1,151 @@
+package hasty
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDBSnapshot(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for _, key := range []string{"planet", "name", "age"} {
+		if err = db.Set(key, []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushDB(t, db)
+	if err = db.Set("name", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The flush is held back, so the rotated memtable is still immutable when the snapshot is taken.
+	mem := db.memtable
+	if err = db.sstWriter.sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := db.Snapshot()
+	db.sstWriter.sem.Release(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	// The memtable became immutable and is shared with the snapshot instead of being copied.
+	if len(snap.memtables) != 1 || snap.memtables[0] != mem {
+		t.Errorf("expected the snapshot to share the memtable, got: %v", snap.memtables)
+	}
+
+	// The later writes and flushes don't affect the snapshot.
+	if err = db.Set("name", []byte("v3")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete("age"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("city", []byte("v3")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+
+	tt := map[string]string{
+		"planet": "v1",
+		"name":   "v2",
+		"age":    "v1",
+	}
+	for key, want := range tt {
+		if got, err := snap.Get(key); string(got) != want || err != nil {
+			t.Errorf("Get(%s) expected %s, got: %q %v", key, want, got, err)
+		}
+	}
+	if _, err = snap.Get("city"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", ErrKeyNotFound, err)
+	}
+
+	got := make(map[string]string)
+	err = snap.ForEach(func(key string, value []byte) error {
+		got[key] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(tt, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestSnapshotClose(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := db.segments.Load().([]*segment)[0]
+	if !seg.pinned() {
+		t.Error("expected segment to be pinned by snapshot")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = snap.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seg.pinned() {
+		t.Error("expected segment to be released")
+	}
+	if _, err = snap.Get("name"); !errors.Is(err, ErrSnapshotClosed) {
+		t.Errorf("expected: %v, got: %v", ErrSnapshotClosed, err)
+	}
+	err = snap.ForEach(func(key string, value []byte) error { return nil })
+	if !errors.Is(err, ErrSnapshotClosed) {
+		t.Errorf("expected: %v, got: %v", ErrSnapshotClosed, err)
+	}
+}
+
+func TestDBSnapshot_emptyMemtable(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+	walSeq := db.walSeq
+
+	// The empty memtable isn't rotated, so the snapshots don't start WAL files nor produce segments.
+	for i := 0; i < 3; i++ {
+		snap, err := db.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := snap.Get("name"); string(got) != "Alice" || err != nil {
+			t.Errorf("expected Alice, got: %q %v", got, err)
+		}
+		snap.Close()
+	}
+	if db.walSeq != walSeq {
+		t.Errorf("expected WAL sequence %d, got: %d", walSeq, db.walSeq)
+	}
+	if got := len(db.segments.Load().([]*segment)); got != 1 {
+		t.Errorf("expected 1 segment, got: %d", got)
+	}
+}
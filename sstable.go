@@ -4,7 +4,8 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"path/filepath"
+	"os"
+	"time"
 
 	"golang.org/x/sync/semaphore"
 
@@ -12,13 +13,21 @@ import (
 )
 
 // newSSTableWriter creates a sstableWriter that can save only one memtable at a time.
+// A notification received while the writer is busy is kept, so the memtables rotated meanwhile are saved next.
 func newSSTableWriter(db *DB) *sstableWriter {
-	return &sstableWriter{
-		db:     db,
-		notif:  make(chan struct{}),
-		sem:    semaphore.NewWeighted(1),
-		encode: encode,
+	w := sstableWriter{
+		db:              db,
+		notif:           make(chan struct{}, 1),
+		sem:             semaphore.NewWeighted(1),
+		compression:     levelCompression(db.cfg.levelCompression, 0, db.cfg.compression),
+		bloomBitsPerKey: db.cfg.bloomBitsPerKey,
+		indexInterval:   db.cfg.sparseIndexInterval,
+		restartInterval: db.cfg.restartInterval,
+		vlog:            db.vlog,
+		valueThreshold:  db.cfg.valueLogThreshold,
 	}
+	w.encode, _ = codecFuncs(db.cfg.codec)
+	return &w
 }
 
 // sstableWriter is an actor that is responsible for saving memtable on disk in SSTable format.
@@ -26,90 +35,208 @@ type sstableWriter struct {
 	db    *DB
 	notif chan struct{}
 	sem   *semaphore.Weighted
+	// compression defines how blocks of segment files are compressed.
+	compression CompressionCodec
+	// bloomBitsPerKey is a number of bits per key in the Bloom filters of segments, zero disables them.
+	bloomBitsPerKey int
+	// indexInterval is a number of bytes of records per indexed key, zero indexes every key.
+	indexInterval int64
+	// restartInterval is a number of records per uncompressed key, see segmentWriter.
+	restartInterval int
+	// vlog is where the values larger than valueThreshold are stored, zero threshold disables it.
+	vlog           *valueLog
+	valueThreshold int
 
 	encode func(out io.Writer, rec *record) error
 }
 
 // Run starts the actor which is stopped by cancelling context.
-// Note, actor will finish its job before exiting or else database might lose recent changes.
+// Note, actor will save the immutable memtables before exiting or else database might lose recent changes.
 func (w *sstableWriter) Run(ctx context.Context) error {
 	for {
 		select {
 		case <-w.notif:
-			if !w.sem.TryAcquire(1) {
-				break
-			}
 			// Flush failure indicates that database can't persist recent changes;
 			// it must be restarted and recovered from the WAL.
 			if err := w.flush(); err != nil {
+				w.db.cfg.logger.Error("hasty: failed to flush memtable", "error", err)
 				return err
 			}
-			w.sem.Release(1)
 		case <-ctx.Done():
+			if err := w.flush(); err != nil {
+				w.db.cfg.logger.Error("hasty: failed to flush memtable", "error", err)
+				return err
+			}
 			return ctx.Err()
 		}
 	}
 }
 
-// Notify informs the actor to persist the memtable on disk.
-// Note, if the memtable is being written on disk, new notifications are ignored.
+// Notify informs the actor to persist the immutable memtables on disk.
+// Note, if the memtables are being written on disk, the actor keeps only one notification.
 func (w *sstableWriter) Notify() {
-	w.notif <- struct{}{}
+	select {
+	case w.notif <- struct{}{}:
+	default:
+	}
 }
 
-// flush creates a new memtable and persists the previous memtable on disk.
+// flush persists the immutable memtables on disk from the oldest to the newest.
+// Flushes are serialized, so it's safe to call flush concurrently.
 func (w *sstableWriter) flush() error {
-	// New writes go into the new memtable and it also serves reads.
-	// Meanwhile the old memtable is being saved on disk,
-	// it remains available for reads until it's fully written on disk.
+	if err := w.sem.Acquire(context.Background(), 1); err != nil {
+		return err
+	}
+	defer w.sem.Release(1)
+
+	for {
+		w.db.memMu.RLock()
+		n := len(w.db.immutables)
+		var mem *index.Memtable
+		if n != 0 {
+			mem = w.db.immutables[n-1]
+		}
+		w.db.memMu.RUnlock()
+		if mem == nil {
+			break
+		}
+
+		if err := w.flushMemtable(mem); err != nil {
+			return err
+		}
+	}
+
+	// Segments can be merged once there are segments on disk.
+	w.db.startCompactor()
+	w.db.compactor.Notify()
+
+	return nil
+}
+
+// flushMemtable persists the oldest immutable memtable on disk.
+// Meanwhile new writes go into the memtable, and the immutable memtable remains available for reads
+// until it's fully written on disk.
+func (w *sstableWriter) flushMemtable(mem *index.Memtable) error {
+	if err := w.saveMemtable(mem); err != nil {
+		return err
+	}
+
 	w.db.memMu.Lock()
-	w.db.flushingMemtable = w.db.memtable
-	w.db.memtable = &index.Memtable{}
+	n := len(w.db.immutables) - 1
+	memWAL := w.db.immutableWALs[n]
+	w.db.immutables = w.db.immutables[:n]
+	w.db.immutableWALs = w.db.immutableWALs[:n]
+	w.db.memChanged()
 	w.db.memMu.Unlock()
 
-	segPath := filepath.Join(w.db.path, "seg0")
-	seg, err := openWriteonlySegment(segPath)
+	// The records of the memtable are in the segment, so its WAL file isn't needed anymore,
+	// while the newer writes are in the WAL files of the newer memtables.
+	w.db.cfg.logger.Debug("hasty: removing WAL", "path", memWAL.path, "size", memWAL.Size())
+	if err := memWAL.Close(); err != nil {
+		return fmt.Errorf("failed to close WAL: %w", err)
+	}
+	if err := os.Remove(memWAL.path); err != nil {
+		return fmt.Errorf("failed to remove WAL: %w", err)
+	}
+
+	// A write waiting for the memtable to be saved can proceed.
+	w.db.immutableSem.Release(1)
+	return nil
+}
+
+// saveMemtable writes the memtable into a new segment which is added to the database's segments list.
+func (w *sstableWriter) saveMemtable(mem *index.Memtable) error {
+	segPath := w.db.nextSegmentPath(0)
+	start := time.Now()
+	w.db.cfg.logger.Info("hasty: flushing memtable", "segment", segPath, "keys", mem.Len(), "size", mem.Size())
+	seg, err := openWriteonlySegment(segPath, w.db.cfg.fileMode, w.db.cfg.directIO)
 	if err != nil {
-		return fmt.Errorf("failed to open %q segment: %w", segPath, err)
+		return SegmentError{Path: segPath, Offset: -1, Err: fmt.Errorf("failed to open segment: %w", err)}
+	}
+	seg.cmp = w.db.cfg.comparator
+	sw := newSegmentWriter(seg, w.compression)
+	sw.restartInterval = w.restartInterval
+	if err = w.write(sw, mem); err != nil {
+		return SegmentError{Path: segPath, Offset: -1, Err: fmt.Errorf("failed to write segment: %w", err)}
+	}
+	// The values must be on disk before the segment which points to them.
+	if w.valueThreshold > 0 {
+		if err = w.vlog.Sync(); err != nil {
+			return fmt.Errorf("failed to sync value log: %w", err)
+		}
 	}
-	if err = w.write(seg.f, w.db.flushingMemtable); err != nil {
-		return fmt.Errorf("failed to write %q segment: %w", segPath, err)
+	if err = sw.Flush(); err != nil {
+		return SegmentError{Path: segPath, Offset: -1, Err: fmt.Errorf("failed to flush segment: %w", err)}
 	}
 	if err = seg.Close(); err != nil {
-		return fmt.Errorf("failed to close %q segment: %w", segPath, err)
+		return SegmentError{Path: segPath, Offset: -1, Err: fmt.Errorf("failed to close segment: %w", err)}
+	}
+
+	// The segment is reopened to serve reads, its index is loaded from the sidecar file.
+	if seg, err = openReadonlySegment(segPath, w.db.cfg.codec, w.db.cfg.comparator); err != nil {
+		return SegmentError{Path: segPath, Offset: -1, Err: fmt.Errorf("failed to open segment: %w", err)}
+	}
+	if w.db.cfg.directIO {
+		if err = seg.useDirectIO(); err != nil {
+			seg.Close()
+			return SegmentError{Path: segPath, Offset: -1, Err: fmt.Errorf("failed to open segment: %w", err)}
+		}
+	}
+	seg.bloom = sw.bloom
+	seg.buildSketch()
+	if w.indexInterval > 0 {
+		if err = seg.LoadSparseIndex(w.indexInterval); err != nil {
+			return SegmentError{Path: segPath, Offset: -1, Err: fmt.Errorf("failed to index segment: %w", err)}
+		}
 	}
 
 	// Add new segment file at the beginning of the database's segments list.
 	w.db.segMu.Lock()
+	defer w.db.segMu.Unlock()
 	current := w.db.segments.Load().([]*segment)
 	ss := make([]*segment, len(current)+1)
 	copy(ss[1:], current)
 	ss[0] = seg
-	w.db.segments.Store(ss)
-	w.db.segMu.Unlock()
-
-	if err = w.db.wal.Truncate(); err != nil {
-		return fmt.Errorf("failed to truncate WAL: %w", err)
+	if err = w.db.manifest.Save(ss); err != nil {
+		seg.Close()
+		return fmt.Errorf("failed to save manifest: %w", err)
 	}
-
-	w.db.memMu.Lock()
-	w.db.flushingMemtable = nil
-	w.db.memMu.Unlock()
-
+	w.db.setSegments(ss)
+	w.db.cfg.logger.Info("hasty: flushed memtable", "segment", segPath, "size", seg.fileSize, "duration", time.Since(start))
 	return nil
 }
 
 // write writes memtable on disk in SSTable format.
 // SSTable is efficiently created from BST because it maintains keys in sorted order.
+// The keys are added to the Bloom filter of the segment as the records are written.
+// Values larger than the threshold are appended to the value log.
 func (w *sstableWriter) write(out io.Writer, bst *index.Memtable) (err error) {
-	for _, key := range bst.Keys() {
+	keys := bst.Keys()
+	if sw, ok := out.(*segmentWriter); ok && w.bloomBitsPerKey > 0 {
+		sw.bloom = newBloomFilterBitsPerKey(len(keys), w.bloomBitsPerKey)
+	}
+
+	for _, key := range keys {
 		rec := record{
-			key:   key,
-			value: bst.Get(key),
+			key: key,
 		}
-		if err = w.encode(out, &rec); err != nil {
+		// Tombstones are written as well to shadow the older versions of the keys.
+		rec.value, rec.deleted, _ = bst.Lookup(key)
+		rec.expiresAt = bst.ExpiresAt(key)
+		// The large value is stored in the value log, and the segment keeps the pointer to it.
+		if w.valueThreshold > 0 && !rec.deleted && len(rec.value) > w.valueThreshold {
+			p, err := w.vlog.Append(key, rec.value)
+			if err != nil {
+				return err
+			}
+			rec.value, rec.pointer = p.encode(), true
+		}
+		if err = w.encode(out, beginRecord(out, &rec)); err != nil {
 			return fmt.Errorf("failed to encode record: %w", err)
 		}
+		if err = endRecord(out); err != nil {
+			return fmt.Errorf("failed to write block: %w", err)
+		}
 	}
 	return nil
 }
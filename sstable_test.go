@@ -3,10 +3,13 @@ package hasty
 import (
 	"bufio"
 	"bytes"
-	"io/ioutil"
+	"context"
+	"log/slog"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 
@@ -71,7 +74,7 @@ handprinted:33632`,
 			scanner := bufio.NewScanner(strings.NewReader(tc.log))
 			scanner.Split(bufio.ScanWords)
 			for scanner.Scan() {
-				rec := plainDecode(scanner.Bytes())
+				rec, _ := plainDecode(scanner.Bytes())
 				mem.Set(rec.key, rec.value)
 			}
 
@@ -143,14 +146,14 @@ handprinted:33632`,
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			seg, err := openWriteonlySegment(segName)
+			seg, err := openWriteonlySegment(segName, DefaultFileMode, false)
 			if err != nil {
 				t.Fatal(err)
 			}
 			seg.encode = plainEncode
 			t.Cleanup(func() {
 				if err := os.Remove(segName); err != nil {
-					t.Errorf("failed to remove %q segment: %w", segName, err)
+					t.Errorf("failed to remove %q segment: %v", segName, err)
 				}
 			})
 
@@ -158,7 +161,7 @@ handprinted:33632`,
 			scanner := bufio.NewScanner(strings.NewReader(tc.log))
 			scanner.Split(bufio.ScanWords)
 			for scanner.Scan() {
-				rec := plainDecode(scanner.Bytes())
+				rec, _ := plainDecode(scanner.Bytes())
 				mem.Set(rec.key, rec.value)
 			}
 
@@ -172,13 +175,113 @@ handprinted:33632`,
 				t.Fatal(err)
 			}
 
-			got, err := ioutil.ReadFile(segName)
-			if err != nil {
-				t.Fatal(err)
-			}
+			got := readSegmentBody(t, segName)
 			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
 				t.Fatalf(diff)
 			}
 		})
 	}
 }
+
+// flushDB makes the database memtable immutable and saves it on disk as a new segment.
+func flushDB(t testing.TB, db *DB) {
+	t.Helper()
+
+	if err := db.rotateMemtable(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.sstWriter.flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDBSet_immutableMemtables(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithMaxMemtableSize(10), WithMaxImmutableMemtables(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// The sstableWriter can't save memtables while the test holds its semaphore.
+	if err = db.sstWriter.sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("name", []byte("Alice in Wonderland")); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.MustGet("name"); string(got) != "Alice in Wonderland" {
+		t.Errorf("expected the immutable memtable to serve reads, got: %s", got)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- db.Set("planet", []byte("Earth is the third planet"))
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("expected the write to wait for the immutable memtable to be saved, got: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	db.sstWriter.sem.Release(1)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := db.MustGet("planet"); string(got) != "Earth is the third planet" {
+		t.Errorf("expected planet=Earth is the third planet, got: %s", got)
+	}
+}
+
+// syncBuffer is a buffer which is safe to write from the database workers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDB_logger(t *testing.T) {
+	var out syncBuffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	db, close, err := Open(t.TempDir(), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for _, name := range []string{"Alice", "Bob"} {
+		if err = db.Set("name", []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		flushDB(t, db)
+	}
+	if err = db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := out.String()
+	for _, msg := range []string{
+		`level=INFO msg="hasty: flushing memtable" segment=`,
+		`level=INFO msg="hasty: flushed memtable" segment=`,
+		`level=DEBUG msg="hasty: removing WAL" path=`,
+		`level=INFO msg="hasty: merging segments" level=6 segments=2 estimated_keys=2`,
+		`level=INFO msg="hasty: merged segments" level=6 segment=`,
+	} {
+		if !strings.Contains(got, msg) {
+			t.Errorf("expected %q in log:\n%s", msg, got)
+		}
+	}
+	if !strings.Contains(got, "keys=1 ") {
+		t.Errorf("expected the merged segment to have 1 key:\n%s", got)
+	}
+}
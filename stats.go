@@ -0,0 +1,207 @@
+package hasty
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Stats represents database metrics at the moment DB.Stats was called.
+// The counters are accumulated since the database was opened.
+type Stats struct {
+	// MemtableSize is a size of the keys and values of the memtable in bytes.
+	MemtableSize int64
+	// MemtableKeyCount is a number of keys in the memtable including the deleted ones.
+	MemtableKeyCount int
+	// ImmutableMemtableCount is a number of full memtables waiting to be written on disk.
+	ImmutableMemtableCount int
+	// SegmentCount is a number of segment files.
+	SegmentCount int
+	// TotalDiskBytes is a size of the segment files and the WAL in bytes.
+	TotalDiskBytes int64
+	// WALBytes is a size of the WAL file in bytes.
+	WALBytes int64
+	// BloomFilterFalsePositives is a number of segment lookups where the segment's Bloom filter
+	// reported that a key might be there, but it wasn't.
+	BloomFilterFalsePositives uint64
+	// CompactionCount is a number of segments compactions including defragmentation.
+	CompactionCount uint64
+	// GetCount is a number of Get, LimitedGet, and GetReader calls.
+	GetCount uint64
+	// SetCount is a number of keys written including those written in batches and transactions.
+	// Deletions are not counted.
+	SetCount uint64
+	// SegmentBytesRead is a number of bytes read from the segment files to find keys which weren't in the memtables.
+	// Divided by GetCount it shows the read amplification: a growing number suggests to shrink
+	// the sparse index interval or enable Bloom filters.
+	SegmentBytesRead uint64
+	// SegmentSeeks is a number of reads at different offsets of the segment files to find keys.
+	SegmentSeeks uint64
+	// GetLatencyP99 is the 99th percentile of Get latency.
+	// It is approximate: latencies are counted in buckets of powers of two nanoseconds,
+	// so the upper bound of the bucket is reported.
+	GetLatencyP99 time.Duration
+}
+
+// dbMetrics are counters updated atomically on the hot path, so collecting them is cheap.
+type dbMetrics struct {
+	bloomFalsePositives uint64
+	compactions         uint64
+	gets                uint64
+	sets                uint64
+	segmentBytesRead    uint64
+	segmentSeeks        uint64
+	// getLatency is a histogram of Get latencies: i-th bucket counts latencies shorter than 2^i nanoseconds
+	// and not shorter than 2^(i-1).
+	getLatency [64]uint64
+}
+
+// observeGet counts a read of the key which took d.
+func (m *dbMetrics) observeGet(d time.Duration) {
+	atomic.AddUint64(&m.gets, 1)
+	atomic.AddUint64(&m.getLatency[bits.Len64(uint64(d))], 1)
+}
+
+// observeSegmentReads counts the reads of segment files made to find a key.
+func (m *dbMetrics) observeSegmentReads(st ReadStats) {
+	if st.SeeksPerformed == 0 {
+		return
+	}
+	atomic.AddUint64(&m.segmentBytesRead, uint64(st.BytesRead))
+	atomic.AddUint64(&m.segmentSeeks, uint64(st.SeeksPerformed))
+}
+
+// getLatencyPercentile returns the upper bound of the latency bucket where p-th percentile falls into, e.g., 0.99.
+func (m *dbMetrics) getLatencyPercentile(p float64) time.Duration {
+	var counts [64]uint64
+	var total uint64
+	for i := range m.getLatency {
+		counts[i] = atomic.LoadUint64(&m.getLatency[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(p * float64(total))
+	var seen uint64
+	for i, n := range counts {
+		seen += n
+		if seen > rank {
+			return time.Duration(1) << uint(i)
+		}
+	}
+	return math.MaxInt64
+}
+
+// Stats returns database metrics. It is cheap to call, so the metrics can be polled frequently.
+// Note, operation is concurrency safe.
+func (db *DB) Stats() Stats {
+	st := Stats{
+		BloomFilterFalsePositives: atomic.LoadUint64(&db.metrics.bloomFalsePositives),
+		CompactionCount:           atomic.LoadUint64(&db.metrics.compactions),
+		GetCount:                  atomic.LoadUint64(&db.metrics.gets),
+		SetCount:                  atomic.LoadUint64(&db.metrics.sets),
+		SegmentBytesRead:          atomic.LoadUint64(&db.metrics.segmentBytesRead),
+		SegmentSeeks:              atomic.LoadUint64(&db.metrics.segmentSeeks),
+		GetLatencyP99:             db.metrics.getLatencyPercentile(0.99),
+	}
+
+	db.memMu.RLock()
+	st.MemtableSize = int64(db.memtable.Size())
+	st.MemtableKeyCount = db.memtable.Len()
+	st.ImmutableMemtableCount = len(db.immutables)
+	db.memMu.RUnlock()
+
+	ss := db.segments.Load().([]*segment)
+	st.SegmentCount = len(ss)
+	for _, s := range ss {
+		st.TotalDiskBytes += s.fileSize
+	}
+	// The database opened read-only has no WAL.
+	if db.wal != nil {
+		st.WALBytes = db.walSize()
+		st.TotalDiskBytes += st.WALBytes
+	}
+	return st
+}
+
+// Size returns how much memory and disk the database uses for capacity management:
+// memBytes is a size of the keys and values of the memtable and the immutable memtables,
+// and diskBytes is a size of the segment files and the WAL.
+// The sizes of the segment files are known since they were written, and the WAL size is tracked as it's appended,
+// so the files aren't stat'ed and Size is cheap to poll.
+// Note, operation is concurrency safe.
+func (db *DB) Size() (memBytes int64, diskBytes int64, err error) {
+	if err = db.enter(); err != nil {
+		return 0, 0, err
+	}
+	defer db.leave()
+
+	db.memMu.RLock()
+	memBytes = int64(db.memtable.Size())
+	for _, mem := range db.immutables {
+		memBytes += int64(mem.Size())
+	}
+	db.memMu.RUnlock()
+
+	for _, s := range db.segments.Load().([]*segment) {
+		diskBytes += s.fileSize
+	}
+	// The database opened read-only has no WAL.
+	if db.wal != nil {
+		diskBytes += db.walSize()
+	}
+	return memBytes, diskBytes, nil
+}
+
+// LevelInfo describes the segments of a compaction level at the moment DB.LevelInfo was called.
+type LevelInfo struct {
+	// Level is the compaction level, level 0 consists of the segments flushed from the memtable.
+	Level int
+	// SegmentCount is a number of segment files at the level.
+	SegmentCount int
+	// Bytes is a size of the segment files at the level.
+	Bytes int64
+}
+
+// LevelInfo returns the number of segments and their size at every compaction level starting from level 0.
+// The empty levels are included up to the last level, see WithLevelCount.
+// Note, operation is concurrency safe.
+func (db *DB) LevelInfo() []LevelInfo {
+	n := db.cfg.levelCount
+	// Level 0 always has a level to be merged into, see newLeveledCompactor.
+	if n < 2 {
+		n = 2
+	}
+	levels := make([]LevelInfo, n)
+	for _, s := range db.segments.Load().([]*segment) {
+		// The segments might have been written with more levels configured.
+		for len(levels) <= s.level {
+			levels = append(levels, LevelInfo{})
+		}
+		levels[s.level].SegmentCount++
+		levels[s.level].Bytes += s.fileSize
+	}
+	for i := range levels {
+		levels[i].Level = i
+	}
+	return levels
+}
+
+// EstimatedKeyCount returns the approximate number of distinct keys in the database without scanning it,
+// e.g., for capacity planning. The estimate is based on HyperLogLog sketches of the keys set since
+// the database was opened and the keys of every segment, so its error is about 1%.
+// Note, the deleted keys are counted until compaction drops their tombstones,
+// and if they were set since the database was opened, until it's reopened.
+func (db *DB) EstimatedKeyCount() int64 {
+	db.memMu.RLock()
+	h := db.sketch.Clone()
+	db.memMu.RUnlock()
+
+	for _, seg := range db.segments.Load().([]*segment) {
+		h.Merge(seg.sketch)
+	}
+	return int64(h.Count())
+}
@@ -0,0 +1,417 @@
+package hasty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDBStats(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithCompactionTrigger(2), WithBloomFilterBitsPerKey(2), WithGlobalBloomFalsePositiveRate(0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	want := Stats{
+		TotalDiskBytes: walHeaderSize,
+		WALBytes:       walHeaderSize,
+	}
+	if st := db.Stats(); st != want {
+		t.Errorf("expected only WAL header in a new database, got: %+v", st)
+	}
+
+	for _, key := range []string{"age", "city", "name"} {
+		if err = db.Set(key, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Delete("age"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"city", "age"} {
+		db.Get(key)
+	}
+
+	st := db.Stats()
+	if st.SetCount != 3 || st.GetCount != 2 {
+		t.Errorf("expected 3 sets and 2 gets, got: %d %d", st.SetCount, st.GetCount)
+	}
+	if st.MemtableKeyCount != 3 || st.MemtableSize != int64(db.memtable.Size()) {
+		t.Errorf("expected 3 keys in memtable of %d bytes, got: %d %d", db.memtable.Size(), st.MemtableKeyCount, st.MemtableSize)
+	}
+	if st.WALBytes <= walHeaderSize || st.TotalDiskBytes != st.WALBytes {
+		t.Errorf("expected WAL records on disk, got: %d %d", st.WALBytes, st.TotalDiskBytes)
+	}
+	if st.GetLatencyP99 <= 0 {
+		t.Errorf("expected Get latency, got: %s", st.GetLatencyP99)
+	}
+
+	// The compactor is blocked, so it doesn't merge the segments concurrently with the test.
+	if err = db.compactor.sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	defer db.compactor.sem.Release(1)
+	flushDB(t, db)
+
+	st = db.Stats()
+	if st.SegmentCount != 1 || st.MemtableKeyCount != 0 || st.ImmutableMemtableCount != 0 {
+		t.Errorf("expected memtable to be flushed in a segment, got: %+v", st)
+	}
+	seg := db.segments.Load().([]*segment)[0]
+	if st.WALBytes != walHeaderSize || st.TotalDiskBytes != seg.fileSize+walHeaderSize {
+		t.Errorf("expected segment of %d bytes on disk, got: %d %d", seg.fileSize, st.WALBytes, st.TotalDiskBytes)
+	}
+
+	// A missing key which passes both Bloom filters has to be looked up in the segment.
+	var missing string
+	for i := 0; missing == "" && i < 10000; i++ {
+		key := fmt.Sprintf("missing%d", i)
+		if db.globalBloom.Load().(*bloomFilter).MayContain(key) && seg.MayContain(key) {
+			missing = key
+		}
+	}
+	if missing == "" {
+		t.Fatal("expected a false positive of the Bloom filters")
+	}
+	if _, err = db.Get(missing); err != ErrKeyNotFound {
+		t.Fatalf("expected: %v, got: %v", ErrKeyNotFound, err)
+	}
+	if st = db.Stats(); st.BloomFilterFalsePositives != 1 {
+		t.Errorf("expected 1 false positive, got: %d", st.BloomFilterFalsePositives)
+	}
+
+	if err = db.Set("zip", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+	if err = db.compactor.compactLevels(); err != nil {
+		t.Fatal(err)
+	}
+	if st = db.Stats(); st.CompactionCount != 1 || st.SegmentCount != 1 {
+		t.Errorf("expected 2 segments to be compacted into 1, got: %d %d", st.CompactionCount, st.SegmentCount)
+	}
+}
+
+func TestDBStats_segmentReads(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithSparseIndexInterval(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for i := 0; i < 100; i++ {
+		if err = db.Set(fmt.Sprintf("key%02d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushDB(t, db)
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key found in the memtable doesn't read segments.
+	if _, err = db.Get("name"); err != nil {
+		t.Fatal(err)
+	}
+	if st := db.Stats(); st.SegmentBytesRead != 0 || st.SegmentSeeks != 0 {
+		t.Errorf("expected no segment reads, got: %d %d", st.SegmentBytesRead, st.SegmentSeeks)
+	}
+
+	// The sparse index makes Get scan the records preceding the key,
+	// so more than one record (21 bytes with its length read twice) is read.
+	if _, err = db.Get("key02"); err != nil {
+		t.Fatal(err)
+	}
+	st := db.Stats()
+	if st.SegmentBytesRead <= 25 || st.SegmentSeeks <= 2 {
+		t.Errorf("expected several records to be read, got: %d bytes %d seeks", st.SegmentBytesRead, st.SegmentSeeks)
+	}
+}
+
+func TestDBMetrics_getLatencyPercentile(t *testing.T) {
+	var m dbMetrics
+	m.getLatency[10] = 98
+	m.getLatency[20] = 2
+	if got, want := m.getLatencyPercentile(0.99), time.Duration(1<<20); got != want {
+		t.Errorf("expected %s, got: %s", want, got)
+	}
+	if got, want := m.getLatencyPercentile(0.5), time.Duration(1<<10); got != want {
+		t.Errorf("expected %s, got: %s", want, got)
+	}
+}
+
+func TestDBEstimatedKeyCount(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if got := db.EstimatedKeyCount(); got != 0 {
+		t.Errorf("expected no keys, got: %d", got)
+	}
+
+	estimate := func(want int) {
+		t.Helper()
+		got := db.EstimatedKeyCount()
+		if math.Abs(float64(got-int64(want))) > float64(want)*0.02 {
+			t.Errorf("expected about %d keys, got: %d", want, got)
+		}
+	}
+	set := func(from, to int) {
+		t.Helper()
+		b := db.NewBatch()
+		for i := from; i < to; i++ {
+			b.Set(fmt.Sprintf("key%05d", i), []byte("v"))
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set(0, 10000)
+	estimate(10000)
+	flushDB(t, db)
+
+	// The overwritten keys are counted once.
+	set(5000, 15000)
+	flushDB(t, db)
+	estimate(15000)
+	if err = db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	estimate(15000)
+}
+
+func TestDBSize(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mem, disk, err := db.Size(); mem != 0 || disk != walHeaderSize || err != nil {
+		t.Errorf("expected only WAL header in a new database, got: %d %d %v", mem, disk, err)
+	}
+
+	// The keys are in a segment, an immutable memtable, and the memtable.
+	for _, key := range []string{"age", "city", "name"} {
+		if err = db.Set(key, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		switch key {
+		case "age":
+			flushDB(t, db)
+		case "city":
+			// The flushes are blocked, so the immutable memtable isn't flushed concurrently with the test.
+			if err = db.sstWriter.sem.Acquire(context.Background(), 1); err != nil {
+				t.Fatal(err)
+			}
+			if err = db.rotateMemtable(0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	mem, disk, err := db.Size()
+	db.sstWriter.sem.Release(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len("city1name1")); mem != want {
+		t.Errorf("expected %d bytes in memtables, got: %d", want, mem)
+	}
+	seg := db.segments.Load().([]*segment)[0]
+	// The WAL files of the immutable memtables are on disk until the memtables are flushed.
+	if want := seg.fileSize + db.wal.Size() + db.immutableWALs[0].Size(); disk != want {
+		t.Errorf("expected %d bytes on disk, got: %d", want, disk)
+	}
+
+	close()
+	if _, _, err = db.Size(); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected: %v, got: %v", ErrClosed, err)
+	}
+}
+
+func BenchmarkDBSize(b *testing.B) {
+	db, close, err := Open(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer close()
+
+	for i := 0; i < 1000; i++ {
+		if err = db.Set(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			b.Fatal(err)
+		}
+		if i%100 == 0 {
+			flushDB(b, db)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err = db.Size(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDBLevelInfo(t *testing.T) {
+	dir := t.TempDir()
+	db, close, err := Open(dir, WithLevelCount(3), WithCompactionTrigger(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The compactor is blocked, so it doesn't merge the segments concurrently with the test.
+	if err = db.compactor.sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = db.Set(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		flushDB(t, db)
+		// The first two segments are merged into level 1.
+		if i == 1 {
+			if err = db.compactor.compactLevels(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	db.compactor.sem.Release(1)
+
+	ss := db.segments.Load().([]*segment)
+	if len(ss) != 2 {
+		t.Fatalf("expected 2 segments, got: %d", len(ss))
+	}
+	want := []LevelInfo{
+		{Level: 0, SegmentCount: 1, Bytes: ss[0].fileSize},
+		{Level: 1, SegmentCount: 1, Bytes: ss[1].fileSize},
+		{Level: 2},
+	}
+	if diff := cmp.Diff(want, db.LevelInfo()); diff != "" {
+		t.Error(diff)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The levels are restored from the segment file names.
+	for _, p := range []string{"seg-L0-000003", "seg-L1-000002"} {
+		if _, err = os.Stat(filepath.Join(dir, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, close, err = Open(dir, WithLevelCount(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	if diff := cmp.Diff(want, db.LevelInfo()); diff != "" {
+		t.Error(diff)
+	}
+	for i := 0; i < 3; i++ {
+		if got, err := db.Get(fmt.Sprintf("key%d", i)); string(got) != "value" || err != nil {
+			t.Errorf("expected key%d value, got: %q %v", i, got, err)
+		}
+	}
+}
+
+func TestOpen_interruptedCompaction(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	db, close, err := Open(dir, WithLevelCount(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced := make(map[string][]byte)
+	for _, v := range []string{"old", "new"} {
+		for _, name := range []string{"seg-L2-000001", "seg-L2-000001" + indexFileSuffix} {
+			if b, err := ioutil.ReadFile(filepath.Join(dir, name)); err == nil {
+				replaced[name] = b
+			}
+		}
+		if err = db.Set("name", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		flushDB(t, db)
+		if err = db.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+	// The second compaction crashed before it removed the segment it had merged.
+	if len(replaced) != 2 {
+		t.Fatalf("expected replaced segment files, got: %d", len(replaced))
+	}
+	for name, b := range replaced {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), b, DefaultFileMode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, close, err = Open(dir, WithLevelCount(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	if got, err := db.Get("name"); string(got) != "new" || err != nil {
+		t.Errorf("expected new, got: %q %v", got, err)
+	}
+	if got := db.LevelInfo()[2].SegmentCount; got != 1 {
+		t.Errorf("expected 1 segment at level 2, got: %d", got)
+	}
+	// The replaced segment isn't listed in the manifest, so it's ignored.
+	if _, err = os.Stat(filepath.Join(dir, "seg-L2-000001")); err != nil {
+		t.Errorf("expected replaced segment to be kept: %v", err)
+	}
+}
+
+func TestDBClose_segments(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"Alice", "Bob"} {
+		db, close, err := Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Set("name", []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err = close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The segments loaded on open and the flushed one are closed along with the database.
+	db, close, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("name", []byte("Eve")); err != nil {
+		t.Fatal(err)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+	ss := db.segments.Load().([]*segment)
+	if len(ss) != 3 {
+		t.Fatalf("expected 3 segments, got: %d", len(ss))
+	}
+	for _, s := range ss {
+		if _, err = s.f.Stat(); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("expected %s to be closed, got: %v", s.path, err)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package hasty
+
+import "os"
+
+// syncDir commits the directory entries to disk, e.g., so a new file isn't lost after a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package hasty
+
+// syncDir is a no-op on Windows where directories can't be synced.
+func syncDir(dir string) error {
+	return nil
+}
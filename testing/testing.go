@@ -0,0 +1,75 @@
+// Package testing provides helpers to unit test code that uses HastyDB.
+package testing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	hasty "github.com/marselester/hastydb"
+)
+
+// NewTestDB opens a database in a temporary directory which is removed when the test finishes.
+// The database is closed automatically as well.
+func NewTestDB(t testing.TB, opts ...hasty.ConfigOption) *hasty.DB {
+	t.Helper()
+
+	db, close, err := hasty.Open(t.TempDir(), opts...)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := close(); err != nil {
+			t.Errorf("failed to close database: %v", err)
+		}
+	})
+	return db
+}
+
+// Populate inserts n random key-value pairs into the database.
+// The inserted pairs are returned for verification.
+func Populate(t testing.TB, db *hasty.DB, n int) map[string][]byte {
+	t.Helper()
+
+	kv := make(map[string][]byte, n)
+	for len(kv) < n {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			t.Fatalf("failed to generate key-value pair: %v", err)
+		}
+		key, value := hex.EncodeToString(b[:8]), b[8:]
+		if _, ok := kv[key]; ok {
+			continue
+		}
+		if err := db.Set(key, value); err != nil {
+			t.Fatalf("failed to set %q key: %v", key, err)
+		}
+		kv[key] = value
+	}
+	return kv
+}
+
+// AssertKeyValue checks that the key is found in the database and has the wanted value.
+func AssertKeyValue(t testing.TB, db *hasty.DB, key string, want []byte) {
+	t.Helper()
+
+	got, err := db.Get(key)
+	if err != nil {
+		t.Errorf("failed to get %q key: %v", key, err)
+		return
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%q key: expected %q, got: %q", key, want, got)
+	}
+}
+
+// AssertKeyNotFound checks that the key is not found in the database.
+func AssertKeyNotFound(t testing.TB, db *hasty.DB, key string) {
+	t.Helper()
+
+	if _, err := db.Get(key); !errors.Is(err, hasty.ErrKeyNotFound) {
+		t.Errorf("%q key: expected: %v, got: %v", key, hasty.ErrKeyNotFound, err)
+	}
+}
@@ -0,0 +1,24 @@
+package testing_test
+
+import (
+	"testing"
+
+	hastytesting "github.com/marselester/hastydb/testing"
+)
+
+func TestPopulate(t *testing.T) {
+	db := hastytesting.NewTestDB(t)
+
+	kv := hastytesting.Populate(t, db, 100)
+	if len(kv) != 100 {
+		t.Fatalf("expected 100 pairs, got: %d", len(kv))
+	}
+	for key, value := range kv {
+		hastytesting.AssertKeyValue(t, db, key, value)
+	}
+
+	if err := db.Delete("name"); err != nil {
+		t.Fatal(err)
+	}
+	hastytesting.AssertKeyNotFound(t, db, "name")
+}
@@ -0,0 +1,124 @@
+package hasty
+
+import (
+	"sync"
+
+	"github.com/marselester/hastydb/internal/index"
+)
+
+// Tx is a transaction which buffers writes until it's committed.
+// Reads observe the transaction's own writes first and then the snapshot of the database
+// taken when the transaction began, so the writes committed meanwhile aren't visible.
+// Note, transaction is concurrency safe.
+type Tx struct {
+	db *DB
+	// snap is the database snapshot which is released when the transaction is committed or rolled back.
+	snap *Snapshot
+
+	mu sync.Mutex
+	// writes is a memtable where the transaction's writes are kept until commit.
+	writes *index.Memtable
+	done   bool
+}
+
+// Begin starts a transaction. ErrClosed is returned if the database is closed.
+// Note, the transaction takes a snapshot, see Snapshot for its cost.
+func (db *DB) Begin() (*Tx, error) {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	tx := Tx{
+		db:     db,
+		snap:   snap,
+		writes: db.newMemtable(),
+	}
+	return &tx, nil
+}
+
+// Get retrieves a key from the transaction or the snapshot if the key wasn't changed within the transaction.
+func (tx *Tx) Get(key string) ([]byte, error) {
+	if key == "" {
+		return nil, ErrEmptyKey
+	}
+
+	tx.mu.Lock()
+	if tx.done {
+		tx.mu.Unlock()
+		return nil, ErrTxDone
+	}
+	value, deleted, ok := tx.writes.Lookup(key)
+	tx.mu.Unlock()
+
+	switch {
+	case deleted:
+		return nil, ErrKeyNotFound
+	case ok:
+		return value, nil
+	}
+	return tx.snap.Get(key)
+}
+
+// Set puts a key in the transaction.
+func (tx *Tx) Set(key string, value []byte) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.writes.Set(key, value)
+	return nil
+}
+
+// Delete removes a key in the transaction.
+func (tx *Tx) Delete(key string) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.writes.Delete(key)
+	return nil
+}
+
+// Commit applies all the transaction's writes to the database at once.
+func (tx *Tx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	defer tx.snap.Close()
+
+	keys := tx.writes.Keys()
+	if len(keys) == 0 {
+		return nil
+	}
+	recs := make([]*record, len(keys))
+	for i, key := range keys {
+		recs[i] = &record{key: key}
+		recs[i].value, recs[i].deleted, _ = tx.writes.Lookup(key)
+	}
+	return tx.db.write(recs...)
+}
+
+// Rollback discards the transaction's writes.
+func (tx *Tx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.writes = tx.db.newMemtable()
+	return tx.snap.Close()
+}
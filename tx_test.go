@@ -0,0 +1,118 @@
+package hasty_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	hasty "github.com/marselester/hastydb"
+)
+
+func TestTx(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("planet", []byte("Earth")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Delete("planet"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction observes its own writes, but the database doesn't until commit.
+	if got, err := tx.Get("name"); err != nil || !bytes.Equal(got, []byte("Alice")) {
+		t.Errorf("expected Alice, got: %q, %v", got, err)
+	}
+	if _, err = tx.Get("planet"); !errors.Is(err, hasty.ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrKeyNotFound, err)
+	}
+	if _, err = db.Get("name"); !errors.Is(err, hasty.ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrKeyNotFound, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("name"); err != nil || !bytes.Equal(got, []byte("Alice")) {
+		t.Errorf("expected Alice, got: %q, %v", got, err)
+	}
+	if _, err = db.Get("planet"); !errors.Is(err, hasty.ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrKeyNotFound, err)
+	}
+
+	if err = tx.Commit(); !errors.Is(err, hasty.ErrTxDone) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrTxDone, err)
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.Get("name"); !errors.Is(err, hasty.ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrKeyNotFound, err)
+	}
+	if err = tx.Set("name", []byte("Bob")); !errors.Is(err, hasty.ErrTxDone) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrTxDone, err)
+	}
+}
+
+func TestTxSnapshot(t *testing.T) {
+	db, close, err := hasty.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// The writes made after the transaction began aren't visible inside of it.
+	if err = db.Set("name", []byte("Bob")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("planet", []byte("Earth")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tx.Get("name"); err != nil || !bytes.Equal(got, []byte("Alice")) {
+		t.Errorf("expected Alice, got: %q, %v", got, err)
+	}
+	if _, err = tx.Get("planet"); !errors.Is(err, hasty.ErrKeyNotFound) {
+		t.Errorf("expected: %v, got: %v", hasty.ErrKeyNotFound, err)
+	}
+	if got, err := db.Get("name"); err != nil || !bytes.Equal(got, []byte("Bob")) {
+		t.Errorf("expected Bob, got: %q, %v", got, err)
+	}
+}
@@ -0,0 +1,137 @@
+package hasty
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// VerifyError describes a problem found in a segment file by Verify.
+type VerifyError struct {
+	// Path is the path of the segment file.
+	Path string
+	// Offset is the offset of the problematic record in the records stream,
+	// -1 means the problem is not related to a particular record.
+	Offset int64
+	// Err is the cause, e.g., ErrChecksum or ErrCorruptRecord.
+	Err error
+}
+
+func (e VerifyError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("%s: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("%s at offset %d: %v", e.Path, e.Offset, e.Err)
+}
+
+func (e VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// Verify scans every segment file from start to end and reports all the problems it finds without repairing them:
+// records which don't match their checksums or can't be read, keys out of order,
+// and index entries which don't point to the records of their keys.
+// A segment is scanned until its records can't be located anymore, e.g., because a record length is damaged.
+// Nil is returned if the segments are intact. ErrClosed is reported if the database is closed.
+// Note, operation is concurrency safe, the writes aren't blocked while the segments are verified.
+func (db *DB) Verify() []VerifyError {
+	if err := db.enter(); err != nil {
+		return []VerifyError{{Path: db.path, Offset: -1, Err: err}}
+	}
+	defer db.leave()
+
+	ss := db.acquireSegments()
+	defer releaseSegments(ss)
+	var errs []VerifyError
+	for _, seg := range ss {
+		errs = append(errs, seg.verify()...)
+	}
+	return errs
+}
+
+// verify scans the records stream of the segment and checks that the records are intact and sorted,
+// and the index points to the records of the indexed keys.
+func (s *segment) verify() []VerifyError {
+	return s.verifyStream(s.newStreamReader())
+}
+
+// verifyStream is like verify, but the records stream of the segment is read from stream,
+// e.g., to throttle the reads.
+func (s *segment) verifyStream(stream io.Reader) []VerifyError {
+	var errs []VerifyError
+	report := func(offset int64, err error) {
+		errs = append(errs, VerifyError{Path: s.path, Offset: offset, Err: err})
+	}
+
+	// keys are the keys of the records by their offsets, they're compared with the index after the scan.
+	// The keys of the damaged records are unknown, so they're empty.
+	keys := make(map[int64]string)
+	r := bufio.NewReader(stream)
+	var (
+		// offset is where the next record starts, the scan stops there if the record can't be read.
+		offset int64
+		prev   string
+		// known indicates that prev holds the key of the previous record,
+		// otherwise the prefix-compressed keys can't be restored until the next restart point.
+		known = true
+	)
+	for {
+		b, err := readRecord(r, s.size-offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			report(offset, fmt.Errorf("failed to read record: %w", err))
+			break
+		}
+
+		keys[offset] = ""
+		rec, err := s.decode(b)
+		if err == nil && (rec.shared == 0 || known) {
+			err = rec.restoreKey(prev)
+		}
+		switch {
+		case err != nil:
+			report(offset, fmt.Errorf("failed to decode record: %w", err))
+			known = false
+		case rec.shared != 0 && !known:
+		default:
+			if offset != 0 && known && s.cmp.Compare(rec.key, prev) < 0 {
+				report(offset, fmt.Errorf("key %q is less than the previous key %q: %w", rec.key, prev, ErrCorruptRecord))
+			}
+			prev, known = rec.key, true
+			keys[offset] = rec.key
+		}
+		offset += int64(len(b))
+	}
+
+	// The index entries beyond the record which couldn't be read are skipped, since the damage is already reported.
+	check := func(key string, at int64) {
+		if offset < s.size && at >= offset {
+			return
+		}
+		if err := verifyIndexEntry(keys, key, at); err != nil {
+			report(at, err)
+		}
+	}
+	for key, at := range s.index {
+		check(key, at)
+	}
+	for _, e := range s.sparse {
+		check(e.key, e.offset)
+	}
+	return errs
+}
+
+// verifyIndexEntry checks that the index entry points to the record with the key,
+// keys are the scanned keys by their offsets. The entries pointing to the damaged records are already reported.
+func verifyIndexEntry(keys map[int64]string, key string, offset int64) error {
+	got, ok := keys[offset]
+	switch {
+	case !ok:
+		return fmt.Errorf("key %q is indexed at a missing record: %w", key, ErrCorruptRecord)
+	case got != "" && got != key:
+		return fmt.Errorf("key %q is indexed at the record of key %q: %w", key, got, ErrCorruptRecord)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package hasty
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDBVerify(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	for i := 0; i < 50; i++ {
+		if err = db.Set(fmt.Sprintf("key%03d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushDB(t, db)
+	if errs := db.Verify(); errs != nil {
+		t.Fatalf("expected intact segments, got: %v", errs)
+	}
+
+	// The last byte of the value is flipped, so the record doesn't match its checksum.
+	seg := db.segments.Load().([]*segment)[0]
+	offset := seg.index["key025"]
+	blen, _, err := seg.readRecordLen(offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(seg.path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{'X'}, segmentHeaderSize+offset+int64(blen)-recordChecksumSize-1)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The records after the damaged one are still verified.
+	errs := db.Verify()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got: %v", errs)
+	}
+	if errs[0].Offset != offset || !errors.Is(errs[0], ErrChecksum) {
+		t.Errorf("expected checksum mismatch at offset %d, got: %v", offset, errs[0])
+	}
+}
+
+func TestSegmentVerify(t *testing.T) {
+	tt := map[string]struct {
+		keys  []string
+		index map[string]int64
+		want  int
+	}{
+		"intact": {
+			keys:  []string{"age", "name"},
+			index: map[string]int64{"age": 0, "name": 14},
+		},
+		"unsorted": {
+			keys:  []string{"name", "age"},
+			index: map[string]int64{"name": 0, "age": 15},
+			want:  1,
+		},
+		"wrong offset": {
+			keys:  []string{"age", "name"},
+			index: map[string]int64{"age": 0, "name": 10},
+			want:  1,
+		},
+		"wrong key": {
+			keys:  []string{"age", "name"},
+			index: map[string]int64{"age": 14, "name": 14},
+			want:  1,
+		},
+	}
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			segPath := filepath.Join(t.TempDir(), "seg")
+			writeSegment(t, segPath, func(seg *segment) error {
+				for _, key := range tc.keys {
+					if err := encode(seg, &record{key: key, value: []byte("30")}); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			seg, err := openReadonlySegment(segPath, BinaryCodec{}, keyComparator{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer seg.Close()
+			seg.index = tc.index
+
+			errs := seg.verify()
+			if len(errs) != tc.want {
+				t.Fatalf("expected %d errors, got: %v", tc.want, errs)
+			}
+			for _, err := range errs {
+				if !errors.Is(err, ErrCorruptRecord) {
+					t.Errorf("expected corrupt record, got: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,444 @@
+package hasty
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// valueLogNameFormat is a name of a value log file which is numbered by a sequence number,
+	// so the files with greater numbers are newer.
+	valueLogNameFormat = "vlog-%06d"
+	// valueLogFileSize is a size of a value log file in bytes after which the values are appended to a new file.
+	valueLogFileSize = 64 * 1024 * 1024
+	// valuePointerSize is a number of bytes of an encoded valuePointer.
+	valuePointerSize = 20
+)
+
+// errValueLogMissing is returned when a value pointer refers to a value log file which doesn't exist,
+// e.g., it was removed by the garbage collector after the pointer was read.
+const errValueLogMissing = Error("value log file not found")
+
+// valuePointer refers to the record in the value log where a value is stored.
+type valuePointer struct {
+	// seq is the sequence number of the value log file.
+	seq uint64
+	// offset is where the record starts in the file.
+	offset int64
+	// length is the length of the encoded record.
+	length uint32
+}
+
+// encode returns the pointer as 8 bytes seq, 8 bytes offset, and 4 bytes length.
+func (p valuePointer) encode() []byte {
+	b := make([]byte, valuePointerSize)
+	binary.LittleEndian.PutUint64(b, p.seq)
+	binary.LittleEndian.PutUint64(b[8:], uint64(p.offset))
+	binary.LittleEndian.PutUint32(b[16:], p.length)
+	return b
+}
+
+// decodeValuePointer returns the pointer encoded in b.
+func decodeValuePointer(b []byte) (valuePointer, error) {
+	if len(b) != valuePointerSize {
+		return valuePointer{}, ErrCorruptRecord
+	}
+	return valuePointer{
+		seq:    binary.LittleEndian.Uint64(b),
+		offset: int64(binary.LittleEndian.Uint64(b[8:])),
+		length: binary.LittleEndian.Uint32(b[16:]),
+	}, nil
+}
+
+// valueLog keeps large values apart from the keys (key-value separation), so segments store only the pointers
+// to the values, and compaction merges the pointers instead of copying the values over and over again.
+// The values are appended into files of limited size, so the space taken by the overwritten values
+// is reclaimed file by file, see DB.gcValueLog.
+// Every value is stored as a record along with its key, so the collector can tell whether the value is still used.
+type valueLog struct {
+	dir string
+	// mode is the permission bits of the new files.
+	mode os.FileMode
+	// maxFileSize is a size of the file after which the values are appended to a new file.
+	maxFileSize int64
+
+	mu sync.RWMutex
+	// files are the value log files opened for reads by their sequence numbers.
+	files map[uint64]*os.File
+	// w is the file where the values are appended, nil until the first append.
+	w *os.File
+	// wseq is the sequence number of w, and size is its size.
+	wseq uint64
+	size int64
+	// nextSeq is the sequence number of the next file.
+	nextSeq uint64
+}
+
+// openValueLog opens the value log files found in the dir for reads.
+// The values are appended into a new file, so a file partially written before a crash isn't appended.
+// The new files are created with the mode permission bits.
+func openValueLog(dir string, mode os.FileMode) (*valueLog, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "vlog-*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list value log files: %w", err)
+	}
+
+	l := valueLog{
+		dir:         dir,
+		mode:        mode,
+		maxFileSize: valueLogFileSize,
+		files:       make(map[uint64]*os.File),
+	}
+	for _, p := range paths {
+		var seq uint64
+		if _, err = fmt.Sscanf(filepath.Base(p), "vlog-%d", &seq); err != nil {
+			continue
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to open value log file: %w", err)
+		}
+		l.files[seq] = f
+		if seq >= l.nextSeq {
+			l.nextSeq = seq + 1
+		}
+	}
+	return &l, nil
+}
+
+// Append writes the key and its value at the end of the value log and returns the pointer to them.
+// Note, the value isn't durable until Sync is called.
+func (l *valueLog) Append(key string, value []byte) (valuePointer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.w == nil || l.size >= l.maxFileSize {
+		if err := l.rotate(); err != nil {
+			return valuePointer{}, err
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf, &record{key: key, value: value}); err != nil {
+		return valuePointer{}, err
+	}
+	p := valuePointer{
+		seq:    l.wseq,
+		offset: l.size,
+		length: uint32(buf.Len()),
+	}
+	n, err := l.w.Write(buf.Bytes())
+	l.size += int64(n)
+	if err != nil {
+		// The partially written record is left behind, the next values are appended to a new file.
+		l.w = nil
+		return valuePointer{}, fmt.Errorf("failed to append to value log: %w", err)
+	}
+	return p, nil
+}
+
+// rotate syncs the current file and starts a new one.
+// Note, the caller must hold the lock.
+func (l *valueLog) rotate() error {
+	if l.w != nil {
+		if err := l.w.Sync(); err != nil {
+			return fmt.Errorf("failed to sync value log: %w", err)
+		}
+	}
+
+	seq := l.nextSeq
+	path := filepath.Join(l.dir, fmt.Sprintf(valueLogNameFormat, seq))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, l.mode)
+	if err != nil {
+		return fmt.Errorf("failed to create value log file: %w", err)
+	}
+	l.files[seq] = f
+	l.w = f
+	l.wseq = seq
+	l.size = 0
+	l.nextSeq++
+	return nil
+}
+
+// Sync commits the appended values to disk.
+func (l *valueLog) Sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.w == nil {
+		return nil
+	}
+	return l.w.Sync()
+}
+
+// Read reads the value by the pointer and checks that it belongs to the key.
+func (l *valueLog) Read(p valuePointer, key string) ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	f, ok := l.files[p.seq]
+	if !ok {
+		return nil, fmt.Errorf("read value log %d: %w", p.seq, errValueLogMissing)
+	}
+	b := make([]byte, p.length)
+	if _, err := f.ReadAt(b, p.offset); err != nil {
+		return nil, fmt.Errorf("read value log %d at offset %d: %w", p.seq, p.offset, err)
+	}
+	rec, err := decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("read value log %d at offset %d: %w", p.seq, p.offset, err)
+	}
+	if rec.key != key {
+		return nil, fmt.Errorf("read value log %d at offset %d: key mismatch: %w", p.seq, p.offset, ErrCorruptRecord)
+	}
+	return rec.value, nil
+}
+
+// Value returns the value of the key by the encoded pointer.
+// Note, the key of a record read from a segment might be prefix-compressed, so the key is passed separately.
+func (l *valueLog) Value(key string, pointer []byte) ([]byte, error) {
+	if l == nil {
+		return nil, fmt.Errorf("value of %q is in the value log which isn't opened: %w", key, ErrCorruptRecord)
+	}
+	p, err := decodeValuePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	return l.Read(p, key)
+}
+
+// sealed returns the sequence numbers of the files which aren't appended anymore, the oldest first.
+func (l *valueLog) sealed() []uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var seqs []uint64
+	for seq := range l.files {
+		if l.w != nil && seq == l.wseq {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+	return seqs
+}
+
+// scan reads the file from the beginning and calls fn with every record and the pointer to it.
+// A partially written record at the end of the file is ignored.
+func (l *valueLog) scan(seq uint64, fn func(p valuePointer, rec *record) error) error {
+	l.mu.RLock()
+	f, ok := l.files[seq]
+	l.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("scan value log %d: %w", seq, errValueLogMissing)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := fi.Size()
+	r := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	for offset := int64(0); offset < size; {
+		b, err := readRecord(r, size-offset)
+		if err == io.EOF || err == ErrCorruptRecord {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("scan value log %d at offset %d: %w", seq, offset, err)
+		}
+		rec, err := decode(b)
+		if err != nil {
+			return fmt.Errorf("scan value log %d at offset %d: %w", seq, offset, err)
+		}
+		p := valuePointer{seq: seq, offset: offset, length: uint32(len(b))}
+		if err = fn(p, rec); err != nil {
+			return err
+		}
+		offset += int64(len(b))
+	}
+	return nil
+}
+
+// remove closes and deletes the file.
+func (l *valueLog) remove(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.files[seq]
+	if !ok {
+		return nil
+	}
+	delete(l.files, seq)
+	f.Close()
+	return os.Remove(filepath.Join(l.dir, fmt.Sprintf(valueLogNameFormat, seq)))
+}
+
+// truncate closes and deletes all the files, the next values are appended to a new file.
+// The sequence numbers aren't reused, so the pointers to the deleted values can't refer to the new files.
+func (l *valueLog) truncate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var err error
+	for seq, f := range l.files {
+		f.Close()
+		delete(l.files, seq)
+		if rmErr := os.Remove(filepath.Join(l.dir, fmt.Sprintf(valueLogNameFormat, seq))); rmErr != nil && err == nil {
+			err = rmErr
+		}
+	}
+	l.w = nil
+	l.size = 0
+	return err
+}
+
+// Close syncs the appended values and closes the files.
+func (l *valueLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var err error
+	if l.w != nil {
+		err = l.w.Sync()
+	}
+	for seq, f := range l.files {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(l.files, seq)
+	}
+	l.w = nil
+	return err
+}
+
+// gcValueLog reclaims the space of the oldest value log file which isn't appended anymore.
+// The values still used by the latest versions of their keys are written into the memtable
+// like regular writes, so they're appended to the value log again once the memtable is flushed,
+// and the file is removed. The file is kept while there are open snapshots which might refer to its values.
+// Note, an iterator created before the file was removed fails once it reaches the removed values.
+func (db *DB) gcValueLog() error {
+	seqs := db.vlog.sealed()
+	if len(seqs) == 0 {
+		return nil
+	}
+	seq := seqs[0]
+
+	for {
+		// The file is scanned before the lock is acquired, so the writes aren't blocked by disk reads.
+		ss := db.acquireSegments()
+		var live []*record
+		err := db.vlog.scan(seq, func(p valuePointer, rec *record) error {
+			current, err := db.findRecord(context.Background(), ss, rec.key)
+			if err != nil {
+				return err
+			}
+			if current == nil || !current.pointer || current.deleted || current.expired(time.Now().UnixNano()) {
+				return nil
+			}
+			if cp, err := decodeValuePointer(current.value); err != nil || cp != p {
+				return err
+			}
+			live = append(live, &record{
+				key:       rec.key,
+				value:     rec.value,
+				expiresAt: current.expiresAt,
+			})
+			return nil
+		})
+		releaseSegments(ss)
+		// The file was removed by Truncate meanwhile.
+		if errors.Is(err, errValueLogMissing) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		db.walMu.RLock()
+		db.memMu.Lock()
+		// A newer version of a key might have been flushed from the memtable meanwhile.
+		if !sameSegments(ss, db.segments.Load().([]*segment)) {
+			db.memMu.Unlock()
+			db.walMu.RUnlock()
+			continue
+		}
+		if atomic.LoadInt32(&db.snapshots) != 0 {
+			db.memMu.Unlock()
+			db.walMu.RUnlock()
+			return nil
+		}
+		// The keys found in the memtables were written after the live values.
+		recs := live[:0]
+		for _, rec := range live {
+			if _, _, ok := db.searchMemtables(rec.key); !ok {
+				recs = append(recs, rec)
+			}
+		}
+		if len(recs) != 0 {
+			if err = db.wal.WriteRecords(recs...); err == nil {
+				err = db.wal.Sync()
+			}
+			if err != nil {
+				db.memMu.Unlock()
+				db.walMu.RUnlock()
+				return fmt.Errorf("failed to write records to WAL file: %w", err)
+			}
+			for _, rec := range recs {
+				db.memtable.SetWithExpiry(rec.key, rec.value, rec.expiresAt)
+			}
+			db.memChanged()
+		}
+		size := db.memtable.Size()
+		err = db.vlog.remove(seq)
+		db.memMu.Unlock()
+		db.walMu.RUnlock()
+		if err != nil {
+			return fmt.Errorf("failed to remove value log file: %w", err)
+		}
+
+		if size > db.cfg.maxMemtableSize {
+			if err = db.rotateMemtable(db.cfg.maxMemtableSize); err != nil {
+				return err
+			}
+		}
+		return db.limitWAL()
+	}
+}
+
+// valueLogGC is an actor that periodically reclaims the space of the value log, see DB.gcValueLog.
+type valueLogGC struct {
+	db       *DB
+	interval time.Duration
+}
+
+// Run starts the actor which is stopped by cancelling context.
+func (g *valueLogGC) Run(ctx context.Context) error {
+	t := time.NewTicker(g.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := g.db.gcValueLog(); err != nil {
+				return fmt.Errorf("failed to collect value log: %w", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package hasty
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestValuePointer(t *testing.T) {
+	want := valuePointer{seq: 3, offset: 1 << 40, length: 100}
+	got, err := decodeValuePointer(want.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("expected: %+v, got: %+v", want, got)
+	}
+
+	if _, err = decodeValuePointer([]byte("short")); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("expected: %v, got: %v", ErrCorruptRecord, err)
+	}
+}
+
+func TestValueLog(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openValueLog(dir, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every value is appended to a new file.
+	l.maxFileSize = 1
+
+	values := map[string][]byte{
+		"name": []byte("Alice"),
+		"city": []byte("Amsterdam"),
+	}
+	pointers := make(map[string]valuePointer)
+	for _, key := range []string{"name", "city"} {
+		if pointers[key], err = l.Append(key, values[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = l.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]uint64{0}, l.sealed()); diff != "" {
+		t.Errorf("expected the first file to be sealed: %s", diff)
+	}
+
+	for key, p := range pointers {
+		got, err := l.Read(p, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, values[key]) {
+			t.Errorf("expected %s value %q, got: %q", key, values[key], got)
+		}
+	}
+	if _, err = l.Read(pointers["name"], "city"); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("expected: %v, got: %v", ErrCorruptRecord, err)
+	}
+
+	var scanned []valuePointer
+	err = l.scan(0, func(p valuePointer, rec *record) error {
+		scanned = append(scanned, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scanned) != 1 || scanned[0] != pointers["name"] {
+		t.Errorf("expected %+v, got: %+v", pointers["name"], scanned)
+	}
+
+	if err = l.remove(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Read(pointers["name"], "name"); !errors.Is(err, errValueLogMissing) {
+		t.Errorf("expected: %v, got: %v", errValueLogMissing, err)
+	}
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The values are appended to a new file after reopening.
+	if l, err = openValueLog(dir, DefaultFileMode); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got, err := l.Read(pointers["city"], "city"); err != nil || string(got) != "Amsterdam" {
+		t.Errorf("expected Amsterdam, got: %q %v", got, err)
+	}
+	p, err := l.Append("planet", []byte("Earth"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.seq != 2 {
+		t.Errorf("expected new file 2, got: %d", p.seq)
+	}
+}
+
+func TestDB_valueLog(t *testing.T) {
+	dir := t.TempDir()
+	db, close, err := Open(dir, WithValueLogThreshold(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := bytes.Repeat([]byte("v"), 100)
+	if err = db.Set("large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("small", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+
+	// Only the pointer to the large value is stored in the segment.
+	seg := db.segments.Load().([]*segment)[0]
+	rec, err := seg.ReadRecord(seg.index["large"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.pointer || len(rec.value) != valuePointerSize {
+		t.Errorf("expected value pointer, got: %t %q", rec.pointer, rec.value)
+	}
+	if rec, err = seg.ReadRecord(seg.index["small"]); err != nil || rec.pointer {
+		t.Errorf("expected small value in segment, got: %+v %v", rec, err)
+	}
+
+	if got, err := db.Get("large"); !bytes.Equal(got, large) || err != nil {
+		t.Errorf("Get expected large value, got: %q %v", got, err)
+	}
+	if got, err := db.LimitedGet("large", 200); !bytes.Equal(got, large) || err != nil {
+		t.Errorf("LimitedGet expected large value, got: %q %v", got, err)
+	}
+	if _, err = db.LimitedGet("large", 50); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expected: %v, got: %v", ErrValueTooLarge, err)
+	}
+	r, err := db.GetReader("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(got, large) || err != nil {
+		t.Errorf("GetReader expected large value, got: %q %v", got, err)
+	}
+	values := make(map[string]string)
+	err = db.ForEach(func(key string, value []byte) error {
+		values[key] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]string{"large": string(large), "small": "v"}, values); diff != "" {
+		t.Error(diff)
+	}
+
+	// Compaction merges the pointers.
+	if err = db.Set("large2", large); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+	if err = db.Defragment(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("large2"); !bytes.Equal(got, large) || err != nil {
+		t.Errorf("Get expected large value after compaction, got: %q %v", got, err)
+	}
+
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+	db, close, err = OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	if got, err := db.Get("large"); !bytes.Equal(got, large) || err != nil {
+		t.Errorf("Get expected large value after reopening, got: %q %v", got, err)
+	}
+}
+
+func TestDB_gcValueLog(t *testing.T) {
+	dir := t.TempDir()
+	db, close, err := Open(dir, WithValueLogThreshold(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	// Every value is appended to a new file.
+	db.vlog.maxFileSize = 1
+
+	for _, key := range []string{"a", "b"} {
+		if err = db.Set(key, []byte(key+"-v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushDB(t, db)
+	if err = db.Set("a", []byte("a-v2")); err != nil {
+		t.Fatal(err)
+	}
+	flushDB(t, db)
+	vlogPath := func(seq int) string {
+		return filepath.Join(dir, fmt.Sprintf(valueLogNameFormat, seq))
+	}
+
+	// The first file holds only the overwritten value, so it's removed.
+	if diff := cmp.Diff([]uint64{0, 1}, db.vlog.sealed()); diff != "" {
+		t.Fatalf("expected sealed files: %s", diff)
+	}
+	if err = db.gcValueLog(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(vlogPath(0)); !os.IsNotExist(err) {
+		t.Errorf("expected removed file, got: %v", err)
+	}
+	if db.memtable.Len() != 0 {
+		t.Errorf("expected no rewritten values, got: %d", db.memtable.Len())
+	}
+
+	// The second file holds the live value which is rewritten.
+	if err = db.gcValueLog(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(vlogPath(1)); !os.IsNotExist(err) {
+		t.Errorf("expected removed file, got: %v", err)
+	}
+	if got := db.memtable.Get("b"); string(got) != "b-v1" {
+		t.Errorf("expected rewritten value, got: %q", got)
+	}
+	flushDB(t, db)
+	for key, want := range map[string]string{"a": "a-v2", "b": "b-v1"} {
+		if got, err := db.Get(key); string(got) != want || err != nil {
+			t.Errorf("expected %s, got: %q %v", want, got, err)
+		}
+	}
+
+	// The files are kept while a snapshot might read them.
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := db.vlog.sealed()
+	if err = db.gcValueLog(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(sealed, db.vlog.sealed()); diff != "" {
+		t.Errorf("expected files to be kept: %s", diff)
+	}
+	if got, err := snap.Get("a"); string(got) != "a-v2" || err != nil {
+		t.Errorf("expected a-v2, got: %q %v", got, err)
+	}
+	snap.Close()
+}
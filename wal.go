@@ -1,17 +1,84 @@
 package hasty
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/bits"
 	"os"
+	"sync"
+	"time"
 )
 
+const (
+	// walHeaderSize is a size of the WAL file header: 8 bytes magic and 8 bytes creation Unix time in nanoseconds.
+	walHeaderSize = 16
+	// slowSyncThreshold is how long a sync of the WAL or a segment can take before it's logged as slow.
+	slowSyncThreshold = 100 * time.Millisecond
+	// walScanChunkSize is a number of bytes read at once while a valid record is looked for after a corrupted one.
+	walScanChunkSize = 64 * 1024
+)
+
+// walMagic starts every WAL file except those written by older versions.
+// The WAL records have checksums.
+var walMagic = []byte("HASTYWL2")
+
+// walMagicV1 started WAL files before the records had checksums.
+// Even older WAL files have no header at all (legacy format).
+var walMagicV1 = []byte("HASTYWAL")
+
+// walBatchBegin and walBatchEnd are sentinel records which enclose the records of a batch in the WAL.
+// Their keys are empty which is invalid for regular records.
+var (
+	walBatchBegin = &record{value: []byte("batch-begin")}
+	walBatchEnd   = &record{value: []byte("batch-end")}
+)
+
+// isSentinel reports whether the record read from the WAL is the given sentinel record.
+func isSentinel(rec, sentinel *record) bool {
+	return rec.key == "" && !rec.deleted && bytes.Equal(rec.value, sentinel.value)
+}
+
 // wal represents a write-ahead log.
 type wal struct {
 	// path is a path to the WAL filename.
 	path string
 	f    *os.File
+	// createdAt is when the WAL file was created or truncated.
+	// It is zero if the file has no header (legacy format).
+	createdAt time.Time
+	// start is an offset where records begin, i.e., right after the header.
+	start int64
+	// end is an offset where the last valid record ends, it's set by Replay.
+	end int64
+	// mu serializes writes, because records are appended by concurrent DB.Set calls.
+	mu sync.Mutex
+	// offset is a position in the file where the next record is appended.
+	offset int64
+	// preallocSize is a size of disk space chunks reserved for the file in advance.
+	preallocSize int64
+	// preallocated is an offset up to which the disk space is reserved.
+	preallocated int64
+	// syncMode defines when the written records are synced to disk.
+	syncMode WALSyncMode
+	// unsynced is set when records were written after the last sync.
+	unsynced bool
+	// bw buffers the records before they're written to the file, nil means the writes are unbuffered.
+	bw *bufio.Writer
+	// truncations is a number of times the file was truncated, so a backup reader can tell
+	// that the records it was reading are gone.
+	truncations uint64
+	// closed is set once the file is closed, e.g., its memtable was saved on disk.
+	closed bool
+	// logger reports the skipped records, the truncations, and the slow syncs.
+	logger *slog.Logger
 
+	decode func(b []byte) (*record, error)
 	encode func(out io.Writer, rec *record) error
 }
 
@@ -19,6 +86,8 @@ type wal struct {
 func openReadonlyWAL(path string) (*wal, error) {
 	w := wal{
 		path:   path,
+		logger: slog.Default(),
+		decode: decode,
 		encode: encode,
 	}
 
@@ -26,46 +95,658 @@ func openReadonlyWAL(path string) (*wal, error) {
 	if w.f, err = os.Open(path); err != nil {
 		return nil, err
 	}
+	if err = w.readHeader(); err != nil {
+		w.f.Close()
+		return nil, err
+	}
 	return &w, nil
 }
 
-// openWritableWAL opens a WAL file for appending records.
-func openAppendonlyWAL(path string) (*wal, error) {
+// openAppendonlyWAL opens a WAL file for appending records.
+// Disk space for the file is reserved in preallocSize chunks to reduce fragmentation, zero disables it.
+// The file is created with the mode permission bits.
+func openAppendonlyWAL(path string, preallocSize int64, mode os.FileMode) (*wal, error) {
 	w := wal{
-		path:   path,
-		encode: encode,
+		path:         path,
+		preallocSize: preallocSize,
+		logger:       slog.Default(),
+		decode:       decode,
+		encode:       encode,
 	}
 
 	var err error
-	if w.f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+	if w.f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, mode); err != nil {
+		return nil, err
+	}
+	fi, err := w.f.Stat()
+	if err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	w.offset = fi.Size()
+	// A new file gets the header, the existing one keeps its format.
+	if w.offset == 0 {
+		err = w.writeHeader()
+	} else {
+		err = w.readHeader()
+	}
+	if err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	if err = w.preallocate(0); err != nil {
+		w.f.Close()
 		return nil, err
 	}
 	return &w, nil
 }
 
-// Write appends a key-value pair to a log file.
-// Note, it is not concurrency safe. By design there is only one writer.
+// CreatedAt returns the time when the WAL file was created or last truncated.
+// It is zero if the WAL was written by an older version without the header.
+func (w *wal) CreatedAt() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.createdAt
+}
+
+// writeHeader writes the header at the beginning of the empty WAL file.
+func (w *wal) writeHeader() error {
+	w.createdAt = time.Now()
+	if _, err := w.f.Write(encodeWALHeader(w.createdAt)); err != nil {
+		return fmt.Errorf("failed to write WAL header: %w", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL header: %w", err)
+	}
+	w.start = walHeaderSize
+	w.offset = walHeaderSize
+	w.encode = encode
+	w.decode = decode
+	return nil
+}
+
+// encodeWALHeader returns the header of the WAL file created at createdAt.
+func encodeWALHeader(createdAt time.Time) []byte {
+	header := make([]byte, walHeaderSize)
+	copy(header, walMagic)
+	binary.LittleEndian.PutUint64(header[len(walMagic):], uint64(createdAt.UnixNano()))
+	return header
+}
+
+// readHeader reads and validates the WAL header.
+// A file which doesn't start with the magic is treated as a legacy WAL, its records start at zero offset.
+// Records of the WAL files written by older versions have no checksums, so they're encoded without them,
+// until the WAL is truncated.
+func (w *wal) readHeader() error {
+	header := make([]byte, walHeaderSize)
+	n, _ := w.f.ReadAt(header, 0)
+	hasMagic := func(magic []byte) bool {
+		return n >= len(magic) && bytes.Equal(header[:len(magic)], magic)
+	}
+	if !hasMagic(walMagic) {
+		w.encode = encodeUnchecked
+		w.decode = decodeUnchecked
+	}
+	if !hasMagic(walMagic) && !hasMagic(walMagicV1) {
+		return nil
+	}
+	if n < walHeaderSize {
+		return fmt.Errorf("failed to read WAL header in %s: %w", w.path, ErrCorruptRecord)
+	}
+	w.createdAt = time.Unix(0, int64(binary.LittleEndian.Uint64(header[len(walMagic):])))
+	w.start = walHeaderSize
+	return nil
+}
+
+// WriteRecord appends a key-value pair to a log file.
+// Note, it is concurrency safe.
 func (w *wal) WriteRecord(rec *record) error {
-	if err := w.encode(w.f, rec); err != nil {
-		return fmt.Errorf("failed to encode record: %w", err)
+	return w.WriteRecords(rec)
+}
+
+// WriteRecords appends the records to a log file as a single unit with one write and one sync,
+// so records of concurrent writers don't interleave.
+// Multiple records are enclosed in the batch sentinel records,
+// so Replay discards the batch if it wasn't written entirely.
+// Note, it is concurrency safe.
+func (w *wal) WriteRecords(recs ...*record) error {
+	for _, rec := range recs {
+		if rec.key == "" {
+			return ErrEmptyKey
+		}
+	}
+	if len(recs) > 1 {
+		batch := make([]*record, 0, len(recs)+2)
+		batch = append(batch, walBatchBegin)
+		batch = append(batch, recs...)
+		recs = append(batch, walBatchEnd)
+	}
+
+	// The buffer is allocated once for all the records.
+	var (
+		buf  bytes.Buffer
+		size int
+	)
+	for _, rec := range recs {
+		size += int(rec.size())
+	}
+	buf.Grow(size)
+	for _, rec := range recs {
+		if err := w.encode(&buf, rec); err != nil {
+			return fmt.Errorf("failed to encode record: %w", err)
+		}
 	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n := int64(buf.Len())
+	if err := w.preallocate(n); err != nil {
+		return fmt.Errorf("failed to preallocate file: %w", err)
+	}
+	var err error
+	if w.bw != nil {
+		_, err = w.bw.Write(buf.Bytes())
+	} else {
+		_, err = w.f.Write(buf.Bytes())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write records: %w", err)
+	}
+	w.offset += n
+	if w.syncMode != SyncAlways {
+		w.unsynced = true
+		return nil
+	}
+	if err = w.flush(); err != nil {
+		return err
+	}
+	return w.sync()
+}
+
+// SetBufferSize makes the records be buffered in memory up to size bytes before they're written to the file,
+// so there are fewer write syscalls. The buffer is written when it's full, and before the file is synced.
+// Zero size disables buffering.
+// Note, it is concurrency safe.
+func (w *wal) SetBufferSize(size int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.bw = nil
+	if size > 0 {
+		w.bw = bufio.NewWriterSize(w.f, size)
+	}
+	return nil
+}
+
+// flush writes the buffered records to the file.
+// Note, the caller must hold mu lock.
+func (w *wal) flush() error {
+	if w.bw == nil {
+		return nil
+	}
+	if err := w.bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write buffered records: %w", err)
+	}
+	return nil
+}
+
+// Sync commits the records written since the last sync to disk unless there are none.
+// Note, it is concurrency safe.
+func (w *wal) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.unsynced {
+		return nil
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := w.sync(); err != nil {
+		return err
+	}
+	w.unsynced = false
+	return nil
+}
+
+// sync commits the file to disk, a sync slower than slowSyncThreshold is logged.
+// Note, the caller must hold mu lock.
+func (w *wal) sync() error {
+	start := time.Now()
 	if err := w.f.Sync(); err != nil {
 		return fmt.Errorf("failed to sync file: %w", err)
 	}
+	if d := time.Since(start); d > slowSyncThreshold {
+		w.logger.Warn("hasty: slow WAL sync", "path", w.path, "duration", d)
+	}
+	return nil
+}
+
+// preallocate reserves the next chunk of disk space if n bytes don't fit into already reserved space.
+func (w *wal) preallocate(n int64) error {
+	if w.preallocSize <= 0 || w.offset+n <= w.preallocated {
+		return nil
+	}
+
+	size := w.preallocSize
+	if n > size {
+		size = n
+	}
+	if err := fallocate(w.f, w.offset, size); err != nil {
+		return err
+	}
+	w.preallocated = w.offset + size
 	return nil
 }
 
+// WALRecoveryMode defines how invalid records are handled during WAL replay.
+type WALRecoveryMode int
+
+const (
+	// AbortOnCorrupt stops the replay with ErrCorruptRecord error on an invalid record in the middle of the WAL.
+	// A partially written record at the end of the WAL (torn write) is ignored, because it was never acknowledged.
+	AbortOnCorrupt WALRecoveryMode = iota
+	// SkipCorrupt logs and skips invalid records, the replay continues from the next valid-looking record.
+	// A record is considered valid if the lengths of the records starting from it lead exactly to the end of the WAL.
+	SkipCorrupt
+	// TolerateCorrupt replays the records up to the first invalid record,
+	// the rest of the WAL is ignored even if there are valid records.
+	TolerateCorrupt
+)
+
+// WALSyncMode defines when the records written to the WAL are synced to disk (fsync),
+// i.e., how many acknowledged writes could be lost if the machine crashes.
+// Note, in SyncPeriodic and SyncNever modes a crash of the process alone loses the records
+// which are still in the WAL buffer (64 kilobytes by default, see WithWALBufferSize).
+// Only when the buffering is disabled, the process crash doesn't lose the writes, because they're in the OS page cache.
+type WALSyncMode int
+
+const (
+	// SyncAlways syncs the WAL on every write, so an acknowledged write is never lost.
+	// It is the safest and the slowest mode, especially on spinning disks.
+	SyncAlways WALSyncMode = iota
+	// SyncPeriodic syncs the WAL in background every sync interval, see WithWALSyncInterval.
+	// The writes acknowledged during the last interval could be lost on a machine crash.
+	SyncPeriodic
+	// SyncNever leaves syncing to the OS which usually flushes dirty pages every 30 seconds.
+	// It is the fastest mode, but an unknown amount of acknowledged writes could be lost on a machine crash.
+	// The WAL is still synced when the memtable is rotated, i.e., a new WAL file is started.
+	SyncNever
+)
+
+// newWALSyncer creates a walSyncer that syncs the WAL every interval.
+func newWALSyncer(db *DB, interval time.Duration) *walSyncer {
+	return &walSyncer{
+		db:       db,
+		interval: interval,
+	}
+}
+
+// walSyncer is an actor that is responsible for syncing the WAL periodically in SyncPeriodic mode.
+type walSyncer struct {
+	db       *DB
+	interval time.Duration
+}
+
+// Run starts the actor which is stopped by cancelling context.
+// Note, actor syncs the WAL before exiting, so the recent writes are not lost.
+func (s *walSyncer) Run(ctx context.Context) error {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			// Sync failure indicates that database can't persist recent changes.
+			if err := s.db.syncWAL(); err != nil {
+				return fmt.Errorf("failed to sync WAL: %w", err)
+			}
+		case <-ctx.Done():
+			if err := s.db.syncWAL(); err != nil {
+				return fmt.Errorf("failed to sync WAL: %w", err)
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// ReplayInBatches is like Replay, but it passes the records to fn in batches of up to batchSize records,
+// so the caller can bound the memory used for recovery, e.g., by saving the records on disk.
+// Note, the batch slice is reused, so fn must not keep it.
+func (w *wal) ReplayInBatches(mode WALRecoveryMode, batchSize int, fn func(batch []*record) error) error {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	batch := make([]*record, 0, batchSize)
+	err := w.Replay(mode, func(rec *record) error {
+		if batch = append(batch, rec); len(batch) < batchSize {
+			return nil
+		}
+		err := fn(batch)
+		batch = batch[:0]
+		return err
+	})
+	if err != nil || len(batch) == 0 {
+		return err
+	}
+	return fn(batch)
+}
+
+// Replay reads the WAL file from the beginning and calls fn for every record.
+// Invalid records are handled according to the recovery mode.
+// The replay stops without an error at a partially written record (torn write),
+// i.e., an invalid record which isn't followed by valid records.
+// Records of a batch are passed to fn only once the whole batch is read,
+// a partially written batch is discarded regardless of the recovery mode.
+func (w *wal) Replay(mode WALRecoveryMode, fn func(rec *record) error) error {
+	fi, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	offset := w.start
+	w.end = offset
+	// batch holds the records of a batch until its end sentinel is read, it's nil outside of a batch.
+	var batch []*record
+	var valid *validOffsets
+	r := bufio.NewReader(io.NewSectionReader(w.f, offset, size-offset))
+	for {
+		var rec *record
+		b, err := readRecord(r, size-offset)
+		if err == nil {
+			rec, err = w.decode(b)
+		}
+		if err != nil && batch != nil {
+			w.logger.Warn("hasty: discarded partially written WAL batch", "path", w.path, "records", len(batch))
+			batch = nil
+		}
+		switch {
+		case err == io.EOF:
+			return nil
+		case errors.Is(err, ErrCorruptRecord), errors.Is(err, ErrChecksum):
+			err = fmt.Errorf("failed to read record at offset %d: %w", offset, err)
+			if mode == TolerateCorrupt {
+				w.logger.Warn("hasty: stopped WAL replay", "path", w.path, "error", err)
+				return nil
+			}
+			// The invalid record is a torn write unless valid records follow it.
+			// The valid offsets are found once, because a valid-looking offset might be corrupted as well.
+			if valid == nil {
+				valid = w.validOffsets(offset+1, size)
+			}
+			next := valid.next(offset + 1)
+			if next == -1 {
+				w.logger.Warn("hasty: stopped WAL replay, no valid records found after", "path", w.path, "error", err)
+				return nil
+			}
+			if mode != SkipCorrupt {
+				return err
+			}
+			w.logger.Warn("hasty: skipped WAL bytes", "path", w.path, "bytes", next-offset, "error", err)
+			offset = next
+			r.Reset(io.NewSectionReader(w.f, offset, size-offset))
+			continue
+		case err != nil:
+			return err
+		}
+
+		offset += int64(len(b))
+		switch {
+		case isSentinel(rec, walBatchBegin):
+			batch = []*record{}
+			continue
+		case isSentinel(rec, walBatchEnd):
+			for _, rec = range batch {
+				if err = fn(rec); err != nil {
+					return err
+				}
+			}
+			batch = nil
+		case batch != nil:
+			batch = append(batch, rec)
+			continue
+		default:
+			if err = fn(rec); err != nil {
+				return err
+			}
+		}
+		w.end = offset
+	}
+}
+
+// validOffsets finds the offsets of valid-looking records starting from the offset "from".
+// The offset is valid if the lengths of the records starting there lead exactly to the end of the file.
+// The offsets are checked once from the end of the file backwards in walScanChunkSize chunks:
+// an offset is valid if the record length stored there leads to a valid offset or to the end of the file.
+func (w *wal) validOffsets(from, size int64) *validOffsets {
+	v := validOffsets{from: from}
+	if from >= size {
+		return &v
+	}
+	// The end of the file is valid, though it's never returned by next.
+	n := size - from
+	v.bits = make([]uint64, n/64+1)
+	v.set(size)
+
+	// The chunk is read along with the bytes of the record length which might cross its end.
+	buf := make([]byte, walScanChunkSize+recordLengthSize-1)
+	for end := size; end > from; end -= walScanChunkSize {
+		start := end - walScanChunkSize
+		if start < from {
+			start = from
+		}
+		chunkEnd := end + recordLengthSize - 1
+		if chunkEnd > size {
+			chunkEnd = size
+		}
+		chunk := buf[:chunkEnd-start]
+		if _, err := w.f.ReadAt(chunk, start); err != nil {
+			v.bits = nil
+			return &v
+		}
+
+		for offset := end - 1; offset >= start; offset-- {
+			if offset+recordLengthSize > size {
+				continue
+			}
+			blen := int64(recordLength(chunk[offset-start:]))
+			if blen >= recordLengthSize && blen <= size-offset && v.isSet(offset+blen) {
+				v.set(offset)
+			}
+		}
+	}
+	v.bits[n/64] &^= 1 << (n % 64)
+	return &v
+}
+
+// validOffsets is a bitset of the valid record offsets of the WAL relative to the offset "from",
+// see wal.validOffsets.
+type validOffsets struct {
+	from int64
+	bits []uint64
+}
+
+func (v *validOffsets) set(offset int64) {
+	i := offset - v.from
+	v.bits[i/64] |= 1 << (i % 64)
+}
+
+func (v *validOffsets) isSet(offset int64) bool {
+	i := offset - v.from
+	return v.bits[i/64]&(1<<(i%64)) != 0
+}
+
+// next returns the first valid offset starting from the offset "from" or -1 if there is none.
+func (v *validOffsets) next(from int64) int64 {
+	if from < v.from {
+		from = v.from
+	}
+	i := from - v.from
+	for j := i / 64; j < int64(len(v.bits)); j++ {
+		word := v.bits[j]
+		if j == i/64 {
+			word &^= 1<<(i%64) - 1
+		}
+		if word != 0 {
+			return v.from + j*64 + int64(bits.TrailingZeros64(word))
+		}
+	}
+	return -1
+}
+
 // Truncate truncates the WAL file to discard WAL records after db recovery.
+// The pre-allocated disk space is reclaimed as well.
+// The header is written anew, so the WAL is upgraded from the legacy format and its creation time is reset.
 func (w *wal) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// The buffered records are written first, otherwise they would be appended after the new header.
 	var err error
+	if err = w.flush(); err != nil {
+		return err
+	}
 	if err = w.f.Truncate(0); err != nil {
 		return err
 	}
-	_, err = w.f.Seek(0, 0)
-	return err
+	if _, err = w.f.Seek(0, 0); err != nil {
+		return err
+	}
+	w.logger.Debug("hasty: truncating WAL", "path", w.path, "size", w.offset)
+	w.offset = 0
+	w.preallocated = 0
+	w.unsynced = false
+	w.truncations++
+	return w.writeHeader()
+}
+
+// Size returns the size of the WAL file in bytes excluding the pre-allocated space.
+// Note, it is concurrency safe.
+func (w *wal) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.offset
 }
 
-// Close closes the WAL file.
+// NewBackupReader returns a reader of the WAL file from the beginning including the header,
+// so a backup tool can stream the file while the records are appended, see ReplayWAL.
+// The buffered records are written to the file before they're read, and the pre-allocated space is never read.
+// The reader returns io.EOF once it catches up with the writes, and the next Read continues with the records
+// appended since then. If the WAL is truncated or closed after the reader was created (the memtable was flushed),
+// the reader returns io.EOF, because the records it was reading are already in the segments.
+// Note, the writes are blocked only while a chunk of the file is read.
+func (w *wal) NewBackupReader() io.ReadCloser {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return &walBackupReader{
+		w:           w,
+		truncations: w.truncations,
+	}
+}
+
+// walBackupReader reads the WAL file for backups, see NewBackupReader.
+type walBackupReader struct {
+	w *wal
+	// truncations is the number of WAL truncations when the reader was created.
+	truncations uint64
+	// pos is the offset in the file where the next Read starts.
+	pos    int64
+	closed bool
+}
+
+func (r *walBackupReader) Read(p []byte) (int, error) {
+	r.w.mu.Lock()
+	defer r.w.mu.Unlock()
+
+	switch {
+	case r.closed:
+		return 0, os.ErrClosed
+	case r.truncations != r.w.truncations, r.w.closed:
+		return 0, io.EOF
+	}
+	if err := r.w.flush(); err != nil {
+		return 0, err
+	}
+	if r.pos >= r.w.offset {
+		return 0, io.EOF
+	}
+	if n := r.w.offset - r.pos; int64(len(p)) > n {
+		p = p[:n]
+	}
+	n, err := r.w.f.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	// The file is never shorter than the offset, so io.EOF is returned once the reader catches up.
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Close releases the reader, the WAL file stays open.
+func (r *walBackupReader) Close() error {
+	r.w.mu.Lock()
+	defer r.w.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+// newChainedBackupReader returns a reader of the WAL files from the oldest to the newest as if they were a single file:
+// the header is written once and the headers of the files are skipped, see NewBackupReader.
+// The files must be in the current format which the header states, and only the last one may grow while it's read.
+// The header has the creation time of the oldest file, because the stream starts with its records.
+func newChainedBackupReader(ww []*wal) io.ReadCloser {
+	r := walChainedReader{
+		rr: []io.ReadCloser{io.NopCloser(bytes.NewReader(encodeWALHeader(ww[0].CreatedAt())))},
+	}
+	for _, w := range ww {
+		br := w.NewBackupReader().(*walBackupReader)
+		br.pos = w.start
+		r.rr = append(r.rr, br)
+	}
+	return &r
+}
+
+// walChainedReader reads the WAL files one after another, see newChainedBackupReader.
+type walChainedReader struct {
+	rr []io.ReadCloser
+}
+
+func (r *walChainedReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.rr[0].Read(p)
+		// The files before the last one don't grow, so once a file is read, the next one follows.
+		if n == 0 && err == io.EOF && len(r.rr) > 1 {
+			r.rr[0].Close()
+			r.rr = r.rr[1:]
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close releases the readers of the files which weren't read to the end.
+func (r *walChainedReader) Close() error {
+	for _, br := range r.rr {
+		br.Close()
+	}
+	return nil
+}
+
+// Close writes the buffered records and closes the WAL file.
+// Note, the records are not synced unless the sync mode requires it.
 func (w *wal) Close() error {
-	return w.f.Close()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.flush()
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	w.closed = true
+	return err
 }
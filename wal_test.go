@@ -0,0 +1,968 @@
+package hasty
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWALPreallocate(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal")
+	w, err := openAppendonlyWAL(walPath, 1024, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	rec := record{
+		key:   "name",
+		value: []byte("Bob"),
+	}
+	for i := 0; i < 100; i++ {
+		if err = w.WriteRecord(&rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Pre-allocated space must not change the file size.
+	fi, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want int64 = walHeaderSize + 100*16
+	if fi.Size() != want {
+		t.Errorf("expected size: %d, got: %d", want, fi.Size())
+	}
+	if w.preallocated < want {
+		t.Errorf("expected at least %d preallocated bytes, got: %d", want, w.preallocated)
+	}
+
+	if err = w.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err = os.Stat(walPath); err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != walHeaderSize {
+		t.Errorf("expected only header, got: %d", fi.Size())
+	}
+}
+
+func TestWALHeader(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal")
+	before := time.Now()
+	w, err := openAppendonlyWAL(walPath, 0, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := record{
+		key:   "name",
+		value: []byte("Bob"),
+	}
+	if err = w.WriteRecord(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err = openReadonlyWAL(walPath); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if got := w.CreatedAt(); got.Before(before.Round(0)) || got.After(time.Now()) {
+		t.Errorf("expected creation time between %v and now, got: %v", before, got)
+	}
+
+	var keys []string
+	err = w.Replay(AbortOnCorrupt, func(rec *record) error {
+		keys = append(keys, rec.key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "name" {
+		t.Errorf("expected [name], got: %v", keys)
+	}
+}
+
+func TestWALHeader_legacy(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal")
+	// The WAL has no header because it was written by an older version.
+	if err := ioutil.WriteFile(walPath, []byte{12, 0, 0, 0, 'n', 'a', 'm', 'e', 0, 'B', 'o', 'b'}, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := openReadonlyWAL(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if !w.CreatedAt().IsZero() {
+		t.Errorf("expected zero creation time, got: %v", w.CreatedAt())
+	}
+
+	var keys []string
+	err = w.Replay(AbortOnCorrupt, func(rec *record) error {
+		keys = append(keys, rec.key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "name" {
+		t.Errorf("expected [name], got: %v", keys)
+	}
+}
+
+func TestWALHeader_unchecked(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal")
+	// The WAL records have no checksums because they were written by an older version.
+	wal := append([]byte("HASTYWAL\x00\x00\x00\x00\x00\x00\x00\x00"), 12, 0, 0, 0, 'n', 'a', 'm', 'e', 0, 'B', 'o', 'b')
+	if err := ioutil.WriteFile(walPath, wal, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// New records are appended in the format of the file.
+	w, err := openAppendonlyWAL(walPath, 0, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteRecord(&record{key: "age", value: []byte("5")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err = openReadonlyWAL(walPath); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var keys []string
+	err = w.Replay(AbortOnCorrupt, func(rec *record) error {
+		keys = append(keys, rec.key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "name" || keys[1] != "age" {
+		t.Errorf("expected [name age], got: %v", keys)
+	}
+}
+
+func TestWALReplayInBatches(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal")
+	w, err := openAppendonlyWAL(walPath, 0, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err = w.WriteRecord(&record{key: fmt.Sprintf("key%d", i), value: []byte("v")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err = openReadonlyWAL(walPath); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var batches [][]string
+	err = w.ReplayInBatches(AbortOnCorrupt, 2, func(batch []*record) error {
+		var keys []string
+		for _, rec := range batch {
+			keys = append(keys, rec.key)
+		}
+		batches = append(batches, keys)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"key0", "key1"}, {"key2", "key3"}, {"key4"}}
+	if diff := cmp.Diff(want, batches); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestWALReplay_checksum(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal")
+	w, err := openAppendonlyWAL(walPath, 0, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"age", "name"} {
+		if err = w.WriteRecord(&record{key: key, value: []byte("Bob")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A byte of the first value is flipped on disk.
+	b, err := ioutil.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[walHeaderSize+8] ^= 1
+	if err = ioutil.WriteFile(walPath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err = openReadonlyWAL(walPath); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	err = w.Replay(AbortOnCorrupt, func(rec *record) error { return nil })
+	if !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected: %v, got: %v", ErrChecksum, err)
+	}
+}
+
+func TestWALHeader_torn(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal")
+	if err := ioutil.WriteFile(walPath, []byte("HASTYWAL\x01"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openReadonlyWAL(walPath); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("expected: %v, got: %v", ErrCorruptRecord, err)
+	}
+}
+
+func TestWALSync(t *testing.T) {
+	rec := record{
+		key:   "name",
+		value: []byte("Bob"),
+	}
+	tt := map[WALSyncMode]bool{
+		SyncAlways:   false,
+		SyncPeriodic: true,
+		SyncNever:    true,
+	}
+	for mode, wantUnsynced := range tt {
+		w, err := openAppendonlyWAL(filepath.Join(t.TempDir(), "wal"), 0, DefaultFileMode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.syncMode = mode
+
+		if err = w.WriteRecord(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if w.unsynced != wantUnsynced {
+			t.Errorf("mode %d: expected unsynced %t after write", mode, wantUnsynced)
+		}
+		if err = w.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if w.unsynced {
+			t.Errorf("mode %d: expected WAL to be synced", mode)
+		}
+		w.Close()
+	}
+}
+
+func TestWALBuffer(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal")
+	w, err := openAppendonlyWAL(walPath, 0, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.syncMode = SyncNever
+	if err = w.SetBufferSize(64); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every record is 16 bytes long.
+	rec := record{
+		key:   "name",
+		value: []byte("Bob"),
+	}
+	fileSize := func() int64 {
+		t.Helper()
+		fi, err := os.Stat(walPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	for i := 0; i < 4; i++ {
+		if err = w.WriteRecord(&rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := fileSize(); got != walHeaderSize {
+		t.Errorf("expected buffered records, got file size: %d", got)
+	}
+	// The full buffer is written to the file.
+	if err = w.WriteRecord(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fileSize(), int64(walHeaderSize+64); got != want {
+		t.Errorf("expected file size: %d, got: %d", want, got)
+	}
+	if err = w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fileSize(), int64(walHeaderSize+5*16); got != want {
+		t.Errorf("expected file size after sync: %d, got: %d", want, got)
+	}
+
+	// The buffered records don't outlive the truncation.
+	if err = w.WriteRecord(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fileSize(); got != walHeaderSize {
+		t.Errorf("expected only header after truncation, got: %d", got)
+	}
+
+	// The buffered records are written when the WAL is closed.
+	if err = w.WriteRecord(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fileSize(), int64(walHeaderSize+16); got != want {
+		t.Errorf("expected file size after close: %d, got: %d", want, got)
+	}
+}
+
+func TestWALBackupReader(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal")
+	w, err := openAppendonlyWAL(walPath, 1024*1024, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err = w.SetBufferSize(64); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every record is 16 bytes long.
+	rec := record{
+		key:   "name",
+		value: []byte("Bob"),
+	}
+	for i := 0; i < 4; i++ {
+		if err = w.WriteRecord(&rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The buffered records are read, but the pre-allocated space isn't.
+	r := w.NewBackupReader()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != walHeaderSize+4*16 {
+		t.Errorf("expected %d bytes, got: %d", walHeaderSize+4*16, len(got))
+	}
+	// The reader continues with the records appended after it caught up.
+	if err = w.WriteRecord(&rec); err != nil {
+		t.Fatal(err)
+	}
+	more, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, more...)
+	want, err := ioutil.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want[:walHeaderSize+5*16], got); diff != "" {
+		t.Error(diff)
+	}
+
+	// The records read by the reader are gone once the WAL is truncated.
+	r = w.NewBackupReader()
+	if _, err = r.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("expected EOF after truncation, got: %d %v", n, err)
+	}
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Read(make([]byte, 10)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("expected: %v, got: %v", os.ErrClosed, err)
+	}
+}
+
+func TestWALBuffer_concurrentWrites(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal")
+	w, err := openAppendonlyWAL(walPath, 0, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.syncMode = SyncPeriodic
+	if err = w.SetBufferSize(100); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				rec := record{key: fmt.Sprintf("key%d-%d", i, j), value: []byte("value")}
+				if err := w.WriteRecord(&rec); err != nil {
+					t.Error(err)
+					return
+				}
+				if j%10 == 0 {
+					if err := w.Sync(); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err = openReadonlyWAL(walPath); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var n int
+	err = w.Replay(AbortOnCorrupt, func(rec *record) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Errorf("expected 1000 records, got: %d", n)
+	}
+}
+
+func TestDB_walSyncer(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithWALSyncMode(SyncPeriodic), WithWALSyncInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("name", []byte("Bob")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.wal.mu.Lock()
+		unsynced := db.wal.unsynced
+		db.wal.mu.Unlock()
+		if !unsynced {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected WAL to be synced in background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func BenchmarkWALWriteRecord(b *testing.B) {
+	benchmarks := map[string]int64{
+		"no prealloc": 0,
+		"prealloc":    DefaultWALPreallocSize,
+	}
+
+	rec := record{
+		key:   "name",
+		value: []byte("Bob"),
+	}
+	for name, size := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			w, err := openAppendonlyWAL(filepath.Join(b.TempDir(), "wal"), size, DefaultFileMode)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer w.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err = w.WriteRecord(&rec); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDBSet_walSyncMode shows write throughput depending on how often the WAL is synced,
+// e.g., on a local SSD SyncAlways is bounded by fsync latency, while the other modes are bounded by memory.
+func BenchmarkDBSet_walSyncMode(b *testing.B) {
+	benchmarks := map[string]WALSyncMode{
+		"always":   SyncAlways,
+		"periodic": SyncPeriodic,
+		"never":    SyncNever,
+	}
+
+	value := make([]byte, 100)
+	for name, mode := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			db, close, err := Open(b.TempDir(), WithWALSyncMode(mode))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err = db.Set(fmt.Sprintf("key%d", i), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWALReplay_recoveryMode(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	walPath := filepath.Join(t.TempDir(), "wal")
+	w, err := openAppendonlyWAL(walPath, 0, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The length of the 500th record is damaged.
+	var corruptOffset int64
+	for i := 1; i <= 1000; i++ {
+		if i == 500 {
+			corruptOffset = w.offset
+		}
+		rec := record{
+			key:   fmt.Sprintf("key%d", i),
+			value: []byte(fmt.Sprintf("value%d", i)),
+		}
+		if err = w.WriteRecord(&rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(walPath, os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, corruptOffset); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := map[string]struct {
+		mode    WALRecoveryMode
+		wantErr error
+		want    int
+	}{
+		"abort":    {AbortOnCorrupt, ErrCorruptRecord, 499},
+		"skip":     {SkipCorrupt, nil, 999},
+		"tolerate": {TolerateCorrupt, nil, 499},
+	}
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			w, err := openReadonlyWAL(walPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+
+			got := make(map[string]bool)
+			err = w.Replay(tc.mode, func(rec *record) error {
+				got[rec.key] = true
+				return nil
+			})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("expected: %v, got: %v", tc.wantErr, err)
+			}
+			if len(got) != tc.want {
+				t.Errorf("expected %d records, got: %d", tc.want, len(got))
+			}
+			if got["key500"] {
+				t.Error("expected key500 to be lost")
+			}
+			if !got["key499"] {
+				t.Error("expected key499 to be recovered")
+			}
+			if tc.mode == SkipCorrupt && !got["key1000"] {
+				t.Error("expected key1000 to be recovered")
+			}
+		})
+	}
+}
+
+// writeCorruptWAL writes a WAL whose 10 records are followed by garbage of the given size and 10 more records.
+// The garbage looks like a chain of 4 bytes records which ends with an invalid length,
+// so every offset of the garbage has to be followed to find out that it doesn't lead to the valid records.
+func writeCorruptWAL(t testing.TB, garbageSize int) string {
+	t.Helper()
+
+	walPath := filepath.Join(t.TempDir(), "wal")
+	w, err := openAppendonlyWAL(walPath, 0, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	write := func(from int) {
+		for i := from; i < from+10; i++ {
+			if err := w.WriteRecord(&record{key: fmt.Sprintf("key%d", i), value: []byte("value")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(0)
+	garbage := bytes.Repeat([]byte{4, 0, 0, 0}, garbageSize/4)
+	if _, err = w.f.Write(append(garbage, 0xff, 0xff, 0xff, 0xff)); err != nil {
+		t.Fatal(err)
+	}
+	write(10)
+	return walPath
+}
+
+func TestWALReplay_largeCorruption(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	w, err := openReadonlyWAL(writeCorruptWAL(t, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var got int
+	err = w.Replay(SkipCorrupt, func(rec *record) error {
+		got++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 20 {
+		t.Errorf("expected 20 records, got: %d", got)
+	}
+}
+
+func BenchmarkWALReplay_largeCorruption(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	w, err := openReadonlyWAL(writeCorruptWAL(b, 1<<20))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = w.Replay(SkipCorrupt, func(rec *record) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestOpen_partialBatch(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal")
+	w, err := openAppendonlyWAL(walPath, 0, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteRecord(&record{key: "age", value: []byte("5")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteRecords(&record{key: "name", value: []byte("Alice")}, &record{key: "age", deleted: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteRecords(&record{key: "name", value: []byte("Bob")}, &record{key: "planet", value: []byte("Earth")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The end sentinel of the last batch wasn't written before the crash.
+	// The records are 13 bytes age:5, 20 bytes begin, 18 bytes name:Alice, 11 bytes age tombstone, 18 bytes end,
+	// then 20 bytes begin, 16 bytes name:Bob, and 20 bytes planet:Earth.
+	var committed int64 = walHeaderSize + 13 + 20 + 18 + 11 + 18
+	size := committed + 20 + 16 + 20
+	if err = os.Truncate(walPath, size); err != nil {
+		t.Fatal(err)
+	}
+
+	db, close, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if got, err := db.Get("name"); err != nil || string(got) != "Alice" {
+		t.Errorf("expected Alice, got: %q, %v", got, err)
+	}
+	if _, err = db.Get("age"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected age to be deleted, got: %v", err)
+	}
+	if _, err = db.Get("planet"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected planet to be discarded, got: %v", err)
+	}
+
+	// The committed records were saved in a segment, so the partial batch is gone along with the old WAL.
+	if _, err = os.Stat(walPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected removed WAL, got: %v", err)
+	}
+	if size := db.wal.Size(); size != walHeaderSize {
+		t.Errorf("expected WAL size %d, got: %d", walHeaderSize, size)
+	}
+}
+
+func TestOpen_tornWrite(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tt := map[string]func(b []byte) []byte{
+		"truncated record": func(b []byte) []byte {
+			return b[:len(b)-3]
+		},
+		"checksum mismatch": func(b []byte) []byte {
+			b[len(b)-1] ^= 1
+			return b
+		},
+	}
+	for name, tear := range tt {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			walPath := filepath.Join(dir, "wal")
+			w, err := openAppendonlyWAL(walPath, 0, DefaultFileMode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"age", "name"} {
+				if err = w.WriteRecord(&record{key: key, value: []byte("Bob")}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(walPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(walPath, tear(b), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			db, close, err := Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer close()
+
+			if got, err := db.Get("age"); err != nil || string(got) != "Bob" {
+				t.Errorf("expected age=Bob, got: %q, %v", got, err)
+			}
+			if _, err = db.Get("name"); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("expected torn name to be discarded, got: %v", err)
+			}
+			if _, err = os.Stat(walPath); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected removed WAL, got: %v", err)
+			}
+			if size := db.wal.Size(); size != walHeaderSize {
+				t.Errorf("expected WAL size %d, got: %d", walHeaderSize, size)
+			}
+		})
+	}
+}
+
+func TestDB_maxWALSize(t *testing.T) {
+	const maxWALSize = 1024
+	db, close, err := Open(t.TempDir(), WithMaxMemtableSize(1<<20), WithMaxWALSize(maxWALSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	// The memtable never reaches its threshold, so the WAL is truncated only by the flushes due to its size.
+	for i := 0; i < 100; i++ {
+		if err = db.Set(fmt.Sprintf("key%03d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if size := db.wal.Size(); size > maxWALSize {
+			t.Fatalf("expected WAL size at most %d, got: %d", maxWALSize, size)
+		}
+	}
+	if len(db.segments.Load().([]*segment)) == 0 {
+		t.Fatal("expected memtables to be flushed")
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if got, err := db.Get(key); string(got) != "value" || err != nil {
+			t.Fatalf("%s: expected value, got: %q %v", key, got, err)
+		}
+	}
+}
+
+func TestDBClose_wal(t *testing.T) {
+	db, close, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No workers are started by the reads, the WAL must be closed anyway.
+	if _, err = db.Get("name"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected: %v, got: %v", ErrKeyNotFound, err)
+	}
+	if err = close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.wal.f.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("expected WAL file to be closed, got: %v", err)
+	}
+}
+
+// copyDir copies the files of the database dir into a new dir as if the machine crashed,
+// so the copy is opened without closing the database.
+func copyDir(t testing.TB, src string) string {
+	t.Helper()
+
+	dst := t.TempDir()
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range files {
+		b, err := ioutil.ReadFile(filepath.Join(src, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dst, fi.Name()), b, fi.Mode()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dst
+}
+
+func TestOpen_recoverOnce(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openAppendonlyWAL(filepath.Join(dir, "wal"), 0, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteRecord(&record{key: "name", value: []byte("Alice")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, close, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+	if got := len(db.segments.Load().([]*segment)); got != 1 {
+		t.Fatalf("expected the recovered records in 1 segment, got: %d", got)
+	}
+
+	// The database crashes right after the recovery, the records aren't replayed again.
+	crashed, closeCrashed, err := Open(copyDir(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeCrashed()
+	if got := len(crashed.segments.Load().([]*segment)); got != 1 {
+		t.Errorf("expected 1 segment, got: %d", got)
+	}
+	if got := crashed.MustGet("name"); string(got) != "Alice" {
+		t.Errorf("expected Alice, got: %q", got)
+	}
+}
+
+func TestDBFlush_crash(t *testing.T) {
+	dir := t.TempDir()
+	db, close, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	if err = db.Set("small1", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	// The flush is held back, so the next write goes into the new memtable.
+	if err = db.sstWriter.sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.rotateMemtable(0); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("small2", []byte("Bob")); err != nil {
+		t.Fatal(err)
+	}
+	db.sstWriter.sem.Release(1)
+
+	// The writes continue while the immutable memtable is flushed.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := db.Set(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	if err = db.sstWriter.flush(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	// The database crashes after the flush, the writes of the memtable are recovered from its WAL file.
+	crashed, closeCrashed, err := Open(copyDir(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeCrashed()
+	for key, want := range map[string]string{"small1": "Alice", "small2": "Bob", "key0": "value", "key99": "value"} {
+		if got, err := crashed.Get(key); err != nil || string(got) != want {
+			t.Errorf("expected %s=%s, got: %q, %v", key, want, got, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package hasty
+
+// WatchEvent describes a change of a watched key, see Watch.
+type WatchEvent struct {
+	Key string
+	// Value is the new value of the key, it's nil if the key was deleted.
+	Value []byte
+	// Deleted indicates that the key was deleted.
+	Deleted bool
+}
+
+// Watch returns a channel which receives an event whenever the key is set or deleted,
+// e.g., with Set, Delete, a batch, or a transaction. The events are sent after the writes succeed
+// in the order of the writes of the key.
+// The channel is buffered, see WithWatchBufferSize, and an event is dropped if the buffer is full,
+// so a slow watcher never blocks the writers.
+// The cancel function stops the notifications, it doesn't close the channel.
+// Note, operation is concurrency safe.
+func (db *DB) Watch(key string) (events <-chan WatchEvent, cancel func()) {
+	ch := make(chan WatchEvent, db.cfg.watchBufferSize)
+
+	// The watchers of a key are replaced rather than modified, so notify reads them without the lock.
+	db.watchMu.Lock()
+	var watchers []chan WatchEvent
+	if v, ok := db.watchers.Load(key); ok {
+		watchers = v.([]chan WatchEvent)
+	}
+	db.watchers.Store(key, append(watchers[:len(watchers):len(watchers)], ch))
+	db.watchMu.Unlock()
+
+	cancel = func() {
+		db.watchMu.Lock()
+		defer db.watchMu.Unlock()
+		v, ok := db.watchers.Load(key)
+		if !ok {
+			return
+		}
+		current := v.([]chan WatchEvent)
+		watchers := make([]chan WatchEvent, 0, len(current))
+		for _, w := range current {
+			if w != ch {
+				watchers = append(watchers, w)
+			}
+		}
+		if len(watchers) == 0 {
+			db.watchers.Delete(key)
+		} else {
+			db.watchers.Store(key, watchers)
+		}
+	}
+	return ch, cancel
+}
+
+// notify sends the events about the written records to the watchers of their keys.
+func (db *DB) notify(recs []*record) {
+	for _, rec := range recs {
+		v, ok := db.watchers.Load(rec.key)
+		if !ok {
+			continue
+		}
+		e := WatchEvent{
+			Key:     rec.key,
+			Deleted: rec.deleted,
+		}
+		if !rec.deleted {
+			e.Value = rec.value
+		}
+		for _, ch := range v.([]chan WatchEvent) {
+			select {
+			case ch <- e:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package hasty
+
+import "testing"
+
+func TestDBWatch(t *testing.T) {
+	db, close, err := Open(t.TempDir(), WithWatchBufferSize(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close()
+
+	events, cancel := db.Watch("name")
+	other, cancelOther := db.Watch("name")
+	defer cancelOther()
+
+	if err = db.Set("name", []byte("Alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("age", []byte("30")); err != nil {
+		t.Fatal(err)
+	}
+	b := db.NewBatch()
+	b.Set("name", []byte("Bob"))
+	b.Delete("name")
+	if err = b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// The buffer is full, so the event is dropped instead of blocking the write.
+	if err = db.Set("name", []byte("Eve")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []WatchEvent{
+		{Key: "name", Value: []byte("Alice")},
+		{Key: "name", Value: []byte("Bob")},
+		{Key: "name", Deleted: true},
+	}
+	for _, ch := range []<-chan WatchEvent{events, other} {
+		if len(ch) != len(want) {
+			t.Fatalf("expected %d events, got: %d", len(want), len(ch))
+		}
+		for _, w := range want {
+			e := <-ch
+			if e.Key != w.Key || string(e.Value) != string(w.Value) || e.Deleted != w.Deleted {
+				t.Errorf("expected %+v, got: %+v", w, e)
+			}
+		}
+	}
+
+	cancel()
+	if err = db.Delete("name"); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected no events after cancel, got: %d", len(events))
+	}
+	if len(other) != 1 {
+		t.Errorf("expected 1 event, got: %d", len(other))
+	}
+}